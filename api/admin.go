@@ -0,0 +1,131 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/KKKIIO/inv-index-demo/query"
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/gin-gonic/gin"
+)
+
+// MountAdminRoutes mounts the routes exposing index internals on r, guard them e.g. with RequireToken
+func MountAdminRoutes(r gin.IRouter, resolve Resolver) {
+	r.GET("/bitmap", func(c *gin.Context) {
+		if s, ok := resolve(c); ok {
+			GetRawBitmap(s.AllIndexReader.BmStore, c)
+		}
+	})
+	r.GET("/index/:field/stats", func(c *gin.Context) {
+		if s, ok := resolve(c); ok {
+			GetIndexStats(s, c)
+		}
+	})
+}
+
+// RequireToken rejects requests without the bearer token, admin endpoints expose index internals.
+func RequireToken(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": gin.H{
+					"message": "Unauthorized",
+				},
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetRawBitmap dumps the serialized bitmap of an index value for debugging
+func GetRawBitmap(bmStore store.BmStore, c *gin.Context) {
+	var q struct {
+		Index string `form:"index" binding:"required"`
+		Value string `form:"value" binding:"required"`
+	}
+	if !bindQuery(c, &q) {
+		return
+	}
+	raw, err := bmStore.GetRaw(q.Index, q.Value)
+	if err != nil {
+		slog.Error("Error getting raw bitmap", "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	if raw == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": gin.H{
+				"message": "Bitmap not found",
+			},
+		})
+		return
+	}
+	bm := roaring.New()
+	if err := bm.UnmarshalBinary(raw); err != nil {
+		slog.Error("Error decoding raw bitmap", "index", q.Index, "value", q.Value, "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"bytes":       base64.StdEncoding.EncodeToString(raw),
+		"cardinality": bm.GetCardinality(),
+	})
+}
+
+// GetIndexStats describes the index of a field: the value count and largest bitmaps of a term index,
+// or the buckets of a sparse index. It reads the whole index, mind large ones.
+func GetIndexStats(s *query.OrdersSearchService, c *gin.Context) {
+	var q struct {
+		Top int `form:"top,default=10" binding:"min=0,max=100"`
+	}
+	if !bindQuery(c, &q) {
+		return
+	}
+	field := c.Param("field")
+	if sparseStats, err := s.SparseIndexStats(field); err == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"kind":         "sparse",
+			"buckets":      sparseStats.Buckets,
+			"min_sort_key": sparseStats.MinSortKey,
+			"max_sort_key": sparseStats.MaxSortKey,
+			"largest_bucket": gin.H{
+				"sort_key":    sparseStats.LargestBucketSortKey,
+				"cardinality": sparseStats.LargestBucketCardinality,
+			},
+		})
+		return
+	} else if !errors.Is(err, query.ErrFieldNotIndexed) {
+		slog.Error("Error getting sparse index stats", "field", field, "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	termStats, err := s.TermIndexStats(field, q.Top)
+	if errors.Is(err, query.ErrFieldNotIndexed) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": gin.H{
+				"message": "Index not found",
+			},
+		})
+		return
+	}
+	if err != nil {
+		slog.Error("Error getting term index stats", "field", field, "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	topValues := make([]gin.H, len(termStats.TopValues))
+	for i, v := range termStats.TopValues {
+		topValues[i] = gin.H{"value": v.Value, "cardinality": v.Cardinality}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"kind":            "term",
+		"distinct_values": termStats.DistinctValues,
+		"top_values":      topValues,
+	})
+}
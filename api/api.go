@@ -0,0 +1,751 @@
+// Package api serves the order index over HTTP, its routes can be mounted on any gin router.
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KKKIIO/inv-index-demo/api/types"
+	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/query"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/jackc/pgx/v5"
+)
+
+// Resolver finds the service serving a request, it responds itself if there's none
+type Resolver func(c *gin.Context) (*query.OrdersSearchService, bool)
+
+// RegisterRoutes mounts the order routes of s on r, the orders are loaded from db
+func RegisterRoutes(r gin.IRouter, s *query.OrdersSearchService, db *sql.DB) {
+	MountRoutes(r, func(*gin.Context) (*query.OrdersSearchService, bool) { return s, true }, DBOrderFetcher(db, s.TableSchema))
+}
+
+// MountRoutes mounts the order routes of the services found by resolve on r
+func MountRoutes(r gin.IRouter, resolve Resolver, fetchOrders OrderFetcher) {
+	r.GET("/orders", func(c *gin.Context) {
+		if s, ok := resolve(c); ok {
+			QueryOrders(s, fetchOrders, c)
+		}
+	})
+	r.GET("/orders.csv", func(c *gin.Context) {
+		if s, ok := resolve(c); ok {
+			QueryOrdersCSV(s, fetchOrders, c)
+		}
+	})
+	r.GET("/orders.bitmap", func(c *gin.Context) {
+		if s, ok := resolve(c); ok {
+			QueryOrdersBitmap(s, c)
+		}
+	})
+	r.GET("/orders/created_since", func(c *gin.Context) {
+		if s, ok := resolve(c); ok {
+			QueryOrdersCreatedSince(s, fetchOrders, c)
+		}
+	})
+	r.POST("/orders/multi", func(c *gin.Context) {
+		if s, ok := resolve(c); ok {
+			QueryOrdersMulti(s, c)
+		}
+	})
+	r.GET("/orders/distinct", func(c *gin.Context) {
+		if s, ok := resolve(c); ok {
+			QueryDistinctCount(s, c)
+		}
+	})
+	r.GET("/schema", func(c *gin.Context) {
+		if s, ok := resolve(c); ok {
+			GetSchema(s, c)
+		}
+	})
+}
+
+// OrderFetcher loads orders by id from the source database, in any order.
+// fields lists the fields of Order to load, see OrderFields, fetchers may load more.
+type OrderFetcher func(ctx context.Context, ids []uint32, fields []string) ([]*Order, error)
+
+// OrderFields are the fields of Order in their JSON and CSV order, the allowlist of the `fields` param
+var OrderFields = []string{"id", "order_status", "product_id", "provider_id", "create_time"}
+
+func DBOrderFetcher(db *sql.DB, schema index.TableSchema) OrderFetcher {
+	selectOrders := selectOrdersSQL(schema, OrderFields)
+	return func(ctx context.Context, ids []uint32, fields []string) ([]*Order, error) {
+		if len(fields) == len(OrderFields) {
+			return queryDbOrders(ctx, db, selectOrders, fields, ids)
+		}
+		return queryDbOrders(ctx, db, selectOrdersSQL(schema, fields), fields, ids)
+	}
+}
+
+// selectOrdersSQL builds the query loading fields of the rows of the table mapped by schema by primary key,
+// fields must be in OrderFields
+func selectOrdersSQL(schema index.TableSchema, fields []string) string {
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		column := schema.PrimaryKey
+		if field != "id" {
+			column = schema.Column(field)
+		}
+		columns[i] = pgx.Identifier{column}.Sanitize()
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s = ANY($1::int[])",
+		strings.Join(columns, ", "),
+		pgx.Identifier{schema.Table}.Sanitize(),
+		pgx.Identifier{schema.PrimaryKey}.Sanitize())
+}
+
+// bindFields binds the `fields` param, a comma separated subset of OrderFields, defaulting to all of them.
+// The id is always included, the result follows the order of OrderFields.
+func bindFields(c *gin.Context) ([]string, bool) {
+	param := c.Query("fields")
+	if param == "" {
+		return OrderFields, true
+	}
+	requested := map[string]bool{"id": true}
+	for _, field := range strings.Split(param, ",") {
+		if !slices.Contains(OrderFields, field) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": gin.H{
+					"message": fmt.Sprintf("Unknown field %q", field),
+				},
+			})
+			return nil, false
+		}
+		requested[field] = true
+	}
+	fields := make([]string, 0, len(requested))
+	for _, field := range OrderFields {
+		if requested[field] {
+			fields = append(fields, field)
+		}
+	}
+	return fields, true
+}
+
+// projectOrders returns copies of orders marshaled with fields only
+func projectOrders(orders []*Order, fields []string) []*Order {
+	if len(fields) == len(OrderFields) {
+		return orders
+	}
+	projected := make([]*Order, len(orders))
+	for i, order := range orders {
+		projected[i] = order.WithFields(fields)
+	}
+	return projected
+}
+
+func QueryOrders(s *query.OrdersSearchService, fetchOrders OrderFetcher, c *gin.Context) {
+	var q struct {
+		IDsOnly bool `form:"ids_only"`
+	}
+	if !bindQuery(c, &q) {
+		return
+	}
+	r, ok := bindRequest(s, c)
+	if !ok {
+		return
+	}
+	var fields []string
+	if !q.IDsOnly {
+		if fields, ok = bindFields(c); !ok {
+			return
+		}
+	}
+	listResp, err := s.List(r)
+	if err != nil {
+		slog.Error("Error querying orders", "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	c.Set(queryTotalKey, listResp.Total)
+	c.Set(queryIdsKey, len(listResp.IDs))
+	// clients caching orders by id only need the ids, the database isn't queried at all
+	if q.IDsOnly {
+		c.JSON(http.StatusOK, orderIDsResponse(listResp))
+		return
+	}
+	resp := QueryOrdersResponse{Total: listResp.Total, UnknownValues: listResp.UnknownValues, Stale: listResp.Stale, Truncated: listResp.Truncated, TotalIsLowerBound: listResp.TotalIsLowerBound}
+	if len(listResp.IDs) == 0 {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	orders, err := fetchOrders(c.Request.Context(), listResp.IDs, fields)
+	if err != nil {
+		slog.Error("Error querying orders", "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	resp.Orders = projectOrders(orderByIds(listResp.IDs, orders), fields)
+	c.JSON(http.StatusOK, resp)
+}
+
+// maxMultiQueries caps the number of queries of a QueryOrdersMulti batch
+const maxMultiQueries = 50
+
+// QueryOrdersMulti runs a batch of queries at once, e.g. the counts of every status tab of a dashboard.
+// The body holds the query strings of /orders, and the results are the ids_only responses in the same order.
+// Bitmaps shared by the queries are read once, see query.OrdersSearchService.ListMulti.
+func QueryOrdersMulti(s *query.OrdersSearchService, c *gin.Context) {
+	var body struct {
+		Queries []string `json:"queries" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": err.Error(),
+			},
+		})
+		return
+	}
+	if len(body.Queries) > maxMultiQueries {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": fmt.Sprintf("Too many queries, max %d", maxMultiQueries),
+			},
+		})
+		return
+	}
+	rs := make([]query.Request, len(body.Queries))
+	for i, rawQuery := range body.Queries {
+		values, err := url.ParseQuery(rawQuery)
+		if err == nil {
+			rs[i], err = parseRequest(values)
+		}
+		if err == nil {
+			err = s.CheckFields(rs[i])
+		}
+		if err != nil {
+			c.JSON(checkFieldsStatus(err), gin.H{
+				"error": gin.H{
+					"message": fmt.Sprintf("Invalid query %d: %s", i, err),
+				},
+			})
+			return
+		}
+	}
+	listResps, err := s.ListMulti(rs)
+	if err != nil {
+		slog.Error("Error querying orders", "queries", len(rs), "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	resp := QueryOrdersMultiResponse{Results: make([]QueryOrderIDsResponse, len(listResps))}
+	for i, listResp := range listResps {
+		resp.Results[i] = orderIDsResponse(listResp)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// orderIDsResponse converts listResp, ids are an empty array rather than null
+func orderIDsResponse(listResp *query.Response) QueryOrderIDsResponse {
+	ids := listResp.IDs
+	if ids == nil {
+		ids = []uint32{}
+	}
+	return QueryOrderIDsResponse{IDs: ids, Total: listResp.Total, UnknownValues: listResp.UnknownValues, Stale: listResp.Stale, Truncated: listResp.Truncated, TotalIsLowerBound: listResp.TotalIsLowerBound}
+}
+
+// QueryDistinctCount counts the distinct values of a field among the matching orders,
+// estimated from the sort values of the field if `estimate` is set, see query.OrdersSearchService.DistinctCount
+func QueryDistinctCount(s *query.OrdersSearchService, c *gin.Context) {
+	var q struct {
+		Field    string `form:"field" binding:"required"`
+		Estimate bool   `form:"estimate"`
+	}
+	if !bindQuery(c, &q) {
+		return
+	}
+	r, ok := bindRequest(s, c)
+	if !ok {
+		return
+	}
+	count, err := s.DistinctCount(r, q.Field, q.Estimate)
+	if errors.Is(err, query.ErrFieldNotIndexed) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": err.Error(),
+			},
+		})
+		return
+	}
+	if err != nil {
+		slog.Error("Error counting distinct values", "field", q.Field, "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	c.JSON(http.StatusOK, DistinctCountResponse{Field: q.Field, Distinct: count, Estimated: q.Estimate})
+}
+
+// defaultFeedLimit is the page size of QueryOrdersCreatedSince if no limit is given
+const defaultFeedLimit = 100
+
+// QueryOrdersCreatedSince pages through the matching orders by (create_time, sort fields, id) asc, starting at the create_time `since`.
+// The returned cursor is passed back as since & after_id to get the orders created afterward.
+// Updates of already returned orders are not reported.
+func QueryOrdersCreatedSince(s *query.OrdersSearchService, fetchOrders OrderFetcher, c *gin.Context) {
+	var q struct {
+		Since   *uint64 `form:"since" binding:"required"`
+		AfterID *uint32 `form:"after_id"`
+	}
+	if !bindQuery(c, &q) {
+		return
+	}
+	r, ok := bindRequest(s, c)
+	if !ok {
+		return
+	}
+	fields, ok := bindFields(c)
+	if !ok {
+		return
+	}
+	limit := defaultFeedLimit
+	if r.Limit != nil {
+		limit = *r.Limit
+	}
+	feedResp, err := s.ListCreatedSince(r, query.CreatedCursor{CreateTime: *q.Since, AfterID: q.AfterID}, limit)
+	if err != nil {
+		slog.Error("Error querying orders", "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	c.Set(queryIdsKey, len(feedResp.IDs))
+	resp := QueryOrdersCreatedSinceResponse{
+		Orders:    []*Order{},
+		Next:      FeedCursor{Since: feedResp.Next.CreateTime, AfterID: feedResp.Next.AfterID},
+		Truncated: feedResp.Truncated,
+	}
+	if len(feedResp.IDs) != 0 {
+		orders, err := fetchOrders(c.Request.Context(), feedResp.IDs, fields)
+		if err != nil {
+			slog.Error("Error querying orders", "error", err)
+			c.JSON(http.StatusInternalServerError, internalErrorBody)
+			return
+		}
+		resp.Orders = projectOrders(orderByIds(feedResp.IDs, orders), fields)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// maxExportLimit caps the number of orders exported by QueryOrdersCSV
+const maxExportLimit = 100000
+
+// truncatedTrailer is the trailer QueryOrdersCSV sets when the export hit the scan budget, rows may then miss matches
+const truncatedTrailer = "X-Truncated"
+
+// exportErrorTrailer is the trailer QueryOrdersCSV sets when the export failed after the status was sent,
+// the rows received are then only a part of the matches
+const exportErrorTrailer = "X-Export-Error"
+
+// exportBatchSize is the number of orders fetched from the database at once by QueryOrdersCSV
+const exportBatchSize = 500
+
+// QueryOrdersCSV streams the matching orders as CSV, fetching them from the database in batches
+func QueryOrdersCSV(s *query.OrdersSearchService, fetchOrders OrderFetcher, c *gin.Context) {
+	r, ok := bindRequest(s, c)
+	if !ok {
+		return
+	}
+	if r.Limit == nil || *r.Limit > maxExportLimit {
+		limit := maxExportLimit
+		r.Limit = &limit
+	}
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", `attachment; filename="orders.csv"`)
+	c.Header("Trailer", truncatedTrailer+", "+exportErrorTrailer)
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	if err := w.Write(OrderFields); err != nil {
+		return
+	}
+	var batchErr error
+	exported := 0
+	defer func() { c.Set(queryIdsKey, exported) }()
+	batch := make([]uint32, 0, exportBatchSize)
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		orders, err := fetchOrders(ctx, batch, OrderFields)
+		if err != nil {
+			batchErr = err
+			return false
+		}
+		for _, order := range orderByIds(batch, orders) {
+			if err := w.Write(csvRecord(order)); err != nil {
+				batchErr = err
+				return false
+			}
+		}
+		w.Flush()
+		c.Writer.Flush()
+		exported += len(batch)
+		batch = batch[:0]
+		return w.Error() == nil
+	}
+	err := s.Iterate(r, func(ids []uint32) bool {
+		for _, id := range ids {
+			batch = append(batch, id)
+			if len(batch) == exportBatchSize && !flush() {
+				return false
+			}
+		}
+		return ctx.Err() == nil
+	})
+	truncated := errors.Is(err, query.ErrScanTruncated)
+	if truncated {
+		err = nil
+	}
+	if err == nil && batchErr == nil && ctx.Err() == nil {
+		flush()
+	}
+	// the status is already sent, the failure is reported in a trailer
+	if err = errors.Join(err, batchErr, w.Error()); err != nil {
+		slog.Error("Error exporting orders", "error", err)
+		c.Writer.Header().Set(exportErrorTrailer, "Internal server error")
+		return
+	}
+	if truncated {
+		c.Writer.Header().Set(truncatedTrailer, "true")
+	}
+}
+
+// QueryOrdersBitmap responds the ids of all matching orders as a serialized roaring bitmap, see roaring.Bitmap.ToBytes.
+// The ids are unordered and limit is ignored, it suits batch jobs reading millions of ids.
+func QueryOrdersBitmap(s *query.OrdersSearchService, c *gin.Context) {
+	r, ok := bindRequest(s, c)
+	if !ok {
+		return
+	}
+	bm, err := s.ListBitmap(r)
+	if err != nil {
+		slog.Error("Error querying orders", "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	bm.RunOptimize()
+	data, err := bm.ToBytes()
+	if err != nil {
+		slog.Error("Error serializing bitmap", "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	total := bm.GetCardinality()
+	c.Set(queryTotalKey, total)
+	c.Header("X-Total-Count", strconv.FormatUint(total, 10))
+	c.Data(http.StatusOK, "application/octet-stream", data)
+}
+
+// bindQuery binds the query parameters to q, responding 400 with the binding error if they are malformed
+func bindQuery(c *gin.Context, q any) bool {
+	if err := c.ShouldBindQuery(q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": err.Error(),
+			},
+		})
+		return false
+	}
+	return true
+}
+
+// bindRequest parses the query string filters, responding 400 on invalid ones or ones s can't serve
+func bindRequest(s *query.OrdersSearchService, c *gin.Context) (query.Request, bool) {
+	r, err := parseRequest(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": err.Error(),
+			},
+		})
+		return query.Request{}, false
+	}
+	c.Set(queryRequestKey, r)
+	if err := s.CheckFields(r); err != nil {
+		c.JSON(checkFieldsStatus(err), gin.H{
+			"error": gin.H{
+				"message": err.Error(),
+			},
+		})
+		return query.Request{}, false
+	}
+	return r, true
+}
+
+// checkFieldsStatus is the status of a request failing query.OrdersSearchService.CheckFields,
+// a field being backfilled is served once its backfill completes
+func checkFieldsStatus(err error) int {
+	if errors.Is(err, query.ErrFieldBackfilling) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// parseRequest parses the filters of a query string
+func parseRequest(values url.Values) (query.Request, error) {
+	var q struct {
+		OrderStatusEq     *int64   `form:"order_status_eq"`
+		OrderStatusIn     []int64  `form:"order_status_in"`
+		ProductIDEq       *int64   `form:"product_id_eq"`
+		ProviderIDEq      string   `form:"provider_id_eq"`
+		ProviderIDNotNull string   `form:"provider_id_not_null"`
+		HasProvider       *bool    `form:"has_provider"`
+		ProviderIDIn      []int64  `form:"provider_id_in"`
+		ProviderIDGt      *int64   `form:"provider_id_gt"`
+		ProviderIDLt      *int64   `form:"provider_id_lt"`
+		IDEq              *uint32  `form:"id_eq"`
+		IDGte             *uint32  `form:"id_gte"`
+		IDLte             *uint32  `form:"id_lte"`
+		CreateWeekdayEq   *int64   `form:"create_weekday_eq"`
+		CreateQuarterEq   *int64   `form:"create_quarter_eq"`
+		TextContainsAll   []string `form:"text_contains_all"`
+		TextContainsAny   []string `form:"text_contains_any"`
+		ShouldMatch       []string `form:"should_match"`
+		MinShouldMatch    int      `form:"min_should_match"`
+		FieldEq           []string `form:"field_eq"`
+		FieldGte          []string `form:"field_gte"`
+		FieldLte          []string `form:"field_lte"`
+		Limit             *int     `form:"limit"`
+		ReportUnknown     bool     `form:"report_unknown_values"`
+		Sort              string   `form:"sort"`
+		ExactTotalUpTo    uint32   `form:"exact_total_up_to"`
+	}
+	if err := binding.MapFormWithTag(&q, values, "form"); err != nil {
+		return query.Request{}, err
+	}
+	r := query.Request{
+		OrderStatusEq:       q.OrderStatusEq,
+		OrderStatusIn:       q.OrderStatusIn,
+		ProductIDEq:         q.ProductIDEq,
+		HasProvider:         q.HasProvider,
+		ProviderIDIn:        q.ProviderIDIn,
+		ProviderIDGt:        q.ProviderIDGt,
+		ProviderIDLt:        q.ProviderIDLt,
+		IDEq:                q.IDEq,
+		CreateWeekdayEq:     q.CreateWeekdayEq,
+		CreateQuarterEq:     q.CreateQuarterEq,
+		TextContainsAll:     q.TextContainsAll,
+		TextContainsAny:     q.TextContainsAny,
+		MinShouldMatch:      q.MinShouldMatch,
+		Limit:               q.Limit,
+		ReportUnknownValues: q.ReportUnknown,
+		ExactTotalUpTo:      q.ExactTotalUpTo,
+	}
+	sortFields, err := query.ParseSortFields(q.Sort)
+	if err != nil {
+		return query.Request{}, err
+	}
+	r.SortFields = sortFields
+	for _, predicates := range []struct {
+		values []string
+		dest   *[]query.TermPredicate
+	}{{q.ShouldMatch, &r.ShouldMatch}, {q.FieldEq, &r.FieldEq}, {q.FieldGte, &r.FieldGte}, {q.FieldLte, &r.FieldLte}} {
+		for _, s := range predicates.values {
+			p, err := query.ParseTermPredicate(s)
+			if err != nil {
+				return query.Request{}, err
+			}
+			*predicates.dest = append(*predicates.dest, p)
+		}
+	}
+	if q.IDGte != nil || q.IDLte != nil {
+		r.IDRange = &query.RangeFilter[uint32]{Gte: q.IDGte, Lte: q.IDLte, IncludeLo: true, IncludeHi: true}
+	}
+	if q.ProviderIDEq == "null" {
+		r.ProviderIDFilter = &query.NullableValueFilter[int64]{
+			Mode: query.FilterModeNull,
+		}
+	} else if q.ProviderIDEq != "" {
+		id, err := strconv.ParseInt(q.ProviderIDEq, 10, 64)
+		if err != nil {
+			return query.Request{}, errors.New("Invalid provider_id_eq")
+		}
+		r.ProviderIDFilter = &query.NullableValueFilter[int64]{
+			Mode:  query.FilterModeEq,
+			Value: id,
+		}
+	} else if q.ProviderIDNotNull != "" {
+		r.ProviderIDFilter = &query.NullableValueFilter[int64]{
+			Mode: query.FilterModeNotNull,
+		}
+	}
+	if err := r.Validate(); err != nil {
+		return query.Request{}, err
+	}
+	return r, nil
+}
+
+// orderByIds arranges orders in the order of ids
+func orderByIds(ids []uint32, orders []*Order) []*Order {
+	orderMap := make(map[int64]*Order)
+	for _, order := range orders {
+		orderMap[order.ID] = order
+	}
+	result := make([]*Order, len(ids))
+	for i, id := range ids {
+		if order, ok := orderMap[int64(id)]; ok {
+			result[i] = order
+		} else { // WARN: may be out of sync
+			result[i] = &Order{ID: int64(id)}
+		}
+	}
+	return result
+}
+
+// QueryOrdersMultiResponse holds the results of the queries of a QueryOrdersMulti batch in their order
+type QueryOrdersMultiResponse struct {
+	Results []QueryOrderIDsResponse `json:"results"`
+}
+
+type DistinctCountResponse struct {
+	Field     string `json:"field"`
+	Distinct  uint64 `json:"distinct"`
+	Estimated bool   `json:"estimated,omitempty"`
+}
+
+type QueryOrdersCreatedSinceResponse struct {
+	Orders []*Order   `json:"orders"`
+	Next   FeedCursor `json:"next"`
+	// Truncated is set when the page hit the scan budget, orders may then miss matches before next
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type FeedCursor struct {
+	Since   uint64  `json:"since"`
+	AfterID *uint32 `json:"after_id,omitempty"`
+}
+
+// Order, QueryOrdersResponse and QueryOrderIDsResponse are shared with the client, see package types
+type (
+	Order                 = types.Order
+	QueryOrdersResponse   = types.QueryOrdersResponse
+	QueryOrderIDsResponse = types.QueryOrderIDsResponse
+)
+
+func csvRecord(o *Order) []string {
+	providerId := ""
+	if o.ProviderID != nil {
+		providerId = strconv.FormatInt(*o.ProviderID, 10)
+	}
+	return []string{
+		strconv.FormatInt(o.ID, 10),
+		strconv.FormatInt(o.OrderStatus, 10),
+		strconv.FormatInt(o.ProductID, 10),
+		providerId,
+		o.CreateTime,
+	}
+}
+
+func queryDbOrders(ctx context.Context, db *sql.DB, selectOrders string, fields []string, ids []uint32) ([]*Order, error) {
+	rows, err := db.QueryContext(ctx, selectOrders, ids)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying orders: %w", err)
+	}
+	defer rows.Close()
+	orders := make([]*Order, 0, len(ids))
+	for rows.Next() {
+		var order Order
+		var createTime time.Time
+		dest := make([]any, len(fields))
+		for i, field := range fields {
+			switch field {
+			case "id":
+				dest[i] = &order.ID
+			case "order_status":
+				dest[i] = &order.OrderStatus
+			case "product_id":
+				dest[i] = &order.ProductID
+			case "provider_id":
+				dest[i] = &order.ProviderID
+			case "create_time":
+				dest[i] = &createTime
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("Error scanning order: %w", err)
+		}
+		if !createTime.IsZero() {
+			order.CreateTime = createTime.Format(time.RFC3339)
+		}
+		orders = append(orders, &order)
+	}
+	return orders, nil
+}
+
+// context keys of the query handlers' results, logged by QueryLogger
+const (
+	queryRequestKey = "query.request"
+	queryTotalKey   = "query.total"
+	queryIdsKey     = "query.ids"
+)
+
+// QueryLogger logs the shape of each served query with its result size and latency,
+// so expensive query patterns can be found by fingerprint
+func QueryLogger(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		v, ok := c.Get(queryRequestKey)
+		if !ok {
+			return
+		}
+		r := v.(query.Request)
+		attrs := []any{
+			"path", c.FullPath(),
+			"fingerprint", r.Fingerprint(),
+			"status", c.Writer.Status(),
+			"ids", c.GetInt(queryIdsKey),
+			"latency", time.Since(start),
+		}
+		if total, ok := c.Get(queryTotalKey); ok {
+			attrs = append(attrs, "total", total)
+		}
+		logger.Info("Query served", attrs...)
+	}
+}
+
+// schemaMaxValues is the largest number of values of a field GetSchema enumerates
+const schemaMaxValues = 100
+
+// GetSchema describes the filterable fields so clients can build their filter forms,
+// with the values and their counts for low cardinality fields
+func GetSchema(s *query.OrdersSearchService, c *gin.Context) {
+	schema, err := s.Schema(schemaMaxValues)
+	if err != nil {
+		slog.Error("Error getting schema", "error", err)
+		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		return
+	}
+	fields := make([]gin.H, len(schema))
+	for i, field := range schema {
+		fields[i] = gin.H{"name": field.Name, "index": field.Kind}
+		if field.Kind != "term" {
+			continue
+		}
+		fields[i]["distinct_values"] = field.DistinctValues
+		if field.Values != nil {
+			values := make([]gin.H, len(field.Values))
+			for j, v := range field.Values {
+				values[j] = gin.H{"value": v.Value, "count": v.Cardinality}
+			}
+			fields[i]["values"] = values
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"fields": fields})
+}
+
+var internalErrorBody = gin.H{
+	"error": gin.H{
+		"message": "Internal server error",
+	},
+}
@@ -0,0 +1,537 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KKKIIO/inv-index-demo/client"
+	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/query"
+	"github.com/KKKIIO/inv-index-demo/store/storetest"
+	"github.com/KKKIIO/inv-index-demo/sync"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestService indexes orders through the consumer into an in-process redis and returns a search service over them,
+// with a fetcher serving the same orders in place of Postgres
+func newTestService(t *testing.T, orders ...sync.Order) (*query.OrdersSearchService, OrderFetcher) {
+	bmStore, skbmStore, fvStore := storetest.NewRedis(t)
+	require.NoError(t, sync.BackfillConfig{}.Insert(bmStore, skbmStore, fvStore, orders...))
+	dbOrders := make(map[uint32]*Order)
+	for _, order := range orders {
+		dbOrders[order.ID] = &Order{
+			ID:          int64(order.ID),
+			OrderStatus: order.OrderStatus,
+			ProductID:   order.ProductID,
+			ProviderID:  order.ProviderID,
+			CreateTime:  time.UnixMicro(int64(order.CreateTime)).UTC().Format(time.RFC3339),
+		}
+	}
+	fetchOrders := func(ctx context.Context, ids []uint32, fields []string) ([]*Order, error) {
+		result := make([]*Order, 0, len(ids))
+		for _, id := range ids {
+			if order, ok := dbOrders[id]; ok {
+				result = append(result, order)
+			}
+		}
+		return result, nil
+	}
+	return query.NewOrdersSearchService(bmStore, skbmStore, fvStore), fetchOrders
+}
+
+func TestQueryOrdersCSV(t *testing.T) {
+	providerId := int64(7)
+	s, fetchOrders := newTestService(t,
+		sync.Order{ID: 1, OrderStatus: 2, ProductID: 10, ProviderID: &providerId, CreateTime: 1_000_000},
+		sync.Order{ID: 2, OrderStatus: 1, ProductID: 11, CreateTime: 2_000_000},
+		sync.Order{ID: 3, OrderStatus: 2, ProductID: 12, CreateTime: 3_000_000},
+		sync.Order{ID: 4, OrderStatus: 2, ProductID: 13, CreateTime: 4_000_000},
+	)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/orders.csv", func(c *gin.Context) {
+		QueryOrdersCSV(s, fetchOrders, c)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders.csv?order_status_eq=2&limit=2", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "order_status", "product_id", "provider_id", "create_time"},
+		{"4", "2", "13", "", "1970-01-01T00:00:04Z"},
+		{"3", "2", "12", "", "1970-01-01T00:00:03Z"},
+	}, records)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders.csv?provider_id_eq=7", nil))
+	records, err = csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "order_status", "product_id", "provider_id", "create_time"},
+		{"1", "2", "10", "7", "1970-01-01T00:00:01Z"},
+	}, records)
+}
+
+func TestQueryOrdersCSVTruncated(t *testing.T) {
+	s, fetchOrders := newTestService(t,
+		sync.Order{ID: 1001, OrderStatus: 2, CreateTime: 0},
+		sync.Order{ID: 1002, OrderStatus: 2, CreateTime: 2_000_000_000},
+	)
+	// hundreds of small buckets between the 2 matches
+	var orders []sync.Order
+	for id := uint32(1); id <= 1000; id++ {
+		orders = append(orders, sync.Order{ID: id, OrderStatus: 1, CreateTime: uint64(id) * 1_000_000})
+	}
+	config := sync.BackfillConfig{SplitThreshold: sync.MinSplitThreshold}
+	require.NoError(t, config.Insert(s.AllIndexReader.BmStore, s.CreateTimeIndexReader.BmStore, s.CreateTimeIndexReader.FvStore, orders...))
+	s.CreateTimeIndexReader.MaxScanPages = 1
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/orders.csv", func(c *gin.Context) {
+		QueryOrdersCSV(s, fetchOrders, c)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders.csv?order_status_eq=2", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "order_status", "product_id", "provider_id", "create_time"},
+		{"1002", "2", "0", "", "1970-01-01T00:33:20Z"},
+	}, records)
+	assert.Equal(t, "true", w.Header().Get(truncatedTrailer))
+
+	s.CreateTimeIndexReader.MaxScanPages = 0
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders.csv?order_status_eq=2", nil))
+	records, err = csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.Empty(t, w.Header().Get(truncatedTrailer))
+}
+
+func TestQueryOrdersCSVFetchError(t *testing.T) {
+	var orders []sync.Order
+	for id := uint32(1); id <= exportBatchSize+1; id++ {
+		orders = append(orders, sync.Order{ID: id, OrderStatus: 1, CreateTime: uint64(id) * 1_000_000})
+	}
+	s, fetchOrders := newTestService(t, orders...)
+	fetches := 0
+	failSecond := func(ctx context.Context, ids []uint32, fields []string) ([]*Order, error) {
+		if fetches++; fetches > 1 {
+			return nil, errors.New("connection reset")
+		}
+		return fetchOrders(ctx, ids, fields)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/orders.csv", func(c *gin.Context) {
+		QueryOrdersCSV(s, failSecond, c)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders.csv", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Len(t, records, exportBatchSize+1)
+	assert.NotEmpty(t, w.Header().Get(exportErrorTrailer))
+	assert.Empty(t, w.Header().Get(truncatedTrailer))
+}
+
+func TestQueryOrdersBitmap(t *testing.T) {
+	var orders []sync.Order
+	for id := uint32(1); id <= 1000; id++ {
+		orders = append(orders, sync.Order{ID: id, OrderStatus: int64(id%2) + 1, CreateTime: uint64(id) * 1_000_000})
+	}
+	s, _ := newTestService(t, orders...)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/orders.bitmap", func(c *gin.Context) {
+		QueryOrdersBitmap(s, c)
+	})
+	w := httptest.NewRecorder()
+	// limit doesn't apply to the bitmap
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders.bitmap?order_status_eq=1&limit=10", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "500", w.Header().Get("X-Total-Count"))
+	bm := roaring.New()
+	require.NoError(t, bm.UnmarshalBinary(w.Body.Bytes()))
+	assert.Equal(t, uint64(500), bm.GetCardinality())
+	assert.True(t, bm.Contains(2))
+	assert.False(t, bm.Contains(1))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders.bitmap?product_id_eq=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, bm.UnmarshalBinary(w.Body.Bytes()))
+	assert.True(t, bm.IsEmpty())
+}
+
+func TestMountRoutesOnCustomRouter(t *testing.T) {
+	s, fetchOrders := newTestService(t,
+		sync.Order{ID: 1, OrderStatus: 1, CreateTime: 1_000_000},
+		sync.Order{ID: 2, OrderStatus: 2, CreateTime: 2_000_000},
+	)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// an embedding app mounts the routes under its own prefix and middleware
+	g := r.Group("/search", func(c *gin.Context) {
+		if c.GetHeader("X-Tenant") == "" {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	})
+	MountRoutes(g, func(*gin.Context) (*query.OrdersSearchService, bool) { return s, true }, fetchOrders)
+	get := func(path string, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := get("/search/orders?order_status_eq=2", "a")
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp QueryOrdersResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, uint64(1), resp.Total)
+	assert.Equal(t, int64(2), resp.Orders[0].ID)
+	assert.Equal(t, http.StatusOK, get("/search/schema", "a").Code)
+	assert.Equal(t, http.StatusForbidden, get("/search/orders", "").Code)
+	assert.Equal(t, http.StatusNotFound, get("/orders", "a").Code)
+}
+
+func TestSelectOrdersSQL(t *testing.T) {
+	assert.Equal(t, `SELECT "id", "order_status", "product_id", "provider_id", "create_time" FROM "orders" WHERE "id" = ANY($1::int[])`,
+		selectOrdersSQL(index.OrdersSchema, OrderFields))
+	assert.Equal(t, `SELECT "pk", "state", "product_id", "provider_id", "created_at" FROM "purchases" WHERE "pk" = ANY($1::int[])`,
+		selectOrdersSQL(index.TableSchema{Table: "purchases", PrimaryKey: "pk", Columns: map[string]string{"order_status": "state", "create_time": "created_at"}}, OrderFields))
+	assert.Equal(t, `SELECT "pk", "state" FROM "purchases" WHERE "pk" = ANY($1::int[])`,
+		selectOrdersSQL(index.TableSchema{Table: "purchases", PrimaryKey: "pk", Columns: map[string]string{"order_status": "state"}}, []string{"id", "order_status"}))
+}
+
+func TestGetIndexStats(t *testing.T) {
+	s, _ := newTestService(t,
+		sync.Order{ID: 1, OrderStatus: 1, ProductID: 10, CreateTime: 1_000_000},
+		sync.Order{ID: 2, OrderStatus: 2, ProductID: 10, CreateTime: 2_000_000},
+		sync.Order{ID: 3, OrderStatus: 2, ProductID: 11, CreateTime: 3_000_000},
+		sync.Order{ID: 4, OrderStatus: 2, ProductID: 12, CreateTime: 3_000_000},
+	)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/admin/index/:field/stats", func(c *gin.Context) {
+		GetIndexStats(s, c)
+	})
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code, w.Body.String()
+	}
+	code, body := get("/admin/index/product_id/stats?top=2")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"kind":"term","distinct_values":3,"top_values":[{"value":"10","cardinality":2},{"value":"11","cardinality":1}]}`, body)
+	code, body = get("/admin/index/create_time/stats")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"kind":"sparse","buckets":1,"min_sort_key":1000000,"max_sort_key":1000000,"largest_bucket":{"sort_key":1000000,"cardinality":4}}`, body)
+	code, _ = get("/admin/index/unknown/stats")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/admin/index/product_id/stats?top=1000")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestGetSchema(t *testing.T) {
+	providerId := int64(7)
+	s, _ := newTestService(t,
+		sync.Order{ID: 1, OrderStatus: 1, ProductID: 10, ProviderID: &providerId, CreateTime: 1_000_000},
+		sync.Order{ID: 2, OrderStatus: 2, ProductID: 11, CreateTime: 2_000_000},
+		sync.Order{ID: 3, OrderStatus: 2, ProductID: 12, CreateTime: 3_000_000},
+	)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/schema", func(c *gin.Context) {
+		GetSchema(s, c)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/schema", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"fields":[
+		{"name":"order_status","index":"term","distinct_values":2,"values":[{"value":"2","count":2},{"value":"1","count":1}]},
+		{"name":"product_id","index":"term","distinct_values":3},
+		{"name":"provider_id","index":"term","distinct_values":2,"values":[{"value":"null","count":2},{"value":"7","count":1}]},
+		{"name":"create_time","index":"sparse"}
+	]}`, w.Body.String())
+}
+
+func TestQueryOrdersByNegativeProviderId(t *testing.T) {
+	negative, positive := int64(-5), int64(5)
+	s, fetchOrders := newTestService(t,
+		sync.Order{ID: 1, ProviderID: &negative, CreateTime: 1_000_000},
+		sync.Order{ID: 2, ProviderID: &positive, CreateTime: 2_000_000},
+		sync.Order{ID: 3, CreateTime: 3_000_000},
+		sync.Order{ID: 4, ProviderID: &negative, CreateTime: 4_000_000},
+	)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/orders", func(c *gin.Context) {
+		QueryOrders(s, fetchOrders, c)
+	})
+	ids := func(query string) []int64 {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders?"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp QueryOrdersResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		ids := make([]int64, len(resp.Orders))
+		for i, order := range resp.Orders {
+			ids[i] = order.ID
+		}
+		return ids
+	}
+	assert.Equal(t, []int64{4, 1}, ids("provider_id_eq=-5"))
+	assert.Equal(t, []int64{2}, ids("provider_id_eq=5"))
+	assert.Equal(t, []int64{3}, ids("provider_id_eq=null"))
+	assert.Equal(t, []int64{4, 2, 1}, ids("provider_id_not_null=1"))
+	assert.Equal(t, "-5", index.TermIndex{}.MakeValueKey(&negative))
+}
+
+func TestQueryOrdersRejectsMalformedParams(t *testing.T) {
+	s, fetchOrders := newTestService(t, sync.Order{ID: 1, CreateTime: 1_000_000})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/orders", func(c *gin.Context) {
+		QueryOrders(s, fetchOrders, c)
+	})
+	for _, query := range []string{"limit=abc", "limit=-1", "order_status_eq=x", "id_gte=-1", "should_match=order_status",
+		"should_match=order_status:1&min_should_match=2", "has_provider=true&provider_id_eq=null", "has_provider=maybe", "field_gte=price"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body), query)
+		assert.NotEmpty(t, body.Error.Message, query)
+	}
+}
+
+func TestQueryOrdersProjectsFields(t *testing.T) {
+	providerId := int64(7)
+	s, fetchOrders := newTestService(t,
+		sync.Order{ID: 1, OrderStatus: 2, ProductID: 10, ProviderID: &providerId, CreateTime: 1_000_000},
+		sync.Order{ID: 2, OrderStatus: 1, ProductID: 11, CreateTime: 2_000_000},
+	)
+	var fetchedFields []string
+	fetch := func(ctx context.Context, ids []uint32, fields []string) ([]*Order, error) {
+		fetchedFields = fields
+		return fetchOrders(ctx, ids, fields)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/orders", func(c *gin.Context) {
+		QueryOrders(s, fetch, c)
+	})
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders?"+query, nil))
+		return w
+	}
+	w := get("fields=order_status")
+	require.Equal(t, http.StatusOK, w.Code)
+	// the id is always loaded
+	assert.Equal(t, []string{"id", "order_status"}, fetchedFields)
+	assert.JSONEq(t, `{"orders":[{"id":2,"order_status":1},{"id":1,"order_status":2}],"total":2}`, w.Body.String())
+
+	w = get("fields=provider_id,id")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"id", "provider_id"}, fetchedFields)
+	assert.JSONEq(t, `{"orders":[{"id":2,"provider_id":null},{"id":1,"provider_id":7}],"total":2}`, w.Body.String())
+
+	w = get("")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, OrderFields, fetchedFields)
+	assert.Contains(t, w.Body.String(), `"create_time":"1970-01-01T00:00:02Z"`)
+
+	for _, query := range []string{"fields=order_status,secret", "fields=id%3Bdrop%20table%20orders", "fields=id,"} {
+		assert.Equal(t, http.StatusBadRequest, get(query).Code, query)
+	}
+}
+
+func TestQueryOrdersIdsOnly(t *testing.T) {
+	s, _ := newTestService(t,
+		sync.Order{ID: 1, OrderStatus: 2, ProductID: 10, CreateTime: 1_000_000},
+		sync.Order{ID: 2, OrderStatus: 1, ProductID: 11, CreateTime: 2_000_000},
+		sync.Order{ID: 3, OrderStatus: 2, ProductID: 11, CreateTime: 3_000_000},
+	)
+	fetch := func(ctx context.Context, ids []uint32, fields []string) ([]*Order, error) {
+		t.Error("ids_only must not query the database")
+		return nil, nil
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/orders", func(c *gin.Context) {
+		QueryOrders(s, fetch, c)
+	})
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders?"+query, nil))
+		return w
+	}
+	w := get("ids_only=1&order_status_eq=2")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"ids":[3,1],"total":2}`, w.Body.String())
+	// fields don't apply to ids
+	w = get("ids_only=true&fields=secret&limit=1")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"ids":[3],"total":3}`, w.Body.String())
+	w = get("ids_only=1&product_id_eq=12")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"ids":[],"total":0}`, w.Body.String())
+	assert.Equal(t, http.StatusBadRequest, get("ids_only=maybe").Code)
+}
+
+func TestQueryOrdersMulti(t *testing.T) {
+	s, fetchOrders := newTestService(t,
+		sync.Order{ID: 1, OrderStatus: 2, ProductID: 10, CreateTime: 1_000_000},
+		sync.Order{ID: 2, OrderStatus: 1, ProductID: 11, CreateTime: 2_000_000},
+		sync.Order{ID: 3, OrderStatus: 2, ProductID: 11, CreateTime: 3_000_000},
+		sync.Order{ID: 4, OrderStatus: 3, ProductID: 11, CreateTime: 4_000_000},
+	)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	MountRoutes(r, func(*gin.Context) (*query.OrdersSearchService, bool) { return s, true }, fetchOrders)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/multi", strings.NewReader(body)))
+		return w
+	}
+	queries := []string{"order_status_eq=1&product_id_eq=11", "order_status_eq=2&product_id_eq=11", "order_status_eq=2&limit=1", "product_id_eq=99"}
+	body, err := json.Marshal(map[string][]string{"queries": queries})
+	require.NoError(t, err)
+	w := post(string(body))
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp QueryOrdersMultiResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Results, len(queries))
+	// each result is the ids_only response of the query alone
+	for i, q := range queries {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders?ids_only=1&"+q, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var single QueryOrderIDsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &single))
+		assert.Equal(t, single, resp.Results[i], q)
+	}
+	assert.Equal(t, []uint32{3}, resp.Results[2].IDs)
+	assert.Equal(t, uint64(2), resp.Results[2].Total)
+
+	for _, body := range []string{`{"queries":[]}`, `{}`, `{"queries":["order_status_eq=x"]}`, `{"queries":["create_weekday_eq=1"]}`, `{"queries":["%zz"]}`} {
+		assert.Equal(t, http.StatusBadRequest, post(body).Code, body)
+	}
+	tooMany, err := json.Marshal(map[string][]string{"queries": make([]string, maxMultiQueries+1)})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, post(string(tooMany)).Code)
+}
+
+func TestClientMatchesServerBinding(t *testing.T) {
+	one, two := int64(1), int64(2)
+	s, fetchOrders := newTestService(t,
+		sync.Order{ID: 1, OrderStatus: 1, ProductID: 10, ProviderID: &one, CreateTime: 1_000_000},
+		sync.Order{ID: 2, OrderStatus: 2, ProductID: 10, CreateTime: 2_000_000},
+		sync.Order{ID: 3, OrderStatus: 3, ProductID: 20, ProviderID: &two, CreateTime: 3_000_000},
+		sync.Order{ID: 4, OrderStatus: 1, ProductID: 20, CreateTime: 4_000_000},
+	)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/orders", func(c *gin.Context) {
+		QueryOrders(s, fetchOrders, c)
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+	c := client.New(server.URL)
+	i64 := func(v int64) *int64 { return &v }
+	u32 := func(v uint32) *uint32 { return &v }
+	limit := 1
+	hasProvider, noProvider := true, false
+	for _, req := range []query.Request{
+		{},
+		{OrderStatusIn: []int64{1, 3}},
+		{ProductIDEq: i64(10), ProviderIDFilter: &query.NullableValueFilter[int64]{Mode: query.FilterModeNull}},
+		{ProviderIDFilter: &query.NullableValueFilter[int64]{Mode: query.FilterModeNotNull}},
+		{ProviderIDFilter: &query.NullableValueFilter[int64]{Mode: query.FilterModeNotNull}, ProviderIDIn: []int64{2, 3}},
+		{ProviderIDFilter: &query.NullableValueFilter[int64]{Mode: query.FilterModeEq, Value: 2}},
+		{IDRange: &query.RangeFilter[uint32]{Gte: u32(2), Lte: u32(3), IncludeLo: true, IncludeHi: true}},
+		{OrderStatusEq: i64(1), Limit: &limit},
+		{HasProvider: &hasProvider, ProductIDEq: i64(20)},
+		{HasProvider: &noProvider},
+		{ShouldMatch: []query.TermPredicate{{Field: "order_status", Value: 1}, {Field: "product_id", Value: 20}, {Field: "provider_id", Value: 2}}, MinShouldMatch: 2},
+		{FieldEq: []query.TermPredicate{{Field: "order_status", Value: 1}, {Field: "product_id", Value: 20}}},
+	} {
+		want, err := s.List(req)
+		require.NoError(t, err)
+		resp, err := c.ListOrders(context.Background(), req)
+		require.NoError(t, err, "%+v", req)
+		ids := make([]uint32, len(resp.Orders))
+		for i, order := range resp.Orders {
+			ids[i] = uint32(order.ID)
+		}
+		assert.Equal(t, want.Total, resp.Total, "%+v", req)
+		assert.Equal(t, want.IDs, ids, "%+v", req)
+		idsResp, err := c.ListOrderIDs(context.Background(), req)
+		require.NoError(t, err, "%+v", req)
+		assert.Equal(t, want.Total, idsResp.Total, "%+v", req)
+		assert.Equal(t, ids, idsResp.IDs, "%+v", req)
+	}
+}
+
+func TestQueryLogger(t *testing.T) {
+	s, fetchOrders := newTestService(t,
+		sync.Order{ID: 1, OrderStatus: 2, CreateTime: 1_000_000},
+		sync.Order{ID: 2, OrderStatus: 2, CreateTime: 2_000_000},
+		sync.Order{ID: 3, OrderStatus: 1, CreateTime: 3_000_000},
+	)
+	var buf bytes.Buffer
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(QueryLogger(slog.New(slog.NewJSONHandler(&buf, nil))))
+	r.GET("/orders", func(c *gin.Context) {
+		QueryOrders(s, fetchOrders, c)
+	})
+	r.GET("/other", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders?order_status_eq=2&provider_id_eq=null&limit=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "Query served", entry["msg"])
+	assert.Equal(t, "/orders", entry["path"])
+	assert.Equal(t, "order_status_eq,provider_id_null,limit", entry["fingerprint"])
+	assert.Equal(t, float64(2), entry["total"])
+	assert.Equal(t, float64(1), entry["ids"])
+	assert.Equal(t, float64(http.StatusOK), entry["status"])
+	assert.Contains(t, entry, "latency")
+	// requests without a query aren't logged
+	buf.Reset()
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/other", nil))
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,77 @@
+// Package types holds the response types of the HTTP API shared by the api package serving it and its client
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Order is an order as the API responds it
+type Order struct {
+	ID          int64  `json:"id"`
+	OrderStatus int64  `json:"order_status"`
+	ProductID   int64  `json:"product_id"`
+	ProviderID  *int64 `json:"provider_id"`
+	CreateTime  string `json:"create_time"`
+	// fields are the fields to marshal, all if nil
+	fields []string
+}
+
+// WithFields returns a copy of o marshaled with fields only, e.g. the ones a request selected
+func (o *Order) WithFields(fields []string) *Order {
+	p := *o
+	p.fields = fields
+	return &p
+}
+
+func (o *Order) MarshalJSON() ([]byte, error) {
+	type order Order
+	if o.fields == nil {
+		return json.Marshal((*order)(o))
+	}
+	projected := make(map[string]any, len(o.fields))
+	for _, field := range o.fields {
+		projected[field] = o.field(field)
+	}
+	return json.Marshal(projected)
+}
+
+// field returns the value of a field named like its JSON key
+func (o *Order) field(name string) any {
+	switch name {
+	case "id":
+		return o.ID
+	case "order_status":
+		return o.OrderStatus
+	case "product_id":
+		return o.ProductID
+	case "provider_id":
+		return o.ProviderID
+	case "create_time":
+		return o.CreateTime
+	}
+	panic(fmt.Errorf("unknown order field %q", name))
+}
+
+// QueryOrdersResponse lists the matching orders
+type QueryOrdersResponse struct {
+	Orders        []*Order `json:"orders"`
+	Total         uint64   `json:"total"`
+	UnknownValues []string `json:"unknown_values,omitempty"`
+	// Stale is set when the index failed and the result is served from cache
+	Stale bool `json:"stale,omitempty"`
+	// Truncated is set when the query hit its scan budget, orders may then miss matches
+	Truncated bool `json:"truncated,omitempty"`
+	// TotalIsLowerBound is set when total is only a lower bound of the matches, see query.Request.ExactTotalUpTo
+	TotalIsLowerBound bool `json:"total_is_lower_bound,omitempty"`
+}
+
+// QueryOrderIDsResponse is the QueryOrders response with ids_only, the ids are ordered like the orders
+type QueryOrderIDsResponse struct {
+	IDs               []uint32 `json:"ids"`
+	Total             uint64   `json:"total"`
+	UnknownValues     []string `json:"unknown_values,omitempty"`
+	Stale             bool     `json:"stale,omitempty"`
+	Truncated         bool     `json:"truncated,omitempty"`
+	TotalIsLowerBound bool     `json:"total_is_lower_bound,omitempty"`
+}
@@ -0,0 +1,245 @@
+// Package client calls the HTTP API of the order index from Go services.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KKKIIO/inv-index-demo/api/types"
+	"github.com/KKKIIO/inv-index-demo/query"
+)
+
+// ErrUnsupportedFilter is returned for request fields the HTTP API can't express
+var ErrUnsupportedFilter = errors.New("filter not supported by the HTTP API")
+
+// Order, QueryOrdersResponse and QueryOrderIDsResponse are the types the API responds, see package types
+type (
+	Order                 = types.Order
+	QueryOrdersResponse   = types.QueryOrdersResponse
+	QueryOrderIDsResponse = types.QueryOrderIDsResponse
+)
+
+// APIError is a non 200 response of the API
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API responded %d: %s", e.StatusCode, e.Message)
+}
+
+type Client struct {
+	// BaseURL is the address of the index, e.g. http://localhost:8080 or http://localhost:8080/indexes/a
+	BaseURL string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// MaxRetries is the number of retries of a request answered 503, e.g. while the index is starting
+	MaxRetries int
+	// RetryDelay is the delay before the first retry, it doubles on every retry
+	RetryDelay time.Duration
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), MaxRetries: 3, RetryDelay: 100 * time.Millisecond}
+}
+
+// ProviderIDEq matches the orders of provider id
+func ProviderIDEq(id int64) *query.NullableValueFilter[int64] {
+	return &query.NullableValueFilter[int64]{Mode: query.FilterModeEq, Value: id}
+}
+
+// ProviderIDNull matches the orders without provider
+func ProviderIDNull() *query.NullableValueFilter[int64] {
+	return &query.NullableValueFilter[int64]{Mode: query.FilterModeNull}
+}
+
+// ProviderIDNotNull matches the orders with any provider
+func ProviderIDNotNull() *query.NullableValueFilter[int64] {
+	return &query.NullableValueFilter[int64]{Mode: query.FilterModeNotNull}
+}
+
+// ListOrders returns the orders matching r ordered by create_time desc
+func (c *Client) ListOrders(ctx context.Context, r query.Request) (*QueryOrdersResponse, error) {
+	values, err := EncodeRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	var resp QueryOrdersResponse
+	if err := c.get(ctx, "/orders", values, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListOrderIDs returns the ids of the orders matching r ordered by create_time desc, the server skips the database
+func (c *Client) ListOrderIDs(ctx context.Context, r query.Request) (*QueryOrderIDsResponse, error) {
+	values, err := EncodeRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	values.Set("ids_only", "true")
+	var resp QueryOrderIDsResponse
+	if err := c.get(ctx, "/orders", values, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// get retries requests answered 503 up to MaxRetries times, unless ctx is done first
+func (c *Client) get(ctx context.Context, path string, values url.Values, result any) error {
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := c.getOnce(ctx, path, values, result)
+		var apiErr *APIError
+		if attempt >= c.MaxRetries || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) getOnce(ctx context.Context, path string, values url.Values, result any) error {
+	u := c.BaseURL + path
+	if len(values) != 0 {
+		u += "?" + values.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpResp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("GET failed, url=%s, err: %w", u, err)
+	}
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read response, url=%s, err: %w", u, err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		var errBody struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(body, &errBody)
+		return &APIError{StatusCode: httpResp.StatusCode, Message: errBody.Error.Message}
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("Failed to decode response, url=%s, err: %w", u, err)
+	}
+	return nil
+}
+
+// EncodeRequest builds the query parameters of r the way the server binds them
+func EncodeRequest(r query.Request) (url.Values, error) {
+	if r.CreateTimeRange != nil {
+		return nil, fmt.Errorf("%w: create_time range", ErrUnsupportedFilter)
+	}
+	if r.WithSortKeys {
+		return nil, fmt.Errorf("%w: sort keys", ErrUnsupportedFilter)
+	}
+	if len(r.CreateTimeWeekdays) != 0 {
+		return nil, fmt.Errorf("%w: create_time weekdays", ErrUnsupportedFilter)
+	}
+	if len(r.IncludeIDs) != 0 {
+		return nil, fmt.Errorf("%w: included ids", ErrUnsupportedFilter)
+	}
+	values := url.Values{}
+	setInt := func(name string, v *int64) {
+		if v != nil {
+			values.Set(name, strconv.FormatInt(*v, 10))
+		}
+	}
+	setUint := func(name string, v *uint32) {
+		if v != nil {
+			values.Set(name, strconv.FormatUint(uint64(*v), 10))
+		}
+	}
+	setInt("order_status_eq", r.OrderStatusEq)
+	for _, status := range r.OrderStatusIn {
+		values.Add("order_status_in", strconv.FormatInt(status, 10))
+	}
+	setInt("product_id_eq", r.ProductIDEq)
+	if f := r.ProviderIDFilter; f != nil {
+		switch f.Mode {
+		case query.FilterModeEq:
+			values.Set("provider_id_eq", strconv.FormatInt(f.Value, 10))
+		case query.FilterModeNull:
+			values.Set("provider_id_eq", "null")
+		case query.FilterModeNotNull:
+			values.Set("provider_id_not_null", "true")
+		}
+	}
+	if r.HasProvider != nil {
+		values.Set("has_provider", strconv.FormatBool(*r.HasProvider))
+	}
+	for _, providerID := range r.ProviderIDIn {
+		values.Add("provider_id_in", strconv.FormatInt(providerID, 10))
+	}
+	setInt("provider_id_gt", r.ProviderIDGt)
+	setInt("provider_id_lt", r.ProviderIDLt)
+	setUint("id_eq", r.IDEq)
+	if f := r.IDRange; f != nil {
+		// the API only takes inclusive id bounds
+		if (f.Gte != nil && !f.IncludeLo) || (f.Lte != nil && !f.IncludeHi) {
+			return nil, fmt.Errorf("%w: exclusive id bound", ErrUnsupportedFilter)
+		}
+		setUint("id_gte", f.Gte)
+		setUint("id_lte", f.Lte)
+	}
+	setInt("create_weekday_eq", r.CreateWeekdayEq)
+	setInt("create_quarter_eq", r.CreateQuarterEq)
+	for _, term := range r.TextContainsAll {
+		values.Add("text_contains_all", term)
+	}
+	for _, term := range r.TextContainsAny {
+		values.Add("text_contains_any", term)
+	}
+	for _, p := range r.ShouldMatch {
+		values.Add("should_match", p.String())
+	}
+	for _, p := range r.FieldEq {
+		values.Add("field_eq", p.String())
+	}
+	for _, p := range r.FieldGte {
+		values.Add("field_gte", p.String())
+	}
+	for _, p := range r.FieldLte {
+		values.Add("field_lte", p.String())
+	}
+	if r.MinShouldMatch > 0 {
+		values.Set("min_should_match", strconv.Itoa(r.MinShouldMatch))
+	}
+	if r.Limit != nil {
+		values.Set("limit", strconv.Itoa(*r.Limit))
+	}
+	if r.ReportUnknownValues {
+		values.Set("report_unknown_values", "true")
+	}
+	if r.ExactTotalUpTo > 0 {
+		values.Set("exact_total_up_to", strconv.FormatUint(uint64(r.ExactTotalUpTo), 10))
+	}
+	if len(r.SortFields) != 0 {
+		values.Set("sort", query.FormatSortFields(r.SortFields))
+	}
+	return values, nil
+}
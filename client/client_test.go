@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/KKKIIO/inv-index-demo/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSearchService answers /orders with canned orders and records the query it got
+type fakeSearchService struct {
+	queries []url.Values
+	orders  []*Order
+	// unavailable is the number of requests to answer 503 first
+	unavailable int
+}
+
+func (s *fakeSearchService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/orders" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.queries = append(s.queries, r.URL.Query())
+	if len(s.queries) <= s.unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(QueryOrdersResponse{Orders: s.orders, Total: uint64(len(s.orders))})
+}
+
+func TestListOrders(t *testing.T) {
+	provider := int64(7)
+	fake := &fakeSearchService{orders: []*Order{{ID: 2, OrderStatus: 1, ProviderID: &provider}, {ID: 1, OrderStatus: 1}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c := New(server.URL + "/")
+
+	i64 := func(v int64) *int64 { return &v }
+	u32 := func(v uint32) *uint32 { return &v }
+	limit := 10
+	resp, err := c.ListOrders(context.Background(), query.Request{
+		OrderStatusIn:       []int64{1, 2},
+		ProductIDEq:         i64(3),
+		ProviderIDFilter:    ProviderIDNull(),
+		IDRange:             &query.RangeFilter[uint32]{Gte: u32(5), IncludeLo: true},
+		Limit:               &limit,
+		ReportUnknownValues: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), resp.Total)
+	assert.Equal(t, fake.orders, resp.Orders)
+	assert.Equal(t, url.Values{
+		"order_status_in":       {"1", "2"},
+		"product_id_eq":         {"3"},
+		"provider_id_eq":        {"null"},
+		"id_gte":                {"5"},
+		"limit":                 {"10"},
+		"report_unknown_values": {"true"},
+	}, fake.queries[0])
+
+	tests := []struct {
+		filter *query.NullableValueFilter[int64]
+		want   url.Values
+	}{
+		{ProviderIDEq(0), url.Values{"provider_id_eq": {"0"}}},
+		{ProviderIDNotNull(), url.Values{"provider_id_not_null": {"true"}}},
+	}
+	for _, tt := range tests {
+		_, err := c.ListOrders(context.Background(), query.Request{ProviderIDFilter: tt.filter})
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, fake.queries[len(fake.queries)-1])
+	}
+}
+
+func TestListOrdersErrors(t *testing.T) {
+	fake := &fakeSearchService{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	_, err := New(server.URL+"/indexes/a").ListOrders(context.Background(), query.Request{})
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+
+	u64 := func(v uint64) *uint64 { return &v }
+	// filters the API can't express are rejected rather than dropped
+	for _, r := range []query.Request{
+		{CreateTimeRange: &query.RangeFilter[uint64]{Gte: u64(1)}},
+		{WithSortKeys: true},
+		{CreateTimeWeekdays: []int64{6}},
+		{IncludeIDs: []uint32{1, 2}},
+	} {
+		_, err = New(server.URL).ListOrders(context.Background(), r)
+		assert.True(t, errors.Is(err, ErrUnsupportedFilter), "%+v", r)
+	}
+	assert.Empty(t, fake.queries)
+}
+
+func TestListOrdersRetriesUnavailable(t *testing.T) {
+	fake := &fakeSearchService{unavailable: 2}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c := New(server.URL)
+	c.RetryDelay = time.Millisecond
+
+	_, err := c.ListOrders(context.Background(), query.Request{})
+	require.NoError(t, err)
+	assert.Len(t, fake.queries, 3)
+
+	fake.queries, fake.unavailable = nil, 10
+	_, err = c.ListOrders(context.Background(), query.Request{})
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+	assert.Len(t, fake.queries, 4)
+
+	// a done context stops the retries
+	fake.queries = nil
+	c.RetryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.ListOrders(ctx, query.Request{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, fake.queries, 1)
+}
@@ -9,20 +9,57 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/KKKIIO/inv-index-demo/index"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
 func main() {
 	var count int
+	var start, end string
+	var productSkew float64
+	var timeUnitName string
+	var schemaPath string
 	flag.IntVar(&count, "count", 10000, "number of orders to generate")
+	flag.StringVar(&start, "start", "2020-01-01T00:00:00Z", "earliest create_time (RFC3339, inclusive)")
+	flag.StringVar(&end, "end", "2020-12-31T00:00:00Z", "latest create_time (RFC3339, exclusive)")
+	flag.Float64Var(&productSkew, "product-skew", 0, "Zipf exponent s (> 1) of the product_id distribution, "+
+		"product k is picked with probability proportional to 1/(k+1)^s so larger values concentrate orders on fewer products; 0 is uniform")
+	flag.StringVar(&timeUnitName, "time-unit", "s", "granularity of the generated create_time: s, ms or us; "+
+		"it's still written as a timestamp column, which Debezium emits in microseconds, so the consumer keeps -time-unit us")
+	flag.StringVar(&schemaPath, "schema", "", "json file of the table to generate rows of, see index.TableSchema; "+
+		"columns are named after it and its fields get random values, 1 in 10 null")
 	flag.Parse()
 	if count <= 0 {
 		flag.Usage()
 		return
 	}
+	startTime, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		log.Fatalf("Invalid -start: %v", err)
+	}
+	endTime, err := time.Parse(time.RFC3339, end)
+	if err != nil {
+		log.Fatalf("Invalid -end: %v", err)
+	}
+	if !startTime.Before(endTime) {
+		log.Fatalf("-start must be before -end, start=%s, end=%s", start, end)
+	}
+	timeUnit, err := index.ParseTimeUnit(timeUnitName)
+	if err != nil {
+		log.Fatalf("Invalid -time-unit: %v", err)
+	}
+	if productSkew != 0 && productSkew <= 1 {
+		log.Fatalf("-product-skew must be greater than 1, productSkew=%v", productSkew)
+	}
+	schema := index.OrdersSchema
+	if schemaPath != "" {
+		if schema, err = index.LoadTableSchema(schemaPath); err != nil {
+			log.Fatal(err)
+		}
+	}
 	writer := csv.NewWriter(os.Stdout)
 	defer writer.Flush()
-	g := Generator{Writer: writer, Count: count}
+	g := Generator{Writer: writer, Schema: schema, Count: count, Start: startTime, End: endTime, ProductSkew: productSkew, Unit: timeUnit}
 	if err := g.Generate(); err != nil {
 		log.Fatal(err)
 	}
@@ -30,32 +67,68 @@ func main() {
 
 type Generator struct {
 	Writer *csv.Writer
+	// Schema names the columns, its Fields are generated too
+	Schema index.TableSchema
 	Count  int
+	// create_time is uniformly distributed in [Start, End) at the granularity of Unit
+	Start time.Time
+	End   time.Time
+	Unit  index.TimeUnit
+	// ProductSkew is the Zipf exponent of product_id, 0 means uniform
+	ProductSkew float64
 }
 
+const productCount = 10000
+
 // Generate inserts random orders into database
 func (g *Generator) Generate() error {
-	// header: order_id,order_status,product_id,provider_id,create_time
-	if err := g.Writer.Write([]string{"id", "order_status", "product_id", "provider_id", "create_time"}); err != nil {
+	// header: id,order_status,product_id,provider_id,create_time, then the fields of the schema
+	header := []string{g.Schema.PrimaryKey, g.Schema.Column("order_status"), g.Schema.Column("product_id"),
+		g.Schema.Column("provider_id"), g.Schema.Column("create_time")}
+	for _, field := range g.Schema.Fields {
+		header = append(header, g.Schema.Column(field.Name))
+	}
+	if err := g.Writer.Write(header); err != nil {
 		return err
 	}
+	steps := max(int64(g.End.Sub(g.Start)/g.Unit.Duration()), 1)
+	nextProductId := func() int { return rand.Intn(productCount) }
+	if g.ProductSkew != 0 {
+		zipf := rand.NewZipf(rand.New(rand.NewSource(time.Now().UnixNano())), g.ProductSkew, 1, productCount-1)
+		nextProductId = func() int { return int(zipf.Uint64()) }
+	}
 	for i := 0; i < g.Count; i++ {
 		status := rand.Intn(3) + 1
 		providerId := ""
 		if status != 1 {
 			providerId = strconv.Itoa(rand.Intn(10000))
 		}
-		// create_time is between 2020-01-01 and 2020-12-31
-		t := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(rand.Intn(365*24*60*60)) * time.Second)
-		if err := g.Writer.Write([]string{
+		t := g.Start.Add(time.Duration(rand.Int63n(steps)) * g.Unit.Duration())
+		record := []string{
 			strconv.Itoa(i + 1),
 			strconv.Itoa(status),
-			strconv.Itoa(rand.Intn(10000)),
+			strconv.Itoa(nextProductId()),
 			providerId,
-			t.Format(time.RFC3339),
-		}); err != nil {
+			t.Format(time.RFC3339Nano),
+		}
+		for _, field := range g.Schema.Fields {
+			record = append(record, fieldValue(field))
+		}
+		if err := g.Writer.Write(record); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// fieldValue returns a random value of a schema field, empty for null: a term field has few distinct values,
+// a sparse one spreads over a wide range
+func fieldValue(field index.Field) string {
+	if rand.Intn(10) == 0 {
+		return ""
+	}
+	if field.Kind == index.TermKind {
+		return strconv.Itoa(rand.Intn(100))
+	}
+	return strconv.Itoa(rand.Intn(1_000_000))
+}
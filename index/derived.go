@@ -0,0 +1,51 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DerivedField is a term field computed from create_time at index time,
+// so e.g. "created on weekends" becomes an equality filter instead of a scan
+type DerivedField struct {
+	Name   string
+	Derive func(createTime uint64) int64
+}
+
+// CreateWeekday is the day of week of create_time in UTC, 0 for Sunday like EXTRACT(DOW ...)
+var CreateWeekday = DerivedField{
+	Name: "create_weekday",
+	Derive: func(createTime uint64) int64 {
+		return int64(time.UnixMicro(int64(createTime)).UTC().Weekday())
+	},
+}
+
+// CreateQuarter is the quarter of create_time in UTC, 1 to 4 like EXTRACT(QUARTER ...)
+var CreateQuarter = DerivedField{
+	Name: "create_quarter",
+	Derive: func(createTime uint64) int64 {
+		return int64(time.UnixMicro(int64(createTime)).UTC().Month()-1)/3 + 1
+	},
+}
+
+var derivedFields = map[string]DerivedField{
+	CreateWeekday.Name: CreateWeekday,
+	CreateQuarter.Name: CreateQuarter,
+}
+
+// ParseDerivedFields looks up comma separated derived field names, an empty string gives none
+func ParseDerivedFields(s string) ([]DerivedField, error) {
+	var fields []DerivedField
+	if s == "" {
+		return fields, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		field, ok := derivedFields[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown derived field: %s", name)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
@@ -0,0 +1,134 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/KKKIIO/inv-index-demo/store"
+)
+
+// TableSchema maps the indexed fields onto a Postgres table, so the index can serve tables other than orders.
+// The built-in fields are order_status, product_id and provider_id as term fields and create_time as the sparse sort
+// field, Fields indexes more integer columns of either kind.
+type TableSchema struct {
+	Table      string `json:"table"`
+	PrimaryKey string `json:"primary_key"`
+	// Columns maps field names to column names, unmapped fields use their field name
+	Columns map[string]string `json:"columns"`
+	// SoftDeleteColumn is a boolean column marking soft-deleted rows, if set they are kept in the DeletedField index
+	// and left out of query results and totals
+	SoftDeleteColumn string `json:"soft_delete_column"`
+	// UniverseField is a term field every row has a value of, one of UniverseFields. If set, AllField isn't maintained,
+	// the indexed ids are the union of the bitmaps of the field instead. It saves a bitmap write per insert
+	// but makes queries without filters read every bitmap of the field.
+	UniverseField string `json:"universe_field"`
+	// TextColumn is a text column whose tokens are kept in the TextField index, see Tokenize
+	TextColumn string `json:"text_column"`
+	// Fields are the indexed fields besides the built-in ones, mapped onto columns like them
+	Fields []Field `json:"fields"`
+}
+
+// FieldKind is how a field of TableSchema.Fields is indexed
+type FieldKind string
+
+const (
+	// TermKind keeps a bitmap per value, for equality filters
+	TermKind FieldKind = "term"
+	// SparseKind keeps buckets of ids ordered by value, for range filters. Null values aren't indexed.
+	SparseKind FieldKind = "sparse"
+)
+
+// Field is a nullable integer column indexed as Kind
+type Field struct {
+	Name string    `json:"name"`
+	Kind FieldKind `json:"kind"`
+}
+
+// builtinFields are the fields every table maps, Fields can't reuse their names
+var builtinFields = []string{"order_status", "product_id", "provider_id", "create_time", AllField, DeletedField, TextField}
+
+// DeletedField is the term field of the soft-deleted ids, see TableSchema.SoftDeleteColumn
+const DeletedField = "__deleted"
+
+// DeletedValue is the single value of DeletedField, whose bitmap holds every soft-deleted id
+const DeletedValue int64 = 0
+
+// ProviderIDRangeField names the sparse index of non-null provider_id values in errors, it's not a term field
+const ProviderIDRangeField = "provider_id range"
+
+// AllField is the term field holding every indexed id in the bitmap of AllValue, see TableSchema.UniverseField
+const AllField = "__all"
+
+// AllValue is the only value of AllField
+const AllValue = 0
+
+// UniverseFields are the term fields which can stand for AllField, provider_id is nullable
+var UniverseFields = []string{"order_status", "product_id"}
+
+var OrdersSchema = TableSchema{Table: "orders", PrimaryKey: "id"}
+
+// ValidateKeyName checks a table or field name can be joined into index keys: it must be non-empty and free of
+// store.KeySeparator, otherwise e.g. table a:b with field c and table a with field b:c would share their keys
+func ValidateKeyName(name string) error {
+	if name == "" || strings.Contains(name, store.KeySeparator) {
+		return fmt.Errorf("Invalid name %q, it must be non-empty and not contain %q", name, store.KeySeparator)
+	}
+	return nil
+}
+
+// Column returns the column holding field
+func (s TableSchema) Column(field string) string {
+	if column, ok := s.Columns[field]; ok {
+		return column
+	}
+	return field
+}
+
+// LoadTableSchema reads a TableSchema from a json file, the primary key defaults to id
+func LoadTableSchema(path string) (TableSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TableSchema{}, fmt.Errorf("Failed to read schema, path=%s, err: %w", path, err)
+	}
+	var schema TableSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return TableSchema{}, fmt.Errorf("Failed to parse schema, path=%s, err: %w", path, err)
+	}
+	if schema.Table == "" {
+		return TableSchema{}, fmt.Errorf("Schema has no table, path=%s", path)
+	}
+	if err := ValidateKeyName(schema.Table); err != nil {
+		return TableSchema{}, fmt.Errorf("Invalid schema table, path=%s, err: %w", path, err)
+	}
+	if schema.PrimaryKey == "" {
+		schema.PrimaryKey = OrdersSchema.PrimaryKey
+	}
+	if schema.UniverseField != "" && !slices.Contains(UniverseFields, schema.UniverseField) {
+		return TableSchema{}, fmt.Errorf("Schema universe field must be one of %v, path=%s, universe_field=%s", UniverseFields, path, schema.UniverseField)
+	}
+	if err := ValidateFields(schema.Fields); err != nil {
+		return TableSchema{}, fmt.Errorf("Invalid schema fields, path=%s, err: %w", path, err)
+	}
+	return schema, nil
+}
+
+// ValidateFields checks fields have a valid kind and distinct key names, which aren't built-in or derived fields
+func ValidateFields(fields []Field) error {
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if err := ValidateKeyName(field.Name); err != nil {
+			return err
+		}
+		if field.Kind != TermKind && field.Kind != SparseKind {
+			return fmt.Errorf("Invalid field kind, field=%s, kind=%q, must be %s or %s", field.Name, field.Kind, TermKind, SparseKind)
+		}
+		if _, derived := derivedFields[field.Name]; derived || seen[field.Name] || slices.Contains(builtinFields, field.Name) {
+			return fmt.Errorf("Duplicate field, field=%s", field.Name)
+		}
+		seen[field.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package index
+
+import (
+	"strings"
+
+	"github.com/KKKIIO/inv-index-demo/store"
+)
+
+// SortableFields are the term fields whose values can be stored by id to order create_time ties
+var SortableFields = []string{"order_status", "product_id", "provider_id"}
+
+// SortValuesKey is the field value store key of the sort values of a field
+func SortValuesKey(tableName string, fieldName string) string {
+	return strings.Join([]string{"sortvalues", tableName, fieldName}, store.KeySeparator)
+}
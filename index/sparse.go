@@ -1,9 +1,11 @@
 package index
 
 import (
-	"fmt"
+	"log/slog"
 	"sort"
+	"strings"
 
+	"github.com/KKKIIO/inv-index-demo/metrics"
 	"github.com/KKKIIO/inv-index-demo/store"
 	"github.com/RoaringBitmap/roaring"
 )
@@ -14,21 +16,32 @@ type SparseIndex struct {
 }
 
 func (i SparseIndex) MakeIndexKey() string {
-	return fmt.Sprintf("sparse:%s:%s", i.TableName, i.FieldName)
+	return strings.Join([]string{"sparse", i.TableName, i.FieldName}, store.KeySeparator)
 }
 
-func QuerySortIds(fvStore *store.RedisFvStore, fieldKey string, bm *roaring.Bitmap) ([]SortId, error) {
+// QuerySortIds returns the ids of bm with their sort keys, ordered by sort key then id.
+// Ids without a stored sort key can't be placed and are left out.
+func QuerySortIds(fvStore store.FieldValueStore, fieldKey string, bm *roaring.Bitmap) ([]SortId, error) {
 	ids := make([]uint32, 0)
 	for it := bm.Iterator(); it.HasNext(); {
 		ids = append(ids, it.Next())
 	}
-	fvs, err := fvStore.MGet(fieldKey, ids)
+	fvs, found, err := fvStore.MGetFound(fieldKey, ids)
 	if err != nil {
 		return nil, err
 	}
-	sortIds := make([]SortId, len(ids))
+	sortIds := make([]SortId, 0, len(ids))
+	var missing []uint32
 	for i, id := range ids {
-		sortIds[i] = SortId{Id: id, SortKey: fvs[i]}
+		if !found[i] {
+			missing = append(missing, id)
+			continue
+		}
+		sortIds = append(sortIds, SortId{Id: id, SortKey: fvs[i]})
+	}
+	if len(missing) > 0 {
+		slog.Warn("Found ids without sort key", "fieldKey", fieldKey, "count", len(missing), "ids", missing[:min(len(missing), 10)])
+		metrics.MissingSortKeys.Add(int64(len(missing)))
 	}
 	sort.Slice(sortIds, func(i, j int) bool {
 		if sortIds[i].SortKey == sortIds[j].SortKey { // order by id if sort key is the same for better stability
@@ -2,15 +2,55 @@ package index
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/KKKIIO/inv-index-demo/store"
 )
 
 type TermIndex struct {
 	TableName string
 	FieldName string
+	// Version tags the key of an index whose indexing logic changed, e.g. term:orders:product_id:v2,
+	// so the new version can be built next to the served one. Versions below 2 use the original key.
+	Version int
+	// KeyNormalizer maps string values to their value key, e.g. strings.ToLower so "US" and "us" match.
+	// Writers and readers of an index must share it, nil keeps values as they are.
+	KeyNormalizer func(string) string
 }
 
 func (i TermIndex) GetIndexKey() string {
-	return fmt.Sprintf("term:%s:%s", i.TableName, i.FieldName)
+	parts := []string{"term", i.TableName, i.FieldName}
+	if i.Version > 1 {
+		parts = append(parts, fmt.Sprintf("v%d", i.Version))
+	}
+	return strings.Join(parts, store.KeySeparator)
+}
+
+// WithVersion returns the index of the same field at version
+func (i TermIndex) WithVersion(version int) TermIndex {
+	i.Version = version
+	return i
+}
+
+// ParseVersions parses comma separated `field=version` entries, e.g. "product_id=2"
+func ParseVersions(s string) (map[string]int, error) {
+	versions := make(map[string]int)
+	if s == "" {
+		return versions, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		field, v, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || field == "" {
+			return nil, fmt.Errorf("Invalid index version %q, expected field=version", entry)
+		}
+		version, err := strconv.Atoi(v)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("Invalid index version %q, expected a positive version", entry)
+		}
+		versions[field] = version
+	}
+	return versions, nil
 }
 
 func (i TermIndex) MakeValueKey(fieldValue any) string {
@@ -22,11 +62,16 @@ func (i TermIndex) MakeValueKey(fieldValue any) string {
 			return "null"
 		}
 		return fmt.Sprint(*value)
+	case string:
+		if i.KeyNormalizer != nil {
+			return i.KeyNormalizer(value)
+		}
+		return value
 	default:
 		panic(fmt.Sprintf("Unsupported key type: %T", value))
 	}
 }
 
 type Term interface {
-	int64 | *int64
+	int64 | *int64 | string
 }
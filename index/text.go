@@ -0,0 +1,23 @@
+package index
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// TextField is the term field of the tokens of the text column, see TableSchema.TextColumn
+const TextField = "text_tokens"
+
+// Tokenize splits text into its distinct tokens in order of appearance.
+// Tokens are runs of letters and digits, case-folded, so punctuation and whitespace only separate them.
+func Tokenize(text string) []string {
+	var tokens []string
+	for _, token := range strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		token = strings.ToLower(token)
+		if !slices.Contains(tokens, token) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,52 @@
+package index
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// TimeUnit is the unit of the create_time values of change events, they're indexed as microseconds
+// like Debezium's MicroTimestamp, so connectors emitting seconds or milliseconds order the same
+type TimeUnit string
+
+const (
+	TimeUnitSeconds TimeUnit = "s"
+	TimeUnitMillis  TimeUnit = "ms"
+	// TimeUnitMicros is the indexed unit, the zero TimeUnit stands for it
+	TimeUnitMicros TimeUnit = "us"
+)
+
+// ParseTimeUnit parses s, ms or us, an empty string gives TimeUnitMicros
+func ParseTimeUnit(s string) (TimeUnit, error) {
+	switch u := TimeUnit(s); u {
+	case "":
+		return TimeUnitMicros, nil
+	case TimeUnitSeconds, TimeUnitMillis, TimeUnitMicros:
+		return u, nil
+	}
+	return "", fmt.Errorf("Unknown time unit %s, want s, ms or us", s)
+}
+
+// Duration returns the length of one unit
+func (u TimeUnit) Duration() time.Duration {
+	switch u {
+	case TimeUnitSeconds:
+		return time.Second
+	case TimeUnitMillis:
+		return time.Millisecond
+	}
+	return time.Microsecond
+}
+
+// ToMicros converts a value of unit u to microseconds, failing if it doesn't fit in a uint64
+func (u TimeUnit) ToMicros(v uint64) (uint64, error) {
+	if _, err := ParseTimeUnit(string(u)); err != nil {
+		return 0, err
+	}
+	factor := uint64(u.Duration() / time.Microsecond)
+	if v > math.MaxUint64/factor {
+		return 0, fmt.Errorf("Time out of range, v=%d, unit=%s", v, u)
+	}
+	return v * factor, nil
+}
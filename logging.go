@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// newLogHandler returns the handler of the LOG_LEVEL and LOG_FORMAT env values, info and text when empty
+func newLogHandler(w io.Writer, level string, format string) (slog.Handler, slog.Level, error) {
+	var logLevel slog.Level
+	if level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, 0, fmt.Errorf("Invalid LOG_LEVEL %q, want debug, info, warn or error", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), logLevel, nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), logLevel, nil
+	default:
+		return nil, 0, fmt.Errorf("Invalid LOG_FORMAT %q, want text or json", format)
+	}
+}
@@ -2,17 +2,19 @@ package main
 
 import (
 	"database/sql"
+	"expvar"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"regexp"
 	"time"
 
 	"github.com/IBM/sarama"
+	"github.com/KKKIIO/inv-index-demo/api"
+	"github.com/KKKIIO/inv-index-demo/index"
 	"github.com/KKKIIO/inv-index-demo/query"
-	"github.com/KKKIIO/inv-index-demo/store"
 	"github.com/KKKIIO/inv-index-demo/sync"
 	"github.com/gin-gonic/gin"
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -20,162 +22,240 @@ import (
 )
 
 func main() {
-	var indexName string
+	var indexNames string
 	var topicPrefix string
-	flag.StringVar(&indexName, "index", "0", "index name")
-	flag.StringVar(&topicPrefix, "topic-prefix", "", "topic prefix")
+	var corruptAsEmpty bool
+	var maxConsumeFailures int
+	var lockNamespace bool
+	var derivedFieldNames string
+	var schemaPath string
+	var tieBreakName string
+	var serveStaleFor time.Duration
+	var compactInterval time.Duration
+	var compactMinBucketSize int
+	var indexVersionsSpec string
+	var nextIndexVersionsSpec string
+	var maxScanPages int
+	var perKeyGets bool
+	var shardThreshold int
+	var sortFieldNames string
+	var lookupIncompleteDeletes bool
+	var providerIDRange bool
+	var timeUnitName string
+	var startOffsetSpec string
+	var resetOffsets bool
+	var consumeBatchSize int
+	var warmup bool
+	var backfillNewFields bool
+	var sizeSampleInterval time.Duration
+	var kafkaConnectTimeout time.Duration
+	flag.StringVar(&indexNames, "index", "0", "comma separated index names, each optionally with its own topic prefix as name=prefix")
+	flag.StringVar(&topicPrefix, "topic-prefix", "", "topic prefix of the indexes without their own")
+	flag.DurationVar(&kafkaConnectTimeout, "kafka-connect-timeout", time.Minute, "retry reaching kafka at startup for that long before failing, 0 fails on the first error")
+	flag.IntVar(&maxConsumeFailures, "max-consume-failures", 0, "exit after that many consecutive consumer failures, 0 retries forever")
+	flag.BoolVar(&corruptAsEmpty, "corrupt-as-empty", false, "read corrupted term bitmaps as empty instead of failing queries")
+	flag.BoolVar(&lockNamespace, "lock-namespace", false, "refuse to start if another instance serves the same index")
+	flag.StringVar(&derivedFieldNames, "derived-fields", "", "comma separated fields derived from create_time to maintain: create_weekday, create_quarter")
+	flag.StringVar(&schemaPath, "schema", "", "json file mapping the indexed fields onto another table than orders, see index.TableSchema")
+	flag.StringVar(&tieBreakName, "tie-break", "sort", "id order of orders created at the same time: sort (same as create_time), asc or desc")
+	flag.DurationVar(&serveStaleFor, "serve-stale-for", 0, "serve results up to that old from an in-process cache when redis fails, 0 disables")
+	flag.DurationVar(&compactInterval, "compact-interval", 0, "mean delay between merges of undersized create_time buckets, 0 disables")
+	flag.IntVar(&compactMinBucketSize, "compact-min-bucket-size", sync.DefaultSplitThreshold/4, "create_time buckets smaller than that are merged by compaction")
+	flag.StringVar(&indexVersionsSpec, "index-versions", "", "comma separated field=version of the term indexes to write, e.g. product_id=2")
+	flag.StringVar(&nextIndexVersionsSpec, "next-index-versions", "", "comma separated field=version of the term indexes to build along with the written ones")
+	flag.IntVar(&maxScanPages, "max-scan-pages", 0, "stop queries after reading that many pages of 100 create_time buckets and flag them truncated, 0 reads all")
+	flag.BoolVar(&perKeyGets, "per-key-gets", false, "read redis hash fields with pipelined HGETs instead of HMGET, for proxies splitting multi-key commands")
+	flag.IntVar(&shardThreshold, "shard-bitmaps-over", 0, "store term bitmaps serialized larger than that many bytes as shards of 2^20 ids, 0 never shards")
+	flag.StringVar(&sortFieldNames, "sort-fields", "", "comma separated fields queries can order orders created at the same time by: order_status, product_id, provider_id")
+	flag.BoolVar(&lookupIncompleteDeletes, "lookup-incomplete-deletes", false, "find the indexed values of orders deleted or updated with only their primary key in the before image, reading every term bitmap")
+	flag.BoolVar(&providerIDRange, "provider-id-range", false, "maintain a sparse index of provider_id to serve provider_id_gt and provider_id_lt filters")
+	flag.StringVar(&timeUnitName, "time-unit", "us", "unit of create_time in change events: s, ms or us, indexed as us")
+	flag.StringVar(&startOffsetSpec, "start-offset", "", "replay the topics from that offset, or comma separated partition=offset entries, for debugging; needs -reset-offsets")
+	flag.BoolVar(&resetOffsets, "reset-offsets", false, "allow -start-offset to rewrite the committed offsets of the consumer groups, stop the other instances first")
+	flag.IntVar(&consumeBatchSize, "consume-batch-size", sync.DefaultBatchSize, "messages of a partition whose term bitmaps are written along with their offset in one redis transaction")
+	flag.BoolVar(&warmup, "warmup", false, "ping the stores and read the newest create_time buckets of each index on startup, so the first queries don't hit cold redis connections")
+	flag.BoolVar(&backfillNewFields, "backfill-new-fields", false, "backfill from postgres the derived fields, sort fields, provider_id range and next index versions not backfilled yet, queries on the fields get 503 until done; an index with orders refuses to start with such fields without it")
+	flag.DurationVar(&sizeSampleInterval, "size-sample-interval", 0, "delay between measures of the term bitmap sizes published at /debug/vars, reading every bitmap, 0 disables")
 	flag.Parse()
-	if indexName == "" || topicPrefix == "" {
+	if indexNames == "" {
 		flag.Usage()
 		return
 	}
-	namespace := fmt.Sprintf("inv-pg-%s", indexName)
-	logLevel := slog.LevelDebug
-	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	h, logLevel, err := newLogHandler(os.Stderr, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		slog.Error("Invalid log config", "error", err)
+		return
+	}
 	slog.SetDefault(slog.New(h))
-	db, err := sql.Open("pgx", fmt.Sprintf("postgres://%s:%s@%s:5432/%s?sslmode=disable",
-		os.Getenv("POSTGRES_USER"), os.Getenv("POSTGRES_PASSWORD"), os.Getenv("POSTGRES_HOSTNAME"), os.Getenv("POSTGRES_DB")))
+	specs, err := ParseIndexSpecs(indexNames, topicPrefix)
 	if err != nil {
-		slog.Error("Failed to connect to database", "error", err)
+		slog.Error("Invalid -index", "error", err)
+		flag.Usage()
 		return
 	}
-	rdb := redis.NewClient(&redis.Options{Addr: "redis:6379"})
-	bmStore := &store.RedisBmStore{RDB: rdb, Prefix: namespace + ":bm:"}
-	skbmStore := &store.RedisSortKeyBitmapStore{RDB: rdb, Prefix: namespace + ":skbm:"}
-	fvStore := &store.RedisFvStore{RDB: rdb, Prefix: namespace + ":fv:"}
-	sarama.Logger = slog.NewLogLogger(h, logLevel)
-	c, err := sync.NewConsumer(sync.Config{
-		Brokers:       []string{"localhost:9092"},
-		Topic:         fmt.Sprintf("%s.public.orders", topicPrefix),
-		ConsumerGroup: namespace,
-	})
+	derivedFields, err := index.ParseDerivedFields(derivedFieldNames)
 	if err != nil {
-		slog.Error("Failed to create consumer", "error", err)
+		slog.Error("Invalid -derived-fields", "error", err)
+		flag.Usage()
+		return
+	}
+	parsedSortFields, err := query.ParseSortFields(sortFieldNames)
+	if err != nil {
+		slog.Error("Invalid -sort-fields", "error", err)
+		flag.Usage()
 		return
 	}
-	c.Start(bmStore, skbmStore, fvStore)
-	defer func() {
-		if err := c.Shutdown(); err != nil {
-			slog.Error("Failed to shutdown consumer", "error", err)
+	sortFields := make([]string, len(parsedSortFields))
+	for i, field := range parsedSortFields {
+		if field.Desc {
+			slog.Error("Invalid -sort-fields, the direction is chosen by queries", "field", field.Field)
+			flag.Usage()
+			return
 		}
-	}()
-	s := query.NewOrdersSearchService(bmStore, skbmStore, fvStore)
-	defer db.Close()
-	r := gin.Default()
-	r.GET("/orders", func(c *gin.Context) {
-		QueryOrders(s, db, c)
-	})
-	slog.Info("Server listening on :8080")
-	if err := r.Run(":8080"); err != nil && err != http.ErrServerClosed {
-		slog.Error("Error running server", "error", err)
+		sortFields[i] = field.Field
 	}
-}
-
-func QueryOrders(s *query.OrdersSearchService, db *sql.DB, c *gin.Context) {
-	var q struct {
-		OrderStatusEq     *int64 `form:"order_status_eq"`
-		ProductIDEq       *int64 `form:"product_id_eq"`
-		ProviderIDEq      string `form:"provider_id_eq"`
-		ProviderIDNotNull string `form:"provider_id_not_null"`
-		Limit             *int   `form:"limit"`
-	}
-	if err := c.BindQuery(&q); err != nil {
+	timeUnit, err := index.ParseTimeUnit(timeUnitName)
+	if err != nil {
+		slog.Error("Invalid -time-unit", "error", err)
+		flag.Usage()
 		return
 	}
-	r := query.Request{
-		OrderStatusEq: q.OrderStatusEq,
-		ProductIDEq:   q.ProductIDEq,
-		Limit:         q.Limit,
+	startOffset, err := sync.ParseStartOffset(startOffsetSpec)
+	if err != nil {
+		slog.Error("Invalid -start-offset", "error", err)
+		flag.Usage()
+		return
 	}
-	if q.ProviderIDEq == "null" {
-		r.ProviderIDFilter = &query.NullableValueFilter[int64]{
-			Mode: query.FilterModeNull,
-		}
-	} else if q.ProviderIDEq != "" {
-		id, err := strconv.ParseInt(q.ProviderIDEq, 10, 64)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": gin.H{
-					"message": "Invalid provider_id_eq",
-				},
-			})
-			return
-		}
-		r.ProviderIDFilter = &query.NullableValueFilter[int64]{
-			Mode:  query.FilterModeEq,
-			Value: id,
-		}
-	} else if q.ProviderIDNotNull != "" {
-		r.ProviderIDFilter = &query.NullableValueFilter[int64]{
-			Mode: query.FilterModeNotNull,
-		}
+	if len(startOffset) > 0 && !resetOffsets {
+		slog.Error("-start-offset rewrites the committed offsets, pass -reset-offsets to confirm")
+		flag.Usage()
+		return
 	}
-	listResp, err := s.List(r)
+	tieBreak, err := query.ParseTieBreak(tieBreakName)
 	if err != nil {
-		slog.Error("Error querying orders", "error", err)
-		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		slog.Error("Invalid -tie-break", "error", err)
+		flag.Usage()
 		return
 	}
-	resp := QueryOrdersResponse{Total: listResp.Total}
-	if len(listResp.IDs) == 0 {
-		c.JSON(http.StatusOK, resp)
+	indexVersions, err := index.ParseVersions(indexVersionsSpec)
+	if err != nil {
+		slog.Error("Invalid -index-versions", "error", err)
+		flag.Usage()
 		return
 	}
-	orders, err := queryDbOrders(db, listResp.IDs)
+	nextIndexVersions, err := index.ParseVersions(nextIndexVersionsSpec)
 	if err != nil {
-		slog.Error("Error querying orders", "error", err)
-		c.JSON(http.StatusInternalServerError, internalErrorBody)
+		slog.Error("Invalid -next-index-versions", "error", err)
+		flag.Usage()
 		return
 	}
-	orderMap := make(map[int64]*Order)
-	for _, order := range orders {
-		orderMap[order.ID] = order
+	schema := index.OrdersSchema
+	if schemaPath != "" {
+		if schema, err = index.LoadTableSchema(schemaPath); err != nil {
+			slog.Error("Invalid -schema", "error", err)
+			return
+		}
+	}
+	db, err := sql.Open("pgx", fmt.Sprintf("postgres://%s:%s@%s:5432/%s?sslmode=disable",
+		os.Getenv("POSTGRES_USER"), os.Getenv("POSTGRES_PASSWORD"), os.Getenv("POSTGRES_HOSTNAME"), os.Getenv("POSTGRES_DB")))
+	if err != nil {
+		slog.Error("Failed to connect to database", "error", err)
+		return
+	}
+	defer db.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: "redis:6379"})
+	sarama.Logger = slog.NewLogLogger(h, logLevel)
+	registry := NewRegistry()
+	// stops the consumers and releases the namespace locks on return
+	defer registry.Close()
+	opts := IndexOptions{
+		Brokers:                 []string{"localhost:9092"},
+		ConnectTimeout:          kafkaConnectTimeout,
+		CorruptAsEmpty:          corruptAsEmpty,
+		MaxConsumeFailures:      maxConsumeFailures,
+		LockNamespace:           lockNamespace,
+		DerivedFields:           derivedFields,
+		Schema:                  schema,
+		TieBreak:                tieBreak,
+		ServeStaleFor:           serveStaleFor,
+		CompactInterval:         compactInterval,
+		CompactMinBucketSize:    compactMinBucketSize,
+		IndexVersions:           indexVersions,
+		NextIndexVersions:       nextIndexVersions,
+		MaxScanPages:            maxScanPages,
+		PerKeyGets:              perKeyGets,
+		ShardThreshold:          shardThreshold,
+		SortFields:              sortFields,
+		LookupIncompleteDeletes: lookupIncompleteDeletes,
+		ProviderIDRange:         providerIDRange,
+		TimeUnit:                timeUnit,
+		StartOffset:             startOffset,
+		ResetOffsets:            resetOffsets,
+		ConsumeBatchSize:        consumeBatchSize,
+		Warmup:                  warmup,
+		BackfillNewFields:       backfillNewFields,
+		DB:                      db,
+		SizeSampleInterval:      sizeSampleInterval,
 	}
-	resp.Orders = make([]*Order, len(listResp.IDs))
-	for i, id := range listResp.IDs {
-		if order, ok := orderMap[int64(id)]; ok {
-			resp.Orders[i] = order
-		} else { // WARN: may be out of sync
-			resp.Orders[i] = &Order{ID: int64(id)}
+	for _, spec := range specs {
+		if _, err := registry.Open(rdb, spec, opts); err != nil {
+			slog.Error("Failed to open index", "index", spec.Name, "error", err)
+			return
 		}
 	}
-	c.JSON(http.StatusOK, resp)
-}
-
-type QueryOrdersResponse struct {
-	Orders []*Order `json:"orders"`
-	Total  uint64   `json:"total"`
-}
-
-type Order struct {
-	ID          int64  `json:"id"`
-	OrderStatus int64  `json:"order_status"`
-	ProductID   int64  `json:"product_id"`
-	ProviderID  *int64 `json:"provider_id"`
-	CreateTime  string `json:"create_time"`
+	go func() {
+		err := <-registry.Stopped()
+		slog.Error("Index stopped", "error", err)
+		// os.Exit skips the deferred Close, the locks would otherwise hold off a restart until they expire
+		registry.Close()
+		os.Exit(1)
+	}()
+	r := gin.Default()
+	r.Use(api.QueryLogger(slog.Default()))
+	fetchOrders := api.DBOrderFetcher(db, schema)
+	registerIndexRoutes(r.Group("/"), func(*gin.Context) (*Index, bool) { return registry.Default, true }, fetchOrders)
+	registerIndexRoutes(r.Group("/indexes/:name"), registry.resolve, fetchOrders)
+	r.GET("/healthz", registry.healthz)
+	r.GET("/consumer/status", registry.consumerStatus)
+	r.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	slog.Info("Server listening on :8080")
+	if err := r.Run(":8080"); err != nil && err != http.ErrServerClosed {
+		slog.Error("Error running server", "error", err)
+	}
 }
 
-func queryDbOrders(db *sql.DB, ids []uint32) ([]*Order, error) {
-	rows, err := db.Query("SELECT id, order_status, product_id, provider_id, create_time FROM orders WHERE id = ANY($1::int[])", ids)
-	if err != nil {
-		return nil, fmt.Errorf("Error querying orders: %w", err)
-	}
-	defer rows.Close()
-	orders := make([]*Order, 0, len(ids))
-	for rows.Next() {
-		var order Order
-		var createTime time.Time
-		if err := rows.Scan(&order.ID, &order.OrderStatus, &order.ProductID, &order.ProviderID, &createTime); err != nil {
-			return nil, fmt.Errorf("Error scanning order: %w", err)
+// registerIndexRoutes adds the routes of the index found by resolve, which responds itself if there's none
+func registerIndexRoutes(g *gin.RouterGroup, resolve func(c *gin.Context) (*Index, bool), fetchOrders api.OrderFetcher) {
+	resolveService := func(c *gin.Context) (*query.OrdersSearchService, bool) {
+		idx, ok := resolve(c)
+		if !ok {
+			return nil, false
 		}
-		order.CreateTime = createTime.Format(time.RFC3339)
-		orders = append(orders, &order)
+		return idx.Service, true
+	}
+	api.MountRoutes(g, resolveService, fetchOrders)
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		admin := g.Group("/admin", api.RequireToken(adminToken))
+		api.MountAdminRoutes(admin, resolveService)
+		admin.POST("/sparse/verify", func(c *gin.Context) {
+			if idx, ok := resolve(c); ok {
+				idx.verifySparse(c)
+			}
+		})
+	} else {
+		slog.Info("ADMIN_TOKEN is not set, admin endpoints are disabled", "group", g.BasePath())
 	}
-	return orders, nil
 }
 
-var internalErrorBody = gin.H{
-	"error": gin.H{
-		"message": "Internal server error",
-	},
+// namespaceLockTTL is how long the namespace lock outlives a crashed instance
+const namespaceLockTTL = 15 * time.Second
+
+// indexNamePattern keeps index names free of ':', which separates the parts of redis keys
+var indexNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func validateIndexName(name string) error {
+	if !indexNamePattern.MatchString(name) {
+		return fmt.Errorf("index name %q must be 1 to 64 letters, digits, '_' or '-'", name)
+	}
+	return nil
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIndexName(t *testing.T) {
+	for _, name := range []string{"0", "tenant_a", "tenant-B-2"} {
+		assert.NoError(t, validateIndexName(name), name)
+	}
+	for _, name := range []string{"", "a:b", "a b", "a/b", "ünicode", strings.Repeat("a", 65)} {
+		assert.Error(t, validateIndexName(name), name)
+	}
+}
+
+func TestNewLogHandler(t *testing.T) {
+	var buf strings.Builder
+	h, level, err := newLogHandler(&buf, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelInfo, level)
+	logger := slog.New(h)
+	logger.Debug("hidden")
+	logger.Info("shown", "k", 1)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), "msg=shown k=1")
+
+	buf.Reset()
+	h, level, err = newLogHandler(&buf, "debug", "json")
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, level)
+	slog.New(h).Debug("shown", "k", 1)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal([]byte(buf.String()), &record))
+	assert.Equal(t, "shown", record["msg"])
+
+	_, _, err = newLogHandler(&buf, "loud", "")
+	assert.Error(t, err)
+	_, _, err = newLogHandler(&buf, "", "xml")
+	assert.Error(t, err)
+}
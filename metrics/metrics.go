@@ -0,0 +1,35 @@
+// Package metrics holds the process-wide counters, published through expvar at /debug/vars.
+package metrics
+
+import "expvar"
+
+var (
+	// SparseOversizedBuckets counts sparse buckets seen by readers holding far more ids than the split threshold
+	SparseOversizedBuckets = expvar.NewInt("sparse_oversized_buckets")
+	// SparseResplits counts buckets re-split after being flagged as oversized
+	SparseResplits = expvar.NewInt("sparse_resplits")
+	// SparseMerges counts undersized sparse buckets merged into their predecessor by compaction
+	SparseMerges = expvar.NewInt("sparse_merges")
+	// MissingSortKeys counts ids found in sparse buckets without a stored sort key
+	MissingSortKeys = expvar.NewInt("missing_sort_keys")
+	// SparseDuplicateIds counts ids skipped by scans because an earlier sparse bucket already held them
+	SparseDuplicateIds = expvar.NewInt("sparse_duplicate_ids")
+	// CorruptBitmaps counts corrupted bitmaps read as empty
+	CorruptBitmaps = expvar.NewInt("corrupt_bitmaps")
+	// ConsumerMessages counts applied change messages by op: snapshot_read, insert, update, delete,
+	// redelivered messages skipped as replayed, and tombstones
+	ConsumerMessages = expvar.NewMap("consumer_messages")
+	// ConsumerErrors counts change messages that failed to apply by op, see ConsumerMessages
+	ConsumerErrors = expvar.NewMap("consumer_errors")
+	// ConsumerHandleMicros sums the time spent applying change messages by op, successful or not
+	ConsumerHandleMicros = expvar.NewMap("consumer_handle_micros")
+	// BackfillSkippedRows counts rows a field backfill left to the consumer, as they changed since they were read
+	BackfillSkippedRows = expvar.NewInt("backfill_skipped_rows")
+	// StaleResponses counts cached query results served because the index failed
+	StaleResponses = expvar.NewInt("stale_responses")
+	// TermBitmapBytes is the serialized size of the term bitmaps by index, as of the last sample
+	TermBitmapBytes = expvar.NewMap("term_bitmap_bytes")
+	// LargestTermBitmapBytes is the size of the largest stored term bitmap or shard by index, as of the last sample.
+	// A hot value growing towards the value size limit of redis shows here first.
+	LargestTermBitmapBytes = expvar.NewMap("largest_term_bitmap_bytes")
+)
@@ -0,0 +1,52 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/KKKIIO/inv-index-demo/index"
+)
+
+// ErrFieldBackfilling is returned when a request filters or sorts on a field whose index is still being backfilled,
+// it would miss the orders indexed before the field was
+var ErrFieldBackfilling = errors.New("field is being backfilled")
+
+// SetBackfilling gates the requests filtering or sorting on field while its index is backfilled, e.g. a field
+// added to a running index. field is a derived field, a sort field, a field of index.TableSchema.Fields or index.ProviderIDRangeField.
+// The index must be enabled too, the gate only fails the requests using it with ErrFieldBackfilling until it's lifted.
+func (s *OrdersSearchService) SetBackfilling(field string, backfilling bool) {
+	if backfilling {
+		s.backfilling.Store(field, true)
+	} else {
+		s.backfilling.Delete(field)
+	}
+}
+
+// checkBackfilled returns ErrFieldBackfilling if r uses a field gated by SetBackfilling
+func (s *OrdersSearchService) checkBackfilled(r Request) error {
+	var fields []string
+	for field := range derivedFilters(r) {
+		fields = append(fields, field)
+	}
+	for _, p := range r.ShouldMatch {
+		fields = append(fields, p.Field)
+	}
+	for _, p := range r.FieldEq {
+		fields = append(fields, p.Field)
+	}
+	for field := range fieldRanges(r) {
+		fields = append(fields, field)
+	}
+	for _, sortField := range r.SortFields {
+		fields = append(fields, sortField.Field)
+	}
+	if r.ProviderIDGt != nil || r.ProviderIDLt != nil {
+		fields = append(fields, index.ProviderIDRangeField)
+	}
+	for _, field := range fields {
+		if _, ok := s.backfilling.Load(field); ok {
+			return fmt.Errorf("%w: %s", ErrFieldBackfilling, field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/RoaringBitmap/roaring"
+)
+
+// distinctBatchSize is the number of ids whose values are read at once by an estimated DistinctCount
+const distinctBatchSize = 1000
+
+// hllPrecision makes estimated distinct counts use 2^14 registers, for a standard error of about 0.8%
+const hllPrecision = 14
+
+// DistinctCount returns the number of distinct values of field among the orders matching r, nulls aren't counted.
+// The exact count reads every bitmap of field, which is slow for fields with many values like product_id.
+// The estimate reads the value of each matching id instead, from the values stored for sort fields,
+// so field must be enabled with EnableSortFields.
+func (s *OrdersSearchService) DistinctCount(r Request, field string, estimate bool) (uint64, error) {
+	if err := r.checkNoWeekdays(); err != nil {
+		return 0, err
+	}
+	var indexKey, sortValuesKey string
+	var bmStore store.BmStore
+	if estimate {
+		key, ok := s.SortValueKeys[field]
+		if !ok {
+			return 0, fmt.Errorf("%w: %s", ErrFieldNotIndexed, field)
+		}
+		sortValuesKey = key
+	} else {
+		idx, termBmStore, ok := s.termIndex(field)
+		if !ok {
+			return 0, fmt.Errorf("%w: %s", ErrFieldNotIndexed, field)
+		}
+		indexKey, bmStore = idx.GetIndexKey(), termBmStore
+	}
+	accBm, err := s.match(r)
+	if err != nil || accBm.IsEmpty() {
+		return 0, err
+	}
+	if estimate {
+		return s.estimateDistinct(accBm, sortValuesKey)
+	}
+	nullKey := s.ProviderIdIndexReader.Index.MakeValueKey((*int64)(nil))
+	var count uint64
+	err = bmStore.ScanValues(indexKey, func(valueKey string, bm *roaring.Bitmap) bool {
+		if valueKey != nullKey && bm.Intersects(accBm) {
+			count++
+		}
+		return true
+	})
+	return count, err
+}
+
+func (s *OrdersSearchService) estimateDistinct(accBm *roaring.Bitmap, sortValuesKey string) (uint64, error) {
+	hll := newHyperLogLog(hllPrecision)
+	ids := make([]uint32, 0, distinctBatchSize)
+	flush := func() error {
+		values, found, err := s.CreateTimeIndexReader.FvStore.MGetFound(sortValuesKey, ids)
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			if found[i] {
+				hll.add(value)
+			}
+		}
+		ids = ids[:0]
+		return nil
+	}
+	for it := accBm.Iterator(); it.HasNext(); {
+		ids = append(ids, it.Next())
+		if len(ids) == distinctBatchSize {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(ids) != 0 {
+		if err := flush(); err != nil {
+			return 0, err
+		}
+	}
+	return hll.estimate(), nil
+}
+
+// hyperLogLog estimates the number of distinct values added to it
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	return &hyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+func (h *hyperLogLog) add(value uint64) {
+	x := mix64(value)
+	// the first bits pick the register, it keeps the longest run of leading zeros of the others
+	i := x >> (64 - h.precision)
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1))) + 1
+	h.registers[i] = max(h.registers[i], rank)
+}
+
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// linear counting is more accurate for small cardinalities
+	if e <= 2.5*m && zeros != 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(e))
+}
+
+// mix64 is the finalizer of splitmix64, it spreads values like consecutive ids over all bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,46 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/KKKIIO/inv-index-demo/index"
+)
+
+// Bucket counts the orders created in [Start, Start + the bucket width), Start is a create_time in microseconds
+type Bucket struct {
+	Start uint64
+	Count uint64
+}
+
+// Histogram counts the orders matching r per bucketSeconds wide create_time bucket, ignoring r.Limit.
+// Buckets are floored to multiples of the width and ordered by Start asc, empty ones are left out.
+// It returns ErrScanTruncated along with the buckets counted so far if the scan reached its page budget.
+func (s *OrdersSearchService) Histogram(r Request, bucketSeconds uint64) ([]Bucket, error) {
+	width, err := index.TimeUnitSeconds.ToMicros(bucketSeconds)
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 {
+		return nil, fmt.Errorf("Invalid bucket width, bucketSeconds=%d", bucketSeconds)
+	}
+	accBm, err := s.match(r)
+	if err != nil || accBm.IsEmpty() {
+		return nil, err
+	}
+	var buckets []Bucket
+	err = s.CreateTimeIndexReader.Scan(accBm, r.createTimeBounds(), false, func(sortedIds []index.SortId) bool {
+		for _, sortId := range sortedIds {
+			start := sortId.SortKey - sortId.SortKey%width
+			if len(buckets) == 0 || buckets[len(buckets)-1].Start != start {
+				buckets = append(buckets, Bucket{Start: start})
+			}
+			buckets[len(buckets)-1].Count++
+		}
+		return true
+	})
+	if err != nil && !errors.Is(err, ErrScanTruncated) {
+		return nil, err
+	}
+	return buckets, err
+}
@@ -0,0 +1,115 @@
+package query
+
+import (
+	"slices"
+
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/RoaringBitmap/roaring"
+)
+
+// ListMulti runs List for each of rs, e.g. the counts of the status tabs of a dashboard.
+// A term bitmap is read once for the whole batch, requests sharing filters or __all reuse it.
+// The responses are in the order of rs.
+func (s *OrdersSearchService) ListMulti(rs []Request) ([]*Response, error) {
+	batch := s.withBmStores(batchBmStores())
+	resps := make([]*Response, len(rs))
+	for i, r := range rs {
+		resp, err := batch.List(r)
+		if err != nil {
+			return nil, err
+		}
+		resps[i] = resp
+	}
+	return resps, nil
+}
+
+// withBmStores returns a copy of s whose term readers read through the stores wrap returns, serving the same versions
+func (s *OrdersSearchService) withBmStores(wrap func(store.BmStore) store.BmStore) *OrdersSearchService {
+	c := *s
+	c.AllIndexReader = s.AllIndexReader.withBmStore(wrap)
+	c.OrderStatusIndexReader = s.OrderStatusIndexReader.withBmStore(wrap)
+	c.ProductIdIndexReader = s.ProductIdIndexReader.withBmStore(wrap)
+	c.ProviderIdIndexReader = s.ProviderIdIndexReader.withBmStore(wrap)
+	c.DerivedIndexReaders = make(map[string]*TermIndexReader[int64], len(s.DerivedIndexReaders))
+	for name, reader := range s.DerivedIndexReaders {
+		c.DerivedIndexReaders[name] = reader.withBmStore(wrap)
+	}
+	c.FieldIndexReaders = make(map[string]*TermIndexReader[*int64], len(s.FieldIndexReaders))
+	for name, reader := range s.FieldIndexReaders {
+		c.FieldIndexReaders[name] = reader.withBmStore(wrap)
+	}
+	c.DeletedIndexReader = s.DeletedIndexReader.withBmStore(wrap)
+	c.TextIndexReader = s.TextIndexReader.withBmStore(wrap)
+	return &c
+}
+
+// withBmStore returns a copy of r reading through the store wrap returns for its store, nil for a nil r
+func (r *TermIndexReader[T]) withBmStore(wrap func(store.BmStore) store.BmStore) *TermIndexReader[T] {
+	if r == nil {
+		return nil
+	}
+	c := &TermIndexReader[T]{Index: r.Index, BmStore: wrap(r.BmStore)}
+	c.version.Store(r.version.Load())
+	return c
+}
+
+// batchBmStores returns a wrapper of bm stores keeping the bitmaps read, so a batch reads each of them once.
+// Stores are wrapped once, readers sharing a store share its cache.
+func batchBmStores() func(store.BmStore) store.BmStore {
+	wrapped := make(map[store.BmStore]*batchBmStore)
+	return func(bmStore store.BmStore) store.BmStore {
+		if _, ok := wrapped[bmStore]; !ok {
+			wrapped[bmStore] = &batchBmStore{BmStore: bmStore, bms: make(map[[2]string]*roaring.Bitmap)}
+		}
+		return wrapped[bmStore]
+	}
+}
+
+// batchBmStore caches the bitmaps read by a batch of requests, it's not safe for concurrent use.
+// Copies are returned since queries modify the bitmaps they read.
+type batchBmStore struct {
+	store.BmStore
+	bms map[[2]string]*roaring.Bitmap
+}
+
+func (s *batchBmStore) Get(indexKey string, valueKey string) (*roaring.Bitmap, error) {
+	bms, err := s.MGet(indexKey, []string{valueKey})
+	if err != nil {
+		return nil, err
+	}
+	return bms[0], nil
+}
+
+// MGet reads the bitmaps missing from the cache in one round-trip
+func (s *batchBmStore) MGet(indexKey string, valueKeys []string) ([]*roaring.Bitmap, error) {
+	var missing []string
+	for _, valueKey := range valueKeys {
+		if _, ok := s.bms[[2]string{indexKey, valueKey}]; !ok && !slices.Contains(missing, valueKey) {
+			missing = append(missing, valueKey)
+		}
+	}
+	if len(missing) > 0 {
+		bms, err := s.BmStore.MGet(indexKey, missing)
+		if err != nil {
+			return nil, err
+		}
+		for i, valueKey := range missing {
+			s.bms[[2]string{indexKey, valueKey}] = bms[i]
+		}
+	}
+	if len(valueKeys) == 0 {
+		return nil, nil
+	}
+	bms := make([]*roaring.Bitmap, len(valueKeys))
+	for i, valueKey := range valueKeys {
+		bms[i] = s.bms[[2]string{indexKey, valueKey}].Clone()
+	}
+	return bms, nil
+}
+
+func (s *batchBmStore) Exists(indexKey string, valueKey string) (bool, error) {
+	if bm, ok := s.bms[[2]string{indexKey, valueKey}]; ok {
+		return !bm.IsEmpty(), nil
+	}
+	return s.BmStore.Exists(indexKey, valueKey)
+}
@@ -1,166 +1,1192 @@
 package query
 
 import (
+	"cmp"
+	"errors"
+	"fmt"
 	"log/slog"
+	"math"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/metrics"
 	"github.com/KKKIIO/inv-index-demo/store"
 	"github.com/RoaringBitmap/roaring"
 )
 
 type OrdersSearchService struct {
+	// TableSchema maps the indexed fields onto the source table
+	TableSchema            index.TableSchema
 	AllIndexReader         *TermIndexReader[int64]
 	OrderStatusIndexReader *TermIndexReader[int64]
 	ProductIdIndexReader   *TermIndexReader[int64]
 	ProviderIdIndexReader  *TermIndexReader[*int64]
 	CreateTimeIndexReader  *SparseU64IndexReader
+	// DerivedIndexReaders holds the readers of the maintained derived fields by name, see EnableDerivedFields
+	DerivedIndexReaders map[string]*TermIndexReader[int64]
+	// ProviderIdRangeReader reads the sparse index of non-null provider_id values, nil until EnableProviderIDRange
+	ProviderIdRangeReader *SparseU64IndexReader
+	// SortValueKeys holds the fv store keys of the fields ties can be ordered by, see EnableSortFields
+	SortValueKeys map[string]string
+	// DeletedIndexReader reads the soft-deleted ids, which are left out of every result. It's nil if the table has no soft delete.
+	DeletedIndexReader *TermIndexReader[int64]
+	// TextIndexReader reads the tokens of the text column, nil if the table has none, see index.TableSchema.TextColumn
+	TextIndexReader *TermIndexReader[string]
+	// FieldIndexReaders and FieldRangeReaders read the term and sparse fields of index.TableSchema.Fields by name
+	FieldIndexReaders map[string]*TermIndexReader[*int64]
+	FieldRangeReaders map[string]*SparseU64IndexReader
+	// StaleCache, if set, makes List serve the last result of a request when the index fails to answer it
+	StaleCache *StaleCache
+	// backfilling holds the fields gated by SetBackfilling, it's a pointer so copies of the service share it
+	backfilling *sync.Map
 }
 
-func NewOrdersSearchService(bmStore *store.RedisBmStore, sortedBmStore *store.RedisSortKeyBitmapStore,
-	fvStore *store.RedisFvStore) *OrdersSearchService {
-	return &OrdersSearchService{
+// ErrFieldNotIndexed is returned when a request filters on a derived field the index doesn't maintain
+var ErrFieldNotIndexed = errors.New("field not indexed")
+
+// ErrUnsupportedFilter is returned when a method can't apply a filter of the request, rather than ignoring it
+var ErrUnsupportedFilter = errors.New("filter not supported")
+
+// ErrScanTruncated is returned by sparse scans which stopped at SparseU64IndexReader.MaxScanPages,
+// the ids found until then were passed on
+var ErrScanTruncated = errors.New("scan truncated")
+
+func NewOrdersSearchService(bmStore store.BmStore, sortedBmStore store.SortKeyBitmapStore,
+	fvStore store.FieldValueStore) *OrdersSearchService {
+	return NewSearchService(index.OrdersSchema, bmStore, sortedBmStore, fvStore)
+}
+
+// NewSearchService returns a service over the index of the table mapped by schema
+func NewSearchService(schema index.TableSchema, bmStore store.BmStore, sortedBmStore store.SortKeyBitmapStore,
+	fvStore store.FieldValueStore) *OrdersSearchService {
+	s := &OrdersSearchService{
+		TableSchema: schema,
+		backfilling: &sync.Map{},
 		AllIndexReader: &TermIndexReader[int64]{
 			Index: index.TermIndex{
-				TableName: "orders",
-				FieldName: "__all",
+				TableName: schema.Table,
+				FieldName: index.AllField,
 			},
 			BmStore: bmStore,
 		},
 		OrderStatusIndexReader: &TermIndexReader[int64]{
 			Index: index.TermIndex{
-				TableName: "orders",
+				TableName: schema.Table,
 				FieldName: "order_status",
 			},
 			BmStore: bmStore,
 		},
 		ProductIdIndexReader: &TermIndexReader[int64]{
 			Index: index.TermIndex{
-				TableName: "orders",
+				TableName: schema.Table,
 				FieldName: "product_id",
 			},
 			BmStore: bmStore,
 		},
 		ProviderIdIndexReader: &TermIndexReader[*int64]{
 			Index: index.TermIndex{
-				TableName: "orders",
+				TableName: schema.Table,
 				FieldName: "provider_id",
 			},
 			BmStore: bmStore,
 		},
 		CreateTimeIndexReader: &SparseU64IndexReader{
 			Index: index.SparseIndex{
-				TableName: "orders",
+				TableName: schema.Table,
 				FieldName: "create_time",
 			},
 			BmStore: sortedBmStore,
 			FvStore: fvStore,
 		},
+		DerivedIndexReaders: make(map[string]*TermIndexReader[int64]),
+		SortValueKeys:       make(map[string]string),
+		FieldIndexReaders:   make(map[string]*TermIndexReader[*int64]),
+		FieldRangeReaders:   make(map[string]*SparseU64IndexReader),
+	}
+	for _, field := range schema.Fields {
+		if field.Kind == index.TermKind {
+			s.FieldIndexReaders[field.Name] = &TermIndexReader[*int64]{
+				Index:   index.TermIndex{TableName: schema.Table, FieldName: field.Name},
+				BmStore: bmStore,
+			}
+		} else {
+			s.FieldRangeReaders[field.Name] = &SparseU64IndexReader{
+				Index:   index.SparseIndex{TableName: schema.Table, FieldName: field.Name},
+				BmStore: sortedBmStore,
+				FvStore: fvStore,
+			}
+		}
+	}
+	if schema.SoftDeleteColumn != "" {
+		s.DeletedIndexReader = &TermIndexReader[int64]{
+			Index: index.TermIndex{
+				TableName: schema.Table,
+				FieldName: index.DeletedField,
+			},
+			BmStore: bmStore,
+		}
+	}
+	if schema.TextColumn != "" {
+		s.TextIndexReader = &TermIndexReader[string]{
+			Index: index.TermIndex{
+				TableName: schema.Table,
+				FieldName: index.TextField,
+			},
+			BmStore: bmStore,
+		}
+	}
+	return s
+}
+
+// EnableProviderIDRange allows provider_id range filters, the consumer must maintain the sparse index of provider_id
+func (s *OrdersSearchService) EnableProviderIDRange() {
+	s.ProviderIdRangeReader = &SparseU64IndexReader{
+		Index: index.SparseIndex{
+			TableName: s.TableSchema.Table,
+			FieldName: "provider_id",
+		},
+		BmStore: s.CreateTimeIndexReader.BmStore,
+		FvStore: s.CreateTimeIndexReader.FvStore,
+	}
+}
+
+// EnableDerivedFields allows filtering on fields, they must be maintained by the consumer too
+func (s *OrdersSearchService) EnableDerivedFields(fields []index.DerivedField) {
+	for _, field := range fields {
+		s.DerivedIndexReaders[field.Name] = &TermIndexReader[int64]{
+			Index: index.TermIndex{
+				TableName: s.AllIndexReader.Index.TableName,
+				FieldName: field.Name,
+			},
+			BmStore: s.AllIndexReader.BmStore,
+		}
 	}
 }
 
 type Request struct {
-	OrderStatusEq    *int64
+	OrderStatusEq *int64
+	// OrderStatusIn matches any of the statuses, it's ignored if empty
+	OrderStatusIn    []int64
 	ProductIDEq      *int64
 	ProviderIDFilter *NullableValueFilter[int64]
-	Limit            *int
+	// HasProvider is a boolean facet for ProviderIDFilter: true is its not null mode, false its null mode.
+	// Validate rejects it along with a ProviderIDFilter.
+	HasProvider *bool
+	// ProviderIDIn matches any of the providers, it's ignored if empty. It's ANDed with ProviderIDFilter like SQL would,
+	// e.g. not null is then a no-op and null matches nothing.
+	ProviderIDIn []int64
+	// ProviderIDGt and ProviderIDLt are exclusive bounds of provider_id, orders without provider never match them.
+	// They need EnableProviderIDRange.
+	ProviderIDGt    *int64
+	ProviderIDLt    *int64
+	CreateTimeRange *RangeFilter[uint64]
+	// CreateTimeWeekdays matches the orders created on these UTC weekdays, 0 is Sunday, it's ignored if empty.
+	// Unlike CreateWeekdayEq it needs no derived index: the create_time of each id is checked while scanning the
+	// sparse index, so it composes with CreateTimeRange and the create_time order. The ids aren't known before the scan,
+	// so Response.Total then counts the listed ids, see ScanBounds.Predicate.
+	// ListBitmap and DistinctCount don't scan, they reject it with ErrUnsupportedFilter.
+	CreateTimeWeekdays []int64
+	IDEq               *uint32
+	IDRange            *RangeFilter[uint32]
+	// IncludeIDs restricts the result to these ids, e.g. to rank a candidate set by create_time, it's ignored if empty
+	IncludeIDs []uint32
+	// CreateWeekdayEq and CreateQuarterEq filter on derived fields, see index.CreateWeekday and index.CreateQuarter
+	CreateWeekdayEq *int64
+	CreateQuarterEq *int64
+	// TextContainsAll and TextContainsAny match the orders whose text has all or any of the tokens of the terms,
+	// tokenized like the text, see index.Tokenize. They're ignored if empty, terms without any token match nothing.
+	TextContainsAll []string
+	TextContainsAny []string
+	// ShouldMatch matches the orders meeting at least MinShouldMatch of the predicates, e.g. for fuzzy matching,
+	// and is ANDed with the other filters. It's ignored if empty, MinShouldMatch then defaults to 1.
+	ShouldMatch    []TermPredicate
+	MinShouldMatch int
+	// FieldEq matches term fields by value, FieldGte and FieldLte bound sparse fields inclusively,
+	// see index.TableSchema.Fields. Every predicate is ANDed with the other filters, null values never match.
+	FieldEq  []TermPredicate
+	FieldGte []TermPredicate
+	FieldLte []TermPredicate
+	// Limit caps the number of listed ids: nil lists all of them, 0 only counts them (Response.Total).
+	// A negative limit is rejected by Validate, the service treats it like nil.
+	Limit *int
+	// ReportUnknownValues makes an empty result report the equality filters whose value isn't indexed at all,
+	// e.g. to tell "no such product" from "no matching orders"
+	ReportUnknownValues bool
+	// WithSortKeys makes the response carry the create_time of each id in SortIds
+	WithSortKeys bool
+	// SortFields order the ids created at the same time, before the id tie-break, e.g. like
+	// ORDER BY create_time DESC, product_id ASC, id DESC. The fields must be enabled, see EnableSortFields.
+	SortFields []SortField
+	// SkipTotal leaves Response.Total 0, so a request without filters can list the latest orders without loading __all
+	SkipTotal bool
+	// ExactTotalUpTo counts Response.Total exactly only for results of at most that many ids, 0 always does.
+	// Larger results report ExactTotalUpTo+1, or the number of listed ids if more, with TotalIsLowerBound instead,
+	// which is enough to tell there are more pages. It saves counting huge intersections, at the cost of the total.
+	ExactTotalUpTo uint32
+}
+
+// Validate rejects the requests whose meaning is unclear, e.g. a negative Limit
+func (r Request) Validate() error {
+	if r.Limit != nil && *r.Limit < 0 {
+		return fmt.Errorf("Invalid limit, limit=%d", *r.Limit)
+	}
+	if r.HasProvider != nil && r.ProviderIDFilter != nil {
+		return errors.New("Conflicting provider filters, has_provider is set along with provider_id_eq or provider_id_not_null")
+	}
+	if r.MinShouldMatch < 0 || r.MinShouldMatch > len(r.ShouldMatch) {
+		return fmt.Errorf("Invalid min should match, minShouldMatch=%d, predicates=%d", r.MinShouldMatch, len(r.ShouldMatch))
+	}
+	for _, weekday := range r.CreateTimeWeekdays {
+		if weekday < 0 || weekday > 6 {
+			return fmt.Errorf("Invalid weekday, weekday=%d", weekday)
+		}
+	}
+	return nil
+}
+
+// hasFilters reports whether r restricts the matched ids at all
+func (r Request) hasFilters() bool {
+	return r.OrderStatusEq != nil || len(r.OrderStatusIn) != 0 || r.ProductIDEq != nil || r.ProviderIDFilter != nil || r.HasProvider != nil ||
+		len(r.ProviderIDIn) != 0 || r.ProviderIDGt != nil || r.ProviderIDLt != nil ||
+		r.CreateTimeRange != nil || len(r.CreateTimeWeekdays) != 0 || r.IDEq != nil || r.IDRange != nil || len(r.IncludeIDs) != 0 ||
+		r.CreateWeekdayEq != nil || r.CreateQuarterEq != nil || len(r.TextContainsAll) != 0 || len(r.TextContainsAny) != 0 ||
+		len(r.ShouldMatch) != 0 || len(r.FieldEq) != 0 || len(r.FieldGte) != 0 || len(r.FieldLte) != 0
+}
+
+// Fingerprint names the filters set in r, e.g. "order_status_eq,provider_id_null,limit".
+// Requests of the same shape share a fingerprint whatever the filter values.
+func (r Request) Fingerprint() string {
+	var parts []string
+	add := func(set bool, name string) {
+		if set {
+			parts = append(parts, name)
+		}
+	}
+	add(r.OrderStatusEq != nil, "order_status_eq")
+	add(len(r.OrderStatusIn) != 0, "order_status_in")
+	add(r.ProductIDEq != nil, "product_id_eq")
+	if r.ProviderIDFilter != nil {
+		switch r.ProviderIDFilter.Mode {
+		case FilterModeEq:
+			parts = append(parts, "provider_id_eq")
+		case FilterModeNull:
+			parts = append(parts, "provider_id_null")
+		case FilterModeNotNull:
+			parts = append(parts, "provider_id_not_null")
+		}
+	}
+	add(r.HasProvider != nil, "has_provider")
+	add(len(r.ProviderIDIn) != 0, "provider_id_in")
+	add(r.ProviderIDGt != nil, "provider_id_gt")
+	add(r.ProviderIDLt != nil, "provider_id_lt")
+	add(r.CreateTimeRange != nil, "create_time_range")
+	add(len(r.CreateTimeWeekdays) != 0, "create_time_weekdays")
+	add(r.IDEq != nil, "id_eq")
+	add(r.IDRange != nil, "id_range")
+	add(len(r.IncludeIDs) != 0, "include_ids")
+	add(r.CreateWeekdayEq != nil, "create_weekday_eq")
+	add(r.CreateQuarterEq != nil, "create_quarter_eq")
+	add(len(r.TextContainsAll) != 0, "text_contains_all")
+	add(len(r.TextContainsAny) != 0, "text_contains_any")
+	add(len(r.ShouldMatch) != 0, "should_match")
+	add(len(r.FieldEq) != 0, "field_eq")
+	add(len(r.FieldGte) != 0, "field_gte")
+	add(len(r.FieldLte) != 0, "field_lte")
+	add(len(r.SortFields) != 0, "sort")
+	add(r.ExactTotalUpTo > 0, "exact_total_up_to")
+	add(r.Limit != nil, "limit")
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ",")
 }
 
 type Response struct {
-	IDs   []uint32
-	Total uint64
+	IDs []uint32
+	// SortIds holds the ids along with their create_time if Request.WithSortKeys is set
+	SortIds []index.SortId
+	Total   uint64
+	// UnknownValues lists the fields whose filter value has no indexed order, see Request.ReportUnknownValues
+	UnknownValues []string
+	// Stale is set if the index failed and the response is a cached one, see OrdersSearchService.StaleCache
+	Stale bool
+	// Truncated is set if the scan stopped at SparseU64IndexReader.MaxScanPages, IDs may then miss matches
+	Truncated bool
+	// TotalIsLowerBound is set if the result has more than Request.ExactTotalUpTo ids, Total is then a lower bound
+	TotalIsLowerBound bool
 }
 
-// List returns a list of order IDs matching the given query ordered by createTime desc.
+// List returns a list of order IDs matching the given query ordered by createTime desc,
+// ties ordered by the tie-break of CreateTimeIndexReader (id desc by default).
 func (s *OrdersSearchService) List(r Request) (*Response, error) {
+	resp, err := s.list(r)
+	if s.StaleCache == nil || errors.Is(err, ErrFieldNotIndexed) || errors.Is(err, ErrFieldBackfilling) {
+		return resp, err
+	}
+	if err == nil {
+		s.StaleCache.put(r, *resp)
+		return resp, nil
+	}
+	cached, ok := s.StaleCache.get(r)
+	if !ok {
+		return nil, err
+	}
+	slog.Warn("Serving stale result", "error", err)
+	metrics.StaleResponses.Add(1)
+	cached.IDs = slices.Clone(cached.IDs)
+	cached.SortIds = slices.Clone(cached.SortIds)
+	cached.Stale = true
+	return &cached, nil
+}
+
+func (s *OrdersSearchService) list(r Request) (*Response, error) {
 	slog.Debug("Querying orders", slog.Group("request",
 		slog.Any("OrderStatusEq", r.OrderStatusEq),
+		slog.Any("OrderStatusIn", r.OrderStatusIn),
 		slog.Any("ProductIDEq", r.ProductIDEq),
 		slog.Any("ProviderIDFilter", r.ProviderIDFilter),
+		slog.Any("HasProvider", r.HasProvider),
+		slog.Any("ProviderIDIn", r.ProviderIDIn),
+		slog.Any("ProviderIDGt", r.ProviderIDGt),
+		slog.Any("ProviderIDLt", r.ProviderIDLt),
+		slog.Any("CreateTimeRange", r.CreateTimeRange),
+		slog.Any("IDEq", r.IDEq),
+		slog.Any("IDRange", r.IDRange),
+		slog.Any("CreateWeekdayEq", r.CreateWeekdayEq),
+		slog.Any("CreateQuarterEq", r.CreateQuarterEq),
+		slog.Any("TextContainsAll", r.TextContainsAll),
+		slog.Any("TextContainsAny", r.TextContainsAny),
+		slog.Any("ShouldMatch", r.ShouldMatch),
+		slog.Int("MinShouldMatch", r.MinShouldMatch),
+		slog.Any("FieldEq", r.FieldEq),
+		slog.Any("FieldGte", r.FieldGte),
+		slog.Any("FieldLte", r.FieldLte),
 	))
-	accBm, err := s.AllIndexReader.Get(0)
+	r.Limit = normalizeLimit(r.Limit)
+	if r.SkipTotal && !r.hasFilters() && s.DeletedIndexReader == nil {
+		// every indexed id is in the sparse index, scan it without a base bitmap
+		return s.listIds(r, nil, &Response{})
+	}
+	accBm, err := s.match(r)
 	if err != nil {
 		return nil, err
 	}
-	if r.OrderStatusEq != nil {
-		bm, err := s.OrderStatusIndexReader.Get(*r.OrderStatusEq)
+	var resp Response
+	if r.ExactTotalUpTo > 0 && cardinalityOver(accBm, r.ExactTotalUpTo) {
+		// more ids than ExactTotalUpTo are known to match, even if none are listed
+		resp.Total, resp.TotalIsLowerBound = uint64(r.ExactTotalUpTo)+1, true
+	} else {
+		resp.Total = accBm.GetCardinality()
+	}
+	if accBm.IsEmpty() && r.ReportUnknownValues {
+		unknownValues, err := s.findUnknownValues(r)
 		if err != nil {
 			return nil, err
 		}
+		resp.UnknownValues = unknownValues
+	}
+	if len(r.CreateTimeWeekdays) != 0 && !accBm.IsEmpty() {
+		// accBm ignores the weekdays, only the listed ids are known to match
+		resp.Total, resp.TotalIsLowerBound = 0, true
+	}
+	if (r.Limit != nil && *r.Limit == 0) || accBm.IsEmpty() {
+		return &resp, nil
+	}
+	if r.SkipTotal {
+		resp.Total = 0
+		resp.TotalIsLowerBound = false
+	}
+	if _, err := s.listIds(r, accBm, &resp); err != nil {
+		return nil, err
+	}
+	if len(r.CreateTimeWeekdays) != 0 && !r.SkipTotal {
+		// exact unless the limit or a scan budget stopped the scan
+		resp.Total = uint64(len(resp.IDs))
+		resp.TotalIsLowerBound = resp.Truncated || (r.Limit != nil && len(resp.IDs) >= *r.Limit)
+	}
+	if resp.TotalIsLowerBound {
+		resp.Total = max(resp.Total, uint64(len(resp.IDs)))
+	}
+	return &resp, nil
+}
+
+// normalizeLimit treats a negative limit like nil, see Request.Limit
+func normalizeLimit(limit *int) *int {
+	if limit != nil && *limit < 0 {
+		return nil
+	}
+	return limit
+}
+
+// cardinalityOver reports whether bm holds more than n ids, without counting all of a larger bitmap
+func cardinalityOver(bm *roaring.Bitmap, n uint32) bool {
+	// Select stops at the container of the n-th id
+	_, err := bm.Select(n)
+	return err == nil
+}
+
+// listIds fills resp with the ids of accBm, nil for all indexed ids, ordered by createTime desc
+func (s *OrdersSearchService) listIds(r Request, accBm *roaring.Bitmap, resp *Response) (*Response, error) {
+	if r.Limit != nil && *r.Limit == 0 {
+		return resp, nil
+	}
+	resultIds := make([]uint32, 0)
+	var resultSortIds []index.SortId
+	err := s.scanSortIds(accBm, r.createTimeBounds(), r.Limit, r.SortFields, func(sortedIds []index.SortId) bool {
+		for _, sortId := range sortedIds {
+			resultIds = append(resultIds, sortId.Id)
+		}
+		if r.WithSortKeys {
+			resultSortIds = append(resultSortIds, sortedIds...)
+		}
+		return true
+	})
+	if errors.Is(err, ErrScanTruncated) {
+		resp.Truncated = true
+	} else if err != nil {
+		return nil, err
+	}
+	resp.IDs = resultIds
+	resp.SortIds = resultSortIds
+	return resp, nil
+}
+
+// Iterate passes the ids matching r ordered by createTime desc to proc in batches,
+// until proc returns false or r.Limit ids were passed. Unlike List, it doesn't hold the whole result.
+// It returns ErrScanTruncated if the scan reached its page budget.
+func (s *OrdersSearchService) Iterate(r Request, proc func(ids []uint32) bool) error {
+	r.Limit = normalizeLimit(r.Limit)
+	accBm, err := s.match(r)
+	if err != nil {
+		return err
+	}
+	if (r.Limit != nil && *r.Limit == 0) || accBm.IsEmpty() {
+		return nil
+	}
+	return s.scan(accBm, r.createTimeBounds(), r.Limit, r.SortFields, proc)
+}
+
+// ListBitmap returns every id matching r as a bitmap, e.g. for batch jobs consuming the whole result.
+// It's unordered, r.Limit and r.SortFields are ignored: ordering by create_time reads the sparse index and is a separate,
+// more expensive step.
+func (s *OrdersSearchService) ListBitmap(r Request) (*roaring.Bitmap, error) {
+	if err := r.checkNoWeekdays(); err != nil {
+		return nil, err
+	}
+	return s.match(r)
+}
+
+// checkNoWeekdays rejects r.CreateTimeWeekdays on the paths reading no create_time, which can't check it
+func (r Request) checkNoWeekdays() error {
+	if len(r.CreateTimeWeekdays) != 0 {
+		return fmt.Errorf("%w: create_time weekdays", ErrUnsupportedFilter)
+	}
+	return nil
+}
+
+// MaxPredicateFvReads bounds the create_time values read by a scan checking r.CreateTimeWeekdays.
+// A predicate few ids match would otherwise read the whole index to fill a page.
+const MaxPredicateFvReads = 100_000
+
+// createTimeBounds returns the bounds of r.CreateTimeRange, so scans stop at them instead of reading every older bucket,
+// and the predicate of r.CreateTimeWeekdays
+func (r Request) createTimeBounds() ScanBounds {
+	var bounds ScanBounds
+	if len(r.CreateTimeWeekdays) != 0 {
+		bounds.Predicate = func(createTime uint64) bool {
+			return slices.Contains(r.CreateTimeWeekdays, index.CreateWeekday.Derive(createTime))
+		}
+		bounds.MaxFvReads = MaxPredicateFvReads
+	}
+	if r.CreateTimeRange == nil {
+		return bounds
+	}
+	lo, hi, ok := r.CreateTimeRange.SortKeyBounds(store.U64Codec{}.Encode)
+	if !ok {
+		// nothing matches, the scan isn't reached
+		return bounds
+	}
+	bounds.MinSortKey, bounds.MaxSortKey = &lo, &hi
+	return bounds
+}
+
+// CreatedCursor is a position in the orders ordered by createTime asc, then by the tie-break of CreateTimeIndexReader
+type CreatedCursor struct {
+	CreateTime uint64
+	// AfterID skips the orders created at CreateTime up to AfterID in the tie-break order, nil skips none
+	AfterID *uint32
+}
+
+type CreatedSinceResponse struct {
+	IDs []uint32
+	// Next is the cursor to continue from, it equals the given cursor if no id was returned.
+	// With Request.SortFields, ties aren't in id order, so pages end after a whole tie, which may exceed the limit,
+	// and Next is the create_time after it.
+	Next CreatedCursor
+	// Truncated is set if the scan stopped at SparseU64IndexReader.MaxScanPages, the page may then be short
+	Truncated bool
+}
+
+// ListCreatedSince returns up to limit ids matching r created at or after since, ordered by createTime asc,
+// ties ordered by r.SortFields then by the tie-break of CreateTimeIndexReader.
+// Paging with the returned cursor gives a feed of newly created orders.
+// It only tracks creation: updates are not reported, and an order whose create_time is changed
+// to, or inserted late with, a time before the cursor is missed.
+func (s *OrdersSearchService) ListCreatedSince(r Request, since CreatedCursor, limit int) (*CreatedSinceResponse, error) {
+	resp := CreatedSinceResponse{IDs: make([]uint32, 0), Next: since}
+	if limit <= 0 {
+		return &resp, nil
+	}
+	accBm, err := s.match(r)
+	if err != nil {
+		return nil, err
+	}
+	sinceBm, err := s.CreateTimeIndexReader.Range(since.CreateTime, math.MaxUint64)
+	if err != nil {
+		return nil, err
+	}
+	accBm.And(sinceBm)
+	if accBm.IsEmpty() {
+		return &resp, nil
+	}
+	idDesc := s.CreateTimeIndexReader.TieBreak.idDesc(false)
+	predicate := r.createTimeBounds().Predicate
+	sortTies := len(r.SortFields) != 0
+	var sortErr error
+	if err := s.CreateTimeIndexReader.ScanSince(accBm, since.CreateTime, func(sortedIds []index.SortId) bool {
+		page := make([]index.SortId, 0, len(sortedIds))
+		for _, sortId := range sortedIds {
+			if sortId.SortKey == since.CreateTime && since.AfterID != nil &&
+				((!idDesc && sortId.Id <= *since.AfterID) || (idDesc && sortId.Id >= *since.AfterID)) {
+				continue
+			}
+			if predicate != nil && !predicate(sortId.SortKey) {
+				continue
+			}
+			page = append(page, sortId)
+		}
+		if sortTies {
+			// a batch holds every id of a create_time
+			if sortErr = s.sortTies(page, r.SortFields); sortErr != nil {
+				return false
+			}
+		}
+		for _, sortId := range page {
+			// ordered by sort fields, a page ends after a whole tie, see CreatedSinceResponse.Next
+			if sortTies && len(resp.IDs) >= limit && sortId.SortKey != resp.Next.CreateTime {
+				return false
+			}
+			resp.IDs = append(resp.IDs, sortId.Id)
+			id := sortId.Id
+			resp.Next = CreatedCursor{CreateTime: sortId.SortKey, AfterID: &id}
+			if !sortTies && len(resp.IDs) == limit {
+				return false
+			}
+		}
+		return len(resp.IDs) < limit
+	}); errors.Is(err, ErrScanTruncated) {
+		resp.Truncated = true
+	} else if err != nil {
+		return nil, err
+	}
+	if sortErr != nil {
+		return nil, sortErr
+	}
+	if sortTies && len(resp.IDs) != 0 {
+		resp.Next = CreatedCursor{CreateTime: resp.Next.CreateTime + 1}
+	}
+	return &resp, nil
+}
+
+// scan passes the ids of accBm ordered by createTime desc, then by sortFields, to proc,
+// stopping after limit ids if limit is set
+func (s *OrdersSearchService) scan(accBm *roaring.Bitmap, bounds ScanBounds, limit *int, sortFields []SortField, proc func(ids []uint32) bool) error {
+	return s.scanSortIds(accBm, bounds, limit, sortFields, func(sortedIds []index.SortId) bool {
+		ids := make([]uint32, len(sortedIds))
+		for i, sortId := range sortedIds {
+			ids[i] = sortId.Id
+		}
+		return proc(ids)
+	})
+}
+
+// scanSortIds passes the ids of accBm, nil for all indexed ids, with their create_time ordered by createTime desc to proc in batches
+// Ties are ordered by sortFields first, a batch holds every id of a create_time.
+func (s *OrdersSearchService) scanSortIds(accBm *roaring.Bitmap, bounds ScanBounds, limit *int, sortFields []SortField, proc func(sortedIds []index.SortId) bool) error {
+	count := 0
+	var sortErr error
+	err := s.CreateTimeIndexReader.Scan(accBm, bounds, true, func(sortedIds []index.SortId) bool {
+		if len(sortFields) != 0 {
+			if sortErr = s.sortTies(sortedIds, sortFields); sortErr != nil {
+				return false
+			}
+		}
+		if limit != nil && count+len(sortedIds) > *limit {
+			sortedIds = sortedIds[:max(*limit-count, 0)]
+		}
+		count += len(sortedIds)
+		return proc(sortedIds) && (limit == nil || count < *limit)
+	})
+	return errors.Join(sortErr, err)
+}
+
+// RefreshVersions switches the term readers to the versions stored in versions, version 1 if there's none
+func (s *OrdersSearchService) RefreshVersions(versions *store.IndexVersions) error {
+	stored, err := versions.Get()
+	if err != nil {
+		return err
+	}
+	set := func(field string, setVersion func(int)) {
+		version, ok := stored[field]
+		if !ok {
+			version = 1
+		}
+		setVersion(version)
+	}
+	set(s.OrderStatusIndexReader.Index.FieldName, s.OrderStatusIndexReader.SetVersion)
+	set(s.ProductIdIndexReader.Index.FieldName, s.ProductIdIndexReader.SetVersion)
+	set(s.ProviderIdIndexReader.Index.FieldName, s.ProviderIdIndexReader.SetVersion)
+	return nil
+}
+
+// match returns the ids matching the filters of r.
+// The filters are ANDed: positive leaves (term and range filters) are subsets of the indexed ids,
+// while negations (provider_id not null) and id filters must be applied to some set of indexed ids.
+// __all stands for that set, it is only read when no positive leaf can seed the result.
+// Soft-deleted ids are removed last, so they are in neither the ids nor the total.
+func (s *OrdersSearchService) match(r Request) (*roaring.Bitmap, error) {
+	if err := s.checkBackfilled(r); err != nil {
+		return nil, err
+	}
+	if r.HasProvider != nil && r.ProviderIDFilter == nil {
+		r.ProviderIDFilter = &NullableValueFilter[int64]{Mode: FilterModeNull}
+		if *r.HasProvider {
+			r.ProviderIDFilter.Mode = FilterModeNotNull
+		}
+	}
+	// the ids must be in every positive leaf, seed from the smallest one instead of loading __all
+	leaves, err := s.positiveLeaves(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(leaves) == 0 {
+		bm, err := s.matchAll()
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, bm)
+	}
+	// the include set may hold unindexed ids, it's ANDed with at least one positive leaf or __all,
+	// but it's often the smallest set so it can still seed
+	if len(r.IncludeIDs) != 0 {
+		leaves = append(leaves, roaring.BitmapOf(r.IncludeIDs...))
+	}
+	slices.SortFunc(leaves, func(a, b *roaring.Bitmap) int {
+		return cmp.Compare(a.GetCardinality(), b.GetCardinality())
+	})
+	accBm := leaves[0]
+	for _, bm := range leaves[1:] {
 		accBm.And(bm)
 	}
-	if r.ProductIDEq != nil {
-		bm, err := s.ProductIdIndexReader.Get(*r.ProductIDEq)
+	// not null is a negation, it holds for the ids of accBm without a null provider: accBm is a subset of __all,
+	// deletes remove ids from __all last. The null bitmap is large, don't read it for nothing,
+	// the ids of an IN leaf all have a provider already.
+	if r.ProviderIDFilter != nil && r.ProviderIDFilter.Mode == FilterModeNotNull && len(r.ProviderIDIn) == 0 && !accBm.IsEmpty() {
+		bm, err := s.ProviderIdIndexReader.Get(nil)
 		if err != nil {
 			return nil, err
 		}
+		accBm.AndNot(bm)
+	}
+	// ids need no index, they are the bitmap members themselves
+	if r.IDEq != nil {
+		accBm.And(roaring.BitmapOf(*r.IDEq))
+	}
+	if r.IDRange != nil {
+		bm := roaring.New()
+		if lo, hi, ok := r.IDRange.SortKeyBounds(func(v uint32) uint64 { return uint64(v) }); ok && lo <= math.MaxUint32 {
+			bm.AddRange(lo, min(hi, math.MaxUint32)+1)
+		}
 		accBm.And(bm)
 	}
+	if s.DeletedIndexReader != nil {
+		bm, err := s.DeletedIndexReader.Get(index.DeletedValue)
+		if err != nil {
+			return nil, err
+		}
+		accBm.AndNot(bm)
+	}
+	return accBm, nil
+}
+
+// matchAll loads every indexed id
+func (s *OrdersSearchService) matchAll() (*roaring.Bitmap, error) {
+	var universe *TermIndexReader[int64]
+	switch s.TableSchema.UniverseField {
+	case "":
+		return s.AllIndexReader.Get(index.AllValue)
+	case s.OrderStatusIndexReader.Index.FieldName:
+		universe = s.OrderStatusIndexReader
+	case s.ProductIdIndexReader.Index.FieldName:
+		universe = s.ProductIdIndexReader
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrFieldNotIndexed, s.TableSchema.UniverseField)
+	}
+	// every id is in the bitmap of its value
+	allBm := roaring.New()
+	err := universe.BmStore.ScanValues(universe.CurrentIndex().GetIndexKey(), func(valueKey string, bm *roaring.Bitmap) bool {
+		allBm.Or(bm)
+		return true
+	})
+	return allBm, err
+}
+
+// positiveLeaves loads the bitmaps of the filters every matching id is in, a union for IN filters
+func (s *OrdersSearchService) positiveLeaves(r Request) ([]*roaring.Bitmap, error) {
+	var leaves []*roaring.Bitmap
+	add := func(get func() (*roaring.Bitmap, error)) error {
+		bm, err := get()
+		if err != nil {
+			return err
+		}
+		leaves = append(leaves, bm)
+		return nil
+	}
+	if r.OrderStatusEq != nil {
+		if err := add(func() (*roaring.Bitmap, error) { return s.OrderStatusIndexReader.Get(*r.OrderStatusEq) }); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.OrderStatusIn) != 0 {
+		if err := add(func() (*roaring.Bitmap, error) { return s.OrderStatusIndexReader.GetAny(r.OrderStatusIn) }); err != nil {
+			return nil, err
+		}
+	}
+	if r.ProductIDEq != nil {
+		if err := add(func() (*roaring.Bitmap, error) { return s.ProductIdIndexReader.Get(*r.ProductIDEq) }); err != nil {
+			return nil, err
+		}
+	}
 	if r.ProviderIDFilter != nil {
 		switch r.ProviderIDFilter.Mode {
 		case FilterModeEq:
-			bm, err := s.ProviderIdIndexReader.Get(&r.ProviderIDFilter.Value)
-			if err != nil {
+			if err := add(func() (*roaring.Bitmap, error) { return s.ProviderIdIndexReader.Get(&r.ProviderIDFilter.Value) }); err != nil {
 				return nil, err
 			}
-			accBm.And(bm)
 		case FilterModeNull:
-			bm, err := s.ProviderIdIndexReader.Get(nil)
-			if err != nil {
+			if err := add(func() (*roaring.Bitmap, error) { return s.ProviderIdIndexReader.Get(nil) }); err != nil {
 				return nil, err
 			}
-			accBm.And(bm)
-		case FilterModeNotNull:
-			bm, err := s.ProviderIdIndexReader.Get(nil)
-			if err != nil {
+		}
+	}
+	if len(r.ProviderIDIn) != 0 {
+		providerIDs := make([]*int64, len(r.ProviderIDIn))
+		for i := range r.ProviderIDIn {
+			providerIDs[i] = &r.ProviderIDIn[i]
+		}
+		if err := add(func() (*roaring.Bitmap, error) { return s.ProviderIdIndexReader.GetAny(providerIDs) }); err != nil {
+			return nil, err
+		}
+	}
+	for field, eq := range derivedFilters(r) {
+		reader, ok := s.DerivedIndexReaders[field]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrFieldNotIndexed, field)
+		}
+		if err := add(func() (*roaring.Bitmap, error) { return reader.Get(*eq) }); err != nil {
+			return nil, err
+		}
+	}
+	if r.CreateTimeRange != nil {
+		// every indexed id has a create_time, so the range is a subset of __all like the term leaves
+		if err := add(func() (*roaring.Bitmap, error) {
+			return EvalRange(s.CreateTimeIndexReader, *r.CreateTimeRange, store.U64Codec{}.Encode)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if r.ProviderIDGt != nil || r.ProviderIDLt != nil {
+		if s.ProviderIdRangeReader == nil {
+			return nil, fmt.Errorf("%w: %s", ErrFieldNotIndexed, index.ProviderIDRangeField)
+		}
+		// null providers aren't in the sparse index
+		f := RangeFilter[int64]{Gte: r.ProviderIDGt, Lte: r.ProviderIDLt}
+		if err := add(func() (*roaring.Bitmap, error) {
+			return EvalRange(s.ProviderIdRangeReader, f, store.Int64Codec{}.Encode)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.ShouldMatch) != 0 {
+		if err := add(func() (*roaring.Bitmap, error) { return s.matchShould(r) }); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range r.FieldEq {
+		get, ok := s.termGetter(p.Field)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrFieldNotIndexed, p.Field)
+		}
+		if err := add(func() (*roaring.Bitmap, error) { return get(p.Value) }); err != nil {
+			return nil, err
+		}
+	}
+	for field, f := range fieldRanges(r) {
+		reader, ok := s.FieldRangeReaders[field]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrFieldNotIndexed, field)
+		}
+		// null values aren't in the sparse index
+		if err := add(func() (*roaring.Bitmap, error) { return EvalRange(reader, f, store.Int64Codec{}.Encode) }); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.TextContainsAll) != 0 || len(r.TextContainsAny) != 0 {
+		if s.TextIndexReader == nil {
+			return nil, fmt.Errorf("%w: %s", ErrFieldNotIndexed, index.TextField)
+		}
+		// every token is a leaf, so the smallest one seeds the intersection.
+		// Terms without any token match nothing, like with TextContainsAny.
+		if len(r.TextContainsAll) != 0 {
+			tokens := tokenize(r.TextContainsAll)
+			if len(tokens) == 0 {
+				leaves = append(leaves, roaring.New())
+			} else {
+				bms, err := s.TextIndexReader.MGet(tokens)
+				if err != nil {
+					return nil, err
+				}
+				leaves = append(leaves, bms...)
+			}
+		}
+		if len(r.TextContainsAny) != 0 {
+			if err := add(func() (*roaring.Bitmap, error) { return s.TextIndexReader.GetAny(tokenize(r.TextContainsAny)) }); err != nil {
 				return nil, err
 			}
-			accBm.AndNot(bm)
 		}
 	}
-	resp := Response{Total: accBm.GetCardinality()}
-	if (r.Limit != nil && *r.Limit == 0) || resp.Total == 0 {
-		return &resp, nil
+	return leaves, nil
+}
+
+// tokenize returns the distinct tokens of terms
+func tokenize(terms []string) []string {
+	return index.Tokenize(strings.Join(terms, " "))
+}
+
+// CheckFields returns ErrFieldNotIndexed if r filters on a derived field, or sorts by a field, which isn't maintained,
+// and ErrFieldBackfilling if it's not fully indexed yet
+func (s *OrdersSearchService) CheckFields(r Request) error {
+	if err := s.checkBackfilled(r); err != nil {
+		return err
 	}
-	resultIds := make([]uint32, 0)
-	if err := s.CreateTimeIndexReader.Scan(accBm, true, func(sortedIds []index.SortId) bool {
-		for _, sortId := range sortedIds {
-			resultIds = append(resultIds, sortId.Id)
-			if r.Limit != nil && len(resultIds) >= *r.Limit {
-				return false
-			}
+	for field := range derivedFilters(r) {
+		if _, ok := s.DerivedIndexReaders[field]; !ok {
+			return fmt.Errorf("%w: %s", ErrFieldNotIndexed, field)
 		}
-		return true
-	}); err != nil {
-		return nil, err
 	}
-	resp.IDs = resultIds
-	return &resp, nil
+	for _, sortField := range r.SortFields {
+		if _, ok := s.SortValueKeys[sortField.Field]; !ok {
+			return fmt.Errorf("%w: %s", ErrFieldNotIndexed, sortField.Field)
+		}
+	}
+	if (r.ProviderIDGt != nil || r.ProviderIDLt != nil) && s.ProviderIdRangeReader == nil {
+		return fmt.Errorf("%w: %s", ErrFieldNotIndexed, index.ProviderIDRangeField)
+	}
+	for _, p := range append(slices.Clip(r.ShouldMatch), r.FieldEq...) {
+		if _, ok := s.termGetter(p.Field); !ok {
+			return fmt.Errorf("%w: %s", ErrFieldNotIndexed, p.Field)
+		}
+	}
+	for field := range fieldRanges(r) {
+		if _, ok := s.FieldRangeReaders[field]; !ok {
+			return fmt.Errorf("%w: %s", ErrFieldNotIndexed, field)
+		}
+	}
+	if (len(r.TextContainsAll) != 0 || len(r.TextContainsAny) != 0) && s.TextIndexReader == nil {
+		return fmt.Errorf("%w: %s", ErrFieldNotIndexed, index.TextField)
+	}
+	return nil
+}
+
+// fieldRanges merges the bounds of r.FieldGte and r.FieldLte by field name, the tightest bound wins
+func fieldRanges(r Request) map[string]RangeFilter[int64] {
+	ranges := make(map[string]RangeFilter[int64])
+	for _, p := range r.FieldGte {
+		v := p.Value
+		f := ranges[p.Field]
+		if f.Gte == nil || *f.Gte < v {
+			f.Gte = &v
+		}
+		f.IncludeLo, f.IncludeHi = true, true
+		ranges[p.Field] = f
+	}
+	for _, p := range r.FieldLte {
+		v := p.Value
+		f := ranges[p.Field]
+		if f.Lte == nil || *f.Lte > v {
+			f.Lte = &v
+		}
+		f.IncludeLo, f.IncludeHi = true, true
+		ranges[p.Field] = f
+	}
+	return ranges
+}
+
+// derivedFilters returns the set equality filters on derived fields by field name
+func derivedFilters(r Request) map[string]*int64 {
+	filters := make(map[string]*int64)
+	if r.CreateWeekdayEq != nil {
+		filters[index.CreateWeekday.Name] = r.CreateWeekdayEq
+	}
+	if r.CreateQuarterEq != nil {
+		filters[index.CreateQuarter.Name] = r.CreateQuarterEq
+	}
+	return filters
+}
+
+func (s *OrdersSearchService) findUnknownValues(r Request) ([]string, error) {
+	var unknownValues []string
+	check := func(field string, exists func() (bool, error)) error {
+		ok, err := exists()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			unknownValues = append(unknownValues, field)
+		}
+		return nil
+	}
+	if r.OrderStatusEq != nil {
+		if err := check("order_status", func() (bool, error) { return s.OrderStatusIndexReader.Exists(*r.OrderStatusEq) }); err != nil {
+			return nil, err
+		}
+	}
+	if r.ProductIDEq != nil {
+		if err := check("product_id", func() (bool, error) { return s.ProductIdIndexReader.Exists(*r.ProductIDEq) }); err != nil {
+			return nil, err
+		}
+	}
+	if r.ProviderIDFilter != nil && r.ProviderIDFilter.Mode == FilterModeEq {
+		if err := check("provider_id", func() (bool, error) { return s.ProviderIdIndexReader.Exists(&r.ProviderIDFilter.Value) }); err != nil {
+			return nil, err
+		}
+	}
+	return unknownValues, nil
 }
 
 type TermIndexReader[T index.Term] struct {
 	Index   index.TermIndex
-	BmStore *store.RedisBmStore
+	BmStore store.BmStore
+	// version overrides Index.Version once set, it's switched while serving, see RefreshVersions
+	version atomic.Int64
+}
+
+// SetVersion makes the reader serve version of its index
+func (r *TermIndexReader[T]) SetVersion(version int) {
+	r.version.Store(int64(version))
+}
+
+// CurrentIndex returns the served version of the index
+func (r *TermIndexReader[T]) CurrentIndex() index.TermIndex {
+	if version := r.version.Load(); version != 0 {
+		return r.Index.WithVersion(int(version))
+	}
+	return r.Index
 }
 
 func (r *TermIndexReader[T]) Get(fv T) (*roaring.Bitmap, error) {
-	return r.BmStore.Get(r.Index.GetIndexKey(), r.Index.MakeValueKey(fv))
+	idx := r.CurrentIndex()
+	return r.BmStore.Get(idx.GetIndexKey(), idx.MakeValueKey(fv))
+}
+
+// GetAny returns the ids having any of the field values fvs
+func (r *TermIndexReader[T]) GetAny(fvs []T) (*roaring.Bitmap, error) {
+	bms, err := r.MGet(fvs)
+	if err != nil {
+		return nil, err
+	}
+	return roaring.FastOr(bms...), nil
+}
+
+// MGet returns the bitmaps of the field values fvs, read in one round-trip
+func (r *TermIndexReader[T]) MGet(fvs []T) ([]*roaring.Bitmap, error) {
+	idx := r.CurrentIndex()
+	valueKeys := make([]string, len(fvs))
+	for i, fv := range fvs {
+		valueKeys[i] = idx.MakeValueKey(fv)
+	}
+	return r.BmStore.MGet(idx.GetIndexKey(), valueKeys)
+}
+
+// Exists reports whether any order has the field value fv
+func (r *TermIndexReader[T]) Exists(fv T) (bool, error) {
+	idx := r.CurrentIndex()
+	return r.BmStore.Exists(idx.GetIndexKey(), idx.MakeValueKey(fv))
+}
+
+// MultiValueTermIndexReader reads the term index of a field holding a set of values, e.g. tags,
+// an id is in the bitmap of each of its values
+type MultiValueTermIndexReader[T index.Term] struct {
+	*TermIndexReader[T]
+}
+
+// GetAll returns the ids having every field value of fvs. Only multi-value fields can match more than one value.
+func (r *MultiValueTermIndexReader[T]) GetAll(fvs []T) (*roaring.Bitmap, error) {
+	if len(fvs) == 0 {
+		return nil, errors.New("GetAll needs at least one value")
+	}
+	bms := make([]*roaring.Bitmap, len(fvs))
+	for i, fv := range fvs {
+		bm, err := r.Get(fv)
+		if err != nil {
+			return nil, err
+		}
+		bms[i] = bm
+	}
+	slices.SortFunc(bms, func(a, b *roaring.Bitmap) int {
+		return cmp.Compare(a.GetCardinality(), b.GetCardinality())
+	})
+	return roaring.FastAnd(bms...), nil
 }
 
 type SparseU64IndexReader struct {
 	Index   index.SparseIndex
-	BmStore *store.RedisSortKeyBitmapStore
-	FvStore *store.RedisFvStore
+	BmStore store.SortKeyBitmapStore
+	FvStore store.FieldValueStore
+	// OversizedThreshold flags buckets holding more ids than this, 0 disables the check.
+	// A bucket can stay oversized if a writer crashed in the middle of a split.
+	OversizedThreshold uint64
+	// OnOversized is called with the sort key of an oversized bucket, e.g. to schedule a re-split
+	OnOversized func(sortKey uint64)
+	// TieBreak orders the ids sharing a sort key in Scan
+	TieBreak TieBreak
+	// MaxScanPages bounds the pages of 100 buckets read by a scan, 0 reads all.
+	// It caps the cost of a small base bitmap spread over many buckets, see ErrScanTruncated.
+	MaxScanPages int
+}
+
+// TieBreak is the id order of the ids sharing a sort key, so pages over equal sort keys are stable
+type TieBreak int
+
+const (
+	// TieBreakFollowSort orders ties by id in the scan direction, i.e. ORDER BY fv DESC, id DESC or ORDER BY fv ASC, id ASC
+	TieBreakFollowSort TieBreak = iota
+	// TieBreakIDAsc orders ties by id asc in both directions
+	TieBreakIDAsc
+	// TieBreakIDDesc orders ties by id desc in both directions
+	TieBreakIDDesc
+)
+
+// ParseTieBreak parses "sort", "asc" or "desc"
+func ParseTieBreak(s string) (TieBreak, error) {
+	switch s {
+	case "sort":
+		return TieBreakFollowSort, nil
+	case "asc":
+		return TieBreakIDAsc, nil
+	case "desc":
+		return TieBreakIDDesc, nil
+	default:
+		return 0, fmt.Errorf("Unknown tie break: %s", s)
+	}
+}
+
+// idDesc reports whether ties are ordered by id desc in a scan in the given direction
+func (t TieBreak) idDesc(reverse bool) bool {
+	switch t {
+	case TieBreakIDAsc:
+		return false
+	case TieBreakIDDesc:
+		return true
+	default:
+		return reverse
+	}
+}
+
+// reverseTies reverses the runs of equal sort keys of sortIds in place
+func reverseTies(sortIds []index.SortId) {
+	for i := 0; i < len(sortIds); {
+		j := i + 1
+		for j < len(sortIds) && sortIds[j].SortKey == sortIds[i].SortKey {
+			j++
+		}
+		slices.Reverse(sortIds[i:j])
+		i = j
+	}
 }
 
-func (r *SparseU64IndexReader) Scan(baseBm *roaring.Bitmap, reverse bool, proc func([]index.SortId) bool) error {
-	// scan bitmaps, sort by fv
-	start, end := uint64(0), uint64(0xFFFFFFFFFFFFFFFF)
+// ScanBounds restricts a Scan to the ids with sort keys in [MinSortKey, MaxSortKey], a nil bound leaves that side open.
+// The scan only reads the buckets which may hold such ids, so it stops early at the bound.
+type ScanBounds struct {
+	MinSortKey *uint64
+	MaxSortKey *uint64
+	// Predicate, if set, drops the ids whose sort key it rejects, e.g. a condition on create_time no range expresses.
+	// Sort keys are read bucket by bucket anyway, so it costs no extra read, but the scan may read many buckets to
+	// find the ids it keeps.
+	Predicate func(sortKey uint64) bool
+	// MaxFvReads stops the scan with ErrScanTruncated once it read that many sort keys, 0 doesn't
+	MaxFvReads int
+}
+
+// Scan passes the ids of baseBm, or of every bucket if baseBm is nil, within bounds ordered by sort key to proc in batches
+func (r *SparseU64IndexReader) Scan(baseBm *roaring.Bitmap, bounds ScanBounds, reverse bool, proc func([]index.SortId) bool) error {
+	start, end := uint64(0), uint64(math.MaxUint64)
+	if bounds.MinSortKey != nil {
+		// the floor bucket of the bound may hold ids above it
+		floorBms, err := r.BmStore.Scan(r.Index.MakeIndexKey(), *bounds.MinSortKey, 0, true, 1)
+		if err != nil {
+			return err
+		}
+		start = *bounds.MinSortKey
+		if len(floorBms) != 0 {
+			start = floorBms[0].SortKey
+		}
+	}
+	if bounds.MaxSortKey != nil {
+		// buckets above the bound only hold ids above it
+		end = *bounds.MaxSortKey
+	}
+	if start > end {
+		return nil
+	}
+	if bounds.MinSortKey != nil || bounds.MaxSortKey != nil || bounds.Predicate != nil {
+		// the edge buckets may hold ids out of bounds
+		inner := proc
+		proc = func(sortedIds []index.SortId) bool {
+			sortedIds = slices.DeleteFunc(sortedIds, func(sortId index.SortId) bool {
+				return (bounds.MinSortKey != nil && sortId.SortKey < *bounds.MinSortKey) ||
+					(bounds.MaxSortKey != nil && sortId.SortKey > *bounds.MaxSortKey) ||
+					(bounds.Predicate != nil && !bounds.Predicate(sortId.SortKey))
+			})
+			return len(sortedIds) == 0 || inner(sortedIds)
+		}
+	}
 	if reverse {
 		start, end = end, start
 	}
+	return r.scan(baseBm, start, end, reverse, bounds.MaxFvReads, proc)
+}
+
+// ScanSince is an ascending Scan of the ids with sort keys from since
+func (r *SparseU64IndexReader) ScanSince(baseBm *roaring.Bitmap, since uint64, proc func([]index.SortId) bool) error {
+	return r.Scan(baseBm, ScanBounds{MinSortKey: &since}, false, proc)
+}
+
+// scan passes the ids of the buckets with sort keys from start to end, both inclusive.
+// It stops with ErrScanTruncated once it read more than maxFvReads sort keys, unless maxFvReads is 0.
+func (r *SparseU64IndexReader) scan(baseBm *roaring.Bitmap, start uint64, end uint64, reverse bool, maxFvReads int, proc func([]index.SortId) bool) error {
 	indexKey := r.Index.MakeIndexKey()
-	for start != end {
+	// an id left in 2 buckets by a broken write is only passed from the first one scanned
+	emitted := roaring.New()
+	fvReads := 0
+	for pages, done := 0, false; !done; pages++ {
+		if r.MaxScanPages > 0 && pages >= r.MaxScanPages {
+			slog.Warn("Sparse scan reached its page budget", "indexKey", indexKey, "pages", pages)
+			return ErrScanTruncated
+		}
 		sortedBms, err := r.BmStore.Scan(indexKey, start, end, reverse, 100)
 		if err != nil {
 			return err
@@ -169,7 +1195,8 @@ func (r *SparseU64IndexReader) Scan(baseBm *roaring.Bitmap, reverse bool, proc f
 			break
 		}
 		start = sortedBms[len(sortedBms)-1].SortKey
-		if start != end {
+		done = start == end
+		if !done {
 			if !reverse {
 				start += 1
 			} else {
@@ -177,17 +1204,37 @@ func (r *SparseU64IndexReader) Scan(baseBm *roaring.Bitmap, reverse bool, proc f
 			}
 		}
 		for _, sortedBm := range sortedBms {
-			sortedBm.Bitmap.And(baseBm)
+			r.checkOversized(indexKey, sortedBm)
+			if baseBm != nil {
+				sortedBm.Bitmap.And(baseBm)
+			}
+			if duplicates := sortedBm.Bitmap.AndCardinality(emitted); duplicates > 0 {
+				slog.Warn("Found ids in more than one sparse bucket", "indexKey", indexKey, "sortKey", sortedBm.SortKey, "count", duplicates)
+				metrics.SparseDuplicateIds.Add(int64(duplicates))
+				sortedBm.Bitmap.AndNot(emitted)
+			}
 			if sortedBm.Bitmap.GetCardinality() == 0 {
 				continue
 			}
+			if maxFvReads > 0 && fvReads >= maxFvReads {
+				slog.Warn("Sparse scan reached its fv read budget", "indexKey", indexKey, "fvReads", fvReads)
+				return ErrScanTruncated
+			}
+			fvReads += int(sortedBm.Bitmap.GetCardinality())
+			emitted.Or(sortedBm.Bitmap)
 			sortedIds, err := index.QuerySortIds(r.FvStore, indexKey, sortedBm.Bitmap)
 			if err != nil {
 				return err
 			}
+			if len(sortedIds) == 0 {
+				continue
+			}
 			if reverse {
 				slices.Reverse(sortedIds)
 			}
+			if r.TieBreak.idDesc(reverse) != reverse {
+				reverseTies(sortedIds)
+			}
 			if !proc(sortedIds) {
 				return nil
 			}
@@ -196,6 +1243,21 @@ func (r *SparseU64IndexReader) Scan(baseBm *roaring.Bitmap, reverse bool, proc f
 	return nil
 }
 
+func (r *SparseU64IndexReader) checkOversized(indexKey string, sortedBm store.SortKeyBitmap) {
+	if r.OversizedThreshold == 0 {
+		return
+	}
+	cardinality := sortedBm.Bitmap.GetCardinality()
+	if cardinality <= r.OversizedThreshold {
+		return
+	}
+	slog.Warn("Found oversized sparse bucket", "indexKey", indexKey, "sortKey", sortedBm.SortKey, "cardinality", cardinality, "threshold", r.OversizedThreshold)
+	metrics.SparseOversizedBuckets.Add(1)
+	if r.OnOversized != nil {
+		r.OnOversized(sortedBm.SortKey)
+	}
+}
+
 type NullableValueFilterMode int
 
 const (
@@ -0,0 +1,107 @@
+package query
+
+import (
+	"math"
+
+	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/RoaringBitmap/roaring"
+)
+
+// RangeFilter matches field values between Gte and Lte, a nil bound leaves that side of the range open.
+// The bounds are exclusive unless IncludeLo/IncludeHi is set.
+type RangeFilter[T any] struct {
+	Gte, Lte             *T
+	IncludeLo, IncludeHi bool
+}
+
+// SortKeyBounds converts the filter to an inclusive sort key range [lo, hi],
+// encode must map values to sort keys preserving their order. ok is false if the range is empty.
+func (f RangeFilter[T]) SortKeyBounds(encode func(T) uint64) (lo uint64, hi uint64, ok bool) {
+	lo, hi = 0, math.MaxUint64
+	if f.Gte != nil {
+		lo = encode(*f.Gte)
+		if !f.IncludeLo {
+			if lo == math.MaxUint64 {
+				return 0, 0, false
+			}
+			lo++
+		}
+	}
+	if f.Lte != nil {
+		hi = encode(*f.Lte)
+		if !f.IncludeHi {
+			if hi == 0 {
+				return 0, 0, false
+			}
+			hi--
+		}
+	}
+	return lo, hi, lo <= hi
+}
+
+// EvalRange returns the ids whose field value, indexed by reader, matches the filter
+func EvalRange[T any](reader *SparseU64IndexReader, f RangeFilter[T], encode func(T) uint64) (*roaring.Bitmap, error) {
+	lo, hi, ok := f.SortKeyBounds(encode)
+	if !ok {
+		return roaring.New(), nil
+	}
+	return reader.Range(lo, hi)
+}
+
+// Range returns the ids whose sort key is in [lo, hi].
+// Buckets entirely inside the range are taken as is, only the edge buckets are filtered by their ids' fv.
+func (r *SparseU64IndexReader) Range(lo uint64, hi uint64) (*roaring.Bitmap, error) {
+	indexKey := r.Index.MakeIndexKey()
+	result := roaring.New()
+	// the floor bucket of lo may hold ids in range
+	start := lo
+	floorBms, err := r.BmStore.Scan(indexKey, lo, 0, true, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(floorBms) != 0 {
+		start = floorBms[0].SortKey
+	}
+	// a bucket covers [its sort key, next sort key), keep one bucket pending until the next key is known
+	var pending *store.SortKeyBitmap
+	flush := func(nextKey *uint64) error {
+		if pending == nil {
+			return nil
+		}
+		if pending.SortKey >= lo && ((nextKey != nil && *nextKey-1 <= hi) || (nextKey == nil && hi == math.MaxUint64)) {
+			result.Or(pending.Bitmap)
+			return nil
+		}
+		sortIds, err := index.QuerySortIds(r.FvStore, indexKey, pending.Bitmap)
+		if err != nil {
+			return err
+		}
+		for _, sortId := range sortIds {
+			if sortId.SortKey >= lo && sortId.SortKey <= hi {
+				result.Add(sortId.Id)
+			}
+		}
+		return nil
+	}
+	for {
+		sortedBms, err := r.BmStore.Scan(indexKey, start, hi, false, 100)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sortedBms {
+			if err := flush(&sortedBms[i].SortKey); err != nil {
+				return nil, err
+			}
+			pending = &sortedBms[i]
+		}
+		if len(sortedBms) < 100 || pending.SortKey == hi {
+			break
+		}
+		start = pending.SortKey + 1
+	}
+	if err := flush(nil); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,78 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/KKKIIO/inv-index-demo/store/storetest"
+	"github.com/KKKIIO/inv-index-demo/sync"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeFilterSortKeyBounds(t *testing.T) {
+	identity := func(v uint64) uint64 { return v }
+	u64 := func(v uint64) *uint64 { return &v }
+	tests := []struct {
+		name   string
+		filter RangeFilter[uint64]
+		lo, hi uint64
+		ok     bool
+	}{
+		{"unbounded", RangeFilter[uint64]{}, 0, 0xFFFFFFFFFFFFFFFF, true},
+		{"inclusive", RangeFilter[uint64]{Gte: u64(3), Lte: u64(5), IncludeLo: true, IncludeHi: true}, 3, 5, true},
+		{"exclusive", RangeFilter[uint64]{Gte: u64(3), Lte: u64(5)}, 4, 4, true},
+		{"only lower", RangeFilter[uint64]{Gte: u64(3)}, 4, 0xFFFFFFFFFFFFFFFF, true},
+		{"only upper", RangeFilter[uint64]{Lte: u64(5), IncludeHi: true}, 0, 5, true},
+		{"empty exclusive", RangeFilter[uint64]{Gte: u64(3), Lte: u64(4)}, 4, 3, false},
+		{"below zero", RangeFilter[uint64]{Lte: u64(0)}, 0, 0, false},
+		{"above max", RangeFilter[uint64]{Gte: u64(0xFFFFFFFFFFFFFFFF)}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lo, hi, ok := tt.filter.SortKeyBounds(identity)
+			assert.Equal(t, tt.ok, ok)
+			if tt.ok {
+				assert.Equal(t, tt.lo, lo)
+				assert.Equal(t, tt.hi, hi)
+			}
+		})
+	}
+}
+
+func TestEvalRange(t *testing.T) {
+	_, skbmStore, fvStore := storetest.NewRedis(t)
+	ss := NewOrdersSearchService(nil, skbmStore, fvStore)
+	// small buckets so ranges cross bucket boundaries
+	w, err := sync.NewSparseU64IndexWriter("orders", "create_time", 3)
+	require.NoError(t, err)
+	fvs := map[uint32]uint64{}
+	for id := uint32(1); id <= 40; id++ {
+		fv := uint64(id%13) * 10
+		fvs[id] = fv
+		require.NoError(t, w.Add(skbmStore, fvStore, fv, id))
+	}
+	u64 := func(v uint64) *uint64 { return &v }
+	filters := []RangeFilter[uint64]{
+		{},
+		{Gte: u64(30), Lte: u64(80), IncludeLo: true, IncludeHi: true},
+		{Gte: u64(30), Lte: u64(80)},
+		{Gte: u64(35), Lte: u64(75), IncludeLo: true, IncludeHi: true},
+		{Gte: u64(90), IncludeLo: true},
+		{Lte: u64(20)},
+		{Gte: u64(200)},
+		{Gte: u64(50), Lte: u64(50), IncludeLo: true, IncludeHi: true},
+	}
+	for _, f := range filters {
+		expected := roaring.New()
+		for id, fv := range fvs {
+			if (f.Gte == nil || fv > *f.Gte || (f.IncludeLo && fv == *f.Gte)) &&
+				(f.Lte == nil || fv < *f.Lte || (f.IncludeHi && fv == *f.Lte)) {
+				expected.Add(id)
+			}
+		}
+		bm, err := EvalRange(ss.CreateTimeIndexReader, f, func(v uint64) uint64 { return v })
+		require.NoError(t, err)
+		assert.Equal(t, expected.ToArray(), bm.ToArray(), "filter %+v", f)
+	}
+}
@@ -0,0 +1,31 @@
+package query
+
+import (
+	"github.com/KKKIIO/inv-index-demo/index"
+)
+
+// Rank returns the 0-based position of id among the ids matching r ordered like List, ignoring r.Limit.
+// found is false if id doesn't match r, or if maxRank is set and id isn't among the first maxRank ids,
+// so the scan stops there instead of reading the whole result. A negative maxRank is like nil.
+// It returns ErrScanTruncated if the scan reached its page budget before finding id.
+func (s *OrdersSearchService) Rank(r Request, id uint32, maxRank *int) (rank int, found bool, err error) {
+	maxRank = normalizeLimit(maxRank)
+	accBm, err := s.match(r)
+	if err != nil || !accBm.Contains(id) {
+		return 0, false, err
+	}
+	err = s.scanSortIds(accBm, r.createTimeBounds(), maxRank, r.SortFields, func(sortedIds []index.SortId) bool {
+		for _, sortId := range sortedIds {
+			if sortId.Id == id {
+				found = true
+				return false
+			}
+			rank++
+		}
+		return true
+	})
+	if err != nil || !found {
+		return 0, false, err
+	}
+	return rank, true, nil
+}
@@ -0,0 +1,90 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// TermPredicate is the equality of a field to a value, e.g. of a term field in Request.ShouldMatch:
+// order_status, product_id, provider_id, a derived field or a term field of index.TableSchema.Fields
+type TermPredicate struct {
+	Field string
+	Value int64
+}
+
+// ParseTermPredicate parses a `field:value` predicate
+func ParseTermPredicate(s string) (TermPredicate, error) {
+	field, value, found := strings.Cut(s, ":")
+	if !found || field == "" {
+		return TermPredicate{}, fmt.Errorf("Invalid term predicate, predicate=%q", s)
+	}
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return TermPredicate{}, fmt.Errorf("Invalid term predicate, predicate=%q, err: %w", s, err)
+	}
+	return TermPredicate{Field: field, Value: v}, nil
+}
+
+// String is the inverse of ParseTermPredicate
+func (p TermPredicate) String() string {
+	return fmt.Sprintf("%s:%d", p.Field, p.Value)
+}
+
+// matchShould returns the ids matching at least r.MinShouldMatch of r.ShouldMatch, at least one if it's 0
+func (s *OrdersSearchService) matchShould(r Request) (*roaring.Bitmap, error) {
+	bms := make([]*roaring.Bitmap, len(r.ShouldMatch))
+	for i, p := range r.ShouldMatch {
+		get, ok := s.termGetter(p.Field)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrFieldNotIndexed, p.Field)
+		}
+		bm, err := get(p.Value)
+		if err != nil {
+			return nil, err
+		}
+		bms[i] = bm
+	}
+	return atLeast(bms, max(r.MinShouldMatch, 1)), nil
+}
+
+// termGetter returns the reader of the bitmaps of field by value, nullable fields are never read at null
+func (s *OrdersSearchService) termGetter(field string) (func(int64) (*roaring.Bitmap, error), bool) {
+	switch field {
+	case s.OrderStatusIndexReader.Index.FieldName:
+		return s.OrderStatusIndexReader.Get, true
+	case s.ProductIdIndexReader.Index.FieldName:
+		return s.ProductIdIndexReader.Get, true
+	case s.ProviderIdIndexReader.Index.FieldName:
+		return func(v int64) (*roaring.Bitmap, error) { return s.ProviderIdIndexReader.Get(&v) }, true
+	}
+	if reader, ok := s.DerivedIndexReaders[field]; ok {
+		return reader.Get, true
+	}
+	if reader, ok := s.FieldIndexReaders[field]; ok {
+		return func(v int64) (*roaring.Bitmap, error) { return reader.Get(&v) }, true
+	}
+	return nil, false
+}
+
+// atLeast returns the ids in at least k of bms.
+// It keeps a bitmap per count reached, counts[j] holding the ids seen in more than j bitmaps so far,
+// so each bitmap costs k unions and intersections instead of a pass over its ids.
+func atLeast(bms []*roaring.Bitmap, k int) *roaring.Bitmap {
+	if k > len(bms) {
+		return roaring.New()
+	}
+	counts := make([]*roaring.Bitmap, k)
+	for i := range counts {
+		counts[i] = roaring.New()
+	}
+	for _, bm := range bms {
+		for j := k - 1; j > 0; j-- {
+			counts[j].Or(roaring.And(counts[j-1], bm))
+		}
+		counts[0].Or(bm)
+	}
+	return counts[k-1]
+}
@@ -0,0 +1,130 @@
+package query
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/KKKIIO/inv-index-demo/index"
+)
+
+// SortField orders ids sharing a create_time by a term field, see Request.SortFields
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// EnableSortFields allows ordering ties by fields, their sort values must be stored by the consumer too
+func (s *OrdersSearchService) EnableSortFields(fields []string) {
+	for _, field := range fields {
+		s.SortValueKeys[field] = index.SortValuesKey(s.TableSchema.Table, field)
+	}
+}
+
+// sortTies orders the runs of equal create_time of sortIds by the sort values of fields,
+// ids with the same values keep their id tie-break order.
+// Ids without a value come after the others in ascending order and before them in descending order,
+// like NULLs in Postgres.
+func (s *OrdersSearchService) sortTies(sortIds []index.SortId, fields []SortField) error {
+	keys := make([]string, len(fields))
+	for i, field := range fields {
+		key, ok := s.SortValueKeys[field.Field]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrFieldNotIndexed, field.Field)
+		}
+		keys[i] = key
+	}
+	var tied []uint32
+	forEachTie(sortIds, func(run []index.SortId) {
+		for _, sortId := range run {
+			tied = append(tied, sortId.Id)
+		}
+	})
+	if len(tied) == 0 {
+		return nil
+	}
+	pos := make(map[uint32]int, len(tied))
+	for i, id := range tied {
+		pos[id] = i
+	}
+	values := make([][]uint64, len(fields))
+	found := make([][]bool, len(fields))
+	for i, key := range keys {
+		var err error
+		values[i], found[i], err = s.CreateTimeIndexReader.FvStore.MGetFound(key, tied)
+		if err != nil {
+			return err
+		}
+	}
+	compare := func(a, b index.SortId) int {
+		i, j := pos[a.Id], pos[b.Id]
+		for f, field := range fields {
+			// a missing value is greater than any value
+			c := cmp.Compare(values[f][i], values[f][j])
+			if found[f][i] != found[f][j] {
+				c = 1
+				if found[f][i] {
+					c = -1
+				}
+			} else if !found[f][i] {
+				c = 0
+			}
+			if field.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+	forEachTie(sortIds, func(run []index.SortId) {
+		slices.SortStableFunc(run, compare)
+	})
+	return nil
+}
+
+// forEachTie passes the runs of more than one equal sort key of sortIds to proc
+func forEachTie(sortIds []index.SortId, proc func(run []index.SortId)) {
+	for i := 0; i < len(sortIds); {
+		j := i + 1
+		for j < len(sortIds) && sortIds[j].SortKey == sortIds[i].SortKey {
+			j++
+		}
+		if j-i > 1 {
+			proc(sortIds[i:j])
+		}
+		i = j
+	}
+}
+
+// ParseSortFields parses comma separated field names, each prefixed with '-' to sort descending
+func ParseSortFields(s string) ([]SortField, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var fields []SortField
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		field := SortField{Field: strings.TrimPrefix(name, "-")}
+		field.Desc = field.Field != name
+		if !slices.Contains(index.SortableFields, field.Field) {
+			return nil, fmt.Errorf("unknown sort field %q", field.Field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// FormatSortFields is the inverse of ParseSortFields
+func FormatSortFields(fields []SortField) string {
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.Field
+		if field.Desc {
+			names[i] = "-" + field.Field
+		}
+	}
+	return strings.Join(names, ",")
+}
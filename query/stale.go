@@ -0,0 +1,88 @@
+package query
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// StaleCache keeps the last results of List requests, so List can serve them when the index is unavailable.
+// It only serves reads, writers never see it.
+type StaleCache struct {
+	// MaxEntries bounds the number of cached requests, the least recently used one is evicted first
+	MaxEntries int
+	// MaxAge bounds the staleness of served results, older results are never served
+	MaxAge  time.Duration
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+type staleEntry struct {
+	key       string
+	resp      Response
+	fetchedAt time.Time
+}
+
+func NewStaleCache(maxEntries int, maxAge time.Duration) *StaleCache {
+	return &StaleCache{
+		MaxEntries: maxEntries,
+		MaxAge:     maxAge,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// cacheKey identifies requests with the same result
+func cacheKey(r Request) (string, bool) {
+	key, err := json.Marshal(r)
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+func (c *StaleCache) put(r Request, resp Response) {
+	key, ok := cacheKey(r)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		e.Value = &staleEntry{key: key, resp: resp, fetchedAt: c.now()}
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&staleEntry{key: key, resp: resp, fetchedAt: c.now()})
+	for c.lru.Len() > c.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*staleEntry).key)
+	}
+}
+
+// get returns the cached result of r if it's at most MaxAge old
+func (c *StaleCache) get(r Request) (Response, bool) {
+	key, ok := cacheKey(r)
+	if !ok {
+		return Response{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return Response{}, false
+	}
+	entry := e.Value.(*staleEntry)
+	if c.now().Sub(entry.fetchedAt) > c.MaxAge {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return Response{}, false
+	}
+	c.lru.MoveToFront(e)
+	return entry.resp, true
+}
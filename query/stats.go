@@ -0,0 +1,206 @@
+package query
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/RoaringBitmap/roaring"
+)
+
+type TermIndexStats struct {
+	DistinctValues int64
+	// TopValues are the values with the largest bitmaps, by cardinality desc
+	TopValues []ValueCardinality
+}
+
+type ValueCardinality struct {
+	Value       string
+	Cardinality uint64
+}
+
+// TermIndexSize sums up the stored sizes of the bitmaps of a term index
+type TermIndexSize struct {
+	Values int
+	Bytes  uint64
+	// LargestValue is the value key of the largest stored bitmap or shard, LargestBytes its size
+	LargestValue string
+	LargestBytes uint64
+}
+
+type SparseIndexStats struct {
+	Buckets                  int
+	MinSortKey               uint64
+	MaxSortKey               uint64
+	LargestBucketSortKey     uint64
+	LargestBucketCardinality uint64
+}
+
+// TermIndexStats describes the term index of field, it reads every bitmap of the field
+func (s *OrdersSearchService) TermIndexStats(field string, topN int) (*TermIndexStats, error) {
+	idx, bmStore, ok := s.termIndex(field)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFieldNotIndexed, field)
+	}
+	indexKey := idx.GetIndexKey()
+	distinct, err := bmStore.Len(indexKey)
+	if err != nil {
+		return nil, err
+	}
+	stats := TermIndexStats{DistinctValues: distinct, TopValues: make([]ValueCardinality, 0, topN+1)}
+	if err := bmStore.ScanValues(indexKey, func(valueKey string, bm *roaring.Bitmap) bool {
+		stats.TopValues = append(stats.TopValues, ValueCardinality{Value: valueKey, Cardinality: bm.GetCardinality()})
+		slices.SortFunc(stats.TopValues, func(a, b ValueCardinality) int {
+			if a.Cardinality != b.Cardinality {
+				return cmp.Compare(b.Cardinality, a.Cardinality)
+			}
+			return cmp.Compare(a.Value, b.Value)
+		})
+		stats.TopValues = stats.TopValues[:min(len(stats.TopValues), topN)]
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+type FieldSchema struct {
+	Name string
+	// Kind is "term" for fields filtered by value, "sparse" for fields filtered by range
+	Kind string
+	// DistinctValues is the number of values of a term field
+	DistinctValues int64
+	// Values are the values of a low cardinality term field by cardinality desc, nil for other fields
+	Values []ValueCardinality
+}
+
+// Schema describes the filterable fields, enumerating the values of term fields with up to maxValues of them.
+// product_id is never enumerated, it's expected to have too many values.
+func (s *OrdersSearchService) Schema(maxValues int) ([]FieldSchema, error) {
+	fields := []string{s.OrderStatusIndexReader.Index.FieldName, s.ProductIdIndexReader.Index.FieldName, s.ProviderIdIndexReader.Index.FieldName}
+	derived := make([]string, 0, len(s.DerivedIndexReaders))
+	for name := range s.DerivedIndexReaders {
+		derived = append(derived, name)
+	}
+	slices.Sort(derived)
+	fields = append(fields, derived...)
+	schema := make([]FieldSchema, 0, len(fields)+1)
+	for _, field := range fields {
+		idx, bmStore, _ := s.termIndex(field)
+		distinct, err := bmStore.Len(idx.GetIndexKey())
+		if err != nil {
+			return nil, err
+		}
+		fieldSchema := FieldSchema{Name: field, Kind: "term", DistinctValues: distinct}
+		// only read the bitmaps of fields small enough to enumerate
+		if field != s.ProductIdIndexReader.Index.FieldName && distinct <= int64(maxValues) {
+			stats, err := s.TermIndexStats(field, maxValues)
+			if err != nil {
+				return nil, err
+			}
+			fieldSchema.Values = stats.TopValues
+		}
+		schema = append(schema, fieldSchema)
+	}
+	return append(schema, FieldSchema{Name: s.CreateTimeIndexReader.Index.FieldName, Kind: "sparse"}), nil
+}
+
+// TermIndexSizes measures the stored bitmaps of every term index by field without reading them.
+// Each shard of a sharded bitmap is measured as a stored value of its own.
+func (s *OrdersSearchService) TermIndexSizes() (map[string]TermIndexSize, error) {
+	bmStores := map[string]store.BmStore{}
+	indexes := map[string]index.TermIndex{}
+	for _, field := range []string{s.AllIndexReader.Index.FieldName, s.OrderStatusIndexReader.Index.FieldName,
+		s.ProductIdIndexReader.Index.FieldName, s.ProviderIdIndexReader.Index.FieldName} {
+		if idx, bmStore, ok := s.termIndex(field); ok {
+			indexes[field], bmStores[field] = idx, bmStore
+		}
+	}
+	for field, reader := range s.DerivedIndexReaders {
+		indexes[field], bmStores[field] = reader.CurrentIndex(), reader.BmStore
+	}
+	if s.DeletedIndexReader != nil {
+		indexes[index.DeletedField], bmStores[index.DeletedField] = s.DeletedIndexReader.CurrentIndex(), s.DeletedIndexReader.BmStore
+	}
+	if s.TextIndexReader != nil {
+		indexes[index.TextField], bmStores[index.TextField] = s.TextIndexReader.CurrentIndex(), s.TextIndexReader.BmStore
+	}
+	sizes := make(map[string]TermIndexSize, len(indexes))
+	for field, idx := range indexes {
+		var size TermIndexSize
+		if err := bmStores[field].ScanSizes(idx.GetIndexKey(), func(valueKey string, stored []uint64) bool {
+			size.Values++
+			for _, bytes := range stored {
+				size.Bytes += bytes
+				if bytes > size.LargestBytes {
+					size.LargestValue, size.LargestBytes = valueKey, bytes
+				}
+			}
+			return true
+		}); err != nil {
+			return nil, err
+		}
+		sizes[field] = size
+	}
+	return sizes, nil
+}
+
+// termIndex returns the term index of field and its store,
+// __all has none when index.TableSchema.UniverseField stands for it
+func (s *OrdersSearchService) termIndex(field string) (index.TermIndex, store.BmStore, bool) {
+	switch field {
+	case s.AllIndexReader.Index.FieldName:
+		if s.TableSchema.UniverseField != "" {
+			return index.TermIndex{}, nil, false
+		}
+		return s.AllIndexReader.CurrentIndex(), s.AllIndexReader.BmStore, true
+	case s.OrderStatusIndexReader.Index.FieldName:
+		return s.OrderStatusIndexReader.CurrentIndex(), s.OrderStatusIndexReader.BmStore, true
+	case s.ProductIdIndexReader.Index.FieldName:
+		return s.ProductIdIndexReader.CurrentIndex(), s.ProductIdIndexReader.BmStore, true
+	case s.ProviderIdIndexReader.Index.FieldName:
+		return s.ProviderIdIndexReader.CurrentIndex(), s.ProviderIdIndexReader.BmStore, true
+	}
+	if reader, ok := s.DerivedIndexReaders[field]; ok {
+		return reader.CurrentIndex(), reader.BmStore, true
+	}
+	return index.TermIndex{}, nil, false
+}
+
+// SparseIndexStats describes the sparse index of field, it reads every bucket of the field
+func (s *OrdersSearchService) SparseIndexStats(field string) (*SparseIndexStats, error) {
+	if field != s.CreateTimeIndexReader.Index.FieldName {
+		return nil, fmt.Errorf("%w: %s", ErrFieldNotIndexed, field)
+	}
+	return s.CreateTimeIndexReader.Stats()
+}
+
+func (r *SparseU64IndexReader) Stats() (*SparseIndexStats, error) {
+	var stats SparseIndexStats
+	indexKey := r.Index.MakeIndexKey()
+	start := uint64(0)
+	for {
+		sortedBms, err := r.BmStore.Scan(indexKey, start, math.MaxUint64, false, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, sortedBm := range sortedBms {
+			if stats.Buckets == 0 {
+				stats.MinSortKey = sortedBm.SortKey
+			}
+			stats.Buckets++
+			stats.MaxSortKey = sortedBm.SortKey
+			if cardinality := sortedBm.Bitmap.GetCardinality(); cardinality > stats.LargestBucketCardinality {
+				stats.LargestBucketCardinality = cardinality
+				stats.LargestBucketSortKey = sortedBm.SortKey
+			}
+		}
+		if len(sortedBms) < 100 || stats.MaxSortKey == math.MaxUint64 {
+			return &stats, nil
+		}
+		start = stats.MaxSortKey + 1
+	}
+}
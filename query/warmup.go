@@ -0,0 +1,33 @@
+package query
+
+import (
+	"math"
+)
+
+// WarmupStats counts what Warmup read
+type WarmupStats struct {
+	// StatusValues is the number of order_status values with a bitmap, counted without reading the bitmaps
+	StatusValues int64
+	Buckets      int
+}
+
+// warmupBuckets is the number of newest create_time buckets read by Warmup, a page of a scan
+const warmupBuckets = 100
+
+// Warmup reads the newest page of create_time buckets, which most queries start from, and counts the order_status
+// values, so the first queries after a start don't pay for cold redis connections.
+// Term bitmaps aren't read: the readers have no cache to keep them in, every query reads them again.
+func (s *OrdersSearchService) Warmup() (*WarmupStats, error) {
+	var stats WarmupStats
+	var err error
+	idx := s.OrderStatusIndexReader.CurrentIndex()
+	if stats.StatusValues, err = s.OrderStatusIndexReader.BmStore.Len(idx.GetIndexKey()); err != nil {
+		return nil, err
+	}
+	buckets, err := s.CreateTimeIndexReader.BmStore.Scan(s.CreateTimeIndexReader.Index.MakeIndexKey(), math.MaxUint64, 0, true, warmupBuckets)
+	if err != nil {
+		return nil, err
+	}
+	stats.Buckets = len(buckets)
+	return &stats, nil
+}
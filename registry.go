@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/metrics"
+	"github.com/KKKIIO/inv-index-demo/query"
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/KKKIIO/inv-index-demo/sync"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// IndexSpec names an index and the CDC topic prefix it consumes
+type IndexSpec struct {
+	Name        string
+	TopicPrefix string
+}
+
+// ParseIndexSpecs parses comma separated `name[=topic-prefix]` entries,
+// entries without a topic prefix use defaultTopicPrefix
+func ParseIndexSpecs(s string, defaultTopicPrefix string) ([]IndexSpec, error) {
+	var specs []IndexSpec
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(s, ",") {
+		name, topicPrefix, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			topicPrefix = defaultTopicPrefix
+		}
+		if err := validateIndexName(name); err != nil {
+			return nil, err
+		}
+		if topicPrefix == "" {
+			return nil, fmt.Errorf("index %s has no topic prefix", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("index %s is listed twice", name)
+		}
+		seen[name] = true
+		specs = append(specs, IndexSpec{Name: name, TopicPrefix: topicPrefix})
+	}
+	return specs, nil
+}
+
+// versionRefreshInterval is how often readers pick up index versions activated in store.IndexVersions
+const versionRefreshInterval = 10 * time.Second
+
+// healthCheckTimeout bounds the store pings of /healthz
+const healthCheckTimeout = time.Second
+
+// staleCacheEntries is the number of requests whose results are kept per index with IndexOptions.ServeStaleFor
+const staleCacheEntries = 1000
+
+// IndexOptions are the settings shared by all indexes of the process
+type IndexOptions struct {
+	Brokers []string
+	// ConnectTimeout is how long opening an index waits for the brokers, see sync.Config
+	ConnectTimeout     time.Duration
+	CorruptAsEmpty     bool
+	MaxConsumeFailures int
+	LockNamespace      bool
+	DerivedFields      []index.DerivedField
+	Schema             index.TableSchema
+	TieBreak           query.TieBreak
+	// ServeStaleFor is the max age of cached results served when redis fails, 0 disables the cache
+	ServeStaleFor time.Duration
+	// CompactInterval is the mean delay between create_time index compactions, 0 disables them
+	CompactInterval      time.Duration
+	CompactMinBucketSize int
+	// IndexVersions and NextIndexVersions are the term index versions written and built by the consumers,
+	// see sync.Config
+	IndexVersions     map[string]int
+	NextIndexVersions map[string]int
+	// MaxScanPages bounds the pages of create_time buckets read per query, 0 reads all
+	MaxScanPages int
+	// PerKeyGets reads hash fields one HGET at a time, for redis proxies mishandling HMGET
+	PerKeyGets bool
+	// ShardThreshold is the serialized size above which term bitmaps are sharded, see store.RedisBmStore
+	ShardThreshold int
+	// SortFields are the fields queries can order ties of create_time by, see index.SortableFields
+	SortFields []string
+	// LookupIncompleteDeletes finds the indexed values of orders deleted or updated without a full before image, see sync.Config
+	LookupIncompleteDeletes bool
+	// ProviderIDRange maintains and serves provider_id range filters, see sync.Config
+	ProviderIDRange bool
+	// TimeUnit is the unit of create_time in change events, see sync.Config
+	TimeUnit index.TimeUnit
+	// StartOffset and ResetOffsets replay the topics from given offsets for debugging, see sync.Config
+	StartOffset  map[int32]int64
+	ResetOffsets bool
+	// ConsumeBatchSize is the number of messages of a partition whose term bitmaps are written at once, see sync.Config
+	ConsumeBatchSize int
+	// Warmup pings the stores and reads the newest create_time buckets when an index is opened,
+	// so the first queries don't hit cold connections
+	Warmup bool
+	// BackfillNewFields backfills from DB the derived fields, sort fields, provider_id range and next index versions
+	// not backfilled yet, an index with orders doesn't open with such fields otherwise, see (*Index).backfillNewFields
+	BackfillNewFields bool
+	DB                *sql.DB
+	// SizeSampleInterval is the delay between measures of the term bitmap sizes, 0 disables them,
+	// see metrics.TermBitmapBytes
+	SizeSampleInterval time.Duration
+}
+
+// Index is one served index with its own namespace, stores, search service and consumer
+type Index struct {
+	Name      string
+	Namespace string
+	BmStore   *store.RedisBmStore
+	Service   *query.OrdersSearchService
+	// Versions holds the term index versions served by the readers of all instances
+	Versions *store.IndexVersions
+	consumer *sync.Consumer
+	// ready reports whether the consumer claimed its partitions, see sync.Consumer.Ready
+	ready func() bool
+	// consumerStatus reports the progress of the consumer, see sync.Consumer.Status
+	consumerStatus func() []sync.PartitionStatus
+	// stores are pinged by /healthz, see store.HealthCheck
+	stores         map[string]store.Pinger
+	lock           *store.NamespaceLock
+	stopRefreshing chan struct{}
+	stopBackfill   context.CancelFunc
+	// closeOnce makes close safe to call again, e.g. by the deferred Close of main after an index stopped
+	closeOnce stdsync.Once
+	closeErr  error
+}
+
+// Registry maps index names to the indexes served by the process
+type Registry struct {
+	indexes map[string]*Index
+	// Default serves the routes without an index name, it's the first opened index
+	Default *Index
+}
+
+func NewRegistry() *Registry {
+	return &Registry{indexes: make(map[string]*Index)}
+}
+
+func (r *Registry) Get(name string) (*Index, bool) {
+	idx, ok := r.indexes[name]
+	return idx, ok
+}
+
+// resolve finds the index named by the :name path parameter, responding 404 if there's none
+func (r *Registry) resolve(c *gin.Context) (*Index, bool) {
+	idx, ok := r.Get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": gin.H{
+				"message": "Index not found",
+			},
+		})
+	}
+	return idx, ok
+}
+
+// Open locks the namespace of spec if configured, and starts consuming into its stores
+func (r *Registry) Open(rdb *redis.Client, spec IndexSpec, opts IndexOptions) (*Index, error) {
+	if _, ok := r.indexes[spec.Name]; ok {
+		return nil, fmt.Errorf("index %s is already open", spec.Name)
+	}
+	idx := &Index{Name: spec.Name, Namespace: fmt.Sprintf("inv-pg-%s", spec.Name)}
+	if opts.LockNamespace {
+		hostname, _ := os.Hostname()
+		lock, err := store.AcquireNamespaceLock(rdb, idx.Namespace, fmt.Sprintf("%s:%d", hostname, os.Getpid()), namespaceLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		idx.lock = lock
+	}
+	idx.BmStore = &store.RedisBmStore{RDB: rdb, Prefix: idx.Namespace + ":bm:", CorruptAsEmpty: opts.CorruptAsEmpty, ShardThreshold: opts.ShardThreshold, PerKeyGets: opts.PerKeyGets}
+	skbmStore := &store.RedisSortKeyBitmapStore{RDB: rdb, Prefix: idx.Namespace + ":skbm:", PerKeyGets: opts.PerKeyGets}
+	fvStore := &store.RedisFvStore{RDB: rdb, Prefix: idx.Namespace + ":fv:", PerKeyGets: opts.PerKeyGets}
+	idx.Versions = &store.IndexVersions{RDB: rdb, Key: idx.Namespace + ":versions"}
+	appliedOffsets := &store.AppliedOffsets{RDB: rdb, Key: idx.Namespace + ":offsets"}
+	idx.stores = map[string]store.Pinger{"bm": idx.BmStore, "skbm": skbmStore, "fv": fvStore, "versions": idx.Versions, "offsets": appliedOffsets}
+	if err := store.HealthCheck(context.Background(), idx.stores); err != nil {
+		return nil, errors.Join(err, idx.close())
+	}
+	c, err := sync.NewConsumer(sync.Config{
+		Brokers:                 opts.Brokers,
+		ConnectTimeout:          opts.ConnectTimeout,
+		Topic:                   fmt.Sprintf("%s.public.%s", spec.TopicPrefix, opts.Schema.Table),
+		ConsumerGroup:           idx.Namespace,
+		MaxConsecutiveFailures:  opts.MaxConsumeFailures,
+		DerivedFields:           opts.DerivedFields,
+		Schema:                  opts.Schema,
+		CompactInterval:         opts.CompactInterval,
+		CompactMinBucketSize:    opts.CompactMinBucketSize,
+		IndexVersions:           opts.IndexVersions,
+		NextIndexVersions:       opts.NextIndexVersions,
+		SortFields:              opts.SortFields,
+		LookupIncompleteDeletes: opts.LookupIncompleteDeletes,
+		ProviderIDRange:         opts.ProviderIDRange,
+		TimeUnit:                opts.TimeUnit,
+		StartOffset:             opts.StartOffset,
+		ResetOffsets:            opts.ResetOffsets,
+		BatchSize:               opts.ConsumeBatchSize,
+	})
+	if err != nil {
+		return nil, errors.Join(err, idx.close())
+	}
+	idx.consumer = c
+	idx.ready = c.Ready
+	idx.consumerStatus = c.Status
+	c.Start(idx.BmStore, skbmStore, fvStore, appliedOffsets)
+	idx.Service = query.NewSearchService(opts.Schema, idx.BmStore, skbmStore, fvStore)
+	idx.Service.CreateTimeIndexReader.OversizedThreshold = 4 * sync.DefaultSplitThreshold
+	idx.Service.CreateTimeIndexReader.OnOversized = c.ScheduleResplit
+	idx.Service.CreateTimeIndexReader.TieBreak = opts.TieBreak
+	idx.Service.CreateTimeIndexReader.MaxScanPages = opts.MaxScanPages
+	idx.Service.EnableDerivedFields(opts.DerivedFields)
+	idx.Service.EnableSortFields(opts.SortFields)
+	if opts.ProviderIDRange {
+		idx.Service.EnableProviderIDRange()
+	}
+	if opts.ServeStaleFor > 0 {
+		idx.Service.StaleCache = query.NewStaleCache(staleCacheEntries, opts.ServeStaleFor)
+	}
+	if err := idx.Service.RefreshVersions(idx.Versions); err != nil {
+		return nil, errors.Join(err, idx.close())
+	}
+	if err := idx.backfillNewFields(opts); err != nil {
+		return nil, errors.Join(err, idx.close())
+	}
+	if opts.Warmup {
+		warmup(idx)
+	}
+	idx.stopRefreshing = make(chan struct{})
+	go idx.refreshVersions()
+	if opts.SizeSampleInterval > 0 {
+		go idx.sampleSizes(opts.SizeSampleInterval)
+	}
+	r.indexes[spec.Name] = idx
+	if r.Default == nil {
+		r.Default = idx
+	}
+	return idx, nil
+}
+
+// backfillNewFields backfills, one at a time in the background, the optional field indexes configured since the index
+// was built and the next term index versions not built yet. The consumer already writes them, so only the rows
+// indexed before are read from Postgres, and it indexes them itself between messages, see sync.Consumer.BackfillField.
+// Queries on a field fail with query.ErrFieldBackfilling until its backfill completes and is recorded in the namespace,
+// later starts then serve it right away. A next version is recorded as built, which lets it be activated,
+// see store.IndexVersions.Activate. A failed backfill leaves the field gated until a restart retries it.
+// The fields of an index without any order yet need no backfill, they are recorded right away. Otherwise it fails
+// unless opts.BackfillNewFields is set, rather than serve e.g. ties sorted by missing values.
+func (idx *Index) backfillNewFields(opts IndexOptions) error {
+	backfilled := &store.BackfilledFields{RDB: idx.BmStore.RDB, Key: idx.Namespace + ":backfilled"}
+	done, err := backfilled.Get()
+	if err != nil {
+		return err
+	}
+	var pending []sync.FieldIndex
+	for _, field := range idx.consumer.FieldIndexes() {
+		if !done[field.Field] {
+			pending = append(pending, field)
+		}
+	}
+	for _, version := range idx.consumer.NextVersionIndexes() {
+		built, err := idx.Versions.Built(version.Field, version.Version)
+		if err != nil {
+			return err
+		}
+		if !built {
+			pending = append(pending, version)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	record := func(field sync.FieldIndex) error {
+		if field.Version != 0 {
+			return idx.Versions.MarkBuilt(field.Field, field.Version)
+		}
+		return backfilled.Add(field.Field)
+	}
+	zero := 0
+	resp, err := idx.Service.List(query.Request{Limit: &zero})
+	if err != nil {
+		return err
+	}
+	if resp.Total == 0 {
+		// the consumer writes the fields of every order it indexes from now on
+		for _, field := range pending {
+			if err := record(field); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !opts.BackfillNewFields {
+		names := make([]string, len(pending))
+		for i, field := range pending {
+			names[i] = field.Field
+			if field.Version != 0 {
+				names[i] = fmt.Sprintf("%s v%d", field.Field, field.Version)
+			}
+		}
+		return fmt.Errorf("Fields %s aren't backfilled in index %s, pass -backfill-new-fields", strings.Join(names, ", "), idx.Name)
+	}
+	for _, field := range pending {
+		if field.Version == 0 {
+			idx.Service.SetBackfilling(field.Field, true)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	idx.stopBackfill = cancel
+	go func() {
+		for _, field := range pending {
+			logger := slog.With("index", idx.Name, "field", field.Field, "version", field.Version)
+			logger.Info("Backfilling field")
+			if _, err := idx.consumer.BackfillField(ctx, opts.DB, field, 0); err != nil {
+				logger.Error("Failed to backfill field, it stays unavailable", "error", err)
+				return
+			}
+			if err := record(field); err != nil {
+				logger.Error("Failed to record field backfill, it stays unavailable", "error", err)
+				return
+			}
+			if field.Version == 0 {
+				idx.Service.SetBackfilling(field.Field, false)
+			}
+		}
+	}()
+	return nil
+}
+
+// warmup pings the stores of the index and reads the newest create_time buckets, see query.OrdersSearchService.Warmup.
+// A failure only leaves the first queries slower.
+func warmup(idx *Index) {
+	start := time.Now()
+	if err := store.HealthCheck(context.Background(), idx.stores); err != nil {
+		slog.Warn("Index warmup failed", "index", idx.Name, "error", err)
+		return
+	}
+	stats, err := idx.Service.Warmup()
+	if err != nil {
+		slog.Warn("Index warmup failed", "index", idx.Name, "error", err)
+		return
+	}
+	slog.Info("Index warmup done", "index", idx.Name, "stores", len(idx.stores), "statusValues", stats.StatusValues, "buckets", stats.Buckets, "took", time.Since(start))
+}
+
+// Stopped receives the first fatal error of any index: a consumer giving up or a lost namespace lock
+func (r *Registry) Stopped() <-chan error {
+	stopped := make(chan error, len(r.indexes))
+	for _, idx := range r.indexes {
+		idx := idx
+		var lost <-chan struct{}
+		if idx.lock != nil {
+			lost = idx.lock.Lost()
+		}
+		go func() {
+			select {
+			case err := <-idx.consumer.Fatal():
+				stopped <- fmt.Errorf("index %s consumer stopped: %w", idx.Name, err)
+			case <-lost:
+				stopped <- fmt.Errorf("index %s lost its namespace lock, another instance may be writing it", idx.Name)
+			}
+		}()
+	}
+	return stopped
+}
+
+// healthz responds 200 once the consumers of all indexes claimed their partitions, 503 while any is connecting
+// or can't reach its stores. An index with an empty topic is ready, it just has nothing to index yet.
+func (r *Registry) healthz(c *gin.Context) {
+	indexes := make(gin.H, len(r.indexes))
+	status := http.StatusOK
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+	defer cancel()
+	for name, idx := range r.indexes {
+		if err := store.HealthCheck(ctx, idx.stores); err != nil {
+			slog.Error("Index stores are unavailable", "index", name, "error", err)
+			indexes[name] = "unavailable"
+			status = http.StatusServiceUnavailable
+		} else if idx.ready() {
+			indexes[name] = "ready"
+		} else {
+			indexes[name] = "connecting"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(status, gin.H{"indexes": indexes})
+}
+
+// consumerStatus responds the offset, high-water mark and lag of the partitions claimed by the consumer of each index
+func (r *Registry) consumerStatus(c *gin.Context) {
+	indexes := make(gin.H, len(r.indexes))
+	for name, idx := range r.indexes {
+		indexes[name] = gin.H{"partitions": idx.consumerStatus()}
+	}
+	c.JSON(http.StatusOK, gin.H{"indexes": indexes})
+}
+
+// verifySparse responds the inconsistencies of the sparse indexes by index key, repairing them with ?repair=true,
+// see sync.Consumer.VerifySparse. It reads every bucket, and waits for the consumer to have a claim.
+func (idx *Index) verifySparse(c *gin.Context) {
+	var q struct {
+		Repair bool `form:"repair"`
+	}
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": err.Error(),
+			},
+		})
+		return
+	}
+	stats, err := idx.consumer.VerifySparse(c.Request.Context(), q.Repair)
+	if err != nil {
+		slog.Error("Failed to verify sparse indexes", "index", idx.Name, "repair", q.Repair, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": gin.H{
+				"message": "Internal server error",
+			},
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"indexes": stats})
+}
+
+// Close shuts down the consumers and releases the namespace locks of all indexes
+func (r *Registry) Close() error {
+	var errs []error
+	for _, idx := range r.indexes {
+		if err := idx.close(); err != nil {
+			slog.Error("Failed to close index", "index", idx.Name, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// refreshVersions switches the readers to newly activated index versions until the index is closed
+func (idx *Index) refreshVersions() {
+	ticker := time.NewTicker(versionRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := idx.Service.RefreshVersions(idx.Versions); err != nil {
+				slog.Error("Failed to refresh index versions", "index", idx.Name, "error", err)
+			}
+		case <-idx.stopRefreshing:
+			return
+		}
+	}
+}
+
+// sampleSizes publishes the sizes of the term bitmaps every interval until the index is closed
+func (idx *Index) sampleSizes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sampleSizes(idx.Name, idx.Service); err != nil {
+				slog.Error("Failed to sample bitmap sizes", "index", idx.Name, "error", err)
+			}
+		case <-idx.stopRefreshing:
+			return
+		}
+	}
+}
+
+// sampleSizes measures the term bitmaps of service into the gauges of the index named name
+func sampleSizes(name string, service *query.OrdersSearchService) error {
+	sizes, err := service.TermIndexSizes()
+	if err != nil {
+		return err
+	}
+	total, largest := new(expvar.Int), new(expvar.Int)
+	for field, size := range sizes {
+		total.Add(int64(size.Bytes))
+		if int64(size.LargestBytes) > largest.Value() {
+			largest.Set(int64(size.LargestBytes))
+		}
+		slog.Debug("Sampled bitmap sizes", "index", name, "field", field, "values", size.Values, "bytes", size.Bytes,
+			"largestValue", size.LargestValue, "largestBytes", size.LargestBytes)
+	}
+	metrics.TermBitmapBytes.Set(name, total)
+	metrics.LargestTermBitmapBytes.Set(name, largest)
+	return nil
+}
+
+// close stops the index once, later calls wait for the first one and return its error
+func (idx *Index) close() error {
+	idx.closeOnce.Do(func() { idx.closeErr = idx.shutdown() })
+	return idx.closeErr
+}
+
+func (idx *Index) shutdown() error {
+	if idx.stopRefreshing != nil {
+		close(idx.stopRefreshing)
+	}
+	if idx.stopBackfill != nil {
+		idx.stopBackfill()
+	}
+	var errs []error
+	if idx.consumer != nil {
+		errs = append(errs, idx.consumer.Shutdown())
+	}
+	// release after the consumer stopped writing
+	if idx.lock != nil {
+		errs = append(errs, idx.lock.Release())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/KKKIIO/inv-index-demo/api"
+	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/metrics"
+	"github.com/KKKIIO/inv-index-demo/query"
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/KKKIIO/inv-index-demo/store/storetest"
+	"github.com/KKKIIO/inv-index-demo/sync"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIndexSpecs(t *testing.T) {
+	specs, err := ParseIndexSpecs("a, b=tenant_b", "dbserver1")
+	require.NoError(t, err)
+	assert.Equal(t, []IndexSpec{{Name: "a", TopicPrefix: "dbserver1"}, {Name: "b", TopicPrefix: "tenant_b"}}, specs)
+	for _, s := range []string{"a,a=x", "a:b", "a=", ""} {
+		_, err := ParseIndexSpecs(s, "dbserver1")
+		assert.Error(t, err, s)
+	}
+	_, err = ParseIndexSpecs("a", "")
+	assert.Error(t, err)
+}
+
+func TestHealthz(t *testing.T) {
+	ready := false
+	registry := NewRegistry()
+	registry.indexes["a"] = &Index{Name: "a", ready: func() bool { return true }}
+	registry.indexes["b"] = &Index{Name: "b", ready: func() bool { return ready }}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/healthz", registry.healthz)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"indexes":{"a":"ready","b":"connecting"}}`, w.Body.String())
+	ready = true
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"indexes":{"a":"ready","b":"ready"}}`, w.Body.String())
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	registry.indexes["b"].stores = map[string]store.Pinger{"bm": &store.RedisBmStore{RDB: rdb, Prefix: "b:bm:"}}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	mr.Close()
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"indexes":{"a":"ready","b":"unavailable"}}`, w.Body.String())
+}
+
+func TestConsumerStatus(t *testing.T) {
+	registry := NewRegistry()
+	registry.indexes["a"] = &Index{Name: "a", consumerStatus: func() []sync.PartitionStatus {
+		return []sync.PartitionStatus{{Topic: "orders", Partition: 0, Offset: 7, HighWaterMark: 10, Lag: 3}}
+	}}
+	registry.indexes["b"] = &Index{Name: "b", consumerStatus: func() []sync.PartitionStatus { return nil }}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/consumer/status", registry.consumerStatus)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/consumer/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"indexes":{
+		"a":{"partitions":[{"topic":"orders","partition":0,"offset":7,"high_water_mark":10,"lag":3}]},
+		"b":{"partitions":null}}}`, w.Body.String())
+}
+
+func TestIndexRoutes(t *testing.T) {
+	newService := func(orders ...sync.Order) *query.OrdersSearchService {
+		bmStore, skbmStore, fvStore := storetest.NewRedis(t)
+		require.NoError(t, sync.BackfillConfig{}.Insert(bmStore, skbmStore, fvStore, orders...))
+		return query.NewOrdersSearchService(bmStore, skbmStore, fvStore)
+	}
+	registry := NewRegistry()
+	registry.indexes["a"] = &Index{Name: "a", Service: newService(sync.Order{ID: 1, CreateTime: 1_000_000})}
+	registry.indexes["b"] = &Index{Name: "b", Service: newService(sync.Order{ID: 2, CreateTime: 1_000_000}, sync.Order{ID: 3, CreateTime: 2_000_000})}
+	registry.Default = registry.indexes["a"]
+	// no row is found, orders are listed by id only
+	fetchOrders := func(ctx context.Context, ids []uint32, fields []string) ([]*api.Order, error) {
+		return nil, nil
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerIndexRoutes(r.Group("/"), func(*gin.Context) (*Index, bool) { return registry.Default, true }, fetchOrders)
+	registerIndexRoutes(r.Group("/indexes/:name"), registry.resolve, fetchOrders)
+	get := func(path string) (int, api.QueryOrdersResponse) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp api.QueryOrdersResponse
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w.Code, resp
+	}
+	code, resp := get("/orders")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, uint64(1), resp.Total)
+	code, resp = get("/indexes/b/orders")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, uint64(2), resp.Total)
+	assert.Equal(t, int64(3), resp.Orders[0].ID)
+	code, _ = get("/indexes/c/orders")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestSampleSizes(t *testing.T) {
+	bmStore := store.NewMemBmStore()
+	service := query.NewOrdersSearchService(bmStore, store.NewMemSortKeyBitmapStore(), store.NewMemFvStore())
+	hot := roaring.New()
+	hot.AddRange(0, 100_000)
+	hot.Add(200_001)
+	cold := roaring.BitmapOf(1, 5, 9)
+	all := roaring.Or(hot, cold)
+	statusKey := service.OrderStatusIndexReader.Index.GetIndexKey()
+	require.NoError(t, bmStore.Set(statusKey, "1", hot))
+	require.NoError(t, bmStore.Set(statusKey, "2", cold))
+	require.NoError(t, bmStore.Set(service.AllIndexReader.Index.GetIndexKey(), "0", all))
+	size := func(bm *roaring.Bitmap) uint64 {
+		raw, err := bm.ToBytes()
+		require.NoError(t, err)
+		return uint64(len(raw))
+	}
+
+	sizes, err := service.TermIndexSizes()
+	require.NoError(t, err)
+	assert.Equal(t, query.TermIndexSize{Values: 2, Bytes: size(hot) + size(cold), LargestValue: "1", LargestBytes: size(hot)}, sizes["order_status"])
+	assert.Equal(t, query.TermIndexSize{Values: 1, Bytes: size(all), LargestValue: "0", LargestBytes: size(all)}, sizes["__all"])
+	assert.Equal(t, query.TermIndexSize{}, sizes["product_id"])
+
+	require.NoError(t, sampleSizes("sizes", service))
+	assert.Equal(t, strconv.FormatUint(size(hot)+size(cold)+size(all), 10), metrics.TermBitmapBytes.Get("sizes").String())
+	assert.Equal(t, strconv.FormatUint(max(size(hot), size(all)), 10), metrics.LargestTermBitmapBytes.Get("sizes").String())
+
+	// __all isn't measured when a universe field stands for it
+	schema := index.OrdersSchema
+	schema.UniverseField = "order_status"
+	universeService := query.NewSearchService(schema, bmStore, store.NewMemSortKeyBitmapStore(), store.NewMemFvStore())
+	sizes, err = universeService.TermIndexSizes()
+	require.NoError(t, err)
+	assert.NotContains(t, sizes, "__all")
+	assert.Contains(t, sizes, "order_status")
+	_, err = universeService.TermIndexStats("__all", 10)
+	assert.ErrorIs(t, err, query.ErrFieldNotIndexed)
+
+	// the shards of a sharded bitmap are measured as stored, the largest of them is the largest value
+	redisBmStore, redisSkbmStore, redisFvStore := storetest.NewRedis(t)
+	redisBmStore.ShardThreshold = 1024
+	redisService := query.NewOrdersSearchService(redisBmStore, redisSkbmStore, redisFvStore)
+	low, high := roaring.New(), roaring.New()
+	for i := uint32(0); i < 1000; i++ {
+		low.Add(i * 7)
+		high.Add(1<<20 + i*3)
+	}
+	high.RemoveRange(1<<20+1800, 1<<20+3000)
+	require.NoError(t, redisBmStore.Set(statusKey, "1", roaring.Or(low, high)))
+	sizes, err = redisService.TermIndexSizes()
+	require.NoError(t, err)
+	assert.Equal(t, query.TermIndexSize{Values: 1, Bytes: size(low) + size(high), LargestValue: "1", LargestBytes: size(low)}, sizes["order_status"])
+}
+
+func TestRegistryCloseTwice(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	lock, err := store.AcquireNamespaceLock(rdb, "a", "owner", time.Minute)
+	require.NoError(t, err)
+	registry := NewRegistry()
+	registry.indexes["a"] = &Index{Name: "a", lock: lock, stopRefreshing: make(chan struct{})}
+	// the goroutine of a stopped index and the deferred Close of main may both close the registry
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- registry.Close() }()
+	}
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	_, err = store.AcquireNamespaceLock(rdb, "a", "other", time.Minute)
+	require.NoError(t, err)
+}
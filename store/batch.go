@@ -0,0 +1,164 @@
+package store
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// BatchBmStore buffers the AddBit and RemoveBit calls on a BmStore until Commit, which writes them at once with
+// UpdateBits, or Rollback. Get, MGet, Contains, Exists and ScanValues see the buffered changes; the other reads,
+// Set, MSet and Drop go straight to the store, the buffered changes are applied over them on Commit.
+type BatchBmStore struct {
+	BmStore
+	changes map[bitmapKey]*BitChanges
+}
+
+type bitmapKey struct {
+	indexKey string
+	valueKey string
+}
+
+func NewBatchBmStore(bmStore BmStore) *BatchBmStore {
+	return &BatchBmStore{BmStore: bmStore, changes: make(map[bitmapKey]*BitChanges)}
+}
+
+func (b *BatchBmStore) get(indexKey string, valueKey string) *BitChanges {
+	key := bitmapKey{indexKey: indexKey, valueKey: valueKey}
+	c, ok := b.changes[key]
+	if !ok {
+		c = &BitChanges{IndexKey: indexKey, ValueKey: valueKey, Added: roaring.New(), Removed: roaring.New()}
+		b.changes[key] = c
+	}
+	return c
+}
+
+func (b *BatchBmStore) AddBit(indexKey string, valueKey string, id uint32) error {
+	c := b.get(indexKey, valueKey)
+	c.Added.Add(id)
+	c.Removed.Remove(id)
+	return nil
+}
+
+func (b *BatchBmStore) RemoveBit(indexKey string, valueKey string, id uint32) error {
+	c := b.get(indexKey, valueKey)
+	c.Removed.Add(id)
+	c.Added.Remove(id)
+	return nil
+}
+
+// UpdateBits buffers changes like AddBit and RemoveBit calls, hash fields can only be set by Commit
+func (b *BatchBmStore) UpdateBits(changes []BitChanges, sets []HashFieldValue) error {
+	if len(sets) != 0 {
+		return errors.New("BatchBmStore can't set hash fields before Commit")
+	}
+	for _, c := range changes {
+		batched := b.get(c.IndexKey, c.ValueKey)
+		batched.Added.AndNot(c.Removed)
+		batched.Added.Or(c.Added)
+		batched.Removed.AndNot(c.Added)
+		batched.Removed.Or(c.Removed)
+	}
+	return nil
+}
+
+// apply changes bm, a bitmap read from the store, like the batch will
+func (b *BatchBmStore) apply(indexKey string, valueKey string, bm *roaring.Bitmap) *roaring.Bitmap {
+	if c, ok := b.changes[bitmapKey{indexKey: indexKey, valueKey: valueKey}]; ok {
+		bm.Or(c.Added)
+		bm.AndNot(c.Removed)
+	}
+	return bm
+}
+
+func (b *BatchBmStore) Get(indexKey string, valueKey string) (*roaring.Bitmap, error) {
+	bm, err := b.BmStore.Get(indexKey, valueKey)
+	if err != nil {
+		return nil, err
+	}
+	return b.apply(indexKey, valueKey, bm), nil
+}
+
+func (b *BatchBmStore) MGet(indexKey string, valueKeys []string) ([]*roaring.Bitmap, error) {
+	bms, err := b.BmStore.MGet(indexKey, valueKeys)
+	if err != nil {
+		return nil, err
+	}
+	for i, valueKey := range valueKeys {
+		b.apply(indexKey, valueKey, bms[i])
+	}
+	return bms, nil
+}
+
+func (b *BatchBmStore) Contains(indexKey string, valueKey string, ids []uint32) ([]bool, error) {
+	bm, err := b.Get(indexKey, valueKey)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]bool, len(ids))
+	for i, id := range ids {
+		result[i] = bm.Contains(id)
+	}
+	return result, nil
+}
+
+func (b *BatchBmStore) Exists(indexKey string, valueKey string) (bool, error) {
+	if _, ok := b.changes[bitmapKey{indexKey: indexKey, valueKey: valueKey}]; !ok {
+		return b.BmStore.Exists(indexKey, valueKey)
+	}
+	bm, err := b.Get(indexKey, valueKey)
+	if err != nil {
+		return false, err
+	}
+	return !bm.IsEmpty(), nil
+}
+
+// ScanValues passes the stored values with the changes of the batch, skipping the ones it empties,
+// then the values only the batch adds, ordered by value key
+func (b *BatchBmStore) ScanValues(indexKey string, proc func(valueKey string, bm *roaring.Bitmap) bool) error {
+	scanned := make(map[string]bool)
+	stopped := false
+	if err := b.BmStore.ScanValues(indexKey, func(valueKey string, bm *roaring.Bitmap) bool {
+		scanned[valueKey] = true
+		if b.apply(indexKey, valueKey, bm).IsEmpty() {
+			return true
+		}
+		stopped = !proc(valueKey, bm)
+		return !stopped
+	}); err != nil || stopped {
+		return err
+	}
+	var added []string
+	for key, c := range b.changes {
+		if key.indexKey == indexKey && !scanned[key.valueKey] && !c.Added.IsEmpty() {
+			added = append(added, key.valueKey)
+		}
+	}
+	slices.Sort(added)
+	for _, valueKey := range added {
+		if !proc(valueKey, b.changes[bitmapKey{indexKey: indexKey, valueKey: valueKey}].Added.Clone()) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Commit writes the buffered changes and sets the fields of sets in one UpdateBits of the store.
+// The batch is emptied whether it succeeds or not.
+func (b *BatchBmStore) Commit(sets []HashFieldValue) error {
+	changes := make([]BitChanges, 0, len(b.changes))
+	for _, c := range b.changes {
+		changes = append(changes, *c)
+	}
+	b.Rollback()
+	if len(changes) == 0 && len(sets) == 0 {
+		return nil
+	}
+	return b.BmStore.UpdateBits(changes, sets)
+}
+
+// Rollback discards the buffered changes
+func (b *BatchBmStore) Rollback() {
+	clear(b.changes)
+}
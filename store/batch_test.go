@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchBmStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	s := &RedisBmStore{RDB: rdb, Prefix: "test:", ShardThreshold: 64}
+	const indexKey = "term:orders:order_status"
+	require.NoError(t, s.Set(indexKey, "1", roaring.BitmapOf(1, 2)))
+	require.NoError(t, s.Set(indexKey, "2", roaring.BitmapOf(3)))
+	snapshot := mr.Dump()
+	batch := NewBatchBmStore(s)
+	change := func() {
+		require.NoError(t, batch.RemoveBit(indexKey, "1", 1))
+		require.NoError(t, batch.AddBit(indexKey, "1", 4))
+		require.NoError(t, batch.RemoveBit(indexKey, "2", 3))
+		require.NoError(t, batch.AddBit(indexKey, "3", 1))
+		require.NoError(t, batch.AddBit(indexKey, "4", 5))
+		require.NoError(t, batch.RemoveBit(indexKey, "4", 5))
+	}
+	scan := func(bmStore BmStore) map[string][]uint32 {
+		scanned := make(map[string][]uint32)
+		require.NoError(t, bmStore.ScanValues(indexKey, func(valueKey string, bm *roaring.Bitmap) bool {
+			scanned[valueKey] = bm.ToArray()
+			return true
+		}))
+		return scanned
+	}
+	want := map[string][]uint32{"1": {2, 4}, "3": {1}}
+
+	// reads see the changes, the store doesn't until they're committed
+	change()
+	assert.Equal(t, want, scan(batch))
+	bms, err := batch.MGet(indexKey, []string{"1", "2", "3", "4"})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{2, 4}, bms[0].ToArray())
+	assert.True(t, bms[1].IsEmpty())
+	assert.Equal(t, []uint32{1}, bms[2].ToArray())
+	assert.True(t, bms[3].IsEmpty())
+	for valueKey, exists := range map[string]bool{"1": true, "2": false, "3": true, "4": false} {
+		ok, err := batch.Exists(indexKey, valueKey)
+		require.NoError(t, err)
+		assert.Equal(t, exists, ok, "valueKey %s", valueKey)
+	}
+	contains, err := batch.Contains(indexKey, "1", []uint32{1, 2, 4})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true}, contains)
+	assert.Equal(t, snapshot, mr.Dump())
+
+	// a rolled back batch leaves redis unchanged
+	batch.Rollback()
+	assert.Equal(t, snapshot, mr.Dump())
+	assert.Equal(t, map[string][]uint32{"1": {1, 2}, "2": {3}}, scan(batch))
+
+	// a committed batch is written along with the fields set on it
+	change()
+	// sharded over 64 bytes
+	for id := uint32(0); id < 1000; id += 2 {
+		require.NoError(t, batch.AddBit(indexKey, "5", id*3001))
+	}
+	require.NoError(t, batch.Commit([]HashFieldValue{{Key: "test:offsets", Field: "orders:0", Value: "7"}}))
+	got := scan(s)
+	assert.Len(t, got["5"], 500)
+	delete(got, "5")
+	assert.Equal(t, want, got)
+	raw, err := rdb.HGet(context.Background(), s.Prefix+indexKey, "5").Result()
+	require.NoError(t, err)
+	assert.Equal(t, shardMarker, raw)
+	offset, err := rdb.HGet(context.Background(), "test:offsets", "orders:0").Int()
+	require.NoError(t, err)
+	assert.Equal(t, 7, offset)
+}
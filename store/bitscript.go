@@ -0,0 +1,455 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/redis/go-redis/v9"
+)
+
+// bitmapLua holds the Lua functions of the scripts updating stored bitmaps server side. decode parses the portable
+// roaring format, update adds or removes an id decoding only its container, which is rewritten as an array or a bitmap
+// container by cardinality like roaring does, a run container being expanded first. encode serializes it back.
+// It uses arithmetic instead of the bit library, which the miniredis Lua of the tests lacks.
+const bitmapLua = `
+local floor = math.floor
+local maxArray = 4096
+
+local function u16(s, i)
+  local a, b = string.byte(s, i, i + 1)
+  return a + b * 256
+end
+local function u32(s, i)
+  local a, b, c, d = string.byte(s, i, i + 3)
+  return a + b * 256 + c * 65536 + d * 16777216
+end
+local function p16(v)
+  return string.char(v % 256, floor(v / 256) % 256)
+end
+local function p32(v)
+  return string.char(v % 256, floor(v / 256) % 256, floor(v / 65536) % 256, floor(v / 16777216) % 256)
+end
+local function corrupted(hashKey, field, reason)
+  return redis.error_reply('corrupted bitmap: ' .. reason .. ', hashKey=' .. hashKey .. ', field=' .. field)
+end
+local function hasBit(b, bit)
+  return floor(b / 2 ^ bit) % 2 == 1
+end
+-- join concatenates strings a chunk at a time, to stay below the stack limits of table.concat and unpack
+local function join(parts)
+  local s = ''
+  for i = 1, #parts, 256 do
+    s = s .. table.concat(parts, '', i, math.min(i + 255, #parts))
+  end
+  return s
+end
+local function bytesToString(bytes)
+  local parts = {}
+  for i = 1, #bytes, 256 do
+    parts[#parts + 1] = string.char(unpack(bytes, i, math.min(i + 255, #bytes)))
+  end
+  return join(parts)
+end
+local function pushU16(bytes, v)
+  bytes[#bytes + 1] = v % 256
+  bytes[#bytes + 1] = floor(v / 256)
+end
+local function zeros()
+  local bytes = {}
+  for i = 1, 8192 do
+    bytes[i] = 0
+  end
+  return bytes
+end
+local function setBit(bytes, v)
+  local i = floor(v / 8) + 1
+  bytes[i] = bytes[i] + 2 ^ (v % 8)
+end
+
+-- decode parses raw, a bitmap in the portable roaring format, into its containers. Only the headers are decoded,
+-- payloads are kept as strings. It returns nil and the reason if raw is malformed.
+local function decode(raw)
+  local keys, cards, runs, payloads = {}, {}, {}, {}
+  if raw and #raw > 0 then
+    if #raw < 8 then
+      return nil, 'short header'
+    end
+    local cookie = u32(raw, 1)
+    local n, pos, flags
+    local hasRun = cookie % 65536 == 12347
+    if hasRun then
+      n = floor(cookie / 65536) + 1
+      flags = 5
+      pos = flags + floor((n + 7) / 8)
+    elseif cookie == 12346 then
+      n = u32(raw, 5)
+      pos = 9
+    else
+      return nil, 'unknown cookie'
+    end
+    if n > 65536 or pos + 4 * n - 1 > #raw then
+      return nil, 'short header'
+    end
+    for i = 1, n do
+      keys[i] = u16(raw, pos)
+      cards[i] = u16(raw, pos + 2) + 1
+      pos = pos + 4
+    end
+    if not hasRun or n >= 4 then
+      pos = pos + 4 * n
+    end
+    for i = 1, n do
+      local size
+      runs[i] = hasRun and hasBit(string.byte(raw, flags + floor((i - 1) / 8)), (i - 1) % 8)
+      if runs[i] then
+        if pos + 1 > #raw then
+          return nil, 'short run container'
+        end
+        size = 2 + 4 * u16(raw, pos)
+      elseif cards[i] <= maxArray then
+        size = 2 * cards[i]
+      else
+        size = 8192
+      end
+      if pos + size - 1 > #raw then
+        return nil, 'short container'
+      end
+      payloads[i] = string.sub(raw, pos, pos + size - 1)
+      pos = pos + size
+    end
+    if pos - 1 ~= #raw then
+      return nil, 'trailing bytes'
+    end
+  end
+  return {keys = keys, cards = cards, runs = runs, payloads = payloads}
+end
+
+-- update adds or removes id in bm, a decoded bitmap, reporting whether it changed
+local function update(bm, id, add)
+  local keys, cards, runs, payloads = bm.keys, bm.cards, bm.runs, bm.payloads
+  local hi, lo = floor(id / 65536), id % 65536
+  local t = 1
+  while t <= #keys and keys[t] < hi do
+    t = t + 1
+  end
+  if t > #keys or keys[t] ~= hi then
+    if not add then
+      return false
+    end
+    table.insert(keys, t, hi)
+    table.insert(cards, t, 1)
+    table.insert(runs, t, false)
+    table.insert(payloads, t, p16(lo))
+  else
+    local p, card = payloads[t], cards[t]
+    if runs[t] then
+      -- expand the runs of start and length - 1 into an array or a bitmap container
+      local bytes, values = nil, {}
+      if card > maxArray then
+        bytes = zeros()
+      end
+      for r = 0, u16(p, 1) - 1 do
+        local start = u16(p, 3 + 4 * r)
+        for v = start, start + u16(p, 5 + 4 * r) do
+          if bytes then
+            setBit(bytes, v)
+          else
+            pushU16(values, v)
+          end
+        end
+      end
+      p = bytesToString(bytes or values)
+    end
+    local changed = false
+    if card <= maxArray then
+      local l, h, found = 1, card, false
+      while l <= h do
+        local m = floor((l + h) / 2)
+        local v = u16(p, 2 * m - 1)
+        if v == lo then
+          l, found = m, true
+          break
+        elseif v < lo then
+          l = m + 1
+        else
+          h = m - 1
+        end
+      end
+      if add and not found then
+        p = string.sub(p, 1, 2 * (l - 1)) .. p16(lo) .. string.sub(p, 2 * l - 1)
+        card, changed = card + 1, true
+      elseif not add and found then
+        p = string.sub(p, 1, 2 * (l - 1)) .. string.sub(p, 2 * l + 1)
+        card, changed = card - 1, true
+      end
+      if card > maxArray then
+        local bytes = zeros()
+        for i = 1, card do
+          setBit(bytes, u16(p, 2 * i - 1))
+        end
+        p = bytesToString(bytes)
+      end
+    else
+      local i, bit = floor(lo / 8) + 1, lo % 8
+      local b = string.byte(p, i)
+      if add and not hasBit(b, bit) then
+        p = string.sub(p, 1, i - 1) .. string.char(b + 2 ^ bit) .. string.sub(p, i + 1)
+        card, changed = card + 1, true
+      elseif not add and hasBit(b, bit) then
+        p = string.sub(p, 1, i - 1) .. string.char(b - 2 ^ bit) .. string.sub(p, i + 1)
+        card, changed = card - 1, true
+      end
+      if card <= maxArray then
+        local values = {}
+        for j = 1, 8192 do
+          local byte = string.byte(p, j)
+          if byte ~= 0 then
+            for k = 0, 7 do
+              if hasBit(byte, k) then
+                pushU16(values, (j - 1) * 8 + k)
+              end
+            end
+          end
+        end
+        p = bytesToString(values)
+      end
+    end
+    if not changed then
+      return false
+    end
+    if card == 0 then
+      table.remove(keys, t)
+      table.remove(cards, t)
+      table.remove(runs, t)
+      table.remove(payloads, t)
+    else
+      cards[t], runs[t], payloads[t] = card, false, p
+    end
+  end
+  return true
+end
+
+-- encode serializes bm in the portable roaring format, '' once it's empty
+local function encode(bm)
+  local keys, cards, runs, payloads = bm.keys, bm.cards, bm.runs, bm.payloads
+  local n = #keys
+  if n == 0 then
+    return ''
+  end
+  local hasRun = false
+  for i = 1, n do
+    hasRun = hasRun or runs[i]
+  end
+  local parts = {}
+  if hasRun then
+    parts[1] = p32(12347 + (n - 1) * 65536)
+    local flags = {}
+    for i = 1, floor((n + 7) / 8) do
+      flags[i] = 0
+    end
+    for i = 1, n do
+      if runs[i] then
+        local j = floor((i - 1) / 8) + 1
+        flags[j] = flags[j] + 2 ^ ((i - 1) % 8)
+      end
+    end
+    parts[2] = bytesToString(flags)
+  else
+    parts[1] = p32(12346) .. p32(n)
+  end
+  local header = #parts[1] + (parts[2] and #parts[2] or 0)
+  for i = 1, n do
+    parts[#parts + 1] = p16(keys[i]) .. p16(cards[i] - 1)
+  end
+  if not hasRun or n >= 4 then
+    local offset = header + 8 * n
+    for i = 1, n do
+      parts[#parts + 1] = p32(offset)
+      offset = offset + #payloads[i]
+    end
+  end
+  for i = 1, n do
+    parts[#parts + 1] = payloads[i]
+  end
+  return join(parts)
+end
+
+-- write stores bm in field of hashKey, deleting the field once it's empty, and returns its serialized size
+local function write(hashKey, field, bm)
+  local value = encode(bm)
+  if value == '' then
+    redis.call('HDEL', hashKey, field)
+  else
+    redis.call('HSET', hashKey, field, value)
+  end
+  return #value
+end
+`
+
+// bitScript adds (ARGV[3] = "1") or removes id ARGV[2] in the roaring bitmap stored in the hash field ARGV[1] of KEYS[1],
+// so concurrent writers can't lose updates.
+// If the field holds ARGV[4], the shard marker, the shard ARGV[5] in the hash KEYS[2] is updated instead and the marker
+// deleted along with the last shard, replying -1. Else it replies the serialized size of the bitmap after the update,
+// 0 once it's deleted. Malformed values are left as is and fail with a corrupted bitmap error.
+var bitScript = redis.NewScript(bitmapLua + `
+local hashKey, field, id, add, marker = KEYS[1], ARGV[1], tonumber(ARGV[2]), ARGV[3] == '1', ARGV[4]
+local raw = redis.call('HGET', hashKey, field)
+local sharded = raw == marker
+if sharded then
+  hashKey, field = KEYS[2], ARGV[5]
+  raw = redis.call('HGET', hashKey, field)
+end
+local bm, reason = decode(raw)
+if not bm then
+  return corrupted(hashKey, field, reason)
+end
+local size = raw and #raw or 0
+if update(bm, id, add) then
+  size = write(hashKey, field, bm)
+end
+if not sharded then
+  return size
+end
+if redis.call('HLEN', hashKey) == 0 then
+  redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return -1
+`)
+
+// batchBitScript applies the changes of many bitmaps like bitScript, then sets hash fields, e.g. the applied offset
+// of the messages the changes come from. KEYS holds the hash and the shards hash of each change, then the hash of each
+// field to set. ARGV holds the shard marker, the number of changes and of fields to set, the hash field, the added ids
+// and the removed ids of each change, ids separated by spaces, then the field and the value of each field to set.
+// Every bitmap is decoded before any write, so a malformed one fails the script with a corrupted bitmap error without
+// writing anything. It replies the serialized size of each changed bitmap, -1 for sharded ones.
+var batchBitScript = redis.NewScript(bitmapLua + `
+local marker, n, m = ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3])
+local bms, loaded, ops, sizes = {}, {}, {}, {}
+-- load decodes the bitmap of field of hashKey once, raw being its value if it was read already
+local function load(hashKey, field, raw)
+  local name = hashKey .. '\n' .. field
+  local bm = loaded[name]
+  if bm then
+    return bm
+  end
+  if raw == nil then
+    raw = redis.call('HGET', hashKey, field)
+  end
+  local reason
+  bm, reason = decode(raw)
+  if not bm then
+    return nil, corrupted(hashKey, field, reason)
+  end
+  bm.hashKey, bm.field, bm.size = hashKey, field, raw and #raw or 0
+  loaded[name] = bm
+  bms[#bms + 1] = bm
+  return bm
+end
+for i = 1, n do
+  local hashKey, shardsKey, field = KEYS[2 * i - 1], KEYS[2 * i], ARGV[1 + 3 * i]
+  local raw = redis.call('HGET', hashKey, field)
+  local sharded = raw == marker
+  local bm, err
+  if not sharded then
+    bm, err = load(hashKey, field, raw)
+    if not bm then
+      return err
+    end
+  end
+  for j, add in ipairs({true, false}) do
+    for id in string.gmatch(ARGV[1 + 3 * i + j], '%d+') do
+      id = tonumber(id)
+      if sharded then
+        bm, err = load(shardsKey, tostring(floor(id / 1048576)))
+        if not bm then
+          return err
+        end
+      end
+      ops[#ops + 1] = {bm, id, add}
+    end
+  end
+  sizes[i] = not sharded and bm or -1
+end
+for _, op in ipairs(ops) do
+  if update(op[1], op[2], op[3]) then
+    op[1].changed = true
+  end
+end
+for _, bm in ipairs(bms) do
+  if bm.changed then
+    bm.size = write(bm.hashKey, bm.field, bm)
+  end
+end
+for i = 1, n do
+  if sizes[i] == -1 then
+    if redis.call('HLEN', KEYS[2 * i]) == 0 then
+      redis.call('HDEL', KEYS[2 * i - 1], ARGV[1 + 3 * i])
+    end
+  else
+    sizes[i] = sizes[i].size
+  end
+end
+for i = 1, m do
+  redis.call('HSET', KEYS[2 * n + i], ARGV[2 + 3 * n + 2 * i], ARGV[3 + 3 * n + 2 * i])
+end
+return sizes
+`)
+
+// updateStoredBitmap adds or removes id in a bitmap stored in a hash field with bitScript in a single round-trip,
+// in its shard field of the shardsKey hash if the field is a shard marker.
+// It returns the serialized size of the bitmap after the update, 0 once it's deleted, or -1 if a shard was updated.
+func updateStoredBitmap(rdb *redis.Client, hashKey string, valueKey string, shardsKey string, shardField string, id uint32, add bool) (int64, error) {
+	op := "0"
+	if add {
+		op = "1"
+	}
+	n, err := bitScript.Run(context.Background(), rdb, []string{hashKey, shardsKey}, valueKey, id, op, shardMarker, shardField).Int64()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "corrupted bitmap") {
+			return 0, fmt.Errorf("%w: %v", ErrCorruptBitmap, err)
+		}
+		return 0, fmt.Errorf("Update bitmap failed, hashKey=%s, valueKey=%s, id=%d, err: %w", hashKey, valueKey, id, err)
+	}
+	return n, nil
+}
+
+// updateStoredBitmaps applies changes to bitmaps stored in hash fields and sets fields with batchBitScript in a single
+// round-trip, changes[i] being the field valueKeys[i] of hashKeys[i] or the shards of shardsKeys[i] if it's sharded.
+// It returns the serialized size of each bitmap after the update, 0 once it's deleted, or -1 if it's sharded.
+func updateStoredBitmaps(rdb *redis.Client, hashKeys []string, valueKeys []string, shardsKeys []string, changes []BitChanges, sets []HashFieldValue) ([]int64, error) {
+	keys := make([]string, 0, 2*len(changes)+len(sets))
+	args := make([]any, 0, 3+3*len(changes)+2*len(sets))
+	args = append(args, shardMarker, len(changes), len(sets))
+	for i, c := range changes {
+		keys = append(keys, hashKeys[i], shardsKeys[i])
+		args = append(args, valueKeys[i], formatIds(c.Added), formatIds(c.Removed))
+	}
+	for _, f := range sets {
+		keys = append(keys, f.Key)
+		args = append(args, f.Field, f.Value)
+	}
+	sizes, err := batchBitScript.Run(context.Background(), rdb, keys, args...).Int64Slice()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "corrupted bitmap") {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptBitmap, err)
+		}
+		return nil, fmt.Errorf("Update bitmaps failed, changes=%d, err: %w", len(changes), err)
+	}
+	return sizes, nil
+}
+
+// formatIds joins the ids of bm with spaces
+func formatIds(bm *roaring.Bitmap) string {
+	var b []byte
+	it := bm.Iterator()
+	for it.HasNext() {
+		if len(b) > 0 {
+			b = append(b, ' ')
+		}
+		b = strconv.AppendUint(b, uint64(it.Next()), 10)
+	}
+	return string(b)
+}
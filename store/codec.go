@@ -0,0 +1,70 @@
+package store
+
+import (
+	"math"
+)
+
+// SortKeyCodec maps field values to uint64 sort keys preserving their order, so any ordered type can back a sparse index
+type SortKeyCodec[T any] interface {
+	Encode(v T) uint64
+	Decode(sortKey uint64) T
+}
+
+// U64Codec is the identity codec, sort keys are the values themselves
+type U64Codec struct{}
+
+func (U64Codec) Encode(v uint64) uint64       { return v }
+func (U64Codec) Decode(sortKey uint64) uint64 { return sortKey }
+
+// Int64Codec flips the sign bit, so negative values sort before positive ones
+type Int64Codec struct{}
+
+func (Int64Codec) Encode(v int64) uint64       { return uint64(v) ^ (1 << 63) }
+func (Int64Codec) Decode(sortKey uint64) int64 { return int64(sortKey ^ (1 << 63)) }
+
+// Float64Codec orders IEEE 754 bits: positive values get the sign bit set, negative ones get all bits flipped.
+// Negative values sort before positive ones, and -0 just before +0, so a range bounded by 0 tells them apart.
+// NaNs sort beyond the infinities, after +Inf or before -Inf by their sign bit, no finite range matches them.
+type Float64Codec struct{}
+
+func (Float64Codec) Encode(v float64) uint64 {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | (1 << 63)
+}
+
+func (Float64Codec) Decode(sortKey uint64) float64 {
+	if sortKey&(1<<63) != 0 {
+		return math.Float64frombits(sortKey &^ (1 << 63))
+	}
+	return math.Float64frombits(^sortKey)
+}
+
+// FvStore keeps field values of type T as their sort keys in a FieldValueStore
+type FvStore[T any] struct {
+	Store FieldValueStore
+	Codec SortKeyCodec[T]
+}
+
+// MGet returns the field values of ids, the zero sort key decoded for ids without a value
+func (s FvStore[T]) MGet(indexKey string, ids []uint32) ([]T, error) {
+	sortKeys, err := s.Store.MGet(indexKey, ids)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]T, len(sortKeys))
+	for i, sortKey := range sortKeys {
+		values[i] = s.Codec.Decode(sortKey)
+	}
+	return values, nil
+}
+
+func (s FvStore[T]) Set(indexKey string, id uint32, value T) error {
+	return s.Store.Set(indexKey, id, s.Codec.Encode(value))
+}
+
+func (s FvStore[T]) Remove(indexKey string, id uint32) error {
+	return s.Store.Remove(indexKey, id)
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortKeyCodecsPreserveOrder(t *testing.T) {
+	ints := []int64{math.MinInt64, -1 << 40, -2, -1, 0, 1, 2, 1 << 40, math.MaxInt64}
+	for i, v := range ints {
+		assert.Equal(t, v, Int64Codec{}.Decode(Int64Codec{}.Encode(v)))
+		if i > 0 {
+			assert.Less(t, Int64Codec{}.Encode(ints[i-1]), Int64Codec{}.Encode(v), "%d < %d", ints[i-1], v)
+		}
+	}
+	floats := []float64{math.Inf(-1), -math.MaxFloat64, -1.5, -math.SmallestNonzeroFloat64, math.Copysign(0, -1), 0, math.SmallestNonzeroFloat64, 1.5, math.MaxFloat64, math.Inf(1)}
+	for i, v := range floats {
+		decoded := Float64Codec{}.Decode(Float64Codec{}.Encode(v))
+		assert.Equal(t, math.Float64bits(v), math.Float64bits(decoded))
+		if i > 0 {
+			assert.Less(t, Float64Codec{}.Encode(floats[i-1]), Float64Codec{}.Encode(v), "%v < %v", floats[i-1], v)
+		}
+	}
+}
+
+func TestFloat64CodecMatchesNativeOrder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	floats := []float64{math.Inf(-1), -1, math.Copysign(0, -1), 0, 1, math.Inf(1)}
+	for i := 0; i < 1000; i++ {
+		// random bit patterns cover every exponent, both signs and subnormals
+		if v := math.Float64frombits(rnd.Uint64()); !math.IsNaN(v) {
+			floats = append(floats, v)
+		}
+	}
+	for _, a := range floats {
+		b := floats[rnd.Intn(len(floats))]
+		ka, kb := Float64Codec{}.Encode(a), Float64Codec{}.Encode(b)
+		switch {
+		case a < b:
+			assert.Less(t, ka, kb, "%v < %v", a, b)
+		case a > b:
+			assert.Greater(t, ka, kb, "%v > %v", a, b)
+		case math.Signbit(a) == math.Signbit(b):
+			assert.Equal(t, ka, kb, "%v == %v", a, b)
+		}
+	}
+	nan := Float64Codec{}.Encode(math.NaN())
+	assert.Greater(t, nan, Float64Codec{}.Encode(math.Inf(1)))
+	assert.True(t, math.IsNaN(Float64Codec{}.Decode(nan)))
+}
+
+func TestTypedFvStore(t *testing.T) {
+	s := FvStore[int64]{Store: &RedisFvStore{RDB: newTestClient(t), Prefix: "test:"}, Codec: Int64Codec{}}
+	require.NoError(t, s.Set("sparse:t:f", 1, -5))
+	require.NoError(t, s.Set("sparse:t:f", 2, 7))
+	values, err := s.MGet("sparse:t:f", []uint32{1, 2})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{-5, 7}, values)
+	// the raw store holds order preserving sort keys
+	sortKeys, err := s.Store.MGet("sparse:t:f", []uint32{1, 2})
+	require.NoError(t, err)
+	assert.Less(t, sortKeys[0], sortKeys[1])
+}
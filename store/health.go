@@ -0,0 +1,45 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Pinger is a store able to check it can reach its backend
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+func (s *RedisBmStore) Ping(ctx context.Context) error {
+	return s.RDB.Ping(ctx).Err()
+}
+
+func (s *RedisSortKeyBitmapStore) Ping(ctx context.Context) error {
+	return s.RDB.Ping(ctx).Err()
+}
+
+func (s *RedisFvStore) Ping(ctx context.Context) error {
+	return s.RDB.Ping(ctx).Err()
+}
+
+func (v *IndexVersions) Ping(ctx context.Context) error {
+	return v.RDB.Ping(ctx).Err()
+}
+
+// HealthCheck pings the named stores, returning the errors of all unreachable ones
+func HealthCheck(ctx context.Context, stores map[string]Pinger) error {
+	names := make([]string, 0, len(stores))
+	for name := range stores {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var errs []error
+	for _, name := range names {
+		if err := stores[name].Ping(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("Ping failed, store=%s, err: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
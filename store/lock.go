@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNamespaceOwned is returned when another instance holds the lock of a namespace
+var ErrNamespaceOwned = errors.New("namespace owned by another instance")
+
+// refreshLockScript extends the lock only if it's still held by the owner
+var refreshLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseLockScript deletes the lock only if it's still held by the owner
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// NamespaceLock marks a namespace as owned by one instance, so two misconfigured instances
+// don't write each other's bitmaps. The lock expires after TTL unless refreshed by the heartbeat.
+type NamespaceLock struct {
+	rdb   *redis.Client
+	key   string
+	owner string
+	ttl   time.Duration
+	lost  chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+	// release makes Release safe to call again
+	release    sync.Once
+	releaseErr error
+}
+
+// AcquireNamespaceLock takes the lock of namespace for owner and keeps refreshing it until Release
+func AcquireNamespaceLock(rdb *redis.Client, namespace string, owner string, ttl time.Duration) (*NamespaceLock, error) {
+	key := namespace + ":lock"
+	ok, err := rdb.SetNX(context.Background(), key, owner, ttl).Result()
+	if err != nil {
+		return nil, fmt.Errorf("SETNX failed, key=%s, err: %w", key, err)
+	}
+	if !ok {
+		current, err := rdb.Get(context.Background(), key).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("GET failed, key=%s, err: %w", key, err)
+		}
+		return nil, fmt.Errorf("%w: key=%s, owner=%s", ErrNamespaceOwned, key, current)
+	}
+	l := &NamespaceLock{
+		rdb:   rdb,
+		key:   key,
+		owner: owner,
+		ttl:   ttl,
+		lost:  make(chan struct{}),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go l.heartbeat()
+	return l, nil
+}
+
+func (l *NamespaceLock) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			refreshed, err := refreshLockScript.Run(context.Background(), l.rdb, []string{l.key}, l.owner, l.ttl.Milliseconds()).Int()
+			if err != nil {
+				// the lock is still held until it expires, retry on the next tick
+				slog.Warn("Failed to refresh namespace lock", "key", l.key, "error", err)
+				continue
+			}
+			if refreshed == 0 {
+				slog.Error("Lost namespace lock", "key", l.key, "owner", l.owner)
+				close(l.lost)
+				return
+			}
+		}
+	}
+}
+
+// Lost is closed if the lock expired or was taken over, the owner should stop writing then
+func (l *NamespaceLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release stops the heartbeat and deletes the lock if still owned, later calls return the error of the first one
+func (l *NamespaceLock) Release() error {
+	l.release.Do(func() {
+		close(l.stop)
+		<-l.done
+		if err := releaseLockScript.Run(context.Background(), l.rdb, []string{l.key}, l.owner).Err(); err != nil {
+			l.releaseErr = fmt.Errorf("Failed to release lock, key=%s, err: %w", l.key, err)
+		}
+	})
+	return l.releaseErr
+}
@@ -0,0 +1,45 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceLock(t *testing.T) {
+	rdb := newTestClient(t)
+	l, err := AcquireNamespaceLock(rdb, "test", "a", time.Minute)
+	require.NoError(t, err)
+	_, err = AcquireNamespaceLock(rdb, "test", "b", time.Minute)
+	assert.ErrorIs(t, err, ErrNamespaceOwned)
+	// other namespaces are independent
+	other, err := AcquireNamespaceLock(rdb, "test2", "b", time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, other.Release())
+	require.NoError(t, l.Release())
+	l, err = AcquireNamespaceLock(rdb, "test", "b", time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, l.Release())
+	// releasing again is a no-op
+	require.NoError(t, l.Release())
+}
+
+func TestNamespaceLockLost(t *testing.T) {
+	rdb := newTestClient(t)
+	l, err := AcquireNamespaceLock(rdb, "test", "a", 30*time.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, rdb.Set(context.Background(), "test:lock", "b", 0).Err())
+	select {
+	case <-l.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock loss not detected")
+	}
+	require.NoError(t, l.Release())
+	// the new owner's lock is left alone
+	owner, err := rdb.Get(context.Background(), "test:lock").Result()
+	require.NoError(t, err)
+	assert.Equal(t, "b", owner)
+}
@@ -0,0 +1,296 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// MemBmStore is an in-memory BmStore for tests, bitmaps are copied in and out like they're serialized by redis
+type MemBmStore struct {
+	mu      sync.Mutex
+	indexes map[string]map[string]*roaring.Bitmap
+}
+
+func NewMemBmStore() *MemBmStore {
+	return &MemBmStore{indexes: make(map[string]map[string]*roaring.Bitmap)}
+}
+
+func (s *MemBmStore) Get(indexKey string, valueKey string) (*roaring.Bitmap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bm, ok := s.indexes[indexKey][valueKey]; ok {
+		return bm.Clone(), nil
+	}
+	return roaring.New(), nil
+}
+
+func (s *MemBmStore) MGet(indexKey string, valueKeys []string) ([]*roaring.Bitmap, error) {
+	if len(valueKeys) == 0 {
+		return nil, nil
+	}
+	bms := make([]*roaring.Bitmap, len(valueKeys))
+	for i, valueKey := range valueKeys {
+		bms[i], _ = s.Get(indexKey, valueKey)
+	}
+	return bms, nil
+}
+
+func (s *MemBmStore) Contains(indexKey string, valueKey string, ids []uint32) ([]bool, error) {
+	bm, _ := s.Get(indexKey, valueKey)
+	result := make([]bool, len(ids))
+	for i, id := range ids {
+		result[i] = bm.Contains(id)
+	}
+	return result, nil
+}
+
+func (s *MemBmStore) Exists(indexKey string, valueKey string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.indexes[indexKey][valueKey]
+	return ok, nil
+}
+
+func (s *MemBmStore) GetRaw(indexKey string, valueKey string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bm, ok := s.indexes[indexKey][valueKey]
+	if !ok {
+		return nil, nil
+	}
+	return bm.ToBytes()
+}
+
+func (s *MemBmStore) Len(indexKey string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.indexes[indexKey])), nil
+}
+
+// ScanValues passes the values ordered by value key, proc runs on a snapshot and may write the store
+func (s *MemBmStore) ScanValues(indexKey string, proc func(valueKey string, bm *roaring.Bitmap) bool) error {
+	s.mu.Lock()
+	values := s.indexes[indexKey]
+	valueKeys := make([]string, 0, len(values))
+	bms := make(map[string]*roaring.Bitmap, len(values))
+	for valueKey, bm := range values {
+		valueKeys = append(valueKeys, valueKey)
+		bms[valueKey] = bm.Clone()
+	}
+	s.mu.Unlock()
+	slices.Sort(valueKeys)
+	for _, valueKey := range valueKeys {
+		if !proc(valueKey, bms[valueKey]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ScanSizes passes the serialized sizes of the bitmaps ordered by value key, the store never shards
+func (s *MemBmStore) ScanSizes(indexKey string, proc func(valueKey string, sizes []uint64) bool) error {
+	return s.ScanValues(indexKey, func(valueKey string, bm *roaring.Bitmap) bool {
+		return proc(valueKey, []uint64{bm.GetSerializedSizeInBytes()})
+	})
+}
+
+func (s *MemBmStore) Drop(indexKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.indexes, indexKey)
+	return nil
+}
+
+func (s *MemBmStore) Set(indexKey string, valueKey string, bitmap *roaring.Bitmap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(indexKey, valueKey, bitmap)
+	return nil
+}
+
+func (s *MemBmStore) MSet(indexKey string, entries map[string]*roaring.Bitmap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for valueKey, bitmap := range entries {
+		s.set(indexKey, valueKey, bitmap)
+	}
+	return nil
+}
+
+// set stores a copy of bitmap, deleting the value key if it's empty
+func (s *MemBmStore) set(indexKey string, valueKey string, bitmap *roaring.Bitmap) {
+	if bitmap == nil || bitmap.IsEmpty() {
+		delete(s.indexes[indexKey], valueKey)
+		if len(s.indexes[indexKey]) == 0 {
+			delete(s.indexes, indexKey)
+		}
+		return
+	}
+	if s.indexes[indexKey] == nil {
+		s.indexes[indexKey] = make(map[string]*roaring.Bitmap)
+	}
+	s.indexes[indexKey][valueKey] = bitmap.Clone()
+}
+
+func (s *MemBmStore) AddBit(indexKey string, valueKey string, id uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bm, ok := s.indexes[indexKey][valueKey]
+	if !ok {
+		bm = roaring.New()
+	}
+	bm.Add(id)
+	s.set(indexKey, valueKey, bm)
+	return nil
+}
+
+func (s *MemBmStore) RemoveBit(indexKey string, valueKey string, id uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bm, ok := s.indexes[indexKey][valueKey]
+	if !ok {
+		return nil
+	}
+	bm.Remove(id)
+	s.set(indexKey, valueKey, bm)
+	return nil
+}
+
+// UpdateBits applies changes under the lock of the store, sets must be empty since there is no redis hash to set
+func (s *MemBmStore) UpdateBits(changes []BitChanges, sets []HashFieldValue) error {
+	if len(sets) != 0 {
+		return errors.New("MemBmStore can't set redis hash fields with its bitmaps")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range changes {
+		bm, ok := s.indexes[c.IndexKey][c.ValueKey]
+		if !ok {
+			bm = roaring.New()
+		}
+		bm.Or(c.Added)
+		bm.AndNot(c.Removed)
+		s.set(c.IndexKey, c.ValueKey, bm)
+	}
+	return nil
+}
+
+func (s *MemBmStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// MemSortKeyBitmapStore is an in-memory SortKeyBitmapStore for tests.
+// Buckets are ordered by sort key, like the zero-padded hex members of the redis sorted set are by lex order.
+type MemSortKeyBitmapStore struct {
+	mu      sync.Mutex
+	indexes map[string]map[uint64]*roaring.Bitmap
+}
+
+func NewMemSortKeyBitmapStore() *MemSortKeyBitmapStore {
+	return &MemSortKeyBitmapStore{indexes: make(map[string]map[uint64]*roaring.Bitmap)}
+}
+
+func (s *MemSortKeyBitmapStore) Scan(indexKey string, start uint64, stop uint64, reverse bool, limit int) ([]SortKeyBitmap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lo, hi := start, stop
+	if reverse {
+		lo, hi = stop, start
+	}
+	var sortKeys []uint64
+	for sortKey := range s.indexes[indexKey] {
+		if lo <= sortKey && sortKey <= hi {
+			sortKeys = append(sortKeys, sortKey)
+		}
+	}
+	slices.Sort(sortKeys)
+	if reverse {
+		slices.Reverse(sortKeys)
+	}
+	if limit > 0 && len(sortKeys) > limit {
+		sortKeys = sortKeys[:limit]
+	}
+	if len(sortKeys) == 0 {
+		return nil, nil
+	}
+	result := make([]SortKeyBitmap, len(sortKeys))
+	for i, sortKey := range sortKeys {
+		result[i] = SortKeyBitmap{SortKey: sortKey, Bitmap: s.indexes[indexKey][sortKey].Clone()}
+	}
+	return result, nil
+}
+
+// MSet writes all buckets at once, so readers never see half of a split or merge
+func (s *MemSortKeyBitmapStore) MSet(indexKey string, skbms []SortKeyBitmap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, skbm := range skbms {
+		if skbm.Bitmap == nil || skbm.Bitmap.IsEmpty() {
+			delete(s.indexes[indexKey], skbm.SortKey)
+			continue
+		}
+		if s.indexes[indexKey] == nil {
+			s.indexes[indexKey] = make(map[uint64]*roaring.Bitmap)
+		}
+		s.indexes[indexKey][skbm.SortKey] = skbm.Bitmap.Clone()
+	}
+	if len(s.indexes[indexKey]) == 0 {
+		delete(s.indexes, indexKey)
+	}
+	return nil
+}
+
+func (s *MemSortKeyBitmapStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// MemFvStore is an in-memory FieldValueStore for tests
+type MemFvStore struct {
+	mu      sync.Mutex
+	indexes map[string]map[uint32]uint64
+}
+
+func NewMemFvStore() *MemFvStore {
+	return &MemFvStore{indexes: make(map[string]map[uint32]uint64)}
+}
+
+func (s *MemFvStore) MGet(indexKey string, ids []uint32) ([]uint64, error) {
+	values, _, err := s.MGetFound(indexKey, ids)
+	return values, err
+}
+
+func (s *MemFvStore) MGetFound(indexKey string, ids []uint32) ([]uint64, []bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]uint64, len(ids))
+	found := make([]bool, len(ids))
+	for i, id := range ids {
+		values[i], found[i] = s.indexes[indexKey][id]
+	}
+	return values, found, nil
+}
+
+func (s *MemFvStore) Set(indexKey string, id uint32, value uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.indexes[indexKey] == nil {
+		s.indexes[indexKey] = make(map[uint32]uint64)
+	}
+	s.indexes[indexKey][id] = value
+	return nil
+}
+
+func (s *MemFvStore) Remove(indexKey string, id uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.indexes[indexKey], id)
+	return nil
+}
+
+func (s *MemFvStore) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AppliedOffsets keeps the last kafka offset applied to the index per partition,
+// so redelivered messages are skipped. It must be deleted along with the index to consume a topic again.
+type AppliedOffsets struct {
+	RDB *redis.Client
+	Key string
+}
+
+func offsetField(topic string, partition int32) string {
+	return fmt.Sprintf("%s:%d", topic, partition)
+}
+
+// Get returns the last applied offset of the partition, -1 if none was applied
+func (o *AppliedOffsets) Get(topic string, partition int32) (int64, error) {
+	field := offsetField(topic, partition)
+	offset, err := o.RDB.HGet(context.Background(), o.Key, field).Int64()
+	if errors.Is(err, redis.Nil) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("HGET failed, key=%s, field=%s, err: %w", o.Key, field, err)
+	}
+	return offset, nil
+}
+
+// Set records offset as the last applied offset of the partition
+func (o *AppliedOffsets) Set(topic string, partition int32, offset int64) error {
+	field := offsetField(topic, partition)
+	if err := o.RDB.HSet(context.Background(), o.Key, field, strconv.FormatInt(offset, 10)).Err(); err != nil {
+		return fmt.Errorf("HSET failed, key=%s, field=%s, offset=%d, err: %w", o.Key, field, offset, err)
+	}
+	return nil
+}
+
+// FieldValue is the hash field Set writes, e.g. to record the offset with BmStore.UpdateBits along with the bitmaps
+func (o *AppliedOffsets) FieldValue(topic string, partition int32, offset int64) HashFieldValue {
+	return HashFieldValue{Key: o.Key, Field: offsetField(topic, partition), Value: strconv.FormatInt(offset, 10)}
+}
+
+func (o *AppliedOffsets) Ping(ctx context.Context) error {
+	return o.RDB.Ping(ctx).Err()
+}
@@ -2,16 +2,31 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
 	"strconv"
 
+	"github.com/KKKIIO/inv-index-demo/metrics"
 	"github.com/RoaringBitmap/roaring"
 	"github.com/redis/go-redis/v9"
 )
 
+// ErrCorruptBitmap is returned when stored bytes can't be decoded as a bitmap
+var ErrCorruptBitmap = errors.New("corrupted bitmap")
+
 type RedisBmStore struct {
 	RDB    *redis.Client
 	Prefix string
+	// CorruptAsEmpty makes Get quarantine corrupted bitmaps and treat them as empty,
+	// so one bad key doesn't fail every query. Writes always fail on corrupted bitmaps.
+	CorruptAsEmpty bool
+	// ShardThreshold is the serialized size in bytes above which a bitmap is stored as shards of 2^20 ids,
+	// so hot values don't grow single redis values without bound. 0 disables sharding.
+	ShardThreshold int
+	// PerKeyGets makes MGet read hash fields with pipelined HGETs instead of one HMGET, see hmget
+	PerKeyGets bool
 }
 
 func (s *RedisBmStore) Get(indexKey string, valueKey string) (*roaring.Bitmap, error) {
@@ -20,11 +35,234 @@ func (s *RedisBmStore) Get(indexKey string, valueKey string) (*roaring.Bitmap, e
 	if err != nil && err != redis.Nil {
 		return nil, fmt.Errorf("HGET failed, hashKey=%s, valueKey=%s, err: %w", hashKey, valueKey, err)
 	}
-	return parseBitmap(value)
+	return s.decode(indexKey, valueKey, value)
+}
+
+// MGet returns the bitmaps of valueKeys in one round-trip, empty ones for missing values.
+// Sharded values are read with extra round-trips.
+func (s *RedisBmStore) MGet(indexKey string, valueKeys []string) ([]*roaring.Bitmap, error) {
+	if len(valueKeys) == 0 {
+		return nil, nil
+	}
+	values, err := hmget(s.RDB, s.Prefix+indexKey, valueKeys, s.PerKeyGets)
+	if err != nil {
+		return nil, err
+	}
+	bms := make([]*roaring.Bitmap, len(valueKeys))
+	for i, valueKey := range valueKeys {
+		value, _ := values[i].(string)
+		if bms[i], err = s.decode(indexKey, valueKey, value); err != nil {
+			return nil, err
+		}
+	}
+	return bms, nil
+}
+
+// decode parses the stored value of valueKey, "" if missing, reading its shards if it's sharded
+func (s *RedisBmStore) decode(indexKey string, valueKey string, value string) (*roaring.Bitmap, error) {
+	hashKey := s.Prefix + indexKey
+	if value == shardMarker {
+		return s.getShards(indexKey, valueKey)
+	}
+	bm, err := parseBitmap(value)
+	if err != nil {
+		err = fmt.Errorf("Failed to parse bitmap, hashKey=%s, valueKey=%s, err: %w", hashKey, valueKey, err)
+		if !s.CorruptAsEmpty || !errors.Is(err, ErrCorruptBitmap) {
+			return nil, err
+		}
+		slog.Error("Treating corrupted bitmap as empty", "error", err)
+		metrics.CorruptBitmaps.Add(1)
+		if err := s.quarantine(indexKey, valueKey, value); err != nil {
+			slog.Error("Failed to quarantine corrupted bitmap", "hashKey", hashKey, "valueKey", valueKey, "error", err)
+		}
+		return roaring.New(), nil
+	}
+	return bm, nil
+}
+
+// quarantine keeps a copy of corrupted bytes for later inspection, the original value is left in place
+func (s *RedisBmStore) quarantine(indexKey string, valueKey string, value string) error {
+	return s.RDB.HSet(context.Background(), s.Prefix+"quarantine:"+indexKey, valueKey, value).Err()
+}
+
+// Contains reports for each of ids, in input order, whether it is in the stored bitmap.
+// The bitmap is fetched once for all ids.
+func (s *RedisBmStore) Contains(indexKey string, valueKey string, ids []uint32) ([]bool, error) {
+	bm, err := s.Get(indexKey, valueKey)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]bool, len(ids))
+	for i, id := range ids {
+		result[i] = bm.Contains(id)
+	}
+	return result, nil
+}
+
+// Exists reports whether a bitmap is stored for the value key, empty bitmaps are never stored
+func (s *RedisBmStore) Exists(indexKey string, valueKey string) (bool, error) {
+	hashKey := s.Prefix + indexKey
+	exists, err := s.RDB.HExists(context.Background(), hashKey, valueKey).Result()
+	if err != nil {
+		return false, fmt.Errorf("HEXISTS failed, hashKey=%s, valueKey=%s, err: %w", hashKey, valueKey, err)
+	}
+	return exists, nil
+}
+
+// GetRaw returns the serialized bitmap as stored, or nil if the value key doesn't exist.
+// The shards of a sharded bitmap are serialized as their union.
+// It is meant for diagnostics, use Get to read bitmaps.
+func (s *RedisBmStore) GetRaw(indexKey string, valueKey string) ([]byte, error) {
+	hashKey := s.Prefix + indexKey
+	value, err := s.RDB.HGet(context.Background(), hashKey, valueKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("HGET failed, hashKey=%s, valueKey=%s, err: %w", hashKey, valueKey, err)
+	}
+	if string(value) == shardMarker {
+		bm, err := s.getShards(indexKey, valueKey)
+		if err != nil {
+			return nil, err
+		}
+		return bm.ToBytes()
+	}
+	return value, nil
+}
+
+// Len returns the number of distinct values with a stored bitmap
+func (s *RedisBmStore) Len(indexKey string) (int64, error) {
+	hashKey := s.Prefix + indexKey
+	n, err := s.RDB.HLen(context.Background(), hashKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("HLEN failed, hashKey=%s, err: %w", hashKey, err)
+	}
+	return n, nil
+}
+
+// ScanValues passes every stored value key and its bitmap to proc, in no particular order, until proc returns false.
+// Values changed during the scan may be missed or passed twice.
+func (s *RedisBmStore) ScanValues(indexKey string, proc func(valueKey string, bm *roaring.Bitmap) bool) error {
+	hashKey := s.Prefix + indexKey
+	var cursor uint64
+	for {
+		kvs, next, err := s.RDB.HScan(context.Background(), hashKey, cursor, "", 100).Result()
+		if err != nil {
+			return fmt.Errorf("HSCAN failed, hashKey=%s, cursor=%d, err: %w", hashKey, cursor, err)
+		}
+		for i := 0; i+1 < len(kvs); i += 2 {
+			var bm *roaring.Bitmap
+			if kvs[i+1] == shardMarker {
+				bm, err = s.getShards(indexKey, kvs[i])
+			} else if bm, err = parseBitmap(kvs[i+1]); err != nil {
+				err = fmt.Errorf("Failed to parse bitmap, hashKey=%s, valueKey=%s, err: %w", hashKey, kvs[i], err)
+			}
+			if err != nil {
+				return err
+			}
+			if !proc(kvs[i], bm) {
+				return nil
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// sizeScript replies the next cursor of a page of HSCAN over KEYS[1] from cursor ARGV[1], then each field and the
+// length of its value, what HSTRLEN replies, or -1 for the shard marker ARGV[2]. Values aren't sent to the client.
+var sizeScript = redis.NewScript(`
+local page = redis.call('HSCAN', KEYS[1], ARGV[1], 'COUNT', 100)
+local reply = {page[1]}
+for i = 1, #page[2], 2 do
+  local value = page[2][i + 1]
+  reply[#reply + 1] = page[2][i]
+  if value == ARGV[2] then
+    reply[#reply + 1] = -1
+  else
+    reply[#reply + 1] = #value
+  end
+end
+return reply
+`)
+
+// ScanSizes passes every stored value key and the sizes of its stored bitmap to proc, in no particular order,
+// until proc returns false. A sharded bitmap has the size of each shard. Sizes are measured server side.
+func (s *RedisBmStore) ScanSizes(indexKey string, proc func(valueKey string, sizes []uint64) bool) error {
+	return s.scanSizes(s.Prefix+indexKey, func(valueKey string, size int64) (bool, error) {
+		if size >= 0 {
+			return proc(valueKey, []uint64{uint64(size)}), nil
+		}
+		var shards []uint64
+		if err := s.scanSizes(s.shardsKey(indexKey, valueKey), func(_ string, size int64) (bool, error) {
+			shards = append(shards, uint64(size))
+			return true, nil
+		}); err != nil {
+			return false, err
+		}
+		return proc(valueKey, shards), nil
+	})
+}
+
+// scanSizes passes the fields of a hash and the sizes of their values to proc with sizeScript
+func (s *RedisBmStore) scanSizes(hashKey string, proc func(field string, size int64) (bool, error)) error {
+	cursor := "0"
+	for {
+		reply, err := sizeScript.Run(context.Background(), s.RDB, []string{hashKey}, cursor, shardMarker).Slice()
+		if err != nil {
+			return fmt.Errorf("Scan sizes failed, hashKey=%s, cursor=%s, err: %w", hashKey, cursor, err)
+		}
+		if len(reply) == 0 || len(reply)%2 != 1 {
+			return fmt.Errorf("Scan sizes replied %d elements, hashKey=%s, cursor=%s", len(reply), hashKey, cursor)
+		}
+		cursor, _ = reply[0].(string)
+		for i := 1; i+1 < len(reply); i += 2 {
+			field, _ := reply[i].(string)
+			size, _ := reply[i+1].(int64)
+			if ok, err := proc(field, size); err != nil || !ok {
+				return err
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// Drop deletes the bitmaps of every value of an index
+func (s *RedisBmStore) Drop(indexKey string) error {
+	hashKey := s.Prefix + indexKey
+	keys := []string{hashKey}
+	var cursor uint64
+	for {
+		kvs, next, err := s.RDB.HScan(context.Background(), hashKey, cursor, "", 100).Result()
+		if err != nil {
+			return fmt.Errorf("HSCAN failed, hashKey=%s, cursor=%d, err: %w", hashKey, cursor, err)
+		}
+		for i := 0; i+1 < len(kvs); i += 2 {
+			if kvs[i+1] == shardMarker {
+				keys = append(keys, s.shardsKey(indexKey, kvs[i]))
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if err := s.RDB.Del(context.Background(), keys...).Err(); err != nil {
+		return fmt.Errorf("DEL failed, hashKey=%s, err: %w", hashKey, err)
+	}
+	return nil
 }
 
 func (s *RedisBmStore) Set(indexKey string, valueKey string, bitmap *roaring.Bitmap) error {
 	hashKey := s.Prefix + indexKey
+	if s.ShardThreshold > 0 {
+		return s.setSharded(indexKey, valueKey, bitmap)
+	}
 	// delete empty bitmaps, update non-empty bitmaps
 	if bitmap == nil || bitmap.GetCardinality() == 0 {
 		return s.RDB.HDel(context.Background(), hashKey, valueKey).Err()
@@ -36,12 +274,159 @@ func (s *RedisBmStore) Set(indexKey string, valueKey string, bitmap *roaring.Bit
 	return s.RDB.HSet(context.Background(), hashKey, valueKey, raw).Err()
 }
 
+// MSet writes the bitmaps of many value keys of indexKey in one MULTI round-trip, deleting empty or nil ones like Set.
+// It mirrors RedisSortKeyBitmapStore.MSet, e.g. to write the term bitmaps changed by a batch of rows at once.
+func (s *RedisBmStore) MSet(indexKey string, entries map[string]*roaring.Bitmap) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	hashKey := s.Prefix + indexKey
+	valueKeys := make([]string, 0, len(entries))
+	for valueKey := range entries {
+		valueKeys = append(valueKeys, valueKey)
+	}
+	slices.Sort(valueKeys)
+	delFields := make([]string, 0)
+	pairs := make([]any, 0, len(entries)*2)
+	if s.ShardThreshold == 0 {
+		for _, valueKey := range valueKeys {
+			bitmap := entries[valueKey]
+			if bitmap == nil || bitmap.GetCardinality() == 0 {
+				delFields = append(delFields, valueKey)
+				continue
+			}
+			raw, err := bitmap.ToBytes()
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, valueKey, raw)
+		}
+	}
+	_, err := s.RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if s.ShardThreshold > 0 {
+			for _, valueKey := range valueKeys {
+				if err := s.setPipelined(pipe, indexKey, valueKey, entries[valueKey]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if len(delFields) > 0 {
+			pipe.HDel(ctx, hashKey, delFields...)
+		}
+		if len(pairs) > 0 {
+			pipe.HSet(ctx, hashKey, pairs...)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("MSET failed, hashKey=%s, err: %w", hashKey, err)
+	}
+	return nil
+}
+
+// setSharded is Set replacing the shards of the value too, the bitmap is sharded if it's over ShardThreshold
+func (s *RedisBmStore) setSharded(indexKey string, valueKey string, bitmap *roaring.Bitmap) error {
+	ctx := context.Background()
+	hashKey := s.Prefix + indexKey
+	shardsKey := s.shardsKey(indexKey, valueKey)
+	_, err := s.RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return s.setPipelined(pipe, indexKey, valueKey, bitmap)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to set bitmap, hashKey=%s, valueKey=%s, shardsKey=%s, err: %w", hashKey, valueKey, shardsKey, err)
+	}
+	return nil
+}
+
+// setPipelined queues the commands of Set on pipe, replacing the shards of the value too.
+// The bitmap is written once pipe is executed, wrap it in a transaction to write it atomically with other values.
+func (s *RedisBmStore) setPipelined(pipe redis.Pipeliner, indexKey string, valueKey string, bitmap *roaring.Bitmap) error {
+	ctx := context.Background()
+	hashKey := s.Prefix + indexKey
+	pipe.Del(ctx, s.shardsKey(indexKey, valueKey))
+	if bitmap == nil || bitmap.GetCardinality() == 0 {
+		return pipe.HDel(ctx, hashKey, valueKey).Err()
+	}
+	if !s.shouldShard(bitmap) {
+		raw, err := bitmap.ToBytes()
+		if err != nil {
+			return err
+		}
+		return pipe.HSet(ctx, hashKey, valueKey, raw).Err()
+	}
+	shards, err := splitShards(bitmap)
+	if err != nil {
+		return err
+	}
+	pipe.HSet(ctx, s.shardsKey(indexKey, valueKey), shards...)
+	return pipe.HSet(ctx, hashKey, valueKey, shardMarker).Err()
+}
+
+// AddBit adds id to a stored bitmap.
+// Unlike Get then Set, it is safe against concurrent writers of the same value key.
+func (s *RedisBmStore) AddBit(indexKey string, valueKey string, id uint32) error {
+	return s.updateBitmap(indexKey, valueKey, id, true)
+}
+
+// RemoveBit removes id from a stored bitmap, the value key is deleted once the bitmap is empty.
+// Unlike Get then Set, it is safe against concurrent writers of the same value key.
+func (s *RedisBmStore) RemoveBit(indexKey string, valueKey string, id uint32) error {
+	return s.updateBitmap(indexKey, valueKey, id, false)
+}
+
+// updateBitmap adds or removes id in a stored bitmap server side, see updateStoredBitmap.
+// A sharded bitmap only has the shard of id updated, a bitmap growing over ShardThreshold is sharded, see reshard.
+func (s *RedisBmStore) updateBitmap(indexKey string, valueKey string, id uint32, add bool) error {
+	n, err := updateStoredBitmap(s.RDB, s.Prefix+indexKey, valueKey, s.shardsKey(indexKey, valueKey), shardField(id), id, add)
+	if err != nil {
+		return err
+	}
+	if !add || s.ShardThreshold <= 0 || n <= int64(s.ShardThreshold) {
+		return nil
+	}
+	return s.reshard(indexKey, valueKey)
+}
+
+// UpdateBits applies changes server side and sets the fields of sets in one script, see batchBitScript, so like AddBit
+// and RemoveBit it's safe against concurrent writers. Only the containers of the changed ids are rewritten, the shards
+// of a sharded bitmap holding none of them are left untouched. Bitmaps growing over ShardThreshold are sharded after.
+func (s *RedisBmStore) UpdateBits(changes []BitChanges, sets []HashFieldValue) error {
+	if len(changes) == 0 && len(sets) == 0 {
+		return nil
+	}
+	hashKeys := make([]string, len(changes))
+	valueKeys := make([]string, len(changes))
+	shardsKeys := make([]string, len(changes))
+	for i, c := range changes {
+		hashKeys[i], valueKeys[i], shardsKeys[i] = s.Prefix+c.IndexKey, c.ValueKey, s.shardsKey(c.IndexKey, c.ValueKey)
+	}
+	sizes, err := updateStoredBitmaps(s.RDB, hashKeys, valueKeys, shardsKeys, changes, sets)
+	if err != nil {
+		return err
+	}
+	if s.ShardThreshold <= 0 {
+		return nil
+	}
+	for i, c := range changes {
+		if !c.Added.IsEmpty() && sizes[i] > int64(s.ShardThreshold) {
+			if err := s.reshard(c.IndexKey, c.ValueKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // RedisSortKeyBitmapStore store sorted bitmaps in redis
 // Value keys are stored in a sorted set, and bitmaps are stored in a hash
 // numberic key is serialized as zero-padded hex string
 type RedisSortKeyBitmapStore struct {
 	RDB    *redis.Client
 	Prefix string
+	// PerKeyGets reads hash fields with pipelined HGETs instead of one HMGET, see hmget
+	PerKeyGets bool
 }
 
 func (s *RedisSortKeyBitmapStore) Scan(indexKey string, start uint64, stop uint64, reverse bool, limit int) ([]SortKeyBitmap, error) {
@@ -70,9 +455,9 @@ func (s *RedisSortKeyBitmapStore) Scan(indexKey string, start uint64, stop uint6
 		return nil, nil
 	}
 	hashKey := s.makeHashKey(indexKey)
-	values, err := s.RDB.HMGet(context.Background(), hashKey, keys...).Result()
+	values, err := hmget(s.RDB, hashKey, keys, s.PerKeyGets)
 	if err != nil {
-		return nil, fmt.Errorf("HMGet failed, hashKey=%s, keys=%+v, err: %w", hashKey, keys, err)
+		return nil, err
 	}
 	result := make([]SortKeyBitmap, len(keys))
 	for i, key := range keys {
@@ -88,74 +473,110 @@ func (s *RedisSortKeyBitmapStore) Scan(indexKey string, start uint64, stop uint6
 		result[i] = SortKeyBitmap{SortKey: sortKey, Bitmap: bm}
 	}
 	return result, nil
+}
 
+// hmget returns the values of fields of a hash, nil for missing fields.
+// Proxies and cluster clients may split or partially fail a multi-field command,
+// so a result not matching the fields is an error rather than misaligned values.
+// perKey reads each field with its own HGET in a pipeline instead, which such setups handle.
+func hmget(rdb *redis.Client, hashKey string, fields []string, perKey bool) ([]any, error) {
+	if !perKey {
+		values, err := rdb.HMGet(context.Background(), hashKey, fields...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("HMGet failed, hashKey=%s, fields=%+v, err: %w", hashKey, fields, err)
+		}
+		if len(values) != len(fields) {
+			return nil, fmt.Errorf("HMGet returned %d values for %d fields, hashKey=%s", len(values), len(fields), hashKey)
+		}
+		return values, nil
+	}
+	cmds := make([]*redis.StringCmd, len(fields))
+	if _, err := rdb.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for i, field := range fields {
+			cmds[i] = pipe.HGet(context.Background(), hashKey, field)
+		}
+		return nil
+	}); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("HGET pipeline failed, hashKey=%s, fields=%+v, err: %w", hashKey, fields, err)
+	}
+	values := make([]any, len(fields))
+	for i, cmd := range cmds {
+		value, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("HGET failed, hashKey=%s, field=%s, err: %w", hashKey, fields[i], err)
+		}
+		values[i] = value
+	}
+	return values, nil
 }
 
 func (s *RedisSortKeyBitmapStore) MSet(indexKey string, skbms []SortKeyBitmap) error {
 	if len(skbms) == 0 {
 		return nil
 	}
-	// delete empty bitmaps, update non-empty bitmaps
+	// delete empty bitmaps, update non-empty bitmaps, in one MULTI so readers never see half of a split or merge
 	zsetKey := s.makeZsetKey(indexKey)
 	hashKey := s.makeHashKey(indexKey)
-	delKeys := make([]uint64, 0)
-	setSkbms := make([]SortKeyBitmap, 0)
+	delMembers := make([]any, 0)
+	delFields := make([]string, 0)
+	zs := make([]redis.Z, 0, len(skbms))
+	pairs := make([]any, 0, len(skbms)*2)
 	for _, skbm := range skbms {
+		field := u64ToHex(skbm.SortKey)
 		if skbm.Bitmap == nil || skbm.Bitmap.GetCardinality() == 0 {
-			delKeys = append(delKeys, skbm.SortKey)
-		} else {
-			setSkbms = append(setSkbms, skbm)
+			delMembers = append(delMembers, field)
+			delFields = append(delFields, field)
+			continue
 		}
-	}
-	if len(delKeys) > 0 {
-		members := make([]any, len(delKeys))
-		fields := make([]string, len(delKeys))
-		for i, key := range delKeys {
-			fields[i] = u64ToHex(key)
-			members[i] = fields[i]
-		}
-		if err := s.RDB.ZRem(context.Background(), zsetKey, members...).Err(); err != nil {
-			return fmt.Errorf("ZRem failed, zsetKey=%s, members=%+v, err: %w", zsetKey, members, err)
-		}
-		if err := s.RDB.HDel(context.Background(), hashKey, fields...).Err(); err != nil {
-			return fmt.Errorf("HDel failed, hashKey=%s, fields=%+v, err: %w", hashKey, fields, err)
+		raw, err := skbm.Bitmap.ToBytes()
+		if err != nil {
+			return err
 		}
+		zs = append(zs, redis.Z{Score: float64(skbm.SortKey), Member: field})
+		pairs = append(pairs, field, raw)
 	}
-	if len(setSkbms) > 0 {
-		zs := make([]redis.Z, len(setSkbms))
-		pairs := make([]any, len(setSkbms)*2)
-		for i, skbm := range setSkbms {
-			zs[i] = redis.Z{Score: float64(skbm.SortKey), Member: u64ToHex(skbm.SortKey)}
-			pairs[i*2] = u64ToHex(skbm.SortKey)
-			raw, err := skbm.Bitmap.ToBytes()
-			if err != nil {
-				return err
-			}
-			pairs[i*2+1] = raw
-		}
-		if err := s.RDB.ZAdd(context.Background(), zsetKey, zs...).Err(); err != nil {
-			return fmt.Errorf("ZAdd failed, zsetKey=%s, zs=%+v, err: %w", zsetKey, zs, err)
+	if _, err := s.RDB.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		if len(delFields) > 0 {
+			pipe.ZRem(context.Background(), zsetKey, delMembers...)
+			pipe.HDel(context.Background(), hashKey, delFields...)
 		}
-		if err := s.RDB.HMSet(context.Background(), hashKey, pairs...).Err(); err != nil {
-			return fmt.Errorf("HMSet failed, hashKey=%s, pairs=%+v, err: %w", hashKey, pairs, err)
+		if len(zs) > 0 {
+			pipe.ZAdd(context.Background(), zsetKey, zs...)
+			pipe.HMSet(context.Background(), hashKey, pairs...)
 		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("MSet failed, zsetKey=%s, hashKey=%s, delFields=%+v, zs=%+v, err: %w", zsetKey, hashKey, delFields, zs, err)
 	}
 	return nil
 }
 
 func (s *RedisSortKeyBitmapStore) makeZsetKey(indexKey string) string {
-	return s.Prefix + indexKey + ":zs"
+	return s.Prefix + indexKey + KeySeparator + "zs"
 }
 
 func (s *RedisSortKeyBitmapStore) makeHashKey(indexKey string) string {
-	return s.Prefix + indexKey + ":hm"
+	return s.Prefix + indexKey + KeySeparator + "hm"
 }
 
 func u64ToHex(u uint64) string {
 	return fmt.Sprintf("%016x", u)
 }
 
+// hexToU64 parses a sort key member written by u64ToHex. Other spellings, e.g. uppercase or unpadded hex,
+// are rejected: they don't sort with the others in ByLex ranges, so the buckets around them would be misread.
 func hexToU64(s string) (uint64, error) {
+	if len(s) != 16 {
+		return 0, fmt.Errorf("Invalid sort key member, s=%s, want 16 hex digits", s)
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return 0, fmt.Errorf("Invalid sort key member, s=%s, want lowercase hex digits", s)
+		}
+	}
 	v, err := strconv.ParseUint(s, 16, 64)
 	if err != nil {
 		return 0, fmt.Errorf("Failed to parse uint64, s=%s, err: %w", s, err)
@@ -166,29 +587,40 @@ func hexToU64(s string) (uint64, error) {
 type RedisFvStore struct {
 	RDB    *redis.Client
 	Prefix string
+	// PerKeyGets reads hash fields with pipelined HGETs instead of one HMGET, see hmget
+	PerKeyGets bool
 }
 
+// MGet returns the values of ids, 0 for ids without a value
 func (s *RedisFvStore) MGet(indexKey string, ids []uint32) ([]uint64, error) {
+	values, _, err := s.MGetFound(indexKey, ids)
+	return values, err
+}
+
+// MGetFound returns the values of ids and whether each id has a value
+func (s *RedisFvStore) MGetFound(indexKey string, ids []uint32) ([]uint64, []bool, error) {
 	hashKey := s.Prefix + indexKey
 	keys := make([]string, len(ids))
 	for i, id := range ids {
 		keys[i] = fmt.Sprint(id)
 	}
-	values, err := s.RDB.HMGet(context.Background(), hashKey, keys...).Result()
+	values, err := hmget(s.RDB, hashKey, keys, s.PerKeyGets)
 	if err != nil {
-		return nil, fmt.Errorf("HMGet failed, hashKey=%s, keys=%+v, err: %w", hashKey, keys, err)
+		return nil, nil, err
 	}
 	result := make([]uint64, len(values))
+	found := make([]bool, len(values))
 	for i, value := range values {
-		var res uint64
-		if sv, ok := value.(string); ok {
-			if res, err = strconv.ParseUint(sv, 10, 64); err != nil {
-				return nil, fmt.Errorf("Failed to parse uint64, hashKey=%s, key=%s, value=%s, err: %w", hashKey, keys[i], sv, err)
-			}
+		sv, ok := value.(string)
+		if !ok {
+			continue
 		}
-		result[i] = res
+		if result[i], err = strconv.ParseUint(sv, 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse uint64, hashKey=%s, key=%s, value=%s, err: %w", hashKey, keys[i], sv, err)
+		}
+		found[i] = true
 	}
-	return result, nil
+	return result, found, nil
 }
 
 func (s *RedisFvStore) Set(indexKey string, id uint32, value uint64) error {
@@ -205,16 +637,20 @@ type SortKeyBitmap struct {
 	Bitmap  *roaring.Bitmap
 }
 
+// parseBitmap decodes a stored bitmap, "" is the empty bitmap. The returned bitmap owns its bytes,
+// sv may be backed by a buffer go-redis reuses once the reply is read.
 func parseBitmap(sv string) (*roaring.Bitmap, error) {
 	roaringBitmap := roaring.New()
 	if len(sv) == 0 {
 		return roaringBitmap, nil
 	}
+	// FromBuffer keeps referencing the buffer, the conversion copies sv so every bitmap owns its bytes,
+	// even when values of a pipeline or HMGET share a reply buffer
 	value := []byte(sv)
 	if p, err := roaringBitmap.FromBuffer(value); err != nil {
-		return nil, fmt.Errorf("Failed to decode bitmap: %w", err)
+		return nil, fmt.Errorf("%w: failed to decode: %v", ErrCorruptBitmap, err)
 	} else if p != int64(len(value)) {
-		return nil, fmt.Errorf("Corrupted bitmap data: p=%d, len(value)=%d", p, len(value))
+		return nil, fmt.Errorf("%w: p=%d, len(value)=%d", ErrCorruptBitmap, p, len(value))
 	}
 	return roaringBitmap, nil
 }
@@ -0,0 +1,631 @@
+package store
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T) *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+}
+
+func TestRedisBmStoreGetRaw(t *testing.T) {
+	s := &RedisBmStore{RDB: newTestClient(t), Prefix: "test:"}
+	raw, err := s.GetRaw("term:orders:product_id", "42")
+	require.NoError(t, err)
+	assert.Nil(t, raw)
+
+	bm := roaring.BitmapOf(1, 2, 3, 100000)
+	require.NoError(t, s.Set("term:orders:product_id", "42", bm))
+	raw, err = s.GetRaw("term:orders:product_id", "42")
+	require.NoError(t, err)
+	parsed, err := parseBitmap(string(raw))
+	require.NoError(t, err)
+	assert.True(t, bm.Equals(parsed))
+}
+
+func TestParseBitmapOwnsItsBytes(t *testing.T) {
+	bm := roaring.BitmapOf(1, 2, 3, 70000, 1<<20)
+	bm.RunOptimize()
+	raw, err := bm.ToBytes()
+	require.NoError(t, err)
+	// a string sharing the bytes of a reply buffer, like one converted without copy by a client
+	buf := slices.Clone(raw)
+	parsed, err := parseBitmap(unsafe.String(&buf[0], len(buf)))
+	require.NoError(t, err)
+	// the buffer is reused for the next reply
+	other, err := roaring.BitmapOf(5, 6).ToBytes()
+	require.NoError(t, err)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	copy(buf, other)
+	assert.True(t, bm.Equals(parsed))
+	parsed.Add(4)
+	assert.True(t, parsed.Contains(4) && parsed.Contains(70000))
+}
+
+func TestRedisBmStoreShardsOversizedBitmaps(t *testing.T) {
+	rdb := newTestClient(t)
+	s := &RedisBmStore{RDB: rdb, Prefix: "test:", ShardThreshold: 1024}
+	const indexKey, valueKey = "term:orders:product_id", "42"
+	shards := func() int64 {
+		n, err := rdb.HLen(context.Background(), s.shardsKey(indexKey, valueKey)).Result()
+		require.NoError(t, err)
+		return n
+	}
+	// random ids over 4 shard ranges serialize far beyond the threshold
+	rnd := rand.New(rand.NewSource(1))
+	bm := roaring.New()
+	for i := 0; i < 5000; i++ {
+		bm.Add(uint32(rnd.Int63n(4 << shardBits)))
+	}
+	require.NoError(t, s.Set(indexKey, valueKey, bm))
+	assert.Equal(t, int64(4), shards())
+	got, err := s.Get(indexKey, valueKey)
+	require.NoError(t, err)
+	assert.True(t, bm.Equals(got))
+	raw, err := rdb.HGet(context.Background(), s.Prefix+indexKey, valueKey).Result()
+	require.NoError(t, err)
+	assert.Equal(t, shardMarker, raw)
+
+	// bit updates only touch their shard
+	require.NoError(t, s.AddBit(indexKey, valueKey, 9<<shardBits))
+	require.NoError(t, s.RemoveBit(indexKey, valueKey, bm.Minimum()))
+	bm.Add(9 << shardBits)
+	bm.Remove(bm.Minimum())
+	assert.Equal(t, int64(5), shards())
+	got, err = s.Get(indexKey, valueKey)
+	require.NoError(t, err)
+	assert.True(t, bm.Equals(got))
+	require.NoError(t, s.ScanValues(indexKey, func(v string, scanned *roaring.Bitmap) bool {
+		assert.Equal(t, valueKey, v)
+		assert.True(t, bm.Equals(scanned))
+		return true
+	}))
+	// each shard is measured as stored
+	require.NoError(t, s.ScanSizes(indexKey, func(v string, sizes []uint64) bool {
+		assert.Equal(t, valueKey, v)
+		stored, err := rdb.HGetAll(context.Background(), s.shardsKey(indexKey, valueKey)).Result()
+		require.NoError(t, err)
+		var want []uint64
+		for _, raw := range stored {
+			want = append(want, uint64(len(raw)))
+		}
+		assert.ElementsMatch(t, want, sizes)
+		return true
+	}))
+	n, err := s.Len(indexKey)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	// a small bitmap is stored whole again
+	require.NoError(t, s.Set(indexKey, valueKey, roaring.BitmapOf(1, 2)))
+	assert.Zero(t, shards())
+	got, err = s.Get(indexKey, valueKey)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2}, got.ToArray())
+
+	// a bitmap growing past the threshold bit by bit is sharded
+	for i := uint32(0); i < 3000; i++ {
+		require.NoError(t, s.AddBit(indexKey, "7", i*701))
+	}
+	got, err = s.Get(indexKey, "7")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3000), got.GetCardinality())
+	assert.Positive(t, func() int64 {
+		n, err := rdb.HLen(context.Background(), s.shardsKey(indexKey, "7")).Result()
+		require.NoError(t, err)
+		return n
+	}())
+
+	require.NoError(t, s.Drop(indexKey))
+	keys, err := rdb.Keys(context.Background(), "*").Result()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestRedisBmStoreMSet(t *testing.T) {
+	rdb := newTestClient(t)
+	for _, shardThreshold := range []int{0, 64} {
+		s := &RedisBmStore{RDB: rdb, Prefix: "test:" + strconv.Itoa(shardThreshold) + ":", ShardThreshold: shardThreshold}
+		const indexKey = "term:orders:product_id"
+		require.NoError(t, s.Set(indexKey, "1", roaring.BitmapOf(1)))
+		require.NoError(t, s.Set(indexKey, "2", roaring.BitmapOf(2)))
+		// sharded over 64 bytes
+		large := roaring.New()
+		for i := uint32(0); i < 1000; i++ {
+			large.Add(i * 3001)
+		}
+
+		// sets, replaces and deletes in one call
+		require.NoError(t, s.MSet(indexKey, map[string]*roaring.Bitmap{
+			"1": nil,
+			"2": roaring.New(),
+			"3": roaring.BitmapOf(3, 4),
+			"4": large,
+		}))
+		bms, err := s.MGet(indexKey, []string{"1", "2", "3", "4"})
+		require.NoError(t, err)
+		assert.True(t, bms[0].IsEmpty(), "shardThreshold=%d", shardThreshold)
+		assert.True(t, bms[1].IsEmpty(), "shardThreshold=%d", shardThreshold)
+		assert.Equal(t, []uint32{3, 4}, bms[2].ToArray(), "shardThreshold=%d", shardThreshold)
+		assert.True(t, large.Equals(bms[3]), "shardThreshold=%d", shardThreshold)
+		n, err := s.Len(indexKey)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n, "shardThreshold=%d", shardThreshold)
+		require.NoError(t, s.MSet(indexKey, nil))
+	}
+}
+
+func TestRedisBmStoreAddBitConcurrently(t *testing.T) {
+	s := &RedisBmStore{RDB: newTestClient(t), Prefix: "test:"}
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for id := uint32(0); id < n; id++ {
+		wg.Add(1)
+		go func(id uint32) {
+			defer wg.Done()
+			errs <- s.AddBit("term:orders:order_status", "1", id)
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	bm, err := s.Get("term:orders:order_status", "1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(n), bm.GetCardinality())
+
+	for id := uint32(0); id < n; id++ {
+		require.NoError(t, s.RemoveBit("term:orders:order_status", "1", id))
+	}
+	raw, err := s.GetRaw("term:orders:order_status", "1")
+	require.NoError(t, err)
+	assert.Nil(t, raw, "empty bitmaps are deleted")
+}
+
+func TestRedisBmStoreUpdateBitsConcurrently(t *testing.T) {
+	s := &RedisBmStore{RDB: newTestClient(t), Prefix: "test:"}
+	const indexKey, writers, ids = "term:orders:order_status", 4, 20
+	// the writers update the same bitmaps, the ones of an AddBit writer too
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+1)
+	for w := uint32(0); w < writers; w++ {
+		wg.Add(1)
+		go func(w uint32) {
+			defer wg.Done()
+			for i := uint32(0); i < ids; i++ {
+				id := i*(writers+1) + w
+				if err := s.UpdateBits([]BitChanges{
+					{IndexKey: indexKey, ValueKey: "1", Added: roaring.BitmapOf(id), Removed: roaring.New()},
+					{IndexKey: indexKey, ValueKey: "2", Added: roaring.BitmapOf(id), Removed: roaring.New()},
+				}, nil); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint32(0); i < ids; i++ {
+			if err := s.AddBit(indexKey, "1", i*(writers+1)+writers); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	bms, err := s.MGet(indexKey, []string{"1", "2"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64((writers+1)*ids), bms[0].GetCardinality())
+	assert.Equal(t, uint64(writers*ids), bms[1].GetCardinality())
+}
+
+func TestRedisBmStoreShardsConcurrently(t *testing.T) {
+	rdb := newTestClient(t)
+	s := &RedisBmStore{RDB: rdb, Prefix: "test:", ShardThreshold: 256}
+	const indexKey, valueKey, writers, ids = "term:orders:order_status", "1", 8, 300
+	// each writer has its own ids over several shard ranges, the value is sharded while they write
+	run := func(update func(id uint32) error) {
+		var wg sync.WaitGroup
+		errs := make(chan error, writers)
+		for w := uint32(0); w < writers; w++ {
+			wg.Add(1)
+			go func(w uint32) {
+				defer wg.Done()
+				for i := uint32(0); i < ids; i++ {
+					if err := update(i%4<<shardBits | i*writers + w); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	}
+	run(func(id uint32) error { return s.AddBit(indexKey, valueKey, id) })
+	bm, err := s.Get(indexKey, valueKey)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(writers*ids), bm.GetCardinality())
+	raw, err := rdb.HGet(context.Background(), s.Prefix+indexKey, valueKey).Result()
+	require.NoError(t, err)
+	assert.Equal(t, shardMarker, raw)
+
+	// the marker goes with the last shard, no id is left behind in an orphaned shard
+	run(func(id uint32) error { return s.RemoveBit(indexKey, valueKey, id) })
+	keys, err := rdb.Keys(context.Background(), "*").Result()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestRedisBmStoreAddBitMatchesRoaring(t *testing.T) {
+	s := &RedisBmStore{RDB: newTestClient(t), Prefix: "test:"}
+	r := rand.New(rand.NewSource(1))
+	expected := roaring.New()
+	expected.AddRange(0, 3000)
+	expected.AddRange(200000, 200010)
+	expected.Add(70000)
+	expected.RunOptimize()
+	require.NoError(t, s.Set("term:orders:order_status", "1", expected))
+	expected = expected.Clone()
+
+	// the first container holds about half of 8000 ids, crossing the 4096 array/bitmap boundary both ways
+	for i := 0; i < 6000; i++ {
+		id := uint32(r.Intn(8000))
+		if i%500 == 499 {
+			id = uint32(r.Intn(300000))
+		}
+		if i < 3000 || r.Intn(2) == 0 {
+			expected.Add(id)
+			require.NoError(t, s.AddBit("term:orders:order_status", "1", id))
+		} else {
+			expected.Remove(id)
+			require.NoError(t, s.RemoveBit("term:orders:order_status", "1", id))
+		}
+		if i%250 == 0 {
+			bm, err := s.Get("term:orders:order_status", "1")
+			require.NoError(t, err)
+			require.True(t, expected.Equals(bm), "i=%d", i)
+		}
+	}
+	bm, err := s.Get("term:orders:order_status", "1")
+	require.NoError(t, err)
+	require.True(t, expected.Equals(bm))
+	for _, id := range expected.ToArray() {
+		require.NoError(t, s.RemoveBit("term:orders:order_status", "1", id))
+	}
+	raw, err := s.GetRaw("term:orders:order_status", "1")
+	require.NoError(t, err)
+	assert.Nil(t, raw)
+}
+
+func TestRedisBmStoreUpdateBitsMatchesRoaring(t *testing.T) {
+	rdb := newTestClient(t)
+	s := &RedisBmStore{RDB: rdb, Prefix: "test:", ShardThreshold: 4096}
+	const indexKey = "term:orders:order_status"
+	r := rand.New(rand.NewSource(1))
+	runs := roaring.New()
+	runs.AddRange(0, 3000)
+	runs.AddRange(200000, 200010)
+	runs.RunOptimize()
+	require.NoError(t, s.Set(indexKey, "1", runs))
+	expected := map[string]*roaring.Bitmap{"1": runs.Clone(), "2": roaring.New()}
+
+	// "2" grows over the threshold into shards spread over 4 id ranges, batches then change both of them
+	for batch := 0; batch < 40; batch++ {
+		var changes []BitChanges
+		for _, valueKey := range []string{"1", "2"} {
+			c := BitChanges{IndexKey: indexKey, ValueKey: valueKey, Added: roaring.New(), Removed: roaring.New()}
+			for i := 0; i < 200; i++ {
+				id := uint32(r.Intn(8000))
+				if valueKey == "2" {
+					id |= uint32(r.Intn(4)) << shardBits
+				}
+				if batch < 10 || r.Intn(2) == 0 {
+					c.Added.Add(id)
+					c.Removed.Remove(id)
+				} else {
+					c.Removed.Add(id)
+					c.Added.Remove(id)
+				}
+			}
+			expected[valueKey].Or(c.Added)
+			expected[valueKey].AndNot(c.Removed)
+			changes = append(changes, c)
+		}
+		require.NoError(t, s.UpdateBits(changes, nil))
+		bms, err := s.MGet(indexKey, []string{"1", "2"})
+		require.NoError(t, err)
+		require.True(t, expected["1"].Equals(bms[0]), "batch=%d", batch)
+		require.True(t, expected["2"].Equals(bms[1]), "batch=%d", batch)
+	}
+	raw, err := rdb.HGet(context.Background(), s.Prefix+indexKey, "2").Result()
+	require.NoError(t, err)
+	assert.Equal(t, shardMarker, raw)
+
+	// emptying a sharded value drops its marker
+	require.NoError(t, s.UpdateBits([]BitChanges{
+		{IndexKey: indexKey, ValueKey: "1", Added: roaring.New(), Removed: expected["1"]},
+		{IndexKey: indexKey, ValueKey: "2", Added: roaring.New(), Removed: expected["2"]},
+	}, nil))
+	keys, err := rdb.Keys(context.Background(), "*").Result()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func BenchmarkRedisBmStoreGetSet(b *testing.B) {
+	s := &RedisBmStore{RDB: redis.NewClient(&redis.Options{Addr: miniredis.RunT(b).Addr()}), Prefix: "bench:"}
+	for i := 0; i < b.N; i++ {
+		bm, err := s.Get("term:orders:product_id", "1")
+		if err != nil {
+			b.Fatal(err)
+		}
+		bm.Add(uint32(i))
+		if err := s.Set("term:orders:product_id", "1", bm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRedisBmStoreAddBit(b *testing.B) {
+	s := &RedisBmStore{RDB: redis.NewClient(&redis.Options{Addr: miniredis.RunT(b).Addr()}), Prefix: "bench:"}
+	for i := 0; i < b.N; i++ {
+		if err := s.AddBit("term:orders:product_id", "1", uint32(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRedisBmStoreTruncatedBitmap(t *testing.T) {
+	rdb := newTestClient(t)
+	s := &RedisBmStore{RDB: rdb, Prefix: "test:"}
+	raw, err := roaring.BitmapOf(1, 2, 3, 70000).ToBytes()
+	require.NoError(t, err)
+	truncated := raw[:len(raw)-3]
+	require.NoError(t, rdb.HSet(context.Background(), "test:term:orders:product_id", "42", truncated).Err())
+
+	_, err = s.Get("term:orders:product_id", "42")
+	assert.ErrorIs(t, err, ErrCorruptBitmap)
+	assert.ErrorIs(t, s.AddBit("term:orders:product_id", "42", 4), ErrCorruptBitmap)
+
+	s.CorruptAsEmpty = true
+	bm, err := s.Get("term:orders:product_id", "42")
+	require.NoError(t, err)
+	assert.True(t, bm.IsEmpty())
+	quarantined, err := rdb.HGet(context.Background(), "test:quarantine:term:orders:product_id", "42").Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, truncated, quarantined)
+	// writes still refuse to overwrite the corrupted value
+	assert.ErrorIs(t, s.AddBit("term:orders:product_id", "42", 4), ErrCorruptBitmap)
+	// a batch changing it writes none of its changes and fields
+	assert.ErrorIs(t, s.UpdateBits([]BitChanges{
+		{IndexKey: "term:orders:product_id", ValueKey: "7", Added: roaring.BitmapOf(4), Removed: roaring.New()},
+		{IndexKey: "term:orders:product_id", ValueKey: "42", Added: roaring.BitmapOf(4), Removed: roaring.New()},
+	}, []HashFieldValue{{Key: "test:offsets", Field: "orders:0", Value: "7"}}), ErrCorruptBitmap)
+	exists, err := s.Exists("term:orders:product_id", "7")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	n, err := rdb.Exists(context.Background(), "test:offsets").Result()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestRedisBmStoreContains(t *testing.T) {
+	s := &RedisBmStore{RDB: newTestClient(t), Prefix: "test:"}
+	require.NoError(t, s.Set("term:orders:order_status", "1", roaring.BitmapOf(2, 4, 70000)))
+	found, err := s.Contains("term:orders:order_status", "1", []uint32{4, 3, 70000, 2, 4})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true, true, true}, found)
+	found, err = s.Contains("term:orders:order_status", "2", []uint32{4})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false}, found)
+}
+
+func TestRedisBmStoreMGetMatchesGets(t *testing.T) {
+	rdb := newTestClient(t)
+	const indexKey = "term:orders:product_id"
+	rnd := rand.New(rand.NewSource(1))
+	writer := &RedisBmStore{RDB: rdb, Prefix: "test:", ShardThreshold: 1024}
+	for _, valueKey := range []string{"1", "2", "3"} {
+		bm := roaring.New()
+		for i := 0; i < 10; i++ {
+			bm.Add(uint32(rnd.Int63n(100)))
+		}
+		require.NoError(t, writer.Set(indexKey, valueKey, bm))
+	}
+	// sharded
+	large := roaring.New()
+	for i := 0; i < 5000; i++ {
+		large.Add(uint32(rnd.Int63n(2 << shardBits)))
+	}
+	require.NoError(t, writer.Set(indexKey, "4", large))
+	require.NoError(t, rdb.HSet(context.Background(), "test:"+indexKey, "corrupt", "not a bitmap").Err())
+
+	valueKeys := []string{"3", "missing", "4", "1", "2", "1"}
+	for _, perKeyGets := range []bool{false, true} {
+		s := &RedisBmStore{RDB: rdb, Prefix: "test:", PerKeyGets: perKeyGets}
+		bms, err := s.MGet(indexKey, valueKeys)
+		require.NoError(t, err)
+		require.Len(t, bms, len(valueKeys))
+		for i, valueKey := range valueKeys {
+			bm, err := s.Get(indexKey, valueKey)
+			require.NoError(t, err)
+			assert.Equal(t, bm.ToArray(), bms[i].ToArray(), "perKeyGets=%v valueKey=%s", perKeyGets, valueKey)
+		}
+		assert.True(t, bms[1].IsEmpty())
+		assert.True(t, large.Equals(bms[2]))
+
+		_, err = s.MGet(indexKey, []string{"1", "corrupt"})
+		assert.ErrorIs(t, err, ErrCorruptBitmap)
+		s.CorruptAsEmpty = true
+		bms, err = s.MGet(indexKey, []string{"1", "corrupt"})
+		require.NoError(t, err)
+		assert.True(t, bms[1].IsEmpty())
+	}
+	bms, err := writer.MGet(indexKey, nil)
+	require.NoError(t, err)
+	assert.Empty(t, bms)
+}
+
+func TestPipelinedReadsDontAlias(t *testing.T) {
+	rdb := newTestClient(t)
+	bmStore := &RedisBmStore{RDB: rdb, Prefix: "test:"}
+	skbmStore := &RedisSortKeyBitmapStore{RDB: rdb, Prefix: "test:"}
+	const n = 100
+	expected := func(i int) *roaring.Bitmap {
+		bm := roaring.New()
+		bm.AddRange(uint64(i)*1000, uint64(i)*1000+uint64(i)+1)
+		return bm
+	}
+	skbms := make([]SortKeyBitmap, n)
+	for i := 0; i < n; i++ {
+		require.NoError(t, bmStore.Set("term:t:f", strconv.Itoa(i), expected(i)))
+		skbms[i] = SortKeyBitmap{SortKey: uint64(i), Bitmap: expected(i)}
+	}
+	require.NoError(t, skbmStore.MSet("sparse:t:f", skbms))
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 10; round++ {
+				cmds, err := rdb.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+					for i := 0; i < n; i++ {
+						pipe.HGet(context.Background(), "test:term:t:f", strconv.Itoa(i))
+					}
+					return nil
+				})
+				if !assert.NoError(t, err) {
+					return
+				}
+				bms := make([]*roaring.Bitmap, n)
+				for i, cmd := range cmds {
+					bm, err := parseBitmap(cmd.(*redis.StringCmd).Val())
+					if !assert.NoError(t, err) {
+						return
+					}
+					bms[i] = bm
+				}
+				// mutating one bitmap must not show up in another
+				for i, bm := range bms {
+					bm.Add(uint32(i)*1000 + 999)
+				}
+				for i, bm := range bms {
+					want := expected(i)
+					want.Add(uint32(i)*1000 + 999)
+					assert.True(t, want.Equals(bm), "bitmap %d", i)
+				}
+				// HMGET replies several bitmaps at once too
+				sorted, err := skbmStore.Scan("sparse:t:f", 0, n, false, n)
+				if !assert.NoError(t, err) || !assert.Len(t, sorted, n) {
+					return
+				}
+				for i, skbm := range sorted {
+					skbm.Bitmap.Add(uint32(i)*1000 + 999)
+				}
+				for i, skbm := range sorted {
+					want := expected(i)
+					want.Add(uint32(i)*1000 + 999)
+					assert.True(t, want.Equals(skbm.Bitmap), "bucket %d", i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// shortHMGet drops the last value of HMGET replies, as a misbehaving proxy could
+type shortHMGet struct{}
+
+func (shortHMGet) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (shortHMGet) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if cmd, ok := cmd.(*redis.SliceCmd); ok && cmd.Name() == "hmget" && len(cmd.Val()) > 0 {
+			cmd.SetVal(cmd.Val()[:len(cmd.Val())-1])
+		}
+		return err
+	}
+}
+
+func (shortHMGet) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestMismatchedHMGetReply(t *testing.T) {
+	rdb := newTestClient(t)
+	skbmStore := &RedisSortKeyBitmapStore{RDB: rdb, Prefix: "test:skbm:"}
+	fvStore := &RedisFvStore{RDB: rdb, Prefix: "test:fv:"}
+	require.NoError(t, skbmStore.MSet("sparse:orders:create_time", []SortKeyBitmap{
+		{SortKey: 100, Bitmap: roaring.BitmapOf(1)},
+		{SortKey: 200, Bitmap: roaring.BitmapOf(2)},
+	}))
+	require.NoError(t, fvStore.Set("sparse:orders:create_time", 1, 100))
+	require.NoError(t, fvStore.Set("sparse:orders:create_time", 2, 200))
+	rdb.AddHook(shortHMGet{})
+
+	_, err := skbmStore.Scan("sparse:orders:create_time", 0, 1000, false, 10)
+	assert.ErrorContains(t, err, "HMGet returned 1 values for 2 fields")
+	_, err = fvStore.MGet("sparse:orders:create_time", []uint32{1, 2})
+	assert.ErrorContains(t, err, "HMGet returned 1 values for 2 fields")
+
+	// per key reads don't use HMGET
+	skbmStore.PerKeyGets, fvStore.PerKeyGets = true, true
+	sortedBms, err := skbmStore.Scan("sparse:orders:create_time", 0, 1000, false, 10)
+	require.NoError(t, err)
+	require.Len(t, sortedBms, 2)
+	assert.Equal(t, []uint32{2}, sortedBms[1].Bitmap.ToArray())
+	fvs, found, err := fvStore.MGetFound("sparse:orders:create_time", []uint32{1, 3, 2})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{100, 0, 200}, fvs)
+	assert.Equal(t, []bool{true, false, true}, found)
+}
+
+func TestSortKeyHexRoundTripAndOrder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	keys := []uint64{0, 1, 0xf, 0x10, 0x7fffffffffffffff, 0x8000000000000000, 0x8000000000000001, math.MaxUint64 - 1, math.MaxUint64}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, rnd.Uint64())
+	}
+	for _, key := range keys {
+		parsed, err := hexToU64(u64ToHex(key))
+		require.NoError(t, err)
+		assert.Equal(t, key, parsed)
+	}
+	slices.Sort(keys)
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] != keys[i] {
+			assert.Less(t, u64ToHex(keys[i-1]), u64ToHex(keys[i]))
+		}
+	}
+	for _, s := range []string{"00000000000000FF", "ff", "0x00000000000000ff", "000000000000000g"} {
+		_, err := hexToU64(s)
+		assert.Error(t, err, s)
+	}
+}
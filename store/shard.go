@@ -0,0 +1,113 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/redis/go-redis/v9"
+)
+
+// shardMarker is stored in place of a bitmap sharded by RedisBmStore.ShardThreshold,
+// it can't be mistaken for a serialized bitmap, which starts with a roaring cookie
+const shardMarker = "sharded"
+
+// shardBits is log2 of the id range of a shard, a shard holds at most 2^20 ids, 128KiB serialized
+const shardBits = 20
+
+// shardsKey is the hash holding the shards of a sharded value, keyed by the id range of each shard
+func (s *RedisBmStore) shardsKey(indexKey string, valueKey string) string {
+	return s.Prefix + indexKey + KeySeparator + "shards" + KeySeparator + valueKey
+}
+
+func shardField(id uint32) string {
+	return strconv.FormatUint(uint64(id>>shardBits), 10)
+}
+
+// shouldShard reports whether bm is too large to be stored as a single value
+func (s *RedisBmStore) shouldShard(bm *roaring.Bitmap) bool {
+	return s.ShardThreshold > 0 && bm.GetSerializedSizeInBytes() > uint64(s.ShardThreshold)
+}
+
+// splitShards splits bm by id range, as "field, bitmap" pairs for HSET
+func splitShards(bm *roaring.Bitmap) ([]any, error) {
+	var args []any
+	for n := uint64(bm.Minimum() >> shardBits); n <= uint64(bm.Maximum()>>shardBits); n++ {
+		lo := n << shardBits
+		shard := roaring.New()
+		shard.AddRange(lo, lo+1<<shardBits)
+		shard.And(bm)
+		if shard.IsEmpty() {
+			continue
+		}
+		raw, err := shard.ToBytes()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, shardField(uint32(lo)), raw)
+	}
+	return args, nil
+}
+
+// getShards returns the union of the shards of a sharded value
+func (s *RedisBmStore) getShards(indexKey string, valueKey string) (*roaring.Bitmap, error) {
+	shardsKey := s.shardsKey(indexKey, valueKey)
+	shards, err := s.RDB.HGetAll(context.Background(), shardsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("HGETALL failed, shardsKey=%s, err: %w", shardsKey, err)
+	}
+	bms := make([]*roaring.Bitmap, 0, len(shards))
+	for field, value := range shards {
+		bm, err := parseBitmap(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse bitmap shard, shardsKey=%s, shard=%s, err: %w", shardsKey, field, err)
+		}
+		bms = append(bms, bm)
+	}
+	return roaring.FastOr(bms...), nil
+}
+
+// maxReshardAttempts bounds the retries of reshard when the value is updated concurrently
+const maxReshardAttempts = 10
+
+// reshard shards a value whose bitmap grew over ShardThreshold. It runs under WATCH of the value and its shards,
+// so a concurrent update of them fails the transaction to be retried rather than being lost.
+// Past maxReshardAttempts the value is left whole, the next update over the threshold shards it.
+func (s *RedisBmStore) reshard(indexKey string, valueKey string) error {
+	ctx := context.Background()
+	hashKey := s.Prefix + indexKey
+	shardsKey := s.shardsKey(indexKey, valueKey)
+	for attempt := 0; attempt < maxReshardAttempts; attempt++ {
+		err := s.RDB.Watch(ctx, func(tx *redis.Tx) error {
+			value, err := tx.HGet(ctx, hashKey, valueKey).Result()
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("HGET failed, hashKey=%s, valueKey=%s, err: %w", hashKey, valueKey, err)
+			}
+			if value == shardMarker {
+				return nil
+			}
+			bm, err := parseBitmap(value)
+			if err != nil {
+				return fmt.Errorf("Failed to parse bitmap, hashKey=%s, valueKey=%s, err: %w", hashKey, valueKey, err)
+			}
+			if !s.shouldShard(bm) {
+				return nil
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return s.setPipelined(pipe, indexKey, valueKey, bm)
+			})
+			return err
+		}, hashKey, shardsKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	slog.Warn("Gave up sharding a bitmap updated concurrently", "hashKey", hashKey, "valueKey", valueKey, "attempts", maxReshardAttempts)
+	return nil
+}
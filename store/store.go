@@ -0,0 +1,71 @@
+package store
+
+import (
+	"github.com/RoaringBitmap/roaring"
+)
+
+// KeySeparator joins the parts of keys, e.g. the kind, table and field of an index key or the suffix of a redis key.
+// The joined names must not contain it, see index.ValidateKeyName.
+const KeySeparator = ":"
+
+// BmStore stores the bitmaps of term indexes by index key and value key.
+// Empty bitmaps are never stored, reading a missing value key returns an empty bitmap.
+type BmStore interface {
+	Get(indexKey string, valueKey string) (*roaring.Bitmap, error)
+	MGet(indexKey string, valueKeys []string) ([]*roaring.Bitmap, error)
+	Contains(indexKey string, valueKey string, ids []uint32) ([]bool, error)
+	Exists(indexKey string, valueKey string) (bool, error)
+	GetRaw(indexKey string, valueKey string) ([]byte, error)
+	Len(indexKey string) (int64, error)
+	ScanValues(indexKey string, proc func(valueKey string, bm *roaring.Bitmap) bool) error
+	ScanSizes(indexKey string, proc func(valueKey string, sizes []uint64) bool) error
+	Drop(indexKey string) error
+	Set(indexKey string, valueKey string, bitmap *roaring.Bitmap) error
+	MSet(indexKey string, entries map[string]*roaring.Bitmap) error
+	AddBit(indexKey string, valueKey string, id uint32) error
+	RemoveBit(indexKey string, valueKey string, id uint32) error
+	// UpdateBits applies changes and sets the fields of sets at once, e.g. to record the kafka offset of the messages
+	// the changes come from. See BatchBmStore.
+	UpdateBits(changes []BitChanges, sets []HashFieldValue) error
+}
+
+// BitChanges are the ids added to and removed from the bitmap of a value key, an id is in at most one of them
+type BitChanges struct {
+	IndexKey string
+	ValueKey string
+	Added    *roaring.Bitmap
+	Removed  *roaring.Bitmap
+}
+
+// HashFieldValue is the value of a field of a redis hash, written by UpdateBits along with the bitmaps
+type HashFieldValue struct {
+	Key   string
+	Field string
+	Value string
+}
+
+// SortKeyBitmapStore stores the buckets of sparse indexes by index key and sort key.
+// Scan returns the buckets with sort keys from start to stop, both inclusive, at most limit of them unless limit is 0.
+// A reverse scan is descending, start is then the upper bound.
+type SortKeyBitmapStore interface {
+	Scan(indexKey string, start uint64, stop uint64, reverse bool, limit int) ([]SortKeyBitmap, error)
+	MSet(indexKey string, skbms []SortKeyBitmap) error
+}
+
+// FieldValueStore stores the field values of ids by index key
+type FieldValueStore interface {
+	MGet(indexKey string, ids []uint32) ([]uint64, error)
+	MGetFound(indexKey string, ids []uint32) ([]uint64, []bool, error)
+	Set(indexKey string, id uint32, value uint64) error
+	Remove(indexKey string, id uint32) error
+}
+
+var (
+	_ BmStore            = (*RedisBmStore)(nil)
+	_ BmStore            = (*MemBmStore)(nil)
+	_ BmStore            = (*BatchBmStore)(nil)
+	_ SortKeyBitmapStore = (*RedisSortKeyBitmapStore)(nil)
+	_ SortKeyBitmapStore = (*MemSortKeyBitmapStore)(nil)
+	_ FieldValueStore    = (*RedisFvStore)(nil)
+	_ FieldValueStore    = (*MemFvStore)(nil)
+)
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStores(t *testing.T) {
+	testBmStore(t, func(t *testing.T) BmStore {
+		return &RedisBmStore{RDB: newTestClient(t), Prefix: "test:bm:"}
+	})
+	testSortKeyBitmapStore(t, func(t *testing.T) SortKeyBitmapStore {
+		return &RedisSortKeyBitmapStore{RDB: newTestClient(t), Prefix: "test:skbm:"}
+	})
+	testFieldValueStore(t, func(t *testing.T) FieldValueStore {
+		return &RedisFvStore{RDB: newTestClient(t), Prefix: "test:fv:"}
+	})
+}
+
+func TestShardedRedisStores(t *testing.T) {
+	testBmStore(t, func(t *testing.T) BmStore {
+		return &RedisBmStore{RDB: newTestClient(t), Prefix: "test:bm:", ShardThreshold: 1}
+	})
+	testSortKeyBitmapStore(t, func(t *testing.T) SortKeyBitmapStore {
+		return &RedisSortKeyBitmapStore{RDB: newTestClient(t), Prefix: "test:skbm:", PerKeyGets: true}
+	})
+	testFieldValueStore(t, func(t *testing.T) FieldValueStore {
+		return &RedisFvStore{RDB: newTestClient(t), Prefix: "test:fv:", PerKeyGets: true}
+	})
+}
+
+func TestMemStores(t *testing.T) {
+	testBmStore(t, func(t *testing.T) BmStore { return NewMemBmStore() })
+	testSortKeyBitmapStore(t, func(t *testing.T) SortKeyBitmapStore { return NewMemSortKeyBitmapStore() })
+	testFieldValueStore(t, func(t *testing.T) FieldValueStore { return NewMemFvStore() })
+}
+
+// testBmStore checks the contract of BmStore on a store built by newStore
+func testBmStore(t *testing.T, newStore func(t *testing.T) BmStore) {
+	t.Run("BmStore", func(t *testing.T) {
+		s := newStore(t)
+		const indexKey = "term:orders:product_id"
+		bm, err := s.Get(indexKey, "1")
+		require.NoError(t, err)
+		assert.True(t, bm.IsEmpty())
+		raw, err := s.GetRaw(indexKey, "1")
+		require.NoError(t, err)
+		assert.Nil(t, raw)
+
+		require.NoError(t, s.Set(indexKey, "1", roaring.BitmapOf(1, 2, 3)))
+		require.NoError(t, s.AddBit(indexKey, "2", 4))
+		require.NoError(t, s.AddBit(indexKey, "2", 5))
+		require.NoError(t, s.AddBit(indexKey, "3", 6))
+		require.NoError(t, s.RemoveBit(indexKey, "3", 6))
+		require.NoError(t, s.RemoveBit(indexKey, "4", 7))
+
+		// returned bitmaps are copies
+		bm, err = s.Get(indexKey, "1")
+		require.NoError(t, err)
+		bm.Add(100)
+		bms, err := s.MGet(indexKey, []string{"2", "3", "1"})
+		require.NoError(t, err)
+		require.Len(t, bms, 3)
+		assert.Equal(t, []uint32{4, 5}, bms[0].ToArray())
+		assert.True(t, bms[2].Equals(roaring.BitmapOf(1, 2, 3)))
+		assert.True(t, bms[1].IsEmpty())
+		raw, err = s.GetRaw(indexKey, "1")
+		require.NoError(t, err)
+		assert.NotNil(t, raw)
+
+		// emptied bitmaps aren't stored
+		for valueKey, want := range map[string]bool{"1": true, "2": true, "3": false, "4": false} {
+			exists, err := s.Exists(indexKey, valueKey)
+			require.NoError(t, err)
+			assert.Equal(t, want, exists, "valueKey %s", valueKey)
+		}
+		n, err := s.Len(indexKey)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		contains, err := s.Contains(indexKey, "2", []uint32{5, 1, 4})
+		require.NoError(t, err)
+		assert.Equal(t, []bool{true, false, true}, contains)
+
+		scanned := make(map[string][]uint32)
+		require.NoError(t, s.ScanValues(indexKey, func(valueKey string, bm *roaring.Bitmap) bool {
+			scanned[valueKey] = bm.ToArray()
+			return true
+		}))
+		assert.Equal(t, map[string][]uint32{"1": {1, 2, 3}, "2": {4, 5}}, scanned)
+		sizes := make(map[string][]uint64)
+		require.NoError(t, s.ScanSizes(indexKey, func(valueKey string, stored []uint64) bool {
+			sizes[valueKey] = stored
+			return true
+		}))
+		assert.Equal(t, map[string][]uint64{"1": {roaring.BitmapOf(1, 2, 3).GetSerializedSizeInBytes()},
+			"2": {roaring.BitmapOf(4, 5).GetSerializedSizeInBytes()}}, sizes)
+
+		require.NoError(t, s.Set(indexKey, "2", roaring.New()))
+		exists, err := s.Exists(indexKey, "2")
+		require.NoError(t, err)
+		assert.False(t, exists)
+
+		// MSet writes many value keys at once, deleting the empty ones
+		require.NoError(t, s.MSet(indexKey, map[string]*roaring.Bitmap{"1": nil, "5": roaring.BitmapOf(8, 9), "6": roaring.New()}))
+		bms, err = s.MGet(indexKey, []string{"1", "5", "6"})
+		require.NoError(t, err)
+		assert.True(t, bms[0].IsEmpty())
+		assert.Equal(t, []uint32{8, 9}, bms[1].ToArray())
+		assert.True(t, bms[2].IsEmpty())
+		n, err = s.Len(indexKey)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+
+		// UpdateBits changes many bitmaps at once, deleting the emptied ones
+		require.NoError(t, s.UpdateBits([]BitChanges{
+			{IndexKey: indexKey, ValueKey: "5", Added: roaring.BitmapOf(10), Removed: roaring.BitmapOf(8, 9)},
+			{IndexKey: indexKey, ValueKey: "7", Added: roaring.BitmapOf(11), Removed: roaring.New()},
+			{IndexKey: indexKey, ValueKey: "8", Added: roaring.New(), Removed: roaring.BitmapOf(12)},
+		}, nil))
+		bms, err = s.MGet(indexKey, []string{"5", "7", "8"})
+		require.NoError(t, err)
+		assert.Equal(t, []uint32{10}, bms[0].ToArray())
+		assert.Equal(t, []uint32{11}, bms[1].ToArray())
+		assert.True(t, bms[2].IsEmpty())
+		require.NoError(t, s.UpdateBits([]BitChanges{{IndexKey: indexKey, ValueKey: "7", Added: roaring.New(), Removed: roaring.BitmapOf(11)}}, nil))
+		n, err = s.Len(indexKey)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		require.NoError(t, s.Drop(indexKey))
+		n, err = s.Len(indexKey)
+		require.NoError(t, err)
+		assert.Zero(t, n)
+	})
+}
+
+// testSortKeyBitmapStore checks the contract of SortKeyBitmapStore on a store built by newStore
+func testSortKeyBitmapStore(t *testing.T, newStore func(t *testing.T) SortKeyBitmapStore) {
+	t.Run("SortKeyBitmapStore", func(t *testing.T) {
+		s := newStore(t)
+		const indexKey = "sparse:orders:create_time"
+		// the keys differ in hex digit count, they're ordered numerically and not by their shortest spelling
+		sortKeys := []uint64{0, 9, 0x10, 0xff, 0x100, 1 << 40, math.MaxUint64}
+		skbms := make([]SortKeyBitmap, len(sortKeys))
+		for i, sortKey := range sortKeys {
+			skbms[i] = SortKeyBitmap{SortKey: sortKey, Bitmap: roaring.BitmapOf(uint32(i))}
+		}
+		// written out of order, with a bucket deleted in the same call
+		require.NoError(t, s.MSet(indexKey, append([]SortKeyBitmap{{SortKey: 5, Bitmap: nil}}, skbms[4:]...)))
+		require.NoError(t, s.MSet(indexKey, append(skbms[:4], SortKeyBitmap{SortKey: 0x100, Bitmap: roaring.New()})))
+		scan := func(start uint64, stop uint64, reverse bool, limit int) []uint64 {
+			sorted, err := s.Scan(indexKey, start, stop, reverse, limit)
+			require.NoError(t, err)
+			var keys []uint64
+			for _, skbm := range sorted {
+				assert.Equal(t, []uint32{uint32(slices.Index(sortKeys, skbm.SortKey))}, skbm.Bitmap.ToArray())
+				keys = append(keys, skbm.SortKey)
+			}
+			return keys
+		}
+		assert.Equal(t, []uint64{0, 9, 0x10, 0xff, 1 << 40, math.MaxUint64}, scan(0, math.MaxUint64, false, 100))
+		assert.Equal(t, []uint64{math.MaxUint64, 1 << 40, 0xff}, scan(math.MaxUint64, 0, true, 3))
+		// bounds are inclusive, a reverse scan starts from the upper one
+		assert.Equal(t, []uint64{9, 0x10, 0xff}, scan(9, 0xff, false, 100))
+		assert.Equal(t, []uint64{0xff, 0x10, 9}, scan(0xff, 9, true, 100))
+		assert.Empty(t, scan(9, 0xff, true, 100))
+		assert.Equal(t, []uint64{0x10}, scan(0x10, 0x10, true, 100))
+		assert.Empty(t, scan(0x11, 0xfe, false, 100))
+		assert.Empty(t, scan(0xff, 9, false, 100))
+
+		// returned bitmaps are copies
+		sorted, err := s.Scan(indexKey, 9, 9, false, 1)
+		require.NoError(t, err)
+		sorted[0].Bitmap.Add(100)
+		sorted, err = s.Scan(indexKey, 9, 9, false, 1)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), sorted[0].Bitmap.GetCardinality())
+	})
+}
+
+// testFieldValueStore checks the contract of FieldValueStore on a store built by newStore
+func testFieldValueStore(t *testing.T, newStore func(t *testing.T) FieldValueStore) {
+	t.Run("FieldValueStore", func(t *testing.T) {
+		s := newStore(t)
+		const indexKey = "sparse:orders:create_time"
+		require.NoError(t, s.Set(indexKey, 1, 100))
+		require.NoError(t, s.Set(indexKey, 2, math.MaxUint64))
+		require.NoError(t, s.Set(indexKey, 3, 0))
+		require.NoError(t, s.Set(indexKey, 1, 101))
+		require.NoError(t, s.Remove(indexKey, 3))
+		require.NoError(t, s.Remove(indexKey, 4))
+		require.NoError(t, s.Set("other", 4, 1))
+		values, found, err := s.MGetFound(indexKey, []uint32{2, 3, 1, 4})
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{math.MaxUint64, 0, 101, 0}, values)
+		assert.Equal(t, []bool{true, false, true, false}, found)
+		values, err = s.MGet(indexKey, []uint32{1})
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{101}, values)
+	})
+}
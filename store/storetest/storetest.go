@@ -0,0 +1,18 @@
+// Package storetest provides the stores tests index into
+package storetest
+
+import (
+	"testing"
+
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// NewRedis returns the stores of an empty in-process redis, stopped at the end of t
+func NewRedis(t testing.TB) (*store.RedisBmStore, *store.RedisSortKeyBitmapStore, *store.RedisFvStore) {
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	return &store.RedisBmStore{RDB: rdb, Prefix: "test:bm:"},
+		&store.RedisSortKeyBitmapStore{RDB: rdb, Prefix: "test:skbm:"},
+		&store.RedisFvStore{RDB: rdb, Prefix: "test:fv:"}
+}
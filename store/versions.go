@@ -0,0 +1,109 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrVersionNotBuilt is returned when activating an index version that wasn't recorded as built
+var ErrVersionNotBuilt = errors.New("index version not built")
+
+// IndexVersions keeps the index version served for each field, shared by all instances of a namespace.
+// Readers of a field without a stored version serve version 1.
+type IndexVersions struct {
+	RDB *redis.Client
+	Key string
+}
+
+// Get returns the served version of every field with a stored version
+func (v *IndexVersions) Get() (map[string]int, error) {
+	values, err := v.RDB.HGetAll(context.Background(), v.Key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("HGETALL failed, key=%s, err: %w", v.Key, err)
+	}
+	versions := make(map[string]int, len(values))
+	for field, value := range values {
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse version, key=%s, field=%s, value=%s, err: %w", v.Key, field, value, err)
+		}
+		versions[field] = version
+	}
+	return versions, nil
+}
+
+// Activate makes readers serve version of field, it's a single write so every reader flips at its next refresh.
+// A version other than 1, which is written from the start, must have been recorded as built, see MarkBuilt:
+// readers would serve empty results from a version never built.
+func (v *IndexVersions) Activate(field string, version int) error {
+	if version != 1 {
+		built, err := v.Built(field, version)
+		if err != nil {
+			return err
+		}
+		if !built {
+			return fmt.Errorf("%w, field=%s, version=%d", ErrVersionNotBuilt, field, version)
+		}
+	}
+	if err := v.RDB.HSet(context.Background(), v.Key, field, version).Err(); err != nil {
+		return fmt.Errorf("HSET failed, key=%s, field=%s, version=%d, err: %w", v.Key, field, version, err)
+	}
+	return nil
+}
+
+// MarkBuilt records that every row is indexed in version of field, so it can be activated
+func (v *IndexVersions) MarkBuilt(field string, version int) error {
+	if err := v.RDB.SAdd(context.Background(), v.builtKey(), builtMember(field, version)).Err(); err != nil {
+		return fmt.Errorf("SADD failed, key=%s, field=%s, version=%d, err: %w", v.builtKey(), field, version, err)
+	}
+	return nil
+}
+
+// Built reports whether version of field was recorded as built
+func (v *IndexVersions) Built(field string, version int) (bool, error) {
+	built, err := v.RDB.SIsMember(context.Background(), v.builtKey(), builtMember(field, version)).Result()
+	if err != nil {
+		return false, fmt.Errorf("SISMEMBER failed, key=%s, field=%s, version=%d, err: %w", v.builtKey(), field, version, err)
+	}
+	return built, nil
+}
+
+// builtKey is the set of the built versions, as field:vN members
+func (v *IndexVersions) builtKey() string {
+	return v.Key + KeySeparator + "built"
+}
+
+func builtMember(field string, version int) string {
+	return fmt.Sprintf("%s%sv%d", field, KeySeparator, version)
+}
+
+// BackfilledFields records the field indexes whose backfill completed, shared by all instances of a namespace
+type BackfilledFields struct {
+	RDB *redis.Client
+	Key string
+}
+
+// Get returns the set of backfilled fields
+func (f *BackfilledFields) Get() (map[string]bool, error) {
+	members, err := f.RDB.SMembers(context.Background(), f.Key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("SMEMBERS failed, key=%s, err: %w", f.Key, err)
+	}
+	fields := make(map[string]bool, len(members))
+	for _, field := range members {
+		fields[field] = true
+	}
+	return fields, nil
+}
+
+// Add records the backfill of field as complete
+func (f *BackfilledFields) Add(field string) error {
+	if err := f.RDB.SAdd(context.Background(), f.Key, field).Err(); err != nil {
+		return fmt.Errorf("SADD failed, key=%s, field=%s, err: %w", f.Key, field, err)
+	}
+	return nil
+}
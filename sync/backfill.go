@@ -0,0 +1,405 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/metrics"
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultBackfillBatchSize is the number of rows a backfill reads per query
+const DefaultBackfillBatchSize = 10000
+
+// DefaultBackfillProgressInterval is the delay between the progress logs of a backfill
+const DefaultBackfillProgressInterval = 10 * time.Second
+
+type BackfillConfig struct {
+	// Schema maps the indexed fields onto the source table, defaults to index.OrdersSchema
+	Schema index.TableSchema
+	// DerivedFields, SortFields and ProviderIDRange are the indexes maintained besides the term and create_time ones,
+	// they should match the Config of the consumer taking over
+	DerivedFields   []index.DerivedField
+	SortFields      []string
+	ProviderIDRange bool
+	// BatchSize is the number of rows read per query, defaults to DefaultBackfillBatchSize.
+	// Only a batch is held in memory, so it bounds the memory used whatever the size of the table.
+	BatchSize int
+	// ProgressInterval is the delay between progress logs, defaults to DefaultBackfillProgressInterval
+	ProgressInterval time.Duration
+	// CompactMinBucketSize is the bucket cardinality below which the final compaction merges buckets,
+	// defaults to a quarter of DefaultSplitThreshold
+	CompactMinBucketSize int
+	// SplitThreshold is the bucket cardinality at which create_time and provider_id range buckets split, defaults to
+	// DefaultSplitThreshold like the consumer. A smaller one makes small indexes split, e.g. in tests.
+	SplitThreshold int
+}
+
+// BackfillStats sums up a backfill
+type BackfillStats struct {
+	Rows    int
+	Batches int
+	// LastID is the primary key of the last row of the last page indexed, a backfill interrupted by an error
+	// can be resumed after it
+	LastID  uint32
+	Compact CompactStats
+}
+
+// readRows reads up to limit rows whose primary key is greater than afterID, ordered by primary key
+type readRows func(ctx context.Context, afterID uint32, limit int) ([]Order, error)
+
+// Backfill indexes every row of the table mapped by config.Schema, e.g. to build the index of a topic whose
+// retention no longer covers the table. Rows are read in batches of config.BatchSize by keyset pagination on the
+// primary key, so each query is an index range scan whatever the offset. It writes like inserts of the consumer,
+// into an empty index before the consumer starts: changes made meanwhile are caught up by consuming from the
+// offsets at the start of the backfill.
+// Buckets of create_time split at the split threshold on each row whatever the batch size; the undersized
+// buckets splits leave behind are merged by a compaction once all rows are indexed.
+func Backfill(ctx context.Context, db *sql.DB, bmStore *store.RedisBmStore, sortedBmStore *store.RedisSortKeyBitmapStore, fvStore *store.RedisFvStore, config BackfillConfig) (BackfillStats, error) {
+	consumer, err := config.newConsumer(bmStore, sortedBmStore, fvStore)
+	if err != nil {
+		return BackfillStats{}, err
+	}
+	return backfill(ctx, consumer, dbRowReader(db, consumer.Schema), config.BatchSize, config.ProgressInterval)
+}
+
+// newConsumer returns a consumer writing the indexes configured like the one of a Consumer
+func (config BackfillConfig) newConsumer(bmStore store.BmStore, sortedBmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore) (*saramaConsumer, error) {
+	schema := config.Schema
+	if schema.Table == "" {
+		schema = index.OrdersSchema
+	}
+	consumer, err := newSaramaConsumer(schema, bmStore, sortedBmStore, fvStore)
+	if err != nil {
+		return nil, err
+	}
+	if config.SplitThreshold != 0 {
+		consumer.CreateTimeIndexWriter, err = NewSparseU64IndexWriter(schema.Table, "create_time", config.SplitThreshold)
+		if err != nil {
+			return nil, err
+		}
+	}
+	consumer.DerivedIndexWriters = NewDerivedIndexWriters(schema.Table, config.DerivedFields)
+	consumer.SortValueWriters = NewSortValueWriters(schema.Table, config.SortFields)
+	if config.ProviderIDRange {
+		splitThreshold := config.SplitThreshold
+		if splitThreshold == 0 {
+			splitThreshold = DefaultSplitThreshold
+		}
+		if consumer.ProviderIdRangeWriter, err = NewProviderIdRangeWriter(schema.Table, splitThreshold); err != nil {
+			return nil, err
+		}
+	}
+	consumer.CompactMinBucketSize = config.CompactMinBucketSize
+	if consumer.CompactMinBucketSize <= 0 {
+		consumer.CompactMinBucketSize = DefaultSplitThreshold / 4
+	}
+	return consumer, nil
+}
+
+// Insert indexes orders like inserts of the consumer configured by config, e.g. to build the index of tests
+func (config BackfillConfig) Insert(bmStore store.BmStore, sortedBmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, orders ...Order) error {
+	consumer, err := config.newConsumer(bmStore, sortedBmStore, fvStore)
+	if err != nil {
+		return err
+	}
+	return consumer.insertPage(orders)
+}
+
+func backfill(ctx context.Context, consumer *saramaConsumer, read readRows, batchSize int, progressInterval time.Duration) (BackfillStats, error) {
+	logger := slog.With("table", consumer.Schema.Table)
+	stats, err := backfillRows(ctx, logger, read, consumer.insertPage, batchSize, progressInterval)
+	if err != nil {
+		return stats, err
+	}
+	compactStats, err := consumer.CreateTimeIndexWriter.Compact(consumer.SortedBmStore, consumer.FvStore, consumer.CompactMinBucketSize)
+	stats.Compact = compactStats
+	if err != nil {
+		return stats, err
+	}
+	logger.Info("Backfill done", "rows", stats.Rows, "batches", stats.Batches, "merges", compactStats.Merges)
+	return stats, nil
+}
+
+// FieldIndex is the index of a single optional field: a derived field, the sort values of a field,
+// the provider_id range or the next version of a term index
+type FieldIndex struct {
+	// Field names the field like queries do, see query.OrdersSearchService.SetBackfilling
+	Field string
+	// Version is the version of the term index of Field being built, 0 for the other indexes
+	Version int
+	// term is the term field the index is computed from besides create_time, empty for derived fields
+	term string
+	add  func(consumer *saramaConsumer, order Order) error
+}
+
+// FieldIndexes returns the optional field indexes maintained with config, each can be backfilled on its own
+func (config BackfillConfig) FieldIndexes() []FieldIndex {
+	var fields []FieldIndex
+	for i, field := range config.DerivedFields {
+		i := i
+		fields = append(fields, FieldIndex{Field: field.Name, add: func(consumer *saramaConsumer, order Order) error {
+			return consumer.DerivedIndexWriters[i].Add(consumer.BmStore, order.CreateTime, order.ID)
+		}})
+	}
+	for i, field := range config.SortFields {
+		i := i
+		fields = append(fields, FieldIndex{Field: field, term: field, add: func(consumer *saramaConsumer, order Order) error {
+			return consumer.SortValueWriters[i].Set(consumer.FvStore, order)
+		}})
+	}
+	if config.ProviderIDRange {
+		fields = append(fields, FieldIndex{Field: index.ProviderIDRangeField, term: "provider_id", add: func(consumer *saramaConsumer, order Order) error {
+			return consumer.moveProviderRange(nil, order.ProviderID, order.ID)
+		}})
+	}
+	return fields
+}
+
+// FieldIndexes returns the optional field indexes the consumer maintains, see BackfillConfig.FieldIndexes
+func (c *Consumer) FieldIndexes() []FieldIndex {
+	return BackfillConfig{DerivedFields: c.derivedFields, SortFields: c.sortFields, ProviderIDRange: c.providerIDRange}.FieldIndexes()
+}
+
+// NextVersionIndexes returns the next versions of the term indexes the consumer builds, see Config.NextIndexVersions.
+// Backfilling one writes that version alone, the current one already holds every row.
+func (c *Consumer) NextVersionIndexes() []FieldIndex {
+	return nextVersionIndexes(c.nextIndexVersions)
+}
+
+func nextVersionIndexes(versions map[string]int) []FieldIndex {
+	fields := make([]string, 0, len(versions))
+	for field := range versions {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	indexes := make([]FieldIndex, len(fields))
+	for i, field := range fields {
+		field := field
+		indexes[i] = FieldIndex{Field: field, Version: versions[field], term: field, add: func(consumer *saramaConsumer, order Order) error {
+			indexKey, valueKey := consumer.nextTermKeys(field, order)
+			return consumer.BmStore.AddBit(indexKey, valueKey, order.ID)
+		}}
+	}
+	return indexes
+}
+
+// BackfillField indexes every row of the table into the index of field alone, e.g. a field configured on an index
+// already built. The other indexes aren't written, so they keep serving live traffic meanwhile.
+// Queries on field are to be gated until it returns, see query.OrdersSearchService.SetBackfilling.
+// Rows are read here, but each page is indexed by a claim of the consumer between two of its messages,
+// see Consumer.runInClaim and saramaConsumer.indexField.
+// With several partitions the claims of the others keep consuming meanwhile: a row they change between the check
+// of its page and its write keeps the value read in field, until it changes again.
+func (c *Consumer) BackfillField(ctx context.Context, db *sql.DB, field FieldIndex, batchSize int) (BackfillStats, error) {
+	return backfillField(ctx, c.schema.Table, dbRowReader(db, c.schema), field, func(page []Order) error {
+		return c.runInClaim(ctx, func(consumer *saramaConsumer) error { return consumer.indexField(field, page) })
+	}, batchSize, 0)
+}
+
+func backfillField(ctx context.Context, table string, read readRows, field FieldIndex, apply func(page []Order) error, batchSize int, progressInterval time.Duration) (BackfillStats, error) {
+	logger := slog.With("table", table, "field", field.Field)
+	stats, err := backfillRows(ctx, logger, read, apply, batchSize, progressInterval)
+	if err != nil {
+		return stats, err
+	}
+	logger.Info("Backfill done", "rows", stats.Rows, "batches", stats.Batches)
+	return stats, nil
+}
+
+// indexField indexes the orders of page into field, skipping the ones the index doesn't hold at the create_time
+// and term value field is computed from: they were inserted, changed or deleted since they were read,
+// and the consumer writes field along with that change, whether it applied it already or not yet.
+func (consumer *saramaConsumer) indexField(field FieldIndex, page []Order) error {
+	current, err := consumer.current(page, field.term)
+	if err != nil {
+		return err
+	}
+	for i, order := range page {
+		if !current[i] {
+			metrics.BackfillSkippedRows.Add(1)
+			continue
+		}
+		if err := field.add(consumer, order); err != nil {
+			return fmt.Errorf("Backfill failed, id=%d, err: %w", order.ID, err)
+		}
+	}
+	return nil
+}
+
+// current reports whether the index holds each order at its create_time, and at its value of term unless it's empty
+func (consumer *saramaConsumer) current(orders []Order, term string) ([]bool, error) {
+	ids := make([]uint32, len(orders))
+	for i, order := range orders {
+		ids[i] = order.ID
+	}
+	createTimes, found, err := consumer.FvStore.MGetFound(consumer.CreateTimeIndexWriter.Index.MakeIndexKey(), ids)
+	if err != nil {
+		return nil, err
+	}
+	current := make([]bool, len(orders))
+	// positions of the orders to check in the term index, by value key
+	byValue := make(map[string][]int)
+	var indexKey string
+	for i, order := range orders {
+		if !found[i] || createTimes[i] != order.CreateTime {
+			continue
+		}
+		if term == "" {
+			current[i] = true
+			continue
+		}
+		var valueKey string
+		indexKey, valueKey = consumer.termKeys(term, order)
+		byValue[valueKey] = append(byValue[valueKey], i)
+	}
+	for valueKey, positions := range byValue {
+		ids := make([]uint32, len(positions))
+		for j, i := range positions {
+			ids[j] = orders[i].ID
+		}
+		contains, err := consumer.BmStore.Contains(indexKey, valueKey, ids)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range positions {
+			current[i] = contains[j]
+		}
+	}
+	return current, nil
+}
+
+// termKeys returns the index key and the value key of order in the index of the term field, one of sortValues
+func (consumer *saramaConsumer) termKeys(field string, order Order) (string, string) {
+	switch field {
+	case "order_status":
+		return consumer.OrderStatusIndexWriter.Index.GetIndexKey(), consumer.OrderStatusIndexWriter.Index.MakeValueKey(order.OrderStatus)
+	case "product_id":
+		return consumer.ProductIdIndexWriter.Index.GetIndexKey(), consumer.ProductIdIndexWriter.Index.MakeValueKey(order.ProductID)
+	}
+	return consumer.ProviderIdIndexWriter.Index.GetIndexKey(), consumer.ProviderIdIndexWriter.Index.MakeValueKey(order.ProviderID)
+}
+
+// nextTermKeys is termKeys in the version of the term index being built, see TermIndexWriter.BuildVersion
+func (consumer *saramaConsumer) nextTermKeys(field string, order Order) (string, string) {
+	switch field {
+	case "order_status":
+		return consumer.OrderStatusIndexWriter.Next.GetIndexKey(), consumer.OrderStatusIndexWriter.Next.MakeValueKey(order.OrderStatus)
+	case "product_id":
+		return consumer.ProductIdIndexWriter.Next.GetIndexKey(), consumer.ProductIdIndexWriter.Next.MakeValueKey(order.ProductID)
+	}
+	return consumer.ProviderIdIndexWriter.Next.GetIndexKey(), consumer.ProviderIdIndexWriter.Next.MakeValueKey(order.ProviderID)
+}
+
+// insertPage indexes orders like inserts, their term bitmaps are written at once, see store.BatchBmStore
+func (consumer *saramaConsumer) insertPage(orders []Order) error {
+	batch := store.NewBatchBmStore(consumer.BmStore)
+	batched := consumer.withBmStore(batch)
+	for _, order := range orders {
+		if err := batched.onInsert(order); err != nil {
+			return fmt.Errorf("Backfill failed, id=%d, err: %w", order.ID, err)
+		}
+	}
+	return batch.Commit(nil)
+}
+
+// backfillRows applies every page of batchSize rows read
+func backfillRows(ctx context.Context, logger *slog.Logger, read readRows, apply func([]Order) error, batchSize int, progressInterval time.Duration) (BackfillStats, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBackfillBatchSize
+	}
+	if progressInterval <= 0 {
+		progressInterval = DefaultBackfillProgressInterval
+	}
+	var stats BackfillStats
+	start := time.Now()
+	lastLog := start
+	for {
+		orders, err := read(ctx, stats.LastID, batchSize)
+		if err != nil {
+			return stats, err
+		}
+		if err := apply(orders); err != nil {
+			return stats, err
+		}
+		if len(orders) > 0 {
+			stats.LastID = orders[len(orders)-1].ID
+		}
+		stats.Rows += len(orders)
+		stats.Batches++
+		if time.Since(lastLog) >= progressInterval {
+			logger.Info("Backfill progress", "rows", stats.Rows, "lastId", stats.LastID,
+				"rowsPerSecond", int(float64(stats.Rows)/time.Since(start).Seconds()))
+			lastLog = time.Now()
+		}
+		if len(orders) < batchSize {
+			return stats, nil
+		}
+	}
+}
+
+// dbRowReader reads the rows of the table mapped by schema, create_time is a timestamp column
+func dbRowReader(db *sql.DB, schema index.TableSchema) readRows {
+	columns := []string{schema.PrimaryKey, schema.Column("order_status"), schema.Column("product_id"),
+		schema.Column("provider_id"), schema.Column("create_time")}
+	if schema.SoftDeleteColumn != "" {
+		columns = append(columns, schema.SoftDeleteColumn)
+	}
+	if schema.TextColumn != "" {
+		columns = append(columns, schema.TextColumn)
+	}
+	for _, field := range schema.Fields {
+		columns = append(columns, schema.Column(field.Name))
+	}
+	for i, column := range columns {
+		columns[i] = pgx.Identifier{column}.Sanitize()
+	}
+	primaryKey := pgx.Identifier{schema.PrimaryKey}.Sanitize()
+	selectRows := fmt.Sprintf("SELECT %s FROM %s WHERE %s > $1 ORDER BY %s LIMIT $2",
+		strings.Join(columns, ", "), pgx.Identifier{schema.Table}.Sanitize(), primaryKey, primaryKey)
+	return func(ctx context.Context, afterID uint32, limit int) ([]Order, error) {
+		rows, err := db.QueryContext(ctx, selectRows, afterID, limit)
+		if err != nil {
+			return nil, fmt.Errorf("Query rows failed, afterID=%d, err: %w", afterID, err)
+		}
+		defer rows.Close()
+		orders := make([]Order, 0, limit)
+		for rows.Next() {
+			var order Order
+			var createTime time.Time
+			dest := []any{&order.ID, &order.OrderStatus, &order.ProductID, &order.ProviderID, &createTime}
+			if schema.SoftDeleteColumn != "" {
+				dest = append(dest, &order.Deleted)
+			}
+			if schema.TextColumn != "" {
+				dest = append(dest, &order.Text)
+			}
+			values := make([]*int64, len(schema.Fields))
+			for i := range values {
+				dest = append(dest, &values[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return nil, fmt.Errorf("Scan row failed, afterID=%d, err: %w", afterID, err)
+			}
+			if len(values) != 0 {
+				order.Fields = make(map[string]*int64, len(values))
+				for i, field := range schema.Fields {
+					order.Fields[field.Name] = values[i]
+				}
+			}
+			if createTime.Before(time.UnixMicro(0)) {
+				return nil, fmt.Errorf("Invalid create_time, id=%d, create_time=%v", order.ID, createTime)
+			}
+			order.CreateTime = uint64(createTime.UnixMicro())
+			orders = append(orders, order)
+		}
+		return orders, rows.Err()
+	}
+}
@@ -0,0 +1,26 @@
+package sync
+
+import (
+	"github.com/KKKIIO/inv-index-demo/store"
+)
+
+// withBmStore returns a copy of consumer writing the term bitmaps into bmStore, e.g. the batch of a claim.
+// The writers are shared, they take the store on each call.
+func (consumer *saramaConsumer) withBmStore(bmStore store.BmStore) *saramaConsumer {
+	c := *consumer
+	c.BmStore = bmStore
+	return &c
+}
+
+// commitBatch writes the term bitmaps buffered by batch and the last offset applied from the partition in one script,
+// so a redelivered message either has its term bitmap changes written and is skipped, or is applied again.
+// offset is not recorded if it's negative.
+// Only the term bitmaps are batched: the sparse and the field value indexes, and the dead letters, are written as each
+// message is applied, outside of the batch. A failed batch leaves them ahead of the term bitmaps until its messages
+// are redelivered, applying them again rewrites those to the same values.
+func (consumer *saramaConsumer) commitBatch(batch *store.BatchBmStore, topic string, partition int32, offset int64) error {
+	if consumer.AppliedOffsets == nil || offset < 0 {
+		return batch.Commit(nil)
+	}
+	return batch.Commit([]store.HashFieldValue{consumer.AppliedOffsets.FieldValue(topic, partition, offset)})
+}
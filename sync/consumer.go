@@ -3,13 +3,19 @@ package sync
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"math/rand"
+	"slices"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/metrics"
 	"github.com/KKKIIO/inv-index-demo/store"
 	"github.com/RoaringBitmap/roaring"
 )
@@ -18,81 +24,503 @@ type Config struct {
 	Brokers       []string
 	Topic         string
 	ConsumerGroup string
+	// DeadLetterSink receives messages that can't be applied to the index, defaults to LogDeadLetterSink
+	DeadLetterSink DeadLetterSink
+	// RetryBackoff is the delay between failed consume sessions and between connection attempts,
+	// defaults to DefaultBackoff
+	RetryBackoff Backoff
+	// ConnectTimeout is how long NewConsumer retries to reach the brokers, e.g. while Kafka starts along with the service.
+	// 0 fails on the first error.
+	ConnectTimeout time.Duration
+	// MaxConsecutiveFailures stops the consumer and reports on Fatal after that many failed sessions in a row,
+	// 0 retries forever
+	MaxConsecutiveFailures int
+	// Schema maps the indexed fields onto the source table, defaults to index.OrdersSchema
+	Schema index.TableSchema
+	// DerivedFields are the term fields computed from create_time to maintain, see index.DerivedField
+	DerivedFields []index.DerivedField
+	// SortFields are the term fields whose values are stored by id, so queries can order create_time ties by them,
+	// see index.SortableFields
+	SortFields []string
+	// CompactInterval is the mean delay between compactions of the create_time index, 0 disables them.
+	// Each delay is jittered so instances started together don't compact at once.
+	CompactInterval time.Duration
+	// CompactMinBucketSize is the bucket cardinality below which compaction merges buckets,
+	// defaults to a quarter of DefaultSplitThreshold
+	CompactMinBucketSize int
+	// IndexVersions are the versions of the term indexes written by field, fields not listed write version 1
+	IndexVersions map[string]int
+	// NextIndexVersions are the versions of term indexes built along with IndexVersions during a migration
+	NextIndexVersions map[string]int
+	// LookupIncompleteDeletes reads the indexed values of deleted or updated orders whose before image misses columns,
+	// e.g. only has the primary key without REPLICA IDENTITY FULL. Otherwise such deletes and updates are dead-lettered.
+	// The lookup reads every bitmap of the term fields.
+	LookupIncompleteDeletes bool
+	// ProviderIDRange maintains a sparse index of the non-null provider_id values, so queries can filter on ranges of it
+	ProviderIDRange bool
+	// TimeUnit is the unit of the create_time values emitted by the connector, they're indexed as microseconds.
+	// Defaults to index.TimeUnitMicros.
+	TimeUnit index.TimeUnit
+	// StartOffset replays the topic from the given offsets by partition, AllPartitions keys the offset of the others.
+	// The offsets of the consumer group are reset to them before consuming, and the applied offsets moved back before them.
+	// It's meant for debugging and needs ResetOffsets, other members of the group must be stopped.
+	StartOffset  map[int32]int64
+	ResetOffsets bool
+	// BatchSize is the number of messages of a partition whose term bitmaps are written at once, along with their
+	// applied offset. A batch is written before that once no message is waiting. Defaults to DefaultBatchSize.
+	// The sparse and field value indexes aren't batched, they're written as each message is applied.
+	BatchSize int
+}
+
+// DefaultBatchSize is the default Config.BatchSize
+const DefaultBatchSize = 100
+
+// Backoff is an exponential backoff with full jitter, so retries of many clients don't hit a recovering broker at once
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+var DefaultBackoff = Backoff{Initial: time.Second, Max: 30 * time.Second}
+
+// Delay returns a random delay before the given retry, attempt starts at 1
+func (b Backoff) Delay(attempt int) time.Duration {
+	ceil := b.Initial
+	for i := 1; i < attempt && ceil < b.Max; i++ {
+		ceil *= 2
+	}
+	ceil = min(ceil, b.Max)
+	if ceil <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceil)) + 1)
+}
+
+// retryConnect calls connect until it succeeds or maxWait has passed since the first attempt,
+// waiting a delay of backoff between attempts. It returns the last error.
+func retryConnect[T any](maxWait time.Duration, backoff Backoff, connect func() (T, error)) (T, error) {
+	deadline := time.Now().Add(maxWait)
+	for attempt := 1; ; attempt++ {
+		client, err := connect()
+		if err == nil {
+			return client, nil
+		}
+		delay := backoff.Delay(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return client, err
+		}
+		slog.Warn("Failed to connect to brokers, retrying", "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+	}
 }
 
 type Consumer struct {
-	client sarama.ConsumerGroup
-	topic  string
+	client                  sarama.ConsumerGroup
+	topic                   string
+	resplits                chan uint64
+	tasks                   chan claimTask
+	deadLetterSink          DeadLetterSink
+	retryBackoff            Backoff
+	maxConsecutiveFailures  int
+	schema                  index.TableSchema
+	derivedFields           []index.DerivedField
+	sortFields              []string
+	compactInterval         time.Duration
+	compactMinBucketSize    int
+	batchSize               int
+	compactions             chan struct{}
+	indexVersions           map[string]int
+	nextIndexVersions       map[string]int
+	lookupIncompleteDeletes bool
+	providerIDRange         bool
+	timeUnit                index.TimeUnit
+	startOffset             map[int32]int64
+	fatal                   chan error
+	done                    chan struct{}
+	ready                   atomic.Bool
+	offsets                 offsetTracker
 }
 
 func NewConsumer(config Config) (*Consumer, error) {
+	if len(config.StartOffset) > 0 && !config.ResetOffsets {
+		return nil, errors.New("StartOffset rewrites the offsets of the consumer group, it needs ResetOffsets")
+	}
+	deadLetterSink := config.DeadLetterSink
+	if deadLetterSink == nil {
+		deadLetterSink = LogDeadLetterSink{}
+	}
+	retryBackoff := config.RetryBackoff
+	if retryBackoff == (Backoff{}) {
+		retryBackoff = DefaultBackoff
+	}
+	schema := config.Schema
+	if schema.Table == "" {
+		schema = index.OrdersSchema
+	}
+	if err := index.ValidateKeyName(schema.Table); err != nil {
+		return nil, err
+	}
+	if schema.UniverseField != "" && !slices.Contains(index.UniverseFields, schema.UniverseField) {
+		return nil, fmt.Errorf("Field %s can't stand for __all", schema.UniverseField)
+	}
+	for _, field := range config.SortFields {
+		if _, ok := sortValues[field]; !ok {
+			return nil, fmt.Errorf("Field %s can't be sorted by", field)
+		}
+	}
+	for _, versions := range []map[string]int{config.IndexVersions, config.NextIndexVersions} {
+		for field := range versions {
+			if !versionedFields[field] {
+				return nil, fmt.Errorf("Field %s has no versioned index", field)
+			}
+		}
+	}
+	timeUnit, err := index.ParseTimeUnit(string(config.TimeUnit))
+	if err != nil {
+		return nil, err
+	}
 	kafkaConfig := sarama.NewConfig()
 	kafkaConfig.ClientID = "inv-index-demo-sync"
 	kafkaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
-	client, err := sarama.NewConsumerGroup(config.Brokers, config.ConsumerGroup, kafkaConfig)
+	client, err := retryConnect(config.ConnectTimeout, retryBackoff, func() (sarama.ConsumerGroup, error) {
+		return sarama.NewConsumerGroup(config.Brokers, config.ConsumerGroup, kafkaConfig)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("Error creating consumer group client: %w", err)
 	}
+	var startOffset map[int32]int64
+	if len(config.StartOffset) > 0 {
+		if startOffset, err = resetOffsets(config.Brokers, config.ConsumerGroup, config.Topic, config.StartOffset, kafkaConfig); err != nil {
+			return nil, errors.Join(err, client.Close())
+		}
+	}
+	compactMinBucketSize := config.CompactMinBucketSize
+	if compactMinBucketSize <= 0 {
+		compactMinBucketSize = DefaultSplitThreshold / 4
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
 	return &Consumer{
-		client: client,
-		topic:  config.Topic,
+		client:                  client,
+		topic:                   config.Topic,
+		resplits:                make(chan uint64, 16),
+		tasks:                   make(chan claimTask),
+		deadLetterSink:          deadLetterSink,
+		retryBackoff:            retryBackoff,
+		maxConsecutiveFailures:  config.MaxConsecutiveFailures,
+		schema:                  schema,
+		derivedFields:           config.DerivedFields,
+		sortFields:              config.SortFields,
+		compactInterval:         config.CompactInterval,
+		compactMinBucketSize:    compactMinBucketSize,
+		batchSize:               batchSize,
+		compactions:             make(chan struct{}, 1),
+		indexVersions:           config.IndexVersions,
+		nextIndexVersions:       config.NextIndexVersions,
+		lookupIncompleteDeletes: config.LookupIncompleteDeletes,
+		providerIDRange:         config.ProviderIDRange,
+		timeUnit:                timeUnit,
+		startOffset:             startOffset,
+		fatal:                   make(chan error, 1),
+		done:                    make(chan struct{}),
 	}, nil
 }
 
-func (c *Consumer) Start(bmStore *store.RedisBmStore, sortedBmStore *store.RedisSortKeyBitmapStore, fvStore *store.RedisFvStore) {
-	saramaConsumer := &saramaConsumer{
-		BmStore:                bmStore,
-		SortedBmStore:          sortedBmStore,
-		FvStore:                fvStore,
-		AllIndexWriter:         NewTermIndexWriter[int64]("orders", "__all"),
-		OrderStatusIndexWriter: NewTermIndexWriter[int64]("orders", "order_status"),
-		ProductIdIndexWriter:   NewTermIndexWriter[int64]("orders", "product_id"),
-		ProviderIdIndexWriter:  NewTermIndexWriter[*int64]("orders", "provider_id"),
-		CreateTimeIndexWriter: &SparseU64IndexWriter{
-			Index:          index.SparseIndex{TableName: "orders", FieldName: "create_time"},
-			SplitThreshold: 1000,
-		},
+// Start consumes into the stores, skipping the messages appliedOffsets recorded as applied
+func (c *Consumer) Start(bmStore *store.RedisBmStore, sortedBmStore *store.RedisSortKeyBitmapStore, fvStore *store.RedisFvStore, appliedOffsets *store.AppliedOffsets) {
+	if appliedOffsets != nil && len(c.startOffset) > 0 {
+		if err := c.rewindAppliedOffsets(appliedOffsets); err != nil {
+			c.fatal <- err
+			return
+		}
 	}
-	go func() {
-		for {
-			// `Consume` should be called inside an infinite loop, when a
-			// server-side rebalance happens, the consumer session will need to be
-			// recreated to get the new claims
-			if err := c.client.Consume(context.Background(), []string{c.topic}, saramaConsumer); err != nil {
-				if err == sarama.ErrClosedConsumerGroup {
-					return
-				}
-				slog.Error("Error from consumer", "error", err)
-				time.Sleep(time.Second * 1)
-			}
+	saramaConsumer, err := newSaramaConsumer(c.schema, bmStore, sortedBmStore, fvStore)
+	if err != nil {
+		c.fatal <- err
+		return
+	}
+	saramaConsumer.AppliedOffsets = appliedOffsets
+	saramaConsumer.Resplits = c.resplits
+	saramaConsumer.Tasks = c.tasks
+	saramaConsumer.DeadLetterSink = c.deadLetterSink
+	saramaConsumer.DerivedIndexWriters = NewDerivedIndexWriters(c.schema.Table, c.derivedFields)
+	saramaConsumer.SortValueWriters = NewSortValueWriters(c.schema.Table, c.sortFields)
+	saramaConsumer.applyVersions(c.indexVersions, c.nextIndexVersions)
+	saramaConsumer.LookupIncompleteDeletes = c.lookupIncompleteDeletes
+	saramaConsumer.TimeUnit = c.timeUnit
+	if c.providerIDRange {
+		if saramaConsumer.ProviderIdRangeWriter, err = NewProviderIdRangeWriter(c.schema.Table, DefaultSplitThreshold); err != nil {
+			c.fatal <- err
+			return
+		}
+	}
+	saramaConsumer.Compactions = c.compactions
+	saramaConsumer.CompactMinBucketSize = c.compactMinBucketSize
+	saramaConsumer.BatchSize = c.batchSize
+	saramaConsumer.Ready = &c.ready
+	saramaConsumer.Offsets = &c.offsets
+	go c.run(saramaConsumer)
+	if c.compactInterval > 0 {
+		go c.scheduleCompactions()
+	}
+}
+
+// scheduleCompactions asks the consumer to compact between messages every jittered CompactInterval,
+// a compaction still pending is not queued twice
+func (c *Consumer) scheduleCompactions() {
+	for {
+		// uniform in [interval/2, interval*3/2)
+		delay := c.compactInterval/2 + time.Duration(rand.Int63n(int64(c.compactInterval)))
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return
+		}
+		select {
+		case c.compactions <- struct{}{}:
+		default:
 		}
-	}()
+	}
+}
+
+func (c *Consumer) run(handler sarama.ConsumerGroupHandler) {
+	failures := 0
+	for {
+		// `Consume` should be called inside an infinite loop, when a
+		// server-side rebalance happens, the consumer session will need to be
+		// recreated to get the new claims
+		err := c.client.Consume(context.Background(), []string{c.topic}, handler)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if err == sarama.ErrClosedConsumerGroup {
+			return
+		}
+		failures++
+		if c.maxConsecutiveFailures > 0 && failures >= c.maxConsecutiveFailures {
+			slog.Error("Consumer keeps failing, giving up", "failures", failures, "error", err)
+			c.fatal <- fmt.Errorf("Consumer failed %d times in a row, last err: %w", failures, err)
+			return
+		}
+		delay := c.retryBackoff.Delay(failures)
+		slog.Error("Error from consumer", "error", err, "failures", failures, "retryIn", delay)
+		time.Sleep(delay)
+	}
+}
+
+// Ready reports whether the consumer is in a session with its partitions claimed, even if they have no messages.
+// It's false while connecting and during rebalances.
+func (c *Consumer) Ready() bool {
+	return c.ready.Load()
+}
+
+// Status returns the offset, high-water mark and lag of the partitions claimed in the current session
+func (c *Consumer) Status() []PartitionStatus {
+	return c.offsets.statuses()
+}
+
+// Fatal receives an error once the consumer gave up after Config.MaxConsecutiveFailures failures
+func (c *Consumer) Fatal() <-chan error {
+	return c.fatal
+}
+
+// ScheduleResplit asks the consumer to re-split the create_time bucket at sortKey between messages,
+// so the repair doesn't race with index writes. It never blocks, requests are dropped when the queue is full.
+func (c *Consumer) ScheduleResplit(sortKey uint64) {
+	select {
+	case c.resplits <- sortKey:
+	default:
+		slog.Debug("Resplit queue is full, dropping request", "sortKey", sortKey)
+	}
+}
+
+// claimTask is work run by a claim between two of its messages, see Consumer.runInClaim
+type claimTask struct {
+	run  func(consumer *saramaConsumer) error
+	done chan<- error
+}
+
+// runInClaim runs run in a claim of the consumer between two of its messages, so its writes don't race with the ones
+// of the messages of that partition. It waits for the consumer to have a claim.
+func (c *Consumer) runInClaim(ctx context.Context, run func(consumer *saramaConsumer) error) error {
+	done := make(chan error, 1)
+	select {
+	case c.tasks <- claimTask{run: run, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return errors.New("Consumer was shut down")
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (c *Consumer) Shutdown() error {
 	slog.Info("Shutting down consumer...")
+	close(c.done)
 	return c.client.Close()
 }
 
+// DeadLetterSink receives messages that can't be applied to the index.
+// Sending a message to the sink skips it instead of blocking the partition.
+type DeadLetterSink interface {
+	Send(message *sarama.ConsumerMessage, err error) error
+}
+
+// LogDeadLetterSink logs dead letters at error level
+type LogDeadLetterSink struct{}
+
+func (LogDeadLetterSink) Send(message *sarama.ConsumerMessage, err error) error {
+	slog.Error("Skipping invalid message", "topic", message.Topic, "partition", message.Partition, "offset", message.Offset, "value", string(message.Value), "error", err)
+	return nil
+}
+
+// errInvalidMessage marks messages which can never be applied, they are routed to the dead-letter sink
+var errInvalidMessage = errors.New("invalid message")
+
+func newSaramaConsumer(schema index.TableSchema, bmStore store.BmStore, sortedBmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore) (*saramaConsumer, error) {
+	createTimeIndexWriter, err := NewSparseU64IndexWriter(schema.Table, "create_time", DefaultSplitThreshold)
+	if err != nil {
+		return nil, err
+	}
+	fieldWriters, err := NewFieldWriters(schema.Table, schema.Fields)
+	if err != nil {
+		return nil, err
+	}
+	return &saramaConsumer{
+		Schema:                 schema,
+		BmStore:                bmStore,
+		SortedBmStore:          sortedBmStore,
+		FvStore:                fvStore,
+		AllIndexWriter:         allIndexWriter(schema),
+		OrderStatusIndexWriter: NewTermIndexWriter[int64](schema.Table, "order_status"),
+		ProductIdIndexWriter:   NewTermIndexWriter[int64](schema.Table, "product_id"),
+		ProviderIdIndexWriter:  NewTermIndexWriter[*int64](schema.Table, "provider_id"),
+		CreateTimeIndexWriter:  createTimeIndexWriter,
+		DeletedIndexWriter:     deletedIndexWriter(schema),
+		TextIndexWriter:        textIndexWriter(schema),
+		FieldWriters:           fieldWriters,
+		DeadLetterSink:         LogDeadLetterSink{},
+	}, nil
+}
+
+// allIndexWriter returns the writer of __all, nil if the table has a universe field standing for it
+func allIndexWriter(schema index.TableSchema) *TermIndexWriter[int64] {
+	if schema.UniverseField != "" {
+		return nil
+	}
+	return NewTermIndexWriter[int64](schema.Table, index.AllField)
+}
+
+// universe returns the writer and value of the term holding every indexed id, __all or the universe field,
+// see index.TableSchema.UniverseField
+func (consumer *saramaConsumer) universe(order Order) (*TermIndexWriter[int64], int64) {
+	switch consumer.Schema.UniverseField {
+	case consumer.OrderStatusIndexWriter.Index.FieldName:
+		return consumer.OrderStatusIndexWriter, order.OrderStatus
+	case consumer.ProductIdIndexWriter.Index.FieldName:
+		return consumer.ProductIdIndexWriter, order.ProductID
+	}
+	return consumer.AllIndexWriter, index.AllValue
+}
+
+// deletedIndexWriter returns the writer of the soft-deleted ids, all kept under index.DeletedValue,
+// nil if the table has no soft delete
+func deletedIndexWriter(schema index.TableSchema) *TermIndexWriter[int64] {
+	if schema.SoftDeleteColumn == "" {
+		return nil
+	}
+	return NewTermIndexWriter[int64](schema.Table, index.DeletedField)
+}
+
+// textIndexWriter returns the writer of the text tokens, nil if the table has no text column
+func textIndexWriter(schema index.TableSchema) *TermIndexWriter[string] {
+	if schema.TextColumn == "" {
+		return nil
+	}
+	return NewTermIndexWriter[string](schema.Table, index.TextField)
+}
+
+// versionedFields are the term fields whose index can be versioned
+var versionedFields = map[string]bool{"order_status": true, "product_id": true, "provider_id": true}
+
+// applyVersions sets the versions of the term indexes to write, and of the ones to build along with them
+func (consumer *saramaConsumer) applyVersions(versions map[string]int, nextVersions map[string]int) {
+	apply := func(field string, idx *index.TermIndex, buildVersion func(int)) {
+		if version, ok := versions[field]; ok {
+			idx.Version = version
+		}
+		if version, ok := nextVersions[field]; ok {
+			buildVersion(version)
+		}
+	}
+	apply("order_status", &consumer.OrderStatusIndexWriter.Index, consumer.OrderStatusIndexWriter.BuildVersion)
+	apply("product_id", &consumer.ProductIdIndexWriter.Index, consumer.ProductIdIndexWriter.BuildVersion)
+	apply("provider_id", &consumer.ProviderIdIndexWriter.Index, consumer.ProviderIdIndexWriter.BuildVersion)
+}
+
 // saramaConsumer represents a Sarama consumer group consumer
 type saramaConsumer struct {
-	BmStore                *store.RedisBmStore
-	SortedBmStore          *store.RedisSortKeyBitmapStore
-	FvStore                *store.RedisFvStore
+	Schema                 index.TableSchema
+	BmStore                store.BmStore
+	SortedBmStore          store.SortKeyBitmapStore
+	FvStore                store.FieldValueStore
 	AllIndexWriter         *TermIndexWriter[int64]
 	OrderStatusIndexWriter *TermIndexWriter[int64]
 	ProductIdIndexWriter   *TermIndexWriter[int64]
 	ProviderIdIndexWriter  *TermIndexWriter[*int64]
 	CreateTimeIndexWriter  *SparseU64IndexWriter
+	DerivedIndexWriters    []*DerivedIndexWriter
+	SortValueWriters       []*SortValueWriter
+	// DeletedIndexWriter maintains the soft-deleted ids, nil if the table has no soft delete
+	DeletedIndexWriter *TermIndexWriter[int64]
+	// TextIndexWriter maintains the tokens of the text column, nil if the table has none
+	TextIndexWriter *TermIndexWriter[string]
+	// FieldWriters maintain the indexes of index.TableSchema.Fields
+	FieldWriters []*FieldWriter
+	Resplits     <-chan uint64
+	// Tasks receives the work to run between messages, see Consumer.runInClaim
+	Tasks                <-chan claimTask
+	Compactions          <-chan struct{}
+	CompactMinBucketSize int
+	DeadLetterSink       DeadLetterSink
+	// LookupIncompleteDeletes finds the values of orders deleted with an incomplete before image, see Config
+	LookupIncompleteDeletes bool
+	// TimeUnit is the unit create_time values are decoded from, see Config
+	TimeUnit index.TimeUnit
+	// ProviderIdRangeWriter maintains the sparse index of non-null provider_id values, nil if not enabled
+	ProviderIdRangeWriter *SparseIndexWriter[int64]
+	// Ready is set while a session is set up, see Consumer.Ready
+	Ready *atomic.Bool
+	// Offsets tracks the progress of the claims, see Consumer.Status
+	Offsets *offsetTracker
+	// AppliedOffsets records the last offset applied per partition, messages up to it are skipped. Nil applies all.
+	AppliedOffsets *store.AppliedOffsets
+	// BatchSize is the number of messages whose term bitmaps are written at once, see Config. 0 writes each message.
+	BatchSize int
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *saramaConsumer) Setup(sarama.ConsumerGroupSession) error {
+func (consumer *saramaConsumer) Setup(session sarama.ConsumerGroupSession) error {
+	slog.Info("Consumer session set up", "claims", session.Claims())
+	if consumer.Ready != nil {
+		consumer.Ready.Store(true)
+	}
 	return nil
 }
 
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
 func (consumer *saramaConsumer) Cleanup(sarama.ConsumerGroupSession) error {
+	if consumer.Ready != nil {
+		consumer.Ready.Store(false)
+	}
 	return nil
 }
 
@@ -100,39 +528,167 @@ func (consumer *saramaConsumer) Cleanup(sarama.ConsumerGroupSession) error {
 // Once the Messages() channel is closed, the Handler must finish its processing
 // loop and exit.
 func (consumer *saramaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	if consumer.Offsets != nil {
+		consumer.Offsets.track(claim, claim.InitialOffset())
+		defer consumer.Offsets.release(claim.Partition())
+	}
+	applied := int64(-1)
+	if consumer.AppliedOffsets != nil {
+		var err error
+		if applied, err = consumer.AppliedOffsets.Get(claim.Topic(), claim.Partition()); err != nil {
+			return err
+		}
+	}
+	// the term bitmaps of the messages are buffered and written along with their offset, see commitBatch
+	batch := store.NewBatchBmStore(consumer.BmStore)
+	batched := consumer.withBmStore(batch)
+	// last is the last message of the batch, nil while it's empty
+	var last *sarama.ConsumerMessage
+	pending := 0
+	commit := func() error {
+		if last == nil {
+			return nil
+		}
+		message := last
+		last, pending = nil, 0
+		offset := message.Offset
+		if offset <= applied {
+			// the batch only skipped messages, the recorded offset must not move back
+			offset = -1
+		}
+		if err := consumer.commitBatch(batch, claim.Topic(), claim.Partition(), offset); err != nil {
+			return err
+		}
+		session.MarkMessage(message, "")
+		if consumer.Offsets != nil {
+			consumer.Offsets.track(claim, message.Offset+1)
+		}
+		return nil
+	}
 	for {
 		select {
 		case message, ok := <-claim.Messages():
 			if !ok {
 				slog.Info("Message channel was closed", "topic", claim.Topic(), "partition", claim.Partition())
-				return nil
+				return commit()
 			}
 			slog.Debug("Message claimed", "topic", claim.Topic(), "partition", claim.Partition(), "offset", message.Offset, "value", string(message.Value))
-			var dataChangedMessage DataChangedMessage
-			if err := json.Unmarshal(message.Value, &dataChangedMessage); err != nil {
-				return fmt.Errorf("Failed to unmarshal message, offset=%d, value=%s, err: %w", message.Offset, message.Value, err)
+			// redelivered after the index was written but before the offset was committed to kafka
+			if message.Offset <= applied {
+				slog.Debug("Skipping applied message", "topic", claim.Topic(), "partition", claim.Partition(), "offset", message.Offset)
+				metrics.ConsumerMessages.Add("replayed", 1)
+			} else if err := batched.process(message); err != nil {
+				// the messages of the batch are redelivered by the next session
+				batch.Rollback()
+				return err
+			}
+			last = message
+			pending++
+			// a batch is written once full, or once no message is waiting so it isn't held back by a quiet partition
+			if pending >= consumer.BatchSize || len(claim.Messages()) == 0 {
+				if err := commit(); err != nil {
+					return err
+				}
 			}
-			var err error
-			switch dataChangedMessage.Op {
-			case "r", "c":
-				err = consumer.onInsert(*dataChangedMessage.After)
-			case "u":
-				err = consumer.onUpdate(*dataChangedMessage.Before, *dataChangedMessage.After)
-			case "d":
-				err = consumer.onDelete(*dataChangedMessage.Before)
-			default:
-				err = fmt.Errorf("Unknown op, op=%s, value=%s", dataChangedMessage.Op, message.Value)
+		case sortKey := <-consumer.Resplits:
+			if err := consumer.CreateTimeIndexWriter.Resplit(consumer.SortedBmStore, consumer.FvStore, sortKey); err != nil {
+				slog.Error("Failed to resplit sparse bucket", "sortKey", sortKey, "error", err)
 			}
-			if err != nil {
+		case task := <-consumer.Tasks:
+			// tasks read and write the stored term bitmaps
+			if err := commit(); err != nil {
 				return err
 			}
-			// TODO: commit store
-			session.MarkMessage(message, "")
+			task.done <- task.run(consumer)
+		case <-consumer.Compactions:
+			if _, err := consumer.CreateTimeIndexWriter.Compact(consumer.SortedBmStore, consumer.FvStore, consumer.CompactMinBucketSize); err != nil {
+				slog.Error("Failed to compact sparse index", "error", err)
+			}
 		case <-session.Context().Done():
 			slog.Debug("Session was closed", "topic", claim.Topic(), "partition", claim.Partition())
-			return nil
+			return commit()
+		}
+	}
+}
+
+// process applies a message to the index, invalid messages are sent to the dead-letter sink
+func (consumer *saramaConsumer) process(message *sarama.ConsumerMessage) error {
+	err := consumer.handleMessage(message)
+	if errors.Is(err, errInvalidMessage) {
+		return consumer.DeadLetterSink.Send(message, err)
+	}
+	return err
+}
+
+func (consumer *saramaConsumer) handleMessage(message *sarama.ConsumerMessage) error {
+	// debezium follows a delete with a tombstone for log compaction, the delete itself is applied
+	if message.Value == nil {
+		slog.Debug("Skipping tombstone", "offset", message.Offset)
+		metrics.ConsumerMessages.Add("tombstone", 1)
+		return nil
+	}
+	dataChangedMessage, err := decodeMessage(consumer.Schema, consumer.TimeUnit, message.Value)
+	if err != nil {
+		// a message that can't be decoded never will be, so it is dead-lettered instead of retried
+		return fmt.Errorf("%w: failed to unmarshal message, offset=%d, value=%s, err: %w", errInvalidMessage, message.Offset, message.Value, err)
+	}
+	// some connector configs omit images, e.g. the before image of an update without REPLICA IDENTITY FULL
+	before, after := dataChangedMessage.Before, dataChangedMessage.After
+	switch dataChangedMessage.Op {
+	case "r":
+		// snapshot reads are replayed on every backfill, adds are idempotent so they are simply applied
+		if after == nil {
+			return fmt.Errorf("%w: missing after image, op=r, offset=%d", errInvalidMessage, message.Offset)
+		}
+		return consumer.apply("snapshot_read", after.ID, func() error { return consumer.onInsert(*after) })
+	case "c":
+		if after == nil {
+			return fmt.Errorf("%w: missing after image, op=c, offset=%d", errInvalidMessage, message.Offset)
+		}
+		// redelivered inserts are skipped by their applied offset in ConsumeClaim
+		return consumer.apply("insert", after.ID, func() error { return consumer.onInsert(*after) })
+	case "u":
+		if before == nil || after == nil {
+			return fmt.Errorf("%w: missing before or after image, op=u, offset=%d", errInvalidMessage, message.Offset)
+		}
+		if before.Incomplete {
+			// moving from the missing values would leave the order in the bitmaps of the ones it had
+			if !consumer.LookupIncompleteDeletes {
+				return fmt.Errorf("%w: incomplete before image, op=u, id=%d, offset=%d", errInvalidMessage, before.ID, message.Offset)
+			}
+			return consumer.apply("update_lookup", after.ID, func() error { return consumer.onIncompleteUpdate(before.ID, *after) })
+		}
+		return consumer.apply("update", after.ID, func() error { return consumer.onUpdate(*before, *after) })
+	case "d":
+		if before == nil {
+			return fmt.Errorf("%w: missing before image, op=d, offset=%d", errInvalidMessage, message.Offset)
 		}
+		if before.Incomplete {
+			// deleting the missing values would drop the order from the universe but leave it in the bitmaps of the ones it had
+			if !consumer.LookupIncompleteDeletes {
+				return fmt.Errorf("%w: incomplete before image, op=d, id=%d, offset=%d", errInvalidMessage, before.ID, message.Offset)
+			}
+			return consumer.apply("delete_lookup", before.ID, func() error { return consumer.onIncompleteDelete(before.ID) })
+		}
+		return consumer.apply("delete", before.ID, func() error { return consumer.onDelete(*before) })
+	default:
+		return fmt.Errorf("%w: unknown op, op=%s, offset=%d, value=%s", errInvalidMessage, dataChangedMessage.Op, message.Offset, message.Value)
+	}
+}
+
+// apply runs the handler of an op on the order id, counting it and its handling time by op
+func (consumer *saramaConsumer) apply(op string, id uint32, handle func() error) error {
+	start := time.Now()
+	err := handle()
+	elapsed := time.Since(start)
+	metrics.ConsumerHandleMicros.Add(op, elapsed.Microseconds())
+	if err != nil {
+		metrics.ConsumerErrors.Add(op, 1)
+		return err
 	}
+	metrics.ConsumerMessages.Add(op, 1)
+	slog.Debug("Message applied", "op", op, "id", id, "duration", elapsed)
+	return nil
 }
 
 type DataChangedMessage struct {
@@ -141,23 +697,123 @@ type DataChangedMessage struct {
 	After  *Order `json:"after"`
 }
 
+// decodeMessage reads a change event of a table mapped by schema, its row images are keyed by column.
+// create_time values of unit are converted to microseconds.
+func decodeMessage(schema index.TableSchema, unit index.TimeUnit, value []byte) (DataChangedMessage, error) {
+	var raw struct {
+		Op     string                     `json:"op"`
+		Before map[string]json.RawMessage `json:"before"`
+		After  map[string]json.RawMessage `json:"after"`
+	}
+	if err := json.Unmarshal(value, &raw); err != nil {
+		return DataChangedMessage{}, err
+	}
+	before, err := decodeRow(schema, unit, raw.Before)
+	if err != nil {
+		return DataChangedMessage{}, err
+	}
+	after, err := decodeRow(schema, unit, raw.After)
+	if err != nil {
+		return DataChangedMessage{}, err
+	}
+	return DataChangedMessage{Op: raw.Op, Before: before, After: after}, nil
+}
+
+// decodeRow maps a row image to an Order, missing columns are left zero like missing json fields
+func decodeRow(schema index.TableSchema, unit index.TimeUnit, row map[string]json.RawMessage) (*Order, error) {
+	if row == nil {
+		return nil, nil
+	}
+	if value, ok := row[schema.PrimaryKey]; !ok || string(value) == "null" {
+		return nil, fmt.Errorf("%w: missing primary key, column=%s", errInvalidMessage, schema.PrimaryKey)
+	}
+	var order Order
+	// columns every row has a value of, see Order.Incomplete
+	for _, field := range []string{"order_status", "product_id", "create_time"} {
+		if value, ok := row[schema.Column(field)]; !ok || string(value) == "null" {
+			order.Incomplete = true
+		}
+	}
+	columns := map[string]any{
+		schema.PrimaryKey:             &order.ID,
+		schema.Column("order_status"): &order.OrderStatus,
+		schema.Column("product_id"):   &order.ProductID,
+		schema.Column("provider_id"):  &order.ProviderID,
+		schema.Column("create_time"):  &order.CreateTime,
+	}
+	if schema.SoftDeleteColumn != "" {
+		columns[schema.SoftDeleteColumn] = &order.Deleted
+		// the flag is compared between images, see onUpdate
+		if _, ok := row[schema.SoftDeleteColumn]; !ok {
+			order.Incomplete = true
+		}
+	}
+	if schema.TextColumn != "" {
+		columns[schema.TextColumn] = &order.Text
+	}
+	for column, v := range columns {
+		value, ok := row[column]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(value, v); err != nil {
+			return nil, fmt.Errorf("%w: failed to decode column, column=%s, err: %w", errInvalidMessage, column, err)
+		}
+	}
+	for _, field := range schema.Fields {
+		column := schema.Column(field.Name)
+		value, ok := row[column]
+		if !ok {
+			continue
+		}
+		var v *int64
+		if err := json.Unmarshal(value, &v); err != nil {
+			return nil, fmt.Errorf("%w: failed to decode column, column=%s, err: %w", errInvalidMessage, column, err)
+		}
+		if order.Fields == nil {
+			order.Fields = make(map[string]*int64, len(schema.Fields))
+		}
+		order.Fields[field.Name] = v
+	}
+	// an overflowing create_time is never going to fit, so the message is dead-lettered instead of retried
+	createTime, err := unit.ToMicros(order.CreateTime)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode column, column=%s, err: %w", errInvalidMessage, schema.Column("create_time"), err)
+	}
+	order.CreateTime = createTime
+	return &order, nil
+}
+
 type Order struct {
 	ID          uint32 `json:"id"`
 	OrderStatus int64  `json:"order_status"`
 	ProductID   int64  `json:"product_id"`
 	ProviderID  *int64 `json:"provider_id"`
 	CreateTime  uint64 `json:"create_time"`
+	// Deleted is the soft delete flag, see index.TableSchema.SoftDeleteColumn
+	Deleted bool `json:"deleted"`
+	// Text is the value of index.TableSchema.TextColumn
+	Text *string `json:"text"`
+	// Fields holds the values of index.TableSchema.Fields by name, a missing or nil value is null
+	Fields map[string]*int64 `json:"fields"`
+	// Incomplete is set if the row image misses a non-null column, e.g. a before image with only the primary key
+	Incomplete bool `json:"-"`
 }
 
 func (consumer *saramaConsumer) onInsert(order Order) error {
-	if err := consumer.AllIndexWriter.Add(consumer.BmStore, 0, order.ID); err != nil {
+	universe, universeValue := consumer.universe(order)
+	if err := universe.Add(consumer.BmStore, universeValue, order.ID); err != nil {
 		return err
 	}
-	if err := consumer.OrderStatusIndexWriter.Add(consumer.BmStore, order.OrderStatus, order.ID); err != nil {
-		return err
+	if universe != consumer.OrderStatusIndexWriter {
+		if err := consumer.OrderStatusIndexWriter.Add(consumer.BmStore, order.OrderStatus, order.ID); err != nil {
+			return err
+		}
 	}
-	if err := consumer.ProductIdIndexWriter.Add(consumer.BmStore, order.ProductID, order.ID); err != nil {
-		return err
+	if universe != consumer.ProductIdIndexWriter {
+		if err := consumer.ProductIdIndexWriter.Add(consumer.BmStore, order.ProductID, order.ID); err != nil {
+			return err
+		}
 	}
 	if err := consumer.ProviderIdIndexWriter.Add(consumer.BmStore, order.ProviderID, order.ID); err != nil {
 		return err
@@ -165,10 +821,39 @@ func (consumer *saramaConsumer) onInsert(order Order) error {
 	if err := consumer.CreateTimeIndexWriter.Add(consumer.SortedBmStore, consumer.FvStore, order.CreateTime, order.ID); err != nil {
 		return err
 	}
+	if err := consumer.moveProviderRange(nil, order.ProviderID, order.ID); err != nil {
+		return err
+	}
+	if err := consumer.moveTextTokens(nil, order.Text, order.ID); err != nil {
+		return err
+	}
+	for _, w := range consumer.FieldWriters {
+		if err := w.Add(consumer.BmStore, consumer.SortedBmStore, consumer.FvStore, order.Fields[w.Field.Name], order.ID); err != nil {
+			return err
+		}
+	}
+	for _, w := range consumer.DerivedIndexWriters {
+		if err := w.Add(consumer.BmStore, order.CreateTime, order.ID); err != nil {
+			return err
+		}
+	}
+	for _, w := range consumer.SortValueWriters {
+		if err := w.Set(consumer.FvStore, order); err != nil {
+			return err
+		}
+	}
+	if consumer.DeletedIndexWriter != nil && order.Deleted {
+		if err := consumer.DeletedIndexWriter.Add(consumer.BmStore, index.DeletedValue, order.ID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (consumer *saramaConsumer) onUpdate(before Order, after Order) error {
+	if before.ID != after.ID {
+		return consumer.onKeyChange(before, after)
+	}
 	if err := consumer.OrderStatusIndexWriter.Move(consumer.BmStore, before.OrderStatus, after.OrderStatus, after.ID); err != nil {
 		return err
 	}
@@ -181,30 +866,166 @@ func (consumer *saramaConsumer) onUpdate(before Order, after Order) error {
 	if err := consumer.CreateTimeIndexWriter.Move(consumer.SortedBmStore, consumer.FvStore, before.CreateTime, after.CreateTime, after.ID); err != nil {
 		return err
 	}
-	return nil
+	if err := consumer.moveProviderRange(before.ProviderID, after.ProviderID, after.ID); err != nil {
+		return err
+	}
+	if err := consumer.moveTextTokens(before.Text, after.Text, after.ID); err != nil {
+		return err
+	}
+	for _, w := range consumer.FieldWriters {
+		if err := w.Move(consumer.BmStore, consumer.SortedBmStore, consumer.FvStore, before.Fields[w.Field.Name], after.Fields[w.Field.Name], after.ID); err != nil {
+			return err
+		}
+	}
+	for _, w := range consumer.DerivedIndexWriters {
+		if err := w.Move(consumer.BmStore, before.CreateTime, after.CreateTime, after.ID); err != nil {
+			return err
+		}
+	}
+	for _, w := range consumer.SortValueWriters {
+		if err := w.Update(consumer.FvStore, before, after); err != nil {
+			return err
+		}
+	}
+	if before.Deleted == after.Deleted {
+		return nil
+	}
+	return consumer.setDeleted(after)
 }
 
-func (consumer *saramaConsumer) onDelete(order Order) error {
-	if err := consumer.AllIndexWriter.Remove(consumer.BmStore, 0, order.ID); err != nil {
+// onKeyChange applies an update of the primary key as a delete of the old id and an insert of the new one,
+// moving the values between ids would leave the old id in the indexes
+func (consumer *saramaConsumer) onKeyChange(before Order, after Order) error {
+	slog.Debug("Primary key changed", "before", before.ID, "after", after.ID)
+	metrics.ConsumerMessages.Add("key_change", 1)
+	if err := consumer.onDelete(before); err != nil {
 		return err
 	}
-	if err := consumer.OrderStatusIndexWriter.Remove(consumer.BmStore, order.OrderStatus, order.ID); err != nil {
+	return consumer.onInsert(after)
+}
+
+// onIncompleteUpdate applies an update whose before image misses columns as a delete of id with the values found in
+// the indexes and an insert of after, see Config.LookupIncompleteDeletes
+func (consumer *saramaConsumer) onIncompleteUpdate(id uint32, after Order) error {
+	if err := consumer.onIncompleteDelete(id); err != nil {
 		return err
 	}
-	if err := consumer.ProductIdIndexWriter.Remove(consumer.BmStore, order.ProductID, order.ID); err != nil {
+	return consumer.onInsert(after)
+}
+
+// moveProviderRange moves id in the sparse provider_id index, null values aren't indexed
+func (consumer *saramaConsumer) moveProviderRange(before *int64, after *int64, id uint32) error {
+	return moveSparse(consumer.ProviderIdRangeWriter, consumer.SortedBmStore, consumer.FvStore, before, after, id)
+}
+
+// moveTextTokens moves id from the tokens of before to the ones of after, leaving the shared tokens alone
+func (consumer *saramaConsumer) moveTextTokens(before *string, after *string, id uint32) error {
+	w := consumer.TextIndexWriter
+	if w == nil {
+		return nil
+	}
+	var beforeTokens, afterTokens []string
+	if before != nil {
+		beforeTokens = index.Tokenize(*before)
+	}
+	if after != nil {
+		afterTokens = index.Tokenize(*after)
+	}
+	for _, token := range beforeTokens {
+		if !slices.Contains(afterTokens, token) {
+			if err := w.Remove(consumer.BmStore, token, id); err != nil {
+				return err
+			}
+		}
+	}
+	for _, token := range afterTokens {
+		if !slices.Contains(beforeTokens, token) {
+			if err := w.Add(consumer.BmStore, token, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setDeleted records whether order is soft-deleted, following the after image
+func (consumer *saramaConsumer) setDeleted(order Order) error {
+	if consumer.DeletedIndexWriter == nil {
+		return nil
+	}
+	if order.Deleted {
+		return consumer.DeletedIndexWriter.Add(consumer.BmStore, index.DeletedValue, order.ID)
+	}
+	return consumer.DeletedIndexWriter.Remove(consumer.BmStore, index.DeletedValue, order.ID)
+}
+
+// onIncompleteDelete deletes id with the values found in the indexes, see Config.LookupIncompleteDeletes
+func (consumer *saramaConsumer) onIncompleteDelete(id uint32) error {
+	order, found, err := consumer.lookupOrder(id)
+	if err != nil {
 		return err
 	}
+	if !found {
+		slog.Debug("Deleted order isn't indexed", "id", id)
+		return nil
+	}
+	return consumer.onDelete(order)
+}
+
+func (consumer *saramaConsumer) onDelete(order Order) error {
+	// the universe is removed last, as inserts add it first, so an interrupted delete never leaves the id in a value
+	// bitmap without it in the universe, which negations like provider_id not null rely on
+	universe, universeValue := consumer.universe(order)
+	if universe != consumer.OrderStatusIndexWriter {
+		if err := consumer.OrderStatusIndexWriter.Remove(consumer.BmStore, order.OrderStatus, order.ID); err != nil {
+			return err
+		}
+	}
+	if universe != consumer.ProductIdIndexWriter {
+		if err := consumer.ProductIdIndexWriter.Remove(consumer.BmStore, order.ProductID, order.ID); err != nil {
+			return err
+		}
+	}
 	if err := consumer.ProviderIdIndexWriter.Remove(consumer.BmStore, order.ProviderID, order.ID); err != nil {
 		return err
 	}
 	if err := consumer.CreateTimeIndexWriter.Remove(consumer.SortedBmStore, consumer.FvStore, order.CreateTime, order.ID); err != nil {
 		return err
 	}
-	return nil
+	if err := consumer.moveProviderRange(order.ProviderID, nil, order.ID); err != nil {
+		return err
+	}
+	if err := consumer.moveTextTokens(order.Text, nil, order.ID); err != nil {
+		return err
+	}
+	for _, w := range consumer.FieldWriters {
+		if err := w.Remove(consumer.BmStore, consumer.SortedBmStore, consumer.FvStore, order.Fields[w.Field.Name], order.ID); err != nil {
+			return err
+		}
+	}
+	for _, w := range consumer.DerivedIndexWriters {
+		if err := w.Remove(consumer.BmStore, order.CreateTime, order.ID); err != nil {
+			return err
+		}
+	}
+	for _, w := range consumer.SortValueWriters {
+		if err := w.Remove(consumer.FvStore, order.ID); err != nil {
+			return err
+		}
+	}
+	if consumer.DeletedIndexWriter != nil {
+		if err := consumer.DeletedIndexWriter.Remove(consumer.BmStore, index.DeletedValue, order.ID); err != nil {
+			return err
+		}
+	}
+	return universe.Remove(consumer.BmStore, universeValue, order.ID)
 }
 
 type TermIndexWriter[T index.Term] struct {
 	Index index.TermIndex
+	// Next is the version of the index being built during a migration, it's written along with Index
+	// until readers are switched to it, see store.IndexVersions
+	Next *index.TermIndex
 }
 
 func NewTermIndexWriter[T index.Term](tableName string, fieldName string) *TermIndexWriter[T] {
@@ -216,36 +1037,42 @@ func NewTermIndexWriter[T index.Term](tableName string, fieldName string) *TermI
 	}
 }
 
-func (w *TermIndexWriter[T]) Add(bmStore *store.RedisBmStore, fv T, id uint32) error {
-	indexKey := w.Index.GetIndexKey()
-	key := w.Index.MakeValueKey(fv)
-	bm, err := bmStore.Get(indexKey, key)
-	if err != nil {
+func (w *TermIndexWriter[T]) Add(bmStore store.BmStore, fv T, id uint32) error {
+	if err := bmStore.AddBit(w.Index.GetIndexKey(), w.Index.MakeValueKey(fv), id); err != nil {
 		return err
 	}
-	bm.Add(id)
-	if err := bmStore.Set(indexKey, key, bm); err != nil {
-		return err
+	if w.Next != nil {
+		return bmStore.AddBit(w.Next.GetIndexKey(), w.Next.MakeValueKey(fv), id)
 	}
 	return nil
 }
 
-func (w *TermIndexWriter[T]) Remove(bmStore *store.RedisBmStore, fv T, id uint32) error {
-	indexKey := w.Index.GetIndexKey()
-	key := w.Index.MakeValueKey(fv)
-	bm, err := bmStore.Get(indexKey, key)
-	if err != nil {
+func (w *TermIndexWriter[T]) Remove(bmStore store.BmStore, fv T, id uint32) error {
+	if err := bmStore.RemoveBit(w.Index.GetIndexKey(), w.Index.MakeValueKey(fv), id); err != nil {
 		return err
 	}
-	bm.Remove(id)
-	if err := bmStore.Set(indexKey, key, bm); err != nil {
-		return err
+	if w.Next != nil {
+		return bmStore.RemoveBit(w.Next.GetIndexKey(), w.Next.MakeValueKey(fv), id)
 	}
 	return nil
 }
 
-func (w *TermIndexWriter[K]) Move(bmStore *store.RedisBmStore, before K, after K, id uint32) error {
-	if before == after {
+// BuildVersion starts writing version of the index along with the current one.
+// Ids indexed before must be backfilled before readers switch to it, see Consumer.NextVersionIndexes.
+func (w *TermIndexWriter[T]) BuildVersion(version int) {
+	next := w.Index.WithVersion(version)
+	w.Next = &next
+}
+
+// DropTermIndex deletes every bitmap of idx, e.g. the old version once readers switched to a new one
+func DropTermIndex(bmStore store.BmStore, idx index.TermIndex) error {
+	return bmStore.Drop(idx.GetIndexKey())
+}
+
+// Move moves id between the bitmaps of two field values, it's a no-op if the value didn't change
+func (w *TermIndexWriter[K]) Move(bmStore store.BmStore, before K, after K, id uint32) error {
+	// compare value keys rather than values, two *int64 pointing to equal values are the same term
+	if w.Index.MakeValueKey(before) == w.Index.MakeValueKey(after) {
 		return nil
 	}
 	if err := w.Remove(bmStore, before, id); err != nil {
@@ -257,12 +1084,193 @@ func (w *TermIndexWriter[K]) Move(bmStore *store.RedisBmStore, before K, after K
 	return nil
 }
 
+// MultiValueTermIndexWriter maintains the term index of a field holding a set of values, e.g. tags,
+// an id is in the bitmap of each of its values
+type MultiValueTermIndexWriter[T index.Term] struct {
+	writer *TermIndexWriter[T]
+}
+
+func NewMultiValueTermIndexWriter[T index.Term](tableName string, fieldName string) *MultiValueTermIndexWriter[T] {
+	return &MultiValueTermIndexWriter[T]{writer: NewTermIndexWriter[T](tableName, fieldName)}
+}
+
+func (w *MultiValueTermIndexWriter[T]) Add(bmStore store.BmStore, fvs []T, id uint32) error {
+	for _, fv := range fvs {
+		if err := w.writer.Add(bmStore, fv, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *MultiValueTermIndexWriter[T]) Remove(bmStore store.BmStore, fvs []T, id uint32) error {
+	for _, fv := range fvs {
+		if err := w.writer.Remove(bmStore, fv, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move removes id from the values only in before and adds it to the values only in after
+func (w *MultiValueTermIndexWriter[T]) Move(bmStore store.BmStore, before []T, after []T, id uint32) error {
+	keys := func(fvs []T) map[string]bool {
+		m := make(map[string]bool, len(fvs))
+		for _, fv := range fvs {
+			m[w.writer.Index.MakeValueKey(fv)] = true
+		}
+		return m
+	}
+	beforeKeys, afterKeys := keys(before), keys(after)
+	for _, fv := range before {
+		if !afterKeys[w.writer.Index.MakeValueKey(fv)] {
+			if err := w.writer.Remove(bmStore, fv, id); err != nil {
+				return err
+			}
+		}
+	}
+	for _, fv := range after {
+		if !beforeKeys[w.writer.Index.MakeValueKey(fv)] {
+			if err := w.writer.Add(bmStore, fv, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RebuildAll rebuilds the __all bitmap of the table mapped by schema as the union of the bitmaps of the first of
+// index.UniverseFields, every order has a value of it. versions are the written index versions, see Config.IndexVersions.
+// It's a repair cheaper than a backfill when __all drifted or got corrupted.
+// Changes applied by a running consumer during the rebuild may be lost, stop it first.
+func RebuildAll(bmStore store.BmStore, schema index.TableSchema, versions map[string]int) error {
+	if schema.UniverseField != "" {
+		return fmt.Errorf("Table %s has no __all index, universe_field=%s", schema.Table, schema.UniverseField)
+	}
+	allBm := roaring.New()
+	field := index.UniverseFields[0]
+	sourceIndex := index.TermIndex{TableName: schema.Table, FieldName: field, Version: versions[field]}
+	if err := bmStore.ScanValues(sourceIndex.GetIndexKey(), func(valueKey string, bm *roaring.Bitmap) bool {
+		allBm.Or(bm)
+		return true
+	}); err != nil {
+		return err
+	}
+	allWriter := NewTermIndexWriter[int64](schema.Table, index.AllField)
+	slog.Info("Rebuilding __all", "table", schema.Table, "source", sourceIndex.GetIndexKey(), "cardinality", allBm.GetCardinality())
+	return bmStore.Set(allWriter.Index.GetIndexKey(), allWriter.Index.MakeValueKey(int64(index.AllValue)), allBm)
+}
+
+// SortValueWriter stores the value of a term field by id, so queries can order create_time ties by it.
+// Values are stored as store.Int64Codec sort keys, orders without a value (a null provider_id) have none.
+type SortValueWriter struct {
+	Key   string
+	Value func(order Order) (int64, bool)
+}
+
+// sortValues read the values of index.SortableFields
+var sortValues = map[string]func(order Order) (int64, bool){
+	"order_status": func(order Order) (int64, bool) { return order.OrderStatus, true },
+	"product_id":   func(order Order) (int64, bool) { return order.ProductID, true },
+	"provider_id": func(order Order) (int64, bool) {
+		if order.ProviderID == nil {
+			return 0, false
+		}
+		return *order.ProviderID, true
+	},
+}
+
+func NewSortValueWriters(tableName string, fields []string) []*SortValueWriter {
+	writers := make([]*SortValueWriter, len(fields))
+	for i, field := range fields {
+		writers[i] = &SortValueWriter{Key: index.SortValuesKey(tableName, field), Value: sortValues[field]}
+	}
+	return writers
+}
+
+func (w *SortValueWriter) Set(fvStore store.FieldValueStore, order Order) error {
+	v, ok := w.Value(order)
+	if !ok {
+		return fvStore.Remove(w.Key, order.ID)
+	}
+	return fvStore.Set(w.Key, order.ID, store.Int64Codec{}.Encode(v))
+}
+
+// Update stores the value of after, unless it didn't change
+func (w *SortValueWriter) Update(fvStore store.FieldValueStore, before Order, after Order) error {
+	v1, ok1 := w.Value(before)
+	v2, ok2 := w.Value(after)
+	if v1 == v2 && ok1 == ok2 {
+		return nil
+	}
+	return w.Set(fvStore, after)
+}
+
+func (w *SortValueWriter) Remove(fvStore store.FieldValueStore, id uint32) error {
+	return fvStore.Remove(w.Key, id)
+}
+
+// DerivedIndexWriter maintains the term index of a field derived from create_time
+type DerivedIndexWriter struct {
+	Field  index.DerivedField
+	writer *TermIndexWriter[int64]
+}
+
+func NewDerivedIndexWriters(tableName string, fields []index.DerivedField) []*DerivedIndexWriter {
+	writers := make([]*DerivedIndexWriter, len(fields))
+	for i, field := range fields {
+		writers[i] = &DerivedIndexWriter{Field: field, writer: NewTermIndexWriter[int64](tableName, field.Name)}
+	}
+	return writers
+}
+
+func (w *DerivedIndexWriter) Add(bmStore store.BmStore, createTime uint64, id uint32) error {
+	return w.writer.Add(bmStore, w.Field.Derive(createTime), id)
+}
+
+func (w *DerivedIndexWriter) Remove(bmStore store.BmStore, createTime uint64, id uint32) error {
+	return w.writer.Remove(bmStore, w.Field.Derive(createTime), id)
+}
+
+func (w *DerivedIndexWriter) Move(bmStore store.BmStore, before uint64, after uint64, id uint32) error {
+	return w.writer.Move(bmStore, w.Field.Derive(before), w.Field.Derive(after), id)
+}
+
+const (
+	// DefaultSplitThreshold is the bucket cardinality at which the consumer splits create_time buckets
+	DefaultSplitThreshold = 1000
+	// MinSplitThreshold is the smallest usable split threshold, a bucket needs 2 ids to be split
+	MinSplitThreshold = 2
+)
+
 type SparseU64IndexWriter struct {
 	Index          index.SparseIndex
 	SplitThreshold int
 }
 
-func (w *SparseU64IndexWriter) Add(bmStore *store.RedisSortKeyBitmapStore, fvStore *store.RedisFvStore, fv uint64, id uint32) error {
+func NewSparseU64IndexWriter(tableName string, fieldName string, splitThreshold int) (*SparseU64IndexWriter, error) {
+	if splitThreshold < MinSplitThreshold {
+		return nil, fmt.Errorf("Invalid split threshold, splitThreshold=%d, min=%d", splitThreshold, MinSplitThreshold)
+	}
+	for _, name := range []string{tableName, fieldName} {
+		if err := index.ValidateKeyName(name); err != nil {
+			return nil, err
+		}
+	}
+	return &SparseU64IndexWriter{
+		Index: index.SparseIndex{
+			TableName: tableName,
+			FieldName: fieldName,
+		},
+		SplitThreshold: splitThreshold,
+	}, nil
+}
+
+func (w *SparseU64IndexWriter) Add(bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, fv uint64, id uint32) error {
+	if w.SplitThreshold < MinSplitThreshold {
+		// a tiny threshold splits on every insert and degrades the index to one bucket per id
+		return fmt.Errorf("Invalid split threshold, splitThreshold=%d, min=%d", w.SplitThreshold, MinSplitThreshold)
+	}
 	fieldKey := w.Index.MakeIndexKey()
 	floorSortedBm, err := getFloorSortedBm(bmStore, fieldKey, fv)
 	if err != nil {
@@ -274,34 +1282,17 @@ func (w *SparseU64IndexWriter) Add(bmStore *store.RedisSortKeyBitmapStore, fvSto
 	} else if floorSortedBm.Bitmap.GetCardinality() < uint64(w.SplitThreshold) {
 		updateSortedBms = []store.SortKeyBitmap{*floorSortedBm}
 	} else {
-		// sort ids and split into 2 parts
 		sortIds, err := index.QuerySortIds(fvStore, fieldKey, floorSortedBm.Bitmap)
 		if err != nil {
 			return err
 		}
-		if sortIds[0].SortKey == sortIds[len(sortIds)-1].SortKey {
-			// TODO: detect degraded sparse index earlier
+		if len(sortIds) == 0 {
+			// no id of the bucket has a sort key, it can't be split
 			updateSortedBms = []store.SortKeyBitmap{*floorSortedBm}
+		} else if sharedKey := sortIds[0].SortKey; sharedKey == sortIds[len(sortIds)-1].SortKey {
+			updateSortedBms = addToHomogeneous(*floorSortedBm, sharedKey, fv)
 		} else {
-			// split to (-inf, midKey], (midKey, +inf)
-			midKey := sortIds[len(sortIds)/2].SortKey
-			if midKey == sortIds[len(sortIds)-1].SortKey {
-				midKey -= 1 // make sure the second bitmap is not empty
-			}
-			mid := sort.Search(len(sortIds), func(i int) bool { return sortIds[i].SortKey > midKey })
-			if mid == 0 {
-				panic(fmt.Errorf("mid == 0, sortIds=%+v", sortIds))
-			}
-			bm1 := floorSortedBm.Bitmap
-			bm1.Clear()
-			for _, sortId := range sortIds[:mid] {
-				bm1.Add(sortId.Id)
-			}
-			bm2 := roaring.New()
-			for _, sortId := range sortIds[mid:] {
-				bm2.Add(sortId.Id)
-			}
-			updateSortedBms = []store.SortKeyBitmap{{SortKey: sortIds[0].SortKey, Bitmap: bm1}, {SortKey: sortIds[mid].SortKey, Bitmap: bm2}}
+			updateSortedBms = splitSortIds(*floorSortedBm, sortIds)
 			// make first sorted bitmap the floor sorted bitmap
 			if updateSortedBms[1].SortKey <= fv {
 				updateSortedBms[0], updateSortedBms[1] = updateSortedBms[1], updateSortedBms[0]
@@ -318,7 +1309,282 @@ func (w *SparseU64IndexWriter) Add(bmStore *store.RedisSortKeyBitmapStore, fvSto
 	return nil
 }
 
-func (w *SparseU64IndexWriter) Remove(bmStore *store.RedisSortKeyBitmapStore, fvStore *store.RedisFvStore, fv uint64, id uint32) error {
+// Resplit splits the bucket at sortKey until every part is below the split threshold.
+// It repairs buckets left oversized, e.g. by a crash between the fv and bitmap writes of a split.
+func (w *SparseU64IndexWriter) Resplit(bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, sortKey uint64) error {
+	fieldKey := w.Index.MakeIndexKey()
+	sortedBms, err := bmStore.Scan(fieldKey, sortKey, sortKey, false, 1)
+	if err != nil {
+		return err
+	}
+	if len(sortedBms) == 0 {
+		return nil
+	}
+	pending := sortedBms
+	var updateSortedBms []store.SortKeyBitmap
+	for len(pending) > 0 {
+		sortedBm := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if sortedBm.Bitmap.GetCardinality() < uint64(w.SplitThreshold) {
+			updateSortedBms = append(updateSortedBms, sortedBm)
+			continue
+		}
+		parts, err := w.split(fvStore, fieldKey, sortedBm)
+		if err != nil {
+			return err
+		}
+		if len(parts) == 1 {
+			updateSortedBms = append(updateSortedBms, parts[0])
+		} else {
+			pending = append(pending, parts...)
+		}
+	}
+	if len(updateSortedBms) == 1 {
+		return nil
+	}
+	slog.Info("Resplit sparse bucket", "fieldKey", fieldKey, "sortKey", sortKey, "parts", len(updateSortedBms))
+	metrics.SparseResplits.Add(1)
+	return bmStore.MSet(fieldKey, updateSortedBms)
+}
+
+// CompactStats counts the repairs of a Compact run
+type CompactStats struct {
+	Merges int
+	// Resplits counts buckets at or above the split threshold, a homogeneous one is left as is
+	Resplits int
+}
+
+// Compact walks all buckets in sort key order, merges a bucket smaller than minBucketSize with its predecessor
+// while the result stays below the split threshold, and re-splits buckets at or above the threshold.
+// Removals never merge buckets, so without it a sparse index degrades into many tiny buckets.
+// Every repair is a single MSet, but reads in between aren't, so it must not run concurrently with the writer.
+func (w *SparseU64IndexWriter) Compact(bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, minBucketSize int) (CompactStats, error) {
+	var stats CompactStats
+	fieldKey := w.Index.MakeIndexKey()
+	var prev *store.SortKeyBitmap
+	start := uint64(0)
+	for {
+		sortedBms, err := bmStore.Scan(fieldKey, start, math.MaxUint64, false, 100)
+		if err != nil {
+			return stats, err
+		}
+		for i := range sortedBms {
+			cur := &sortedBms[i]
+			cardinality := cur.Bitmap.GetCardinality()
+			if cardinality >= uint64(w.SplitThreshold) {
+				if err := w.Resplit(bmStore, fvStore, cur.SortKey); err != nil {
+					return stats, err
+				}
+				stats.Resplits++
+				// the parts of cur aren't known here, they are merged on the next run if undersized
+				prev = nil
+				continue
+			}
+			if prev != nil && min(prev.Bitmap.GetCardinality(), cardinality) < uint64(minBucketSize) &&
+				prev.Bitmap.GetCardinality()+cardinality < uint64(w.SplitThreshold) {
+				// prev covers [prev, cur) and cur covers [cur, next), the merged bucket covers [prev, next)
+				prev.Bitmap.Or(cur.Bitmap)
+				if err := bmStore.MSet(fieldKey, []store.SortKeyBitmap{*prev, {SortKey: cur.SortKey, Bitmap: nil}}); err != nil {
+					return stats, err
+				}
+				stats.Merges++
+				metrics.SparseMerges.Add(1)
+				continue
+			}
+			prev = cur
+		}
+		if len(sortedBms) < 100 || sortedBms[len(sortedBms)-1].SortKey == math.MaxUint64 {
+			break
+		}
+		start = sortedBms[len(sortedBms)-1].SortKey + 1
+	}
+	if stats.Merges > 0 {
+		slog.Info("Compacted sparse index", "fieldKey", fieldKey, "merges", stats.Merges, "resplits", stats.Resplits)
+	}
+	return stats, nil
+}
+
+// VerifyStats counts the inconsistencies between the buckets and the fvs found by Verify
+type VerifyStats struct {
+	Buckets int `json:"buckets"`
+	Ids     int `json:"ids"`
+	// MissingFv counts bucket members without fv, they can't be ordered
+	MissingFv int `json:"missing_fv"`
+	// Misplaced counts bucket members whose fv is outside the key range of the bucket
+	Misplaced int `json:"misplaced"`
+}
+
+// VerifySparse verifies the sparse indexes written by the consumer, see SparseU64IndexWriter.Verify,
+// returning the stats by index key. It runs in a claim, so it doesn't race with the writes of the consumer.
+func (c *Consumer) VerifySparse(ctx context.Context, repair bool) (map[string]VerifyStats, error) {
+	stats := make(map[string]VerifyStats)
+	err := c.runInClaim(ctx, func(consumer *saramaConsumer) error {
+		writers := []*SparseU64IndexWriter{consumer.CreateTimeIndexWriter}
+		if consumer.ProviderIdRangeWriter != nil {
+			writers = append(writers, consumer.ProviderIdRangeWriter.SparseU64IndexWriter)
+		}
+		for _, w := range consumer.FieldWriters {
+			if w.Sparse != nil {
+				writers = append(writers, w.Sparse.SparseU64IndexWriter)
+			}
+		}
+		for _, w := range writers {
+			s, err := w.Verify(consumer.SortedBmStore, consumer.FvStore, repair)
+			if err != nil {
+				return err
+			}
+			stats[w.Index.MakeIndexKey()] = s
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Verify checks that every member of every bucket has a fv within the bucket's key range, [SortKey, next SortKey).
+// With repair it removes members without fv from their bucket and moves misplaced ones to the bucket of their fv.
+// Like Compact, it must not run concurrently with the writer.
+func (w *SparseU64IndexWriter) Verify(bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, repair bool) (VerifyStats, error) {
+	var stats VerifyStats
+	fieldKey := w.Index.MakeIndexKey()
+	var misplaced []index.SortId
+	// verify checks bucket against the key range [bucket.SortKey, hi], the last bucket has no upper bound
+	verify := func(bucket store.SortKeyBitmap, hi uint64) error {
+		stats.Buckets++
+		ids := bucket.Bitmap.ToArray()
+		stats.Ids += len(ids)
+		fvs, found, err := fvStore.MGetFound(fieldKey, ids)
+		if err != nil {
+			return err
+		}
+		var orphans []uint32
+		for i, id := range ids {
+			switch {
+			case !found[i]:
+				stats.MissingFv++
+				orphans = append(orphans, id)
+			case fvs[i] < bucket.SortKey || fvs[i] > hi:
+				stats.Misplaced++
+				orphans = append(orphans, id)
+				misplaced = append(misplaced, index.SortId{Id: id, SortKey: fvs[i]})
+			}
+		}
+		if len(orphans) == 0 {
+			return nil
+		}
+		slog.Warn("Sparse bucket is inconsistent with fvs", "fieldKey", fieldKey, "sortKey", bucket.SortKey, "orphans", len(orphans), "repair", repair)
+		if !repair {
+			return nil
+		}
+		for _, id := range orphans {
+			bucket.Bitmap.Remove(id)
+		}
+		if bucket.Bitmap.IsEmpty() {
+			// the predecessor takes over the key range
+			bucket.Bitmap = nil
+		}
+		return bmStore.MSet(fieldKey, []store.SortKeyBitmap{bucket})
+	}
+	var prev *store.SortKeyBitmap
+	start := uint64(0)
+	for {
+		sortedBms, err := bmStore.Scan(fieldKey, start, math.MaxUint64, false, 100)
+		if err != nil {
+			return stats, err
+		}
+		for i := range sortedBms {
+			if prev != nil {
+				if err := verify(*prev, sortedBms[i].SortKey-1); err != nil {
+					return stats, err
+				}
+			}
+			prev = &sortedBms[i]
+		}
+		if len(sortedBms) < 100 || sortedBms[len(sortedBms)-1].SortKey == math.MaxUint64 {
+			break
+		}
+		start = sortedBms[len(sortedBms)-1].SortKey + 1
+	}
+	if prev != nil {
+		if err := verify(*prev, math.MaxUint64); err != nil {
+			return stats, err
+		}
+	}
+	if repair {
+		// the misplaced ids are added back once their old buckets are written, their bucket may be any of them
+		for _, sortId := range misplaced {
+			if err := w.Add(bmStore, fvStore, sortId.SortKey, sortId.Id); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if stats.MissingFv > 0 || stats.Misplaced > 0 {
+		slog.Info("Verified sparse index", "fieldKey", fieldKey, "buckets", stats.Buckets, "ids", stats.Ids,
+			"missingFv", stats.MissingFv, "misplaced", stats.Misplaced, "repair", repair)
+	}
+	return stats, nil
+}
+
+// split sorts the ids of a bucket and splits it into 2 parts,
+// a bucket whose ids share the same sort key can't be split and is returned as is.
+func (w *SparseU64IndexWriter) split(fvStore store.FieldValueStore, fieldKey string, sortedBm store.SortKeyBitmap) ([]store.SortKeyBitmap, error) {
+	sortIds, err := index.QuerySortIds(fvStore, fieldKey, sortedBm.Bitmap)
+	if err != nil {
+		return nil, err
+	}
+	if len(sortIds) == 0 || sortIds[0].SortKey == sortIds[len(sortIds)-1].SortKey {
+		return []store.SortKeyBitmap{sortedBm}, nil
+	}
+	return splitSortIds(sortedBm, sortIds), nil
+}
+
+// splitSortIds splits a bucket whose ids are sorted in sortIds, which must have at least 2 distinct sort keys
+func splitSortIds(sortedBm store.SortKeyBitmap, sortIds []index.SortId) []store.SortKeyBitmap {
+	// split to (-inf, midKey], (midKey, +inf)
+	midKey := sortIds[len(sortIds)/2].SortKey
+	if midKey == sortIds[len(sortIds)-1].SortKey {
+		midKey -= 1 // make sure the second bitmap is not empty
+	}
+	mid := sort.Search(len(sortIds), func(i int) bool { return sortIds[i].SortKey > midKey })
+	if mid == 0 {
+		panic(fmt.Errorf("mid == 0, sortIds=%+v", sortIds))
+	}
+	// ids without a sort key aren't in sortIds, keep them in the bucket for a later repair
+	bm1 := sortedBm.Bitmap
+	for _, sortId := range sortIds {
+		bm1.Remove(sortId.Id)
+	}
+	for _, sortId := range sortIds[:mid] {
+		bm1.Add(sortId.Id)
+	}
+	bm2 := roaring.New()
+	for _, sortId := range sortIds[mid:] {
+		bm2.Add(sortId.Id)
+	}
+	// keep the first part at the bucket's own sort key so the old zset member is overwritten,
+	// the second key is greater than it as sortIds[mid].SortKey > midKey >= sortIds[0].SortKey
+	return []store.SortKeyBitmap{{SortKey: sortedBm.SortKey, Bitmap: bm1}, {SortKey: sortIds[mid].SortKey, Bitmap: bm2}}
+}
+
+// addToHomogeneous returns the buckets to update when adding fv to a full bucket whose ids all share sharedKey.
+// Such a bucket can't be split by sort key (it is common with second-granularity timestamps),
+// so a different fv gets its own bucket instead of growing the bucket further.
+// The first returned bucket is the one to add the id to.
+func addToHomogeneous(sortedBm store.SortKeyBitmap, sharedKey uint64, fv uint64) []store.SortKeyBitmap {
+	switch {
+	case fv > sharedKey:
+		return []store.SortKeyBitmap{{SortKey: fv, Bitmap: roaring.New()}}
+	case fv < sharedKey:
+		// sortedBm.SortKey <= fv < sharedKey, move the existing ids up to their own key
+		return []store.SortKeyBitmap{{SortKey: sortedBm.SortKey, Bitmap: roaring.New()}, {SortKey: sharedKey, Bitmap: sortedBm.Bitmap}}
+	default:
+		return []store.SortKeyBitmap{sortedBm}
+	}
+}
+
+func (w *SparseU64IndexWriter) Remove(bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, fv uint64, id uint32) error {
 	fieldKey := w.Index.MakeIndexKey()
 	floorSortedBm, err := getFloorSortedBm(bmStore, fieldKey, fv)
 	if err != nil {
@@ -338,7 +1604,7 @@ func (w *SparseU64IndexWriter) Remove(bmStore *store.RedisSortKeyBitmapStore, fv
 	return nil
 }
 
-func (w *SparseU64IndexWriter) Move(bmStore *store.RedisSortKeyBitmapStore, fvStore *store.RedisFvStore, before uint64, after uint64, id uint32) error {
+func (w *SparseU64IndexWriter) Move(bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, before uint64, after uint64, id uint32) error {
 	if before == after {
 		return nil
 	}
@@ -351,7 +1617,40 @@ func (w *SparseU64IndexWriter) Move(bmStore *store.RedisSortKeyBitmapStore, fvSt
 	return nil
 }
 
-func getFloorSortedBm(bmStore *store.RedisSortKeyBitmapStore, fieldKey string, fv uint64) (*store.SortKeyBitmap, error) {
+// SparseIndexWriter maintains a sparse index of values of type T, stored as the sort keys of Codec.
+// It reuses the buckets and splits of the uint64 writer, readers decode SortId.SortKey with the same codec.
+type SparseIndexWriter[T any] struct {
+	*SparseU64IndexWriter
+	Codec store.SortKeyCodec[T]
+}
+
+func NewSparseIndexWriter[T any](tableName string, fieldName string, splitThreshold int, codec store.SortKeyCodec[T]) (*SparseIndexWriter[T], error) {
+	w, err := NewSparseU64IndexWriter(tableName, fieldName, splitThreshold)
+	if err != nil {
+		return nil, err
+	}
+	return &SparseIndexWriter[T]{SparseU64IndexWriter: w, Codec: codec}, nil
+}
+
+func (w *SparseIndexWriter[T]) Add(bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, fv T, id uint32) error {
+	return w.SparseU64IndexWriter.Add(bmStore, fvStore, w.Codec.Encode(fv), id)
+}
+
+func (w *SparseIndexWriter[T]) Remove(bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, fv T, id uint32) error {
+	return w.SparseU64IndexWriter.Remove(bmStore, fvStore, w.Codec.Encode(fv), id)
+}
+
+func (w *SparseIndexWriter[T]) Move(bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, before T, after T, id uint32) error {
+	return w.SparseU64IndexWriter.Move(bmStore, fvStore, w.Codec.Encode(before), w.Codec.Encode(after), id)
+}
+
+// NewProviderIdRangeWriter returns the writer of the sparse index of non-null provider_id values,
+// keyed by store.Int64Codec so negative ids sort first
+func NewProviderIdRangeWriter(tableName string, splitThreshold int) (*SparseIndexWriter[int64], error) {
+	return NewSparseIndexWriter[int64](tableName, "provider_id", splitThreshold, store.Int64Codec{})
+}
+
+func getFloorSortedBm(bmStore store.SortKeyBitmapStore, fieldKey string, fv uint64) (*store.SortKeyBitmap, error) {
 	sortedBms, err := bmStore.Scan(fieldKey, fv, 0, true, 1)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,1619 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	stdsync "sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/metrics"
+	"github.com/KKKIIO/inv-index-demo/query"
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/KKKIIO/inv-index-demo/store/storetest"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMemTestStores returns empty in-memory stores, for the tests that don't depend on redis
+func newMemTestStores() (*store.MemBmStore, *store.MemSortKeyBitmapStore, *store.MemFvStore) {
+	return store.NewMemBmStore(), store.NewMemSortKeyBitmapStore(), store.NewMemFvStore()
+}
+
+// newTestConsumer is newSaramaConsumer failing t on error
+func newTestConsumer(t testing.TB, schema index.TableSchema, bmStore store.BmStore, sortedBmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore) *saramaConsumer {
+	consumer, err := newSaramaConsumer(schema, bmStore, sortedBmStore, fvStore)
+	require.NoError(t, err)
+	return consumer
+}
+
+// scanBuckets returns all buckets of a sparse index in ascending order
+func scanBuckets(t *testing.T, skbmStore store.SortKeyBitmapStore, indexKey string) []store.SortKeyBitmap {
+	sortedBms, err := skbmStore.Scan(indexKey, 0, 0xFFFFFFFFFFFFFFFF, false, 1000)
+	require.NoError(t, err)
+	return sortedBms
+}
+
+func TestSparseResplitOversizedBucket(t *testing.T) {
+	_, skbmStore, fvStore := newMemTestStores()
+	w := &SparseU64IndexWriter{Index: index.SparseIndex{TableName: "orders", FieldName: "create_time"}, SplitThreshold: 4}
+	indexKey := w.Index.MakeIndexKey()
+	oversized := roaring.New()
+	for id := uint32(1); id <= 20; id++ {
+		oversized.Add(id)
+		require.NoError(t, fvStore.Set(indexKey, id, 100+uint64(id)))
+	}
+	require.NoError(t, skbmStore.MSet(indexKey, []store.SortKeyBitmap{{SortKey: 100, Bitmap: oversized}}))
+
+	require.NoError(t, w.Resplit(skbmStore, fvStore, 100))
+
+	sortedBms := assertBucketsConsistent(t, skbmStore, fvStore, indexKey, oversized)
+	assert.Greater(t, len(sortedBms), 1)
+	assert.Equal(t, uint64(100), sortedBms[0].SortKey)
+	for _, sortedBm := range sortedBms {
+		assert.Less(t, sortedBm.Bitmap.GetCardinality(), uint64(4), "bucket %d", sortedBm.SortKey)
+	}
+}
+
+// assertBucketsConsistent checks the buckets of a sparse index are disjoint, hold exactly the expected ids,
+// and that ids of a bucket are not less than its sort key and less than the next one
+func assertBucketsConsistent(t *testing.T, skbmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, indexKey string, expected *roaring.Bitmap) []store.SortKeyBitmap {
+	sortedBms := scanBuckets(t, skbmStore, indexKey)
+	all := roaring.New()
+	for i, sortedBm := range sortedBms {
+		assert.False(t, all.Intersects(sortedBm.Bitmap), "bucket %d", sortedBm.SortKey)
+		all.Or(sortedBm.Bitmap)
+		sortIds, err := index.QuerySortIds(fvStore, indexKey, sortedBm.Bitmap)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, sortIds[0].SortKey, sortedBm.SortKey)
+		if i+1 < len(sortedBms) {
+			assert.Less(t, sortIds[len(sortIds)-1].SortKey, sortedBms[i+1].SortKey)
+		}
+	}
+	assert.Equal(t, expected.ToArray(), all.ToArray())
+	return sortedBms
+}
+
+func TestSparseVerifyRepairsInconsistentFvs(t *testing.T) {
+	_, skbmStore, fvStore := newMemTestStores()
+	w, err := NewSparseU64IndexWriter("orders", "create_time", 8)
+	require.NoError(t, err)
+	indexKey := w.Index.MakeIndexKey()
+	rnd := rand.New(rand.NewSource(1))
+	expected := roaring.New()
+	for id := uint32(1); id <= 500; id++ {
+		require.NoError(t, w.Add(skbmStore, fvStore, uint64(rnd.Int63n(100_000)), id))
+		expected.Add(id)
+	}
+	stats, err := w.Verify(skbmStore, fvStore, false)
+	require.NoError(t, err)
+	assert.Equal(t, VerifyStats{Buckets: len(scanBuckets(t, skbmStore, indexKey)), Ids: 500}, stats)
+
+	buckets := scanBuckets(t, skbmStore, indexKey)
+	require.Greater(t, len(buckets), 10)
+	for id := uint32(1); id <= 500; id++ {
+		switch rnd.Intn(10) {
+		case 0:
+			// the bitmap was written but not the fv
+			require.NoError(t, fvStore.Remove(indexKey, id))
+			expected.Remove(id)
+		case 1:
+			// the fv was moved but not the bitmap
+			require.NoError(t, fvStore.Set(indexKey, id, uint64(rnd.Int63n(100_000))))
+		case 2:
+			// a stale copy in another bucket
+			bucket := buckets[rnd.Intn(len(buckets))]
+			bucket.Bitmap.Add(id)
+			require.NoError(t, skbmStore.MSet(indexKey, []store.SortKeyBitmap{bucket}))
+		}
+	}
+
+	stats, err = w.Verify(skbmStore, fvStore, false)
+	require.NoError(t, err)
+	assert.Greater(t, stats.MissingFv, 0)
+	assert.Greater(t, stats.Misplaced, 0)
+	// reporting doesn't change anything
+	again, err := w.Verify(skbmStore, fvStore, false)
+	require.NoError(t, err)
+	assert.Equal(t, stats, again)
+
+	repaired, err := w.Verify(skbmStore, fvStore, true)
+	require.NoError(t, err)
+	assert.Equal(t, stats.MissingFv, repaired.MissingFv)
+	assert.Equal(t, stats.Misplaced, repaired.Misplaced)
+	stats, err = w.Verify(skbmStore, fvStore, false)
+	require.NoError(t, err)
+	assert.Zero(t, stats.MissingFv)
+	assert.Zero(t, stats.Misplaced)
+	assertBucketsConsistent(t, skbmStore, fvStore, indexKey, expected)
+}
+
+// newTestProviderRangeWriter returns the provider_id range writer of the orders table
+func newTestProviderRangeWriter(t *testing.T) *SparseIndexWriter[int64] {
+	w, err := NewProviderIdRangeWriter("orders", DefaultSplitThreshold)
+	require.NoError(t, err)
+	return w
+}
+
+func TestConsumerVerifySparse(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.ProviderIdRangeWriter = newTestProviderRangeWriter(t)
+	provider := int64(7)
+	require.NoError(t, consumer.onInsert(Order{ID: 1, OrderStatus: 1, ProviderID: &provider, CreateTime: 100}))
+	require.NoError(t, consumer.onInsert(Order{ID: 2, OrderStatus: 1, CreateTime: 200}))
+	createTimeKey := consumer.CreateTimeIndexWriter.Index.MakeIndexKey()
+	require.NoError(t, fvStore.Remove(createTimeKey, 2))
+	c := &Consumer{tasks: make(chan claimTask), done: make(chan struct{})}
+	consumer.Tasks = c.tasks
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = consumer.ConsumeClaim(testSession{ctx: ctx}, &testClaim{messages: make(chan *sarama.ConsumerMessage)})
+	}()
+
+	stats, err := c.VerifySparse(context.Background(), false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]VerifyStats{
+		createTimeKey: {Buckets: 1, Ids: 2, MissingFv: 1},
+		consumer.ProviderIdRangeWriter.Index.MakeIndexKey(): {Buckets: 1, Ids: 1},
+	}, stats)
+	_, err = c.VerifySparse(context.Background(), true)
+	require.NoError(t, err)
+	stats, err = c.VerifySparse(context.Background(), false)
+	require.NoError(t, err)
+	assert.Equal(t, VerifyStats{Buckets: 1, Ids: 1}, stats[createTimeKey])
+}
+
+// TestSplitSortIds splits a bucket by the sort ids the reader side returns from index.QuerySortIds
+func TestSplitSortIds(t *testing.T) {
+	bucket := store.SortKeyBitmap{SortKey: 10, Bitmap: roaring.BitmapOf(1, 2, 3, 4, 5)}
+	// id 5 has no sort key and stays in the first part
+	sortIds := []index.SortId{{Id: 3, SortKey: 10}, {Id: 1, SortKey: 12}, {Id: 4, SortKey: 12}, {Id: 2, SortKey: 15}}
+	parts := splitSortIds(bucket, sortIds)
+	require.Len(t, parts, 2)
+	assert.Equal(t, uint64(10), parts[0].SortKey)
+	assert.Equal(t, []uint32{1, 3, 4, 5}, parts[0].Bitmap.ToArray())
+	assert.Equal(t, uint64(15), parts[1].SortKey)
+	assert.Equal(t, []uint32{2}, parts[1].Bitmap.ToArray())
+}
+
+func TestSparseCompactRestoresBalancedBuckets(t *testing.T) {
+	_, skbmStore, fvStore := newMemTestStores()
+	w, err := NewSparseU64IndexWriter("orders", "create_time", 8)
+	require.NoError(t, err)
+	indexKey := w.Index.MakeIndexKey()
+	expected := roaring.New()
+	for id := uint32(1); id <= 200; id++ {
+		require.NoError(t, w.Add(skbmStore, fvStore, uint64(id)*10, id))
+		expected.Add(id)
+	}
+	// removals leave many tiny buckets behind
+	for id := uint32(1); id <= 200; id++ {
+		if id%7 != 0 {
+			require.NoError(t, w.Remove(skbmStore, fvStore, uint64(id)*10, id))
+			expected.Remove(id)
+		}
+	}
+	// and a lost split leaves an oversized one
+	oversized := roaring.New()
+	for id := uint32(1001); id <= 1020; id++ {
+		oversized.Add(id)
+		expected.Add(id)
+		require.NoError(t, fvStore.Set(indexKey, id, 5000+uint64(id)))
+	}
+	require.NoError(t, skbmStore.MSet(indexKey, []store.SortKeyBitmap{{SortKey: 5000, Bitmap: oversized}}))
+	before := assertBucketsConsistent(t, skbmStore, fvStore, indexKey, expected)
+
+	stats, err := w.Compact(skbmStore, fvStore, 4)
+	require.NoError(t, err)
+	assert.Greater(t, stats.Merges, 0)
+	assert.Equal(t, 1, stats.Resplits)
+	// a second run merges the parts of the re-split bucket
+	_, err = w.Compact(skbmStore, fvStore, 4)
+	require.NoError(t, err)
+
+	sortedBms := assertBucketsConsistent(t, skbmStore, fvStore, indexKey, expected)
+	assert.Less(t, len(sortedBms), len(before))
+	for i, sortedBm := range sortedBms {
+		cardinality := sortedBm.Bitmap.GetCardinality()
+		assert.Less(t, cardinality, uint64(8), "bucket %d", sortedBm.SortKey)
+		if i > 0 {
+			prevCardinality := sortedBms[i-1].Bitmap.GetCardinality()
+			mergeable := min(prevCardinality, cardinality) < 4 && prevCardinality+cardinality < 8
+			assert.False(t, mergeable, "buckets %d and %d", sortedBms[i-1].SortKey, sortedBm.SortKey)
+		}
+	}
+}
+
+func TestSparseWriterRandomChanges(t *testing.T) {
+	_, skbmStore, fvStore := newMemTestStores()
+	w, err := NewSparseU64IndexWriter("orders", "create_time", 8)
+	require.NoError(t, err)
+	indexKey := w.Index.MakeIndexKey()
+	rnd := rand.New(rand.NewSource(1))
+	fvs := make(map[uint32]uint64)
+	expected := roaring.New()
+	for i := 0; i < 1000; i++ {
+		id := uint32(rnd.Intn(300)) + 1
+		fv, ok := fvs[id]
+		after := uint64(rnd.Int63n(500))
+		switch {
+		case !ok:
+			require.NoError(t, w.Add(skbmStore, fvStore, after, id))
+		case i%3 == 0:
+			require.NoError(t, w.Remove(skbmStore, fvStore, fv, id))
+		default:
+			require.NoError(t, w.Move(skbmStore, fvStore, fv, after, id))
+		}
+		if i%250 == 0 {
+			_, err := w.Compact(skbmStore, fvStore, 3)
+			require.NoError(t, err)
+		}
+		switch {
+		case ok && i%3 == 0:
+			delete(fvs, id)
+			expected.Remove(id)
+		default:
+			fvs[id] = after
+			expected.Add(id)
+		}
+	}
+	buckets := assertBucketsConsistent(t, skbmStore, fvStore, indexKey, expected)
+	require.Greater(t, len(buckets), 10)
+}
+
+func TestSparseAddSameSortKeyBeyondThreshold(t *testing.T) {
+	_, skbmStore, fvStore := newMemTestStores()
+	w, err := NewSparseU64IndexWriter("orders", "create_time", 4)
+	require.NoError(t, err)
+	indexKey := w.Index.MakeIndexKey()
+	expected := roaring.New()
+	add := func(fv uint64, id uint32) {
+		require.NoError(t, w.Add(skbmStore, fvStore, fv, id))
+		expected.Add(id)
+	}
+	add(50, 1)
+	add(100, 2)
+	add(100, 3)
+	// bucket 50 now only holds ids at 100
+	require.NoError(t, w.Remove(skbmStore, fvStore, 50, 1))
+	expected.Remove(1)
+	for id := uint32(4); id <= 13; id++ {
+		add(100, id)
+	}
+	assertBucketsConsistent(t, skbmStore, fvStore, indexKey, expected)
+	// different keys around a full homogeneous bucket
+	add(150, 14)
+	add(70, 15)
+	add(100, 16)
+	sortedBms := assertBucketsConsistent(t, skbmStore, fvStore, indexKey, expected)
+	keys := make([]uint64, len(sortedBms))
+	for i, sortedBm := range sortedBms {
+		keys[i] = sortedBm.SortKey
+	}
+	assert.Equal(t, []uint64{50, 100, 150}, keys)
+}
+
+type recordingDeadLetterSink struct {
+	messages []*sarama.ConsumerMessage
+	errs     []error
+}
+
+func (s *recordingDeadLetterSink) Send(message *sarama.ConsumerMessage, err error) error {
+	s.messages = append(s.messages, message)
+	s.errs = append(s.errs, err)
+	return nil
+}
+
+func TestUpdateWithoutBeforeImageIsDeadLettered(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	sink := &recordingDeadLetterSink{}
+	consumer.DeadLetterSink = sink
+	message := &sarama.ConsumerMessage{
+		Offset: 7,
+		Value:  []byte(`{"op":"u","before":null,"after":{"id":1,"order_status":2,"product_id":3,"provider_id":null,"create_time":100}}`),
+	}
+	require.NotPanics(t, func() {
+		require.NoError(t, consumer.process(message))
+	})
+	require.Len(t, sink.messages, 1)
+	assert.Same(t, message, sink.messages[0])
+	assert.ErrorIs(t, sink.errs[0], errInvalidMessage)
+	assert.ErrorContains(t, sink.errs[0], "missing before")
+}
+
+func TestConsumerDeadLettersUndecodableMessages(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	sink := &recordingDeadLetterSink{}
+	consumer.DeadLetterSink = sink
+	for _, value := range []string{
+		`{"op":"c","after":`,
+		`{"op":"x","after":{"id":1,"order_status":1,"product_id":1,"create_time":100}}`,
+	} {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	require.Len(t, sink.errs, 2)
+	for _, err := range sink.errs {
+		assert.ErrorIs(t, err, errInvalidMessage)
+	}
+	// a tombstone is skipped
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: nil}))
+	assert.Len(t, sink.errs, 2)
+}
+
+func TestNewSparseU64IndexWriterValidatesSplitThreshold(t *testing.T) {
+	for _, threshold := range []int{-1, 0, 1} {
+		_, err := NewSparseU64IndexWriter("orders", "create_time", threshold)
+		assert.Error(t, err, "threshold %d", threshold)
+	}
+	w, err := NewSparseU64IndexWriter("orders", "create_time", MinSplitThreshold)
+	require.NoError(t, err)
+	assert.Equal(t, MinSplitThreshold, w.SplitThreshold)
+
+	_, skbmStore, fvStore := newMemTestStores()
+	w.SplitThreshold = 1
+	assert.Error(t, w.Add(skbmStore, fvStore, 100, 1))
+}
+
+func TestKeyNamesRejectSeparator(t *testing.T) {
+	for _, pair := range [][2][2]string{
+		{{"a:b", "c"}, {"a", "b:c"}},
+		{{"orders", "product_id:v2"}, {"orders:product_id", "v2"}},
+	} {
+		// joined names of both pairs make the same key, so they're rejected
+		assert.Equal(t, index.SparseIndex{TableName: pair[0][0], FieldName: pair[0][1]}.MakeIndexKey(),
+			index.SparseIndex{TableName: pair[1][0], FieldName: pair[1][1]}.MakeIndexKey())
+		for _, names := range pair {
+			_, err := NewSparseU64IndexWriter(names[0], names[1], MinSplitThreshold)
+			assert.Error(t, err, "%v", names)
+		}
+	}
+	// a term index of version 2 can't be spelled by a field name either
+	assert.Equal(t, index.TermIndex{TableName: "orders", FieldName: "product_id", Version: 2}.GetIndexKey(),
+		index.TermIndex{TableName: "orders", FieldName: "product_id:v2"}.GetIndexKey())
+	assert.Error(t, index.ValidateKeyName("product_id:v2"))
+	assert.Error(t, index.ValidateKeyName(""))
+	assert.NoError(t, index.ValidateKeyName("purchase_orders"))
+
+	path := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"table":"public:orders"}`), 0o644))
+	_, err := index.LoadTableSchema(path)
+	assert.ErrorContains(t, err, "public:orders")
+	_, err = newSaramaConsumer(index.TableSchema{Table: "public:orders", PrimaryKey: "id"}, nil, nil, nil)
+	assert.ErrorContains(t, err, "public:orders")
+}
+
+func TestSparseAddWithMinSplitThreshold(t *testing.T) {
+	_, skbmStore, fvStore := newMemTestStores()
+	w, err := NewSparseU64IndexWriter("orders", "create_time", MinSplitThreshold)
+	require.NoError(t, err)
+	const n = 50
+	for id := uint32(1); id <= n; id++ {
+		// interleave keys so inserts land in the middle of existing buckets
+		require.NoError(t, w.Add(skbmStore, fvStore, uint64(id%7)*100+uint64(id), id))
+	}
+	sortedBms := scanBuckets(t, skbmStore, w.Index.MakeIndexKey())
+	total := uint64(0)
+	for _, sortedBm := range sortedBms {
+		cardinality := sortedBm.Bitmap.GetCardinality()
+		assert.NotZero(t, cardinality, "bucket %d", sortedBm.SortKey)
+		assert.LessOrEqual(t, cardinality, uint64(MinSplitThreshold), "bucket %d", sortedBm.SortKey)
+		total += cardinality
+	}
+	assert.Equal(t, uint64(n), total)
+	assert.GreaterOrEqual(t, len(sortedBms), n/MinSplitThreshold)
+}
+
+func TestReplayedInsertKeepsIndex(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	insert := &sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"id":1,"order_status":2,"product_id":3,"provider_id":null,"create_time":100}}`)}
+	read := &sarama.ConsumerMessage{Value: []byte(`{"op":"r","after":{"id":1,"order_status":2,"product_id":3,"provider_id":null,"create_time":100}}`)}
+	count := func(op string) int64 {
+		if v, ok := metrics.ConsumerMessages.Get(op).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	inserts, reads := count("insert"), count("snapshot_read")
+	require.NoError(t, consumer.process(insert))
+	require.NoError(t, consumer.process(insert))
+	require.NoError(t, consumer.process(read))
+	assert.Equal(t, inserts+2, count("insert"))
+	assert.Equal(t, reads+1, count("snapshot_read"))
+	// inserts and reads are applied again, which leaves the index as is
+	allBm, err := bmStore.Get(consumer.AllIndexWriter.Index.GetIndexKey(), "0")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1}, allBm.ToArray())
+	statusBm, err := bmStore.Get(consumer.OrderStatusIndexWriter.Index.GetIndexKey(), "2")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1}, statusBm.ToArray())
+	assert.Len(t, scanBuckets(t, skbmStore, consumer.CreateTimeIndexWriter.Index.MakeIndexKey()), 1)
+}
+
+func TestConsumerCountsErrorsByOp(t *testing.T) {
+	bmStore, skbmStore, fvStore := storetest.NewRedis(t)
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	count := func(m *expvar.Map, op string) int64 {
+		if v, ok := m.Get(op).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	updates, updateErrors := count(metrics.ConsumerMessages, "update"), count(metrics.ConsumerErrors, "update")
+	update := &sarama.ConsumerMessage{Value: []byte(`{"op":"u","before":{"id":1,"order_status":1,"product_id":0,"create_time":100},"after":{"id":1,"order_status":2,"create_time":100}}`)}
+	require.NoError(t, consumer.process(update))
+	assert.Equal(t, updates+1, count(metrics.ConsumerMessages, "update"))
+	require.NoError(t, bmStore.RDB.Close())
+	require.Error(t, consumer.process(update))
+	assert.Equal(t, updates+1, count(metrics.ConsumerMessages, "update"))
+	assert.Equal(t, updateErrors+1, count(metrics.ConsumerErrors, "update"))
+}
+
+func TestDerivedIndexesFollowCreateTime(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.DerivedIndexWriters = NewDerivedIndexWriters("orders", []index.DerivedField{index.CreateWeekday, index.CreateQuarter})
+	ids := func(field string, value string) []uint32 {
+		bm, err := bmStore.Get(index.TermIndex{TableName: "orders", FieldName: field}.GetIndexKey(), value)
+		require.NoError(t, err)
+		return bm.ToArray()
+	}
+	saturdayInQ1 := time.Date(2024, 1, 6, 10, 0, 0, 0, time.UTC).UnixMicro()
+	wednesdayInQ2 := time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC).UnixMicro()
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"op":"c","after":{"id":1,"order_status":1,"product_id":1,"create_time":%d}}`, saturdayInQ1))}))
+	assert.Equal(t, []uint32{1}, ids("create_weekday", "6"))
+	assert.Equal(t, []uint32{1}, ids("create_quarter", "1"))
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"op":"u","before":{"id":1,"order_status":1,"product_id":1,"create_time":%d},"after":{"id":1,"order_status":1,"product_id":1,"create_time":%d}}`, saturdayInQ1, wednesdayInQ2))}))
+	assert.Empty(t, ids("create_weekday", "6"))
+	assert.Empty(t, ids("create_quarter", "1"))
+	assert.Equal(t, []uint32{1}, ids("create_weekday", "3"))
+	assert.Equal(t, []uint32{1}, ids("create_quarter", "2"))
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"op":"d","before":{"id":1,"order_status":1,"product_id":1,"create_time":%d}}`, wednesdayInQ2))}))
+	assert.Empty(t, ids("create_weekday", "3"))
+	assert.Empty(t, ids("create_quarter", "2"))
+}
+
+func TestConsumerNormalizesTimeUnit(t *testing.T) {
+	saturday := time.Date(2024, 1, 6, 10, 0, 0, 0, time.UTC)
+	for unit, createTime := range map[index.TimeUnit]int64{
+		"":                    saturday.UnixMicro(),
+		index.TimeUnitSeconds: saturday.Unix(),
+		index.TimeUnitMillis:  saturday.UnixMilli(),
+		index.TimeUnitMicros:  saturday.UnixMicro(),
+	} {
+		t.Run(string(unit), func(t *testing.T) {
+			bmStore, skbmStore, fvStore := newMemTestStores()
+			consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+			consumer.TimeUnit = unit
+			consumer.DerivedIndexWriters = NewDerivedIndexWriters("orders", []index.DerivedField{index.CreateWeekday})
+			require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"op":"c","after":{"id":1,"order_status":1,"product_id":1,"create_time":%d}}`, createTime))}))
+			values, err := fvStore.MGet(consumer.CreateTimeIndexWriter.Index.MakeIndexKey(), []uint32{1})
+			require.NoError(t, err)
+			assert.Equal(t, []uint64{uint64(saturday.UnixMicro())}, values)
+			bm, err := bmStore.Get(index.TermIndex{TableName: "orders", FieldName: "create_weekday"}.GetIndexKey(), "6")
+			require.NoError(t, err)
+			assert.Equal(t, []uint32{1}, bm.ToArray())
+		})
+	}
+}
+
+func TestConsumerDeadLettersOverflowingCreateTime(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.TimeUnit = index.TimeUnitSeconds
+	sink := &recordingDeadLetterSink{}
+	consumer.DeadLetterSink = sink
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"id":1,"order_status":1,"product_id":1,"create_time":18446744073709551}}`)}))
+	require.Len(t, sink.errs, 1)
+	assert.ErrorIs(t, sink.errs[0], errInvalidMessage)
+	assert.ErrorContains(t, sink.errs[0], "out of range")
+}
+
+func TestConsumerMapsSchemaColumns(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	schema := index.TableSchema{Table: "purchases", PrimaryKey: "pk", Columns: map[string]string{"order_status": "state"}}
+	consumer := newTestConsumer(t, schema, bmStore, skbmStore, fvStore)
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"pk":7,"state":2,"product_id":3,"provider_id":null,"create_time":100}}`)}))
+	statusBm, err := bmStore.Get("term:purchases:order_status", "2")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{7}, statusBm.ToArray())
+	allBm, err := bmStore.Get("term:purchases:__all", "0")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{7}, allBm.ToArray())
+}
+
+func TestConsumerDeadLettersRowWithoutPrimaryKey(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	schema := index.TableSchema{Table: "purchases", PrimaryKey: "pk"}
+	consumer := newTestConsumer(t, schema, bmStore, skbmStore, fvStore)
+	sink := &recordingDeadLetterSink{}
+	consumer.DeadLetterSink = sink
+	// an id column isn't the primary key of purchases, so the row would be indexed as 0
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"id":7,"order_status":1,"product_id":1,"create_time":100}}`)}))
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"pk":null,"order_status":1,"product_id":1,"create_time":100}}`)}))
+	require.Len(t, sink.errs, 2)
+	for _, err := range sink.errs {
+		assert.ErrorIs(t, err, errInvalidMessage)
+		assert.ErrorContains(t, err, "missing primary key")
+	}
+	allBm, err := bmStore.Get("term:purchases:__all", "0")
+	require.NoError(t, err)
+	assert.True(t, allBm.IsEmpty())
+}
+
+func TestConsumerDeadLettersUndecodableColumns(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	schema := index.TableSchema{Table: "orders", PrimaryKey: "id", Fields: []index.Field{{Name: "region", Kind: index.TermKind}}}
+	consumer := newTestConsumer(t, schema, bmStore, skbmStore, fvStore)
+	sink := &recordingDeadLetterSink{}
+	consumer.DeadLetterSink = sink
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"id":1,"order_status":"paid","product_id":1,"create_time":100}}`)}))
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"id":2,"order_status":1,"product_id":1,"create_time":100,"region":"eu"}}`)}))
+	require.Len(t, sink.errs, 2)
+	for _, err := range sink.errs {
+		assert.ErrorIs(t, err, errInvalidMessage)
+		assert.ErrorContains(t, err, "failed to decode column")
+	}
+}
+
+func TestConsumerIndexesSchemaFields(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	schema := index.TableSchema{Table: "orders", PrimaryKey: "id", Columns: map[string]string{"price": "price_cents"},
+		Fields: []index.Field{{Name: "region", Kind: index.TermKind}, {Name: "price", Kind: index.SparseKind}}}
+	consumer := newTestConsumer(t, schema, bmStore, skbmStore, fvStore)
+	consumer.LookupIncompleteDeletes = true
+	for _, value := range []string{
+		`{"op":"c","after":{"id":1,"order_status":1,"product_id":1,"create_time":100,"region":3,"price_cents":-500}}`,
+		`{"op":"c","after":{"id":2,"order_status":1,"product_id":1,"create_time":200,"region":3,"price_cents":2000}}`,
+		`{"op":"c","after":{"id":3,"order_status":1,"product_id":1,"create_time":300,"region":null,"price_cents":null}}`,
+		`{"op":"c","after":{"id":4,"order_status":1,"product_id":1,"create_time":400,"region":4,"price_cents":1000}}`,
+		`{"op":"u","before":{"id":2,"order_status":1,"product_id":1,"create_time":200,"region":3,"price_cents":2000},"after":{"id":2,"order_status":1,"product_id":1,"create_time":200,"region":4,"price_cents":1500}}`,
+		`{"op":"d","before":{"id":4}}`,
+	} {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	ss := query.NewSearchService(schema, bmStore, skbmStore, fvStore)
+	list := func(r query.Request) []uint32 {
+		resp, err := ss.List(r)
+		require.NoError(t, err, "%+v", r)
+		return resp.IDs
+	}
+	assert.Equal(t, []uint32{1}, list(query.Request{FieldEq: []query.TermPredicate{{Field: "region", Value: 3}}}))
+	assert.Equal(t, []uint32{2}, list(query.Request{FieldEq: []query.TermPredicate{{Field: "region", Value: 4}}}))
+	assert.Equal(t, []uint32{2, 1}, list(query.Request{FieldLte: []query.TermPredicate{{Field: "price", Value: 1500}}}))
+	assert.Equal(t, []uint32{2}, list(query.Request{FieldGte: []query.TermPredicate{{Field: "price", Value: 0}}, FieldLte: []query.TermPredicate{{Field: "price", Value: 1500}}}))
+	// the tightest bound of a field wins
+	assert.Empty(t, list(query.Request{FieldGte: []query.TermPredicate{{Field: "price", Value: 0}, {Field: "price", Value: 1600}}}))
+	assert.Equal(t, []uint32{2, 1}, list(query.Request{ShouldMatch: []query.TermPredicate{{Field: "region", Value: 3}, {Field: "region", Value: 4}}}))
+	for _, r := range []query.Request{
+		{FieldEq: []query.TermPredicate{{Field: "price", Value: 1}}},
+		{FieldGte: []query.TermPredicate{{Field: "region", Value: 1}}},
+	} {
+		_, err := ss.List(r)
+		assert.ErrorIs(t, err, query.ErrFieldNotIndexed, "%+v", r)
+		assert.ErrorIs(t, ss.CheckFields(r), query.ErrFieldNotIndexed, "%+v", r)
+	}
+	// the incomplete delete of 4 found its values
+	regionBm, err := bmStore.Get("term:orders:region", "4")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{2}, regionBm.ToArray())
+
+	_, err = newSaramaConsumer(index.TableSchema{Table: "orders", PrimaryKey: "id", Fields: []index.Field{{Name: "product_id", Kind: index.TermKind}}}, nil, nil, nil)
+	assert.ErrorContains(t, err, "Duplicate field")
+	_, err = newSaramaConsumer(index.TableSchema{Table: "orders", PrimaryKey: "id", Fields: []index.Field{{Name: "region", Kind: "bitmap"}}}, nil, nil, nil)
+	assert.ErrorContains(t, err, "Invalid field kind")
+}
+
+func TestConsumerTracksSoftDelete(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	schema := index.TableSchema{Table: "orders", PrimaryKey: "id", SoftDeleteColumn: "is_deleted"}
+	consumer := newTestConsumer(t, schema, bmStore, skbmStore, fvStore)
+	deleted := func() []uint32 {
+		bm, err := bmStore.Get("term:orders:__deleted", "0")
+		require.NoError(t, err)
+		return bm.ToArray()
+	}
+	process := func(value string) {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	process(`{"op":"c","after":{"id":1,"order_status":1,"product_id":1,"create_time":100,"is_deleted":false}}`)
+	process(`{"op":"c","after":{"id":2,"order_status":1,"product_id":1,"create_time":100,"is_deleted":true}}`)
+	assert.Equal(t, []uint32{2}, deleted())
+	process(`{"op":"u","before":{"id":1,"order_status":1,"product_id":1,"create_time":100,"is_deleted":false},"after":{"id":1,"order_status":1,"product_id":1,"create_time":100,"is_deleted":true}}`)
+	assert.Equal(t, []uint32{1, 2}, deleted())
+	process(`{"op":"u","before":{"id":2,"order_status":1,"product_id":1,"create_time":100,"is_deleted":true},"after":{"id":2,"order_status":1,"product_id":1,"create_time":100,"is_deleted":false}}`)
+	process(`{"op":"d","before":{"id":1,"order_status":1,"product_id":1,"create_time":100,"is_deleted":true}}`)
+	assert.Empty(t, deleted())
+
+	// a flag unchanged between complete images isn't written, so the drifted bit stays
+	process(`{"op":"c","after":{"id":3,"order_status":1,"product_id":1,"create_time":100,"is_deleted":false}}`)
+	require.NoError(t, bmStore.AddBit("term:orders:__deleted", "0", 3))
+	process(`{"op":"u","before":{"id":3,"order_status":1,"product_id":1,"create_time":100,"is_deleted":false},"after":{"id":3,"order_status":2,"product_id":1,"create_time":100,"is_deleted":false}}`)
+	assert.Equal(t, []uint32{3}, deleted())
+	// a before image without the flag doesn't tell: the update is dead-lettered, or applied from the looked up values
+	incomplete := `{"op":"u","before":{"id":3,"order_status":2,"product_id":1,"create_time":100},"after":{"id":3,"order_status":1,"product_id":1,"create_time":100,"is_deleted":false}}`
+	process(incomplete)
+	assert.Equal(t, []uint32{3}, deleted())
+	consumer.LookupIncompleteDeletes = true
+	process(incomplete)
+	assert.Empty(t, deleted())
+}
+
+func TestConsumerStoresSortValues(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.SortValueWriters = NewSortValueWriters("orders", []string{"provider_id"})
+	providerID := func(id uint32) (int64, bool) {
+		values, found, err := fvStore.MGetFound("sortvalues:orders:provider_id", []uint32{id})
+		require.NoError(t, err)
+		return store.Int64Codec{}.Decode(values[0]), found[0]
+	}
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"id":1,"order_status":1,"provider_id":-5,"create_time":100}}`)}))
+	v, ok := providerID(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(-5), v)
+	// a null provider_id has no value
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"u","before":{"id":1,"order_status":1,"product_id":0,"provider_id":-5,"create_time":100},"after":{"id":1,"order_status":1,"create_time":100}}`)}))
+	_, ok = providerID(1)
+	assert.False(t, ok)
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"u","before":{"id":1,"order_status":1,"product_id":0,"create_time":100},"after":{"id":1,"order_status":1,"provider_id":7,"create_time":100}}`)}))
+	v, ok = providerID(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), v)
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"d","before":{"id":1,"order_status":1,"product_id":0,"provider_id":7,"create_time":100}}`)}))
+	_, ok = providerID(1)
+	assert.False(t, ok)
+}
+
+func TestConsumerMovesProviderRange(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.ProviderIdRangeWriter = newTestProviderRangeWriter(t)
+	providerID := func(id uint32) (int64, bool) {
+		values, found, err := fvStore.MGetFound("sparse:orders:provider_id", []uint32{id})
+		require.NoError(t, err)
+		return store.Int64Codec{}.Decode(values[0]), found[0]
+	}
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"id":1,"order_status":1,"provider_id":-5,"create_time":100}}`)}))
+	v, ok := providerID(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(-5), v)
+	// null providers aren't indexed
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"u","before":{"id":1,"order_status":1,"product_id":0,"provider_id":-5,"create_time":100},"after":{"id":1,"order_status":1,"create_time":100}}`)}))
+	_, ok = providerID(1)
+	assert.False(t, ok)
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"u","before":{"id":1,"order_status":1,"product_id":0,"create_time":100},"after":{"id":1,"order_status":1,"provider_id":7,"create_time":100}}`)}))
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"u","before":{"id":1,"order_status":1,"product_id":0,"provider_id":7,"create_time":100},"after":{"id":1,"order_status":1,"provider_id":9,"create_time":100}}`)}))
+	v, ok = providerID(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(9), v)
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"d","before":{"id":1,"order_status":1,"product_id":0,"provider_id":9,"create_time":100}}`)}))
+	_, ok = providerID(1)
+	assert.False(t, ok)
+}
+
+// claimedSession is a session claiming partitions of a topic without messages
+type claimedSession struct {
+	sarama.ConsumerGroupSession
+}
+
+func (claimedSession) Claims() map[string][]int32 {
+	return map[string][]int32{"orders": {0, 1}}
+}
+
+func TestConsumerReadyOnceSessionSetUp(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	var ready atomic.Bool
+	consumer.Ready = &ready
+	require.NoError(t, consumer.Setup(claimedSession{}))
+	assert.True(t, ready.Load())
+	require.NoError(t, consumer.Cleanup(claimedSession{}))
+	assert.False(t, ready.Load())
+}
+
+// testClaim delivers messages of partition 0 of a topic with the high-water mark set by the test
+type testClaim struct {
+	sarama.ConsumerGroupClaim
+	messages      chan *sarama.ConsumerMessage
+	initialOffset int64
+	highWaterMark int64
+}
+
+func (c *testClaim) Topic() string                            { return "orders" }
+func (c *testClaim) Partition() int32                         { return 0 }
+func (c *testClaim) InitialOffset() int64                     { return c.initialOffset }
+func (c *testClaim) HighWaterMarkOffset() int64               { return c.highWaterMark }
+func (c *testClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// testSession is a session marking messages nowhere
+type testSession struct {
+	sarama.ConsumerGroupSession
+	ctx context.Context
+}
+
+func (s testSession) Context() context.Context                  { return s.ctx }
+func (testSession) MarkMessage(*sarama.ConsumerMessage, string) {}
+
+func TestConsumerStatusReportsLag(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	c := &Consumer{}
+	consumer.Offsets = &c.offsets
+	claim := &testClaim{messages: make(chan *sarama.ConsumerMessage), initialOffset: 10, highWaterMark: 15}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- consumer.ConsumeClaim(testSession{ctx: ctx}, claim) }()
+	status := func(offset int64, highWaterMark int64, lag int64) []PartitionStatus {
+		return []PartitionStatus{{Topic: "orders", Partition: 0, Offset: offset, HighWaterMark: highWaterMark, Lag: lag}}
+	}
+	assert.Eventually(t, func() bool { return assert.ObjectsAreEqual(status(10, 15, 5), c.Status()) }, time.Second, time.Millisecond)
+	for offset := int64(10); offset < 13; offset++ {
+		claim.messages <- &sarama.ConsumerMessage{Offset: offset, Value: []byte(fmt.Sprintf(`{"op":"c","after":{"id":%d,"order_status":1,"create_time":100}}`, offset))}
+	}
+	assert.Eventually(t, func() bool { return assert.ObjectsAreEqual(status(13, 15, 2), c.Status()) }, time.Second, time.Millisecond)
+	// the lag grows with the topic while no message is applied
+	claim.highWaterMark = 20
+	assert.Equal(t, status(13, 20, 7), c.Status())
+	close(claim.messages)
+	require.NoError(t, <-done)
+	assert.Empty(t, c.Status())
+}
+
+func TestConsumerSkipsAppliedOffsets(t *testing.T) {
+	bmStore, skbmStore, fvStore := storetest.NewRedis(t)
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.AppliedOffsets = &store.AppliedOffsets{RDB: bmStore.RDB, Key: "test:offsets"}
+	batch := []string{
+		`{"op":"c","after":{"id":1,"order_status":1,"create_time":100}}`,
+		`{"op":"u","before":{"id":1,"order_status":1,"product_id":0,"create_time":100},"after":{"id":1,"order_status":2,"create_time":100}}`,
+		`{"op":"c","after":{"id":2,"order_status":1,"create_time":200}}`,
+	}
+	count := func(op string) int64 {
+		if v, ok := metrics.ConsumerMessages.Get(op).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	consume := func() {
+		claim := &testClaim{messages: make(chan *sarama.ConsumerMessage, len(batch)), highWaterMark: int64(len(batch))}
+		for offset, value := range batch {
+			claim.messages <- &sarama.ConsumerMessage{Offset: int64(offset), Value: []byte(value)}
+		}
+		close(claim.messages)
+		require.NoError(t, consumer.ConsumeClaim(testSession{ctx: context.Background()}, claim))
+	}
+	inserts, updates, replayed := count("insert"), count("update"), count("replayed")
+	consume()
+	assert.Equal(t, inserts+2, count("insert"))
+	assert.Equal(t, updates+1, count("update"))
+	assert.Equal(t, replayed, count("replayed"))
+	consume()
+	assert.Equal(t, inserts+2, count("insert"))
+	assert.Equal(t, updates+1, count("update"))
+	assert.Equal(t, replayed+3, count("replayed"))
+	offset, err := consumer.AppliedOffsets.Get("orders", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), offset)
+	statusBm, err := bmStore.Get(consumer.OrderStatusIndexWriter.Index.GetIndexKey(), "2")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1}, statusBm.ToArray())
+}
+
+// markingSession runs onMark on each marked message
+type markingSession struct {
+	testSession
+	onMark func(message *sarama.ConsumerMessage)
+}
+
+func (s markingSession) MarkMessage(message *sarama.ConsumerMessage, _ string) { s.onMark(message) }
+
+func TestConsumeClaimCommitsBatches(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	bmStore := &store.RedisBmStore{RDB: rdb, Prefix: "test:bm:"}
+	_, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.AppliedOffsets = &store.AppliedOffsets{RDB: rdb, Key: "test:offsets"}
+	consumer.LookupIncompleteDeletes = true
+	consumer.BatchSize = 2
+	var marked []int64
+	session := markingSession{testSession: testSession{ctx: context.Background()}, onMark: func(message *sarama.ConsumerMessage) {
+		// the batch and its offset are written before the message is marked
+		offset, err := consumer.AppliedOffsets.Get("orders", 0)
+		require.NoError(t, err)
+		assert.Equal(t, message.Offset, offset)
+		marked = append(marked, message.Offset)
+	}}
+	consume := func(first int64, values ...string) error {
+		claim := &testClaim{messages: make(chan *sarama.ConsumerMessage, len(values))}
+		for i, value := range values {
+			claim.messages <- &sarama.ConsumerMessage{Offset: first + int64(i), Value: []byte(value)}
+		}
+		close(claim.messages)
+		return consumer.ConsumeClaim(session, claim)
+	}
+	require.NoError(t, consume(0,
+		`{"op":"c","after":{"id":1,"order_status":1,"create_time":100}}`,
+		`{"op":"c","after":{"id":2,"order_status":1,"create_time":200}}`,
+		`{"op":"c","after":{"id":3,"order_status":2,"create_time":300}}`,
+		// the lookup reads the bitmaps of the batch with the insert
+		`{"op":"d","before":{"id":3}}`,
+	))
+	assert.Equal(t, []int64{1, 3}, marked)
+	status := func(value string) []uint32 {
+		bm, err := bmStore.Get(consumer.OrderStatusIndexWriter.Index.GetIndexKey(), value)
+		require.NoError(t, err)
+		return bm.ToArray()
+	}
+	assert.Equal(t, []uint32{1, 2}, status("1"))
+	assert.Empty(t, status("2"))
+
+	// a failed message rolls back its batch, nothing is written
+	require.NoError(t, rdb.HSet(context.Background(), bmStore.Prefix+consumer.OrderStatusIndexWriter.Index.GetIndexKey(), "0", "corrupted").Err())
+	snapshot := mr.Dump()
+	require.Error(t, consume(4,
+		`{"op":"c","after":{"id":4,"order_status":1,"create_time":400}}`,
+		`{"op":"d","before":{"id":1}}`,
+	))
+	assert.Equal(t, snapshot, mr.Dump())
+	assert.Equal(t, []int64{1, 3}, marked)
+}
+
+func TestParseStartOffset(t *testing.T) {
+	for spec, want := range map[string]map[int32]int64{
+		"":             {},
+		"100":          {AllPartitions: 100},
+		"0=100, 2=0":   {0: 100, 2: 0},
+		"0=100,7":      {0: 100, AllPartitions: 7},
+		"3=9223372036": {3: 9223372036},
+	} {
+		offsets, err := ParseStartOffset(spec)
+		require.NoError(t, err, spec)
+		assert.Equal(t, want, offsets, spec)
+	}
+	for _, spec := range []string{"-1", "x", "0=", "-1=5", "a=1", "1=2,1=3", "4,5"} {
+		_, err := ParseStartOffset(spec)
+		assert.Error(t, err, spec)
+	}
+	assert.Equal(t, map[int32]int64{0: 10, 1: 5, 2: 5}, startOffsetsOf([]int32{0, 1, 2}, map[int32]int64{0: 10, AllPartitions: 5}))
+	assert.Equal(t, map[int32]int64{1: 3}, startOffsetsOf([]int32{0, 1}, map[int32]int64{1: 3, 4: 1}))
+}
+
+func TestStartOffsetNeedsResetOffsets(t *testing.T) {
+	_, err := NewConsumer(Config{Topic: "orders", StartOffset: map[int32]int64{AllPartitions: 0}})
+	assert.ErrorContains(t, err, "ResetOffsets")
+}
+
+// recordingOffsetManager records the offsets reset through it and when they're committed
+type recordingOffsetManager struct {
+	sarama.OffsetManager
+	reset     map[int32]int64
+	committed map[int32]int64
+	closed    bool
+}
+
+type recordingPartitionOffsetManager struct {
+	sarama.PartitionOffsetManager
+	om        *recordingOffsetManager
+	partition int32
+}
+
+func (om *recordingOffsetManager) ManagePartition(topic string, partition int32) (sarama.PartitionOffsetManager, error) {
+	return &recordingPartitionOffsetManager{om: om, partition: partition}, nil
+}
+
+func (om *recordingOffsetManager) Commit() {
+	om.committed = maps.Clone(om.reset)
+}
+
+func (om *recordingOffsetManager) Close() error {
+	om.closed = true
+	return nil
+}
+
+func (pom *recordingPartitionOffsetManager) NextOffset() (int64, string) { return 42, "" }
+func (pom *recordingPartitionOffsetManager) ResetOffset(offset int64, metadata string) {
+	pom.om.reset[pom.partition] = offset
+}
+func (pom *recordingPartitionOffsetManager) Close() error { return nil }
+
+func TestResetOffsetsSeedsGroupAndAppliedOffsets(t *testing.T) {
+	om := &recordingOffsetManager{reset: make(map[int32]int64)}
+	offsets := map[int32]int64{0: 10, 1: 100}
+	require.NoError(t, seedOffsets(om, "inv-pg-0", "orders", offsets))
+	// offsets can move back, unlike marked ones
+	assert.Equal(t, offsets, om.committed)
+	assert.True(t, om.closed)
+
+	bmStore, _, _ := storetest.NewRedis(t)
+	appliedOffsets := &store.AppliedOffsets{RDB: bmStore.RDB, Key: "test:offsets"}
+	require.NoError(t, appliedOffsets.Set("orders", 0, 50))
+	require.NoError(t, appliedOffsets.Set("orders", 1, 20))
+	c := &Consumer{topic: "orders", startOffset: offsets}
+	require.NoError(t, c.rewindAppliedOffsets(appliedOffsets))
+	for partition, want := range map[int32]int64{0: 9, 1: 20} {
+		applied, err := appliedOffsets.Get("orders", partition)
+		require.NoError(t, err)
+		assert.Equal(t, want, applied, "partition %d", partition)
+	}
+}
+
+// flakyConsumerGroup fails the first failures sessions, then reports the group as closed
+type flakyConsumerGroup struct {
+	sarama.ConsumerGroup
+	failures int
+	calls    int
+}
+
+func (g *flakyConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.calls++
+	if g.calls <= g.failures {
+		return errors.New("broker unavailable")
+	}
+	return sarama.ErrClosedConsumerGroup
+}
+
+func TestConsumerRetriesFailedSessions(t *testing.T) {
+	g := &flakyConsumerGroup{failures: 3}
+	c := &Consumer{client: g, retryBackoff: Backoff{Initial: time.Millisecond, Max: 2 * time.Millisecond}, fatal: make(chan error, 1)}
+	c.run(nil)
+	assert.Equal(t, 4, g.calls)
+	assert.Empty(t, c.Fatal())
+}
+
+func TestConsumerGivesUpAfterMaxFailures(t *testing.T) {
+	g := &flakyConsumerGroup{failures: 10}
+	c := &Consumer{client: g, retryBackoff: Backoff{Initial: time.Millisecond, Max: 2 * time.Millisecond}, maxConsecutiveFailures: 3, fatal: make(chan error, 1)}
+	c.run(nil)
+	assert.Equal(t, 3, g.calls)
+	select {
+	case err := <-c.Fatal():
+		assert.ErrorContains(t, err, "broker unavailable")
+	default:
+		t.Fatal("expected a fatal error")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	for attempt, ceil := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 4: 50 * time.Millisecond, 100: 50 * time.Millisecond} {
+		for i := 0; i < 20; i++ {
+			delay := b.Delay(attempt)
+			assert.Greater(t, delay, time.Duration(0))
+			assert.LessOrEqual(t, delay, ceil, "attempt %d", attempt)
+		}
+	}
+}
+
+func TestRetryConnect(t *testing.T) {
+	b := Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond}
+	attempts := 0
+	client, err := retryConnect(time.Second, b, func() (string, error) {
+		attempts++
+		if attempts < 3 {
+			return "", fmt.Errorf("broker down, attempt=%d", attempts)
+		}
+		return "client", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "client", client)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	start := time.Now()
+	_, err = retryConnect(50*time.Millisecond, b, func() (string, error) {
+		attempts++
+		return "", fmt.Errorf("broker down, attempt=%d", attempts)
+	})
+	assert.EqualError(t, err, fmt.Sprintf("broker down, attempt=%d", attempts))
+	assert.Greater(t, attempts, 1)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// no wait fails on the first error
+	attempts = 0
+	_, err = retryConnect(0, b, func() (string, error) {
+		attempts++
+		return "", errors.New("broker down")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+// writeRecorder records the keys written through a redis client
+type writeRecorder struct {
+	mu   stdsync.Mutex
+	keys []string
+}
+
+func (h *writeRecorder) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *writeRecorder) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.record(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *writeRecorder) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			h.record(cmd)
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func (h *writeRecorder) record(cmd redis.Cmder) {
+	switch cmd.Name() {
+	case "hset", "hdel", "zadd", "zrem", "del":
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.keys = append(h.keys, fmt.Sprint(cmd.Args()[1]))
+	case "eval", "evalsha":
+		// bit updates, the script's first key follows the script and the key count
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.keys = append(h.keys, fmt.Sprint(cmd.Args()[3]))
+	}
+}
+
+func TestUpdateSkipsUnchangedFields(t *testing.T) {
+	bmStore, skbmStore, fvStore := storetest.NewRedis(t)
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"id":1,"order_status":2,"product_id":3,"provider_id":4,"create_time":100}}`)}))
+	recorder := &writeRecorder{}
+	bmStore.RDB.AddHook(recorder)
+	// only provider_id changes, the equal provider ids are decoded to distinct pointers
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"u","before":{"id":1,"order_status":2,"product_id":3,"provider_id":4,"create_time":100},"after":{"id":1,"order_status":2,"product_id":3,"provider_id":5,"create_time":100}}`)}))
+	assert.NotEmpty(t, recorder.keys)
+	for _, key := range recorder.keys {
+		assert.Equal(t, "test:bm:term:orders:provider_id", key)
+	}
+	recorder.keys = nil
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"u","before":{"id":1,"order_status":2,"product_id":3,"provider_id":5,"create_time":100},"after":{"id":1,"order_status":2,"product_id":3,"provider_id":5,"create_time":100}}`)}))
+	assert.Empty(t, recorder.keys)
+	providerBm, err := bmStore.Get("term:orders:provider_id", "5")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1}, providerBm.ToArray())
+}
+
+func TestRebuildAll(t *testing.T) {
+	bmStore, skbmStore, fvStore := storetest.NewRedis(t)
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	for id := 1; id <= 10; id++ {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"op":"c","after":{"id":%d,"order_status":%d,"product_id":1,"create_time":%d}}`, id, id%3+1, id*100))}))
+	}
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"d","before":{"id":4,"order_status":2,"product_id":1,"create_time":400}}`)}))
+	ss := query.NewOrdersSearchService(bmStore, skbmStore, fvStore)
+	// __all drifted: it lost some ids and kept a deleted one
+	require.NoError(t, bmStore.Set("term:orders:__all", "0", roaring.BitmapOf(1, 2, 4)))
+	resp, err := ss.List(query.Request{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), resp.Total)
+	require.NoError(t, RebuildAll(bmStore, index.OrdersSchema, nil))
+	resp, err = ss.List(query.Request{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(9), resp.Total)
+	assert.Equal(t, []uint32{10, 9, 8, 7, 6, 5, 3, 2, 1}, resp.IDs)
+	// corrupted bytes are replaced too
+	require.NoError(t, bmStore.RDB.HSet(context.Background(), "test:bm:term:orders:__all", "0", "garbage").Err())
+	require.NoError(t, RebuildAll(bmStore, index.OrdersSchema, nil))
+	resp, err = ss.List(query.Request{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(9), resp.Total)
+	// a migrated order_status index is read at its version
+	require.NoError(t, bmStore.Set("term:orders:order_status:v2", "1", roaring.BitmapOf(1, 2)))
+	require.NoError(t, RebuildAll(bmStore, index.OrdersSchema, map[string]int{"order_status": 2}))
+	resp, err = ss.List(query.Request{})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{2, 1}, resp.IDs)
+}
+
+func TestTermIndexVersionCutover(t *testing.T) {
+	bmStore, skbmStore, fvStore := storetest.NewRedis(t)
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	row := func(id int, productID int) string {
+		return fmt.Sprintf(`{"id":%d,"order_status":1,"product_id":%d,"create_time":%d}`, id, productID, id*100)
+	}
+	for id := 1; id <= 6; id++ {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"op":"c","after":%s}`, row(id, id%2+1)))}))
+	}
+	// build v2 along with v1, and backfill it from the rows as read before an update
+	consumer.applyVersions(nil, map[string]int{"product_id": 2})
+	var page []Order
+	for id := 1; id <= 6; id++ {
+		page = append(page, Order{ID: uint32(id), OrderStatus: 1, ProductID: int64(id%2 + 1), CreateTime: uint64(id * 100)})
+	}
+	versionIndexes := nextVersionIndexes(map[string]int{"product_id": 2})
+	require.Len(t, versionIndexes, 1)
+	assert.Equal(t, 2, versionIndexes[0].Version)
+	require.NoError(t, consumer.indexField(versionIndexes[0], page))
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"op":"u","before":%s,"after":%s}`, row(2, 1), row(2, 3)))}))
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"op":"c","after":%s}`, row(7, 2)))}))
+
+	ss := query.NewOrdersSearchService(bmStore, skbmStore, fvStore)
+	versions := &store.IndexVersions{RDB: bmStore.RDB, Key: "test:versions"}
+	list := func(productID int64) []uint32 {
+		require.NoError(t, ss.RefreshVersions(versions))
+		resp, err := ss.List(query.Request{ProductIDEq: &productID})
+		require.NoError(t, err)
+		return resp.IDs
+	}
+	assert.Equal(t, "term:orders:product_id", ss.ProductIdIndexReader.CurrentIndex().GetIndexKey())
+	assert.Equal(t, []uint32{6, 4}, list(1))
+	assert.Equal(t, []uint32{7, 5, 3, 1}, list(2))
+
+	// v2 can't be served until it's recorded as built
+	assert.ErrorIs(t, versions.Activate("product_id", 2), store.ErrVersionNotBuilt)
+	assert.Equal(t, "term:orders:product_id", ss.ProductIdIndexReader.CurrentIndex().GetIndexKey())
+	require.NoError(t, versions.MarkBuilt("product_id", 2))
+	require.NoError(t, versions.Activate("product_id", 2))
+	assert.Equal(t, []uint32{6, 4}, list(1))
+	assert.Equal(t, []uint32{7, 5, 3, 1}, list(2))
+	assert.Equal(t, []uint32{2}, list(3))
+	assert.Equal(t, "term:orders:product_id:v2", ss.ProductIdIndexReader.CurrentIndex().GetIndexKey())
+
+	require.NoError(t, DropTermIndex(bmStore, index.TermIndex{TableName: "orders", FieldName: "product_id"}))
+	n, err := bmStore.Len("term:orders:product_id")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, []uint32{6, 4}, list(1))
+}
+
+// removalLimitStore fails the bit removals after the first limit ones
+type removalLimitStore struct {
+	store.BmStore
+	limit int
+}
+
+func (s *removalLimitStore) RemoveBit(indexKey string, valueKey string, id uint32) error {
+	if s.limit == 0 {
+		return errors.New("store down")
+	}
+	s.limit--
+	return s.BmStore.RemoveBit(indexKey, valueKey, id)
+}
+
+func TestInterruptedDeleteKeepsIdInAll(t *testing.T) {
+	provider := int64(7)
+	order := Order{ID: 1, OrderStatus: 2, ProductID: 3, ProviderID: &provider, CreateTime: 100}
+	for limit := 0; ; limit++ {
+		bmStore, skbmStore, fvStore := newMemTestStores()
+		consumer := newTestConsumer(t, index.OrdersSchema, &removalLimitStore{BmStore: bmStore, limit: limit}, skbmStore, fvStore)
+		require.NoError(t, consumer.onInsert(order))
+		deleteErr := consumer.onDelete(order)
+		all, err := bmStore.Get("term:orders:__all", "0")
+		require.NoError(t, err)
+		// an id left in a value bitmap is still in __all
+		for _, field := range []string{"order_status", "product_id", "provider_id"} {
+			require.NoError(t, bmStore.ScanValues("term:orders:"+field, func(valueKey string, bm *roaring.Bitmap) bool {
+				assert.False(t, bm.Contains(order.ID) && !all.Contains(order.ID), "limit %d, field %s", limit, field)
+				return true
+			}))
+		}
+		if deleteErr == nil {
+			assert.False(t, all.Contains(order.ID))
+			return
+		}
+	}
+}
+
+func TestUniverseFieldReplacesAll(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	schema := index.TableSchema{Table: "orders", PrimaryKey: "id", UniverseField: "order_status"}
+	consumer := newTestConsumer(t, schema, bmStore, skbmStore, fvStore)
+	assert.Nil(t, consumer.AllIndexWriter)
+	for _, value := range []string{
+		`{"op":"c","after":{"id":1,"order_status":1,"product_id":10,"create_time":100}}`,
+		`{"op":"c","after":{"id":2,"order_status":2,"product_id":10,"create_time":200}}`,
+		`{"op":"c","after":{"id":3,"order_status":3,"product_id":20,"create_time":300}}`,
+		`{"op":"u","before":{"id":1,"order_status":1,"product_id":10,"create_time":100},"after":{"id":1,"order_status":3,"product_id":10,"create_time":100}}`,
+		`{"op":"d","before":{"id":2,"order_status":2,"product_id":10,"create_time":200}}`,
+	} {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	n, err := bmStore.Len("term:orders:" + index.AllField)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// a replayed insert leaves the index as is
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"c","after":{"id":3,"order_status":3,"product_id":20,"create_time":300}}`)}))
+
+	ss := query.NewSearchService(schema, bmStore, skbmStore, fvStore)
+	resp, err := ss.List(query.Request{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), resp.Total)
+	assert.Equal(t, []uint32{3, 1}, resp.IDs)
+	resp, err = ss.List(query.Request{ProviderIDFilter: &query.NullableValueFilter[int64]{Mode: query.FilterModeNull}})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{3, 1}, resp.IDs)
+	productID := int64(10)
+	resp, err = ss.List(query.Request{ProductIDEq: &productID})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1}, resp.IDs)
+
+	assert.Error(t, RebuildAll(bmStore, schema, nil))
+}
+
+func TestPrimaryKeyOnlyDeleteLooksUpValues(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.DerivedIndexWriters = NewDerivedIndexWriters("orders", []index.DerivedField{index.CreateWeekday})
+	sink := &recordingDeadLetterSink{}
+	consumer.DeadLetterSink = sink
+	for _, value := range []string{
+		`{"op":"c","after":{"id":1,"order_status":1,"product_id":10,"provider_id":5,"create_time":100}}`,
+		`{"op":"c","after":{"id":2,"order_status":2,"product_id":10,"provider_id":null,"create_time":200}}`,
+		`{"op":"c","after":{"id":3,"order_status":1,"product_id":20,"provider_id":5,"create_time":300}}`,
+		// without the lookup the old values are unknown, the delete is dead-lettered and the order left as is
+		`{"op":"d","before":{"id":1}}`,
+	} {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	require.Len(t, sink.errs, 1)
+	assert.ErrorIs(t, sink.errs[0], errInvalidMessage)
+	allBm, err := bmStore.Get("term:orders:__all", "0")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2, 3}, allBm.ToArray())
+
+	consumer.LookupIncompleteDeletes = true
+	for _, value := range []string{
+		`{"op":"d","before":{"id":1,"order_status":null,"product_id":null,"provider_id":null,"create_time":null}}`,
+		`{"op":"d","before":{"id":2}}`,
+		// not indexed
+		`{"op":"d","before":{"id":4}}`,
+	} {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	for _, key := range []string{"term:orders:__all", "term:orders:order_status", "term:orders:product_id", "term:orders:provider_id", "term:orders:create_weekday"} {
+		require.NoError(t, bmStore.ScanValues(key, func(valueKey string, bm *roaring.Bitmap) bool {
+			assert.Equal(t, []uint32{3}, bm.ToArray(), "%s %s", key, valueKey)
+			return true
+		}))
+	}
+	_, found, err := fvStore.MGetFound("sparse:orders:create_time", []uint32{1, 2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, true}, found)
+	assert.Len(t, sink.errs, 1)
+}
+
+func TestPrimaryKeyOnlyUpdateLooksUpValues(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.DerivedIndexWriters = NewDerivedIndexWriters("orders", []index.DerivedField{index.CreateWeekday})
+	consumer.ProviderIdRangeWriter = newTestProviderRangeWriter(t)
+	sink := &recordingDeadLetterSink{}
+	consumer.DeadLetterSink = sink
+	for _, value := range []string{
+		`{"op":"c","after":{"id":1,"order_status":1,"product_id":10,"provider_id":5,"create_time":100}}`,
+		`{"op":"c","after":{"id":2,"order_status":1,"product_id":10,"provider_id":5,"create_time":200}}`,
+	} {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	update := &sarama.ConsumerMessage{Offset: 3, Value: []byte(`{"op":"u","before":{"id":1},"after":{"id":1,"order_status":2,"product_id":20,"provider_id":null,"create_time":500000000}}`)}
+	// without the lookup the old values are unknown, the update is dead-lettered
+	require.NoError(t, consumer.process(update))
+	require.Len(t, sink.messages, 1)
+	assert.ErrorIs(t, sink.errs[0], errInvalidMessage)
+
+	consumer.LookupIncompleteDeletes = true
+	require.NoError(t, consumer.process(update))
+	values := func(key string) map[string][]uint32 {
+		result := make(map[string][]uint32)
+		require.NoError(t, bmStore.ScanValues(key, func(valueKey string, bm *roaring.Bitmap) bool {
+			result[valueKey] = bm.ToArray()
+			return true
+		}))
+		return result
+	}
+	assert.Equal(t, map[string][]uint32{"1": {2}, "2": {1}}, values("term:orders:order_status"))
+	assert.Equal(t, map[string][]uint32{"10": {2}, "20": {1}}, values("term:orders:product_id"))
+	assert.Equal(t, map[string][]uint32{"5": {2}, "null": {1}}, values("term:orders:provider_id"))
+	// the old weekday of id 1 is left, its new one is set
+	weekdays := 0
+	for _, ids := range values("term:orders:create_weekday") {
+		for _, id := range ids {
+			if id == 1 {
+				weekdays++
+			}
+		}
+	}
+	assert.Equal(t, 1, weekdays)
+	createTimeKey := consumer.CreateTimeIndexWriter.Index.MakeIndexKey()
+	assertBucketsConsistent(t, skbmStore, fvStore, createTimeKey, roaring.BitmapOf(1, 2))
+	createTimes, err := fvStore.MGet(createTimeKey, []uint32{1})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{500000000}, createTimes)
+	assertBucketsConsistent(t, skbmStore, fvStore, consumer.ProviderIdRangeWriter.Index.MakeIndexKey(), roaring.BitmapOf(2))
+}
+
+func TestUpdateChangingIdMovesEveryIndex(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+	consumer.DerivedIndexWriters = NewDerivedIndexWriters("orders", []index.DerivedField{index.CreateWeekday})
+	consumer.SortValueWriters = NewSortValueWriters("orders", []string{"product_id"})
+	consumer.ProviderIdRangeWriter = newTestProviderRangeWriter(t)
+	consumer.LookupIncompleteDeletes = true
+	for _, value := range []string{
+		`{"op":"c","after":{"id":1,"order_status":1,"product_id":10,"provider_id":5,"create_time":100}}`,
+		`{"op":"c","after":{"id":2,"order_status":2,"product_id":20,"provider_id":null,"create_time":200}}`,
+		`{"op":"u","before":{"id":1,"order_status":1,"product_id":10,"provider_id":5,"create_time":100},"after":{"id":11,"order_status":3,"product_id":10,"provider_id":5,"create_time":150}}`,
+		// a before image with only the primary key is looked up
+		`{"op":"u","before":{"id":2},"after":{"id":12,"order_status":2,"product_id":20,"provider_id":null,"create_time":200}}`,
+	} {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	for _, key := range []string{"term:orders:__all", "term:orders:order_status", "term:orders:product_id", "term:orders:provider_id", "term:orders:create_weekday"} {
+		indexIds := roaring.New()
+		require.NoError(t, bmStore.ScanValues(key, func(valueKey string, bm *roaring.Bitmap) bool {
+			indexIds.Or(bm)
+			return true
+		}))
+		assert.Equal(t, []uint32{11, 12}, indexIds.ToArray(), key)
+	}
+	statusBm, err := bmStore.Get(consumer.OrderStatusIndexWriter.Index.GetIndexKey(), "3")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{11}, statusBm.ToArray())
+	createTimeKey := consumer.CreateTimeIndexWriter.Index.MakeIndexKey()
+	assertBucketsConsistent(t, skbmStore, fvStore, createTimeKey, roaring.BitmapOf(11, 12))
+	createTimes, found, err := fvStore.MGetFound(createTimeKey, []uint32{1, 2, 11, 12})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, true, true}, found)
+	assert.Equal(t, []uint64{150, 200}, createTimes[2:])
+	assertBucketsConsistent(t, skbmStore, fvStore, consumer.ProviderIdRangeWriter.Index.MakeIndexKey(), roaring.BitmapOf(11))
+	_, found, err = fvStore.MGetFound(consumer.SortValueWriters[0].Key, []uint32{1, 2, 11, 12})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, true, true}, found)
+}
+
+func TestConsumerMaintainsTextTokens(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	schema := index.TableSchema{Table: "orders", PrimaryKey: "id", TextColumn: "note"}
+	consumer := newTestConsumer(t, schema, bmStore, skbmStore, fvStore)
+	consumer.LookupIncompleteDeletes = true
+	tokens := func() map[string][]uint32 {
+		result := make(map[string][]uint32)
+		require.NoError(t, bmStore.ScanValues("term:orders:text_tokens", func(valueKey string, bm *roaring.Bitmap) bool {
+			if !bm.IsEmpty() {
+				result[valueKey] = bm.ToArray()
+			}
+			return true
+		}))
+		return result
+	}
+	for _, value := range []string{
+		`{"op":"c","after":{"id":1,"order_status":1,"create_time":100,"note":"Red apple, red!"}}`,
+		`{"op":"c","after":{"id":2,"order_status":1,"create_time":200,"note":"green apple"}}`,
+		`{"op":"c","after":{"id":3,"order_status":1,"create_time":300,"note":null}}`,
+	} {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	assert.Equal(t, map[string][]uint32{"red": {1}, "apple": {1, 2}, "green": {2}}, tokens())
+
+	for _, value := range []string{
+		`{"op":"u","before":{"id":1,"order_status":1,"create_time":100,"note":"Red apple, red!"},"after":{"id":1,"order_status":1,"create_time":100,"note":"APPLE pie"}}`,
+		`{"op":"u","before":{"id":3,"order_status":1,"create_time":300,"note":null},"after":{"id":3,"order_status":1,"create_time":300,"note":"red pie"}}`,
+	} {
+		require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(value)}))
+	}
+	assert.Equal(t, map[string][]uint32{"red": {3}, "apple": {1, 2}, "green": {2}, "pie": {1, 3}}, tokens())
+
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"d","before":{"id":2,"order_status":1,"create_time":200,"note":"green apple"}}`)}))
+	// the tokens of a primary key only delete are looked up
+	require.NoError(t, consumer.process(&sarama.ConsumerMessage{Value: []byte(`{"op":"d","before":{"id":3}}`)}))
+	assert.Equal(t, map[string][]uint32{"apple": {1}, "pie": {1}}, tokens())
+}
+
+func BenchmarkTermIndexWriterAdd(b *testing.B) {
+	bmStore, _, _ := newMemTestStores()
+	w := NewTermIndexWriter[int64]("orders", "product_id")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := w.Add(bmStore, int64(i%100), uint32(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTermIndexWriterMove moves ids between values the way updates do
+func BenchmarkTermIndexWriterMove(b *testing.B) {
+	bmStore, _, _ := newMemTestStores()
+	w := NewTermIndexWriter[int64]("orders", "product_id")
+	const ids = 10000
+	for id := uint32(0); id < ids; id++ {
+		require.NoError(b, w.Add(bmStore, int64(id%100), id))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := uint32(i % ids)
+		// every round over the ids moves each one to the next value
+		before := int64(int(id)+i/ids) % 100
+		if err := w.Move(bmStore, before, (before+1)%100, id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSparseU64IndexWriterAdd adds random create times, the small threshold splits a bucket every few adds
+func BenchmarkSparseU64IndexWriterAdd(b *testing.B) {
+	for _, splitThreshold := range []int{MinSplitThreshold, 64, DefaultSplitThreshold} {
+		b.Run(fmt.Sprintf("split threshold %d", splitThreshold), func(b *testing.B) {
+			_, skbmStore, fvStore := newMemTestStores()
+			w, err := NewSparseU64IndexWriter("orders", "create_time", splitThreshold)
+			require.NoError(b, err)
+			rnd := rand.New(rand.NewSource(1))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.Add(skbmStore, fvStore, uint64(rnd.Int63n(1_000_000)), uint32(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBackfillPagesByPrimaryKey(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var orders []Order
+	expected := roaring.New()
+	for id := uint32(1); id <= 500; id++ {
+		// create_time mostly follows the ids, like rows inserted over time
+		orders = append(orders, Order{ID: id * 3, OrderStatus: int64(id % 4), ProductID: int64(id % 7), CreateTime: uint64(id)*10 + uint64(rnd.Int63n(300))})
+		expected.Add(id * 3)
+	}
+	var layouts [][]store.SortKeyBitmap
+	for _, batchSize := range []int{7, 64, 1000} {
+		bmStore, skbmStore, fvStore := newMemTestStores()
+		consumer := newTestConsumer(t, index.OrdersSchema, bmStore, skbmStore, fvStore)
+		consumer.CreateTimeIndexWriter.SplitThreshold = 16
+		consumer.CompactMinBucketSize = 4
+		reads := 0
+		read := func(ctx context.Context, afterID uint32, limit int) ([]Order, error) {
+			reads++
+			var page []Order
+			for _, order := range orders {
+				if order.ID > afterID && len(page) < limit {
+					page = append(page, order)
+				}
+			}
+			return page, nil
+		}
+		stats, err := backfill(context.Background(), consumer, read, batchSize, 0)
+		require.NoError(t, err)
+		assert.Equal(t, len(orders), stats.Rows)
+		assert.Equal(t, uint32(1500), stats.LastID)
+		assert.Equal(t, len(orders)/batchSize+1, reads, "batchSize=%d", batchSize)
+
+		all, err := bmStore.Get(consumer.AllIndexWriter.Index.GetIndexKey(), consumer.AllIndexWriter.Index.MakeValueKey(int64(index.AllValue)))
+		require.NoError(t, err)
+		assert.True(t, expected.Equals(all))
+		sortedBms := assertBucketsConsistent(t, skbmStore, fvStore, consumer.CreateTimeIndexWriter.Index.MakeIndexKey(), expected)
+		for i, sortedBm := range sortedBms {
+			cardinality := sortedBm.Bitmap.GetCardinality()
+			assert.Less(t, cardinality, uint64(16), "bucket %d", sortedBm.SortKey)
+			if i > 0 {
+				prevCardinality := sortedBms[i-1].Bitmap.GetCardinality()
+				mergeable := min(prevCardinality, cardinality) < 4 && prevCardinality+cardinality < 16
+				assert.False(t, mergeable, "buckets %d and %d", sortedBms[i-1].SortKey, sortedBm.SortKey)
+			}
+		}
+		layouts = append(layouts, sortedBms)
+	}
+	// rows are written one at a time, the batch size doesn't change the buckets
+	for _, layout := range layouts[1:] {
+		require.Len(t, layout, len(layouts[0]))
+		for i := range layout {
+			assert.Equal(t, layouts[0][i].SortKey, layout[i].SortKey)
+			assert.True(t, layouts[0][i].Bitmap.Equals(layout[i].Bitmap))
+		}
+	}
+}
+
+func TestBackfillConfigInsert(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	assert.Error(t, BackfillConfig{SplitThreshold: 1}.Insert(bmStore, skbmStore, fvStore, Order{ID: 1}))
+	var orders []Order
+	for id := uint32(1); id <= 8; id++ {
+		orders = append(orders, Order{ID: id, OrderStatus: 1, CreateTime: uint64(id)})
+	}
+	require.NoError(t, BackfillConfig{SplitThreshold: MinSplitThreshold}.Insert(bmStore, skbmStore, fvStore, orders...))
+	all, err := bmStore.Get("term:orders:__all", "0")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8), all.GetCardinality())
+	assert.Greater(t, len(scanBuckets(t, skbmStore, "sparse:orders:create_time")), 2)
+}
+
+func TestBackfillFieldWritesOnlyThatField(t *testing.T) {
+	bmStore, skbmStore, fvStore := newMemTestStores()
+	config := BackfillConfig{DerivedFields: []index.DerivedField{index.CreateWeekday}, SortFields: []string{"product_id"}, ProviderIDRange: true}
+	fields := config.FieldIndexes()
+	require.Len(t, fields, 3)
+	assert.Equal(t, "create_weekday", fields[0].Field)
+	assert.Equal(t, "product_id", fields[1].Field)
+	assert.Equal(t, index.ProviderIDRangeField, fields[2].Field)
+	var orders []Order
+	for id := uint32(1); id <= 10; id++ {
+		orders = append(orders, Order{ID: id, OrderStatus: 1, ProductID: int64(id), CreateTime: uint64(id) * 86_400_000_000})
+	}
+	// indexed before the fields were configured
+	require.NoError(t, BackfillConfig{}.Insert(bmStore, skbmStore, fvStore, orders...))
+	consumer, err := config.newConsumer(bmStore, skbmStore, fvStore)
+	require.NoError(t, err)
+	read := func(ctx context.Context, afterID uint32, limit int) ([]Order, error) {
+		var page []Order
+		for _, order := range orders {
+			if order.ID > afterID && len(page) < limit {
+				page = append(page, order)
+			}
+		}
+		return page, nil
+	}
+	// the consumer applies changes made after the rows were read: 9 is deleted and the product of 10 changes
+	require.NoError(t, consumer.onDelete(orders[8]))
+	changed := orders[9]
+	changed.ProductID = 99
+	require.NoError(t, consumer.onUpdate(orders[9], changed))
+	terms := func() map[string][]uint32 {
+		bms := make(map[string][]uint32)
+		for _, key := range []string{"term:orders:__all", "term:orders:order_status", "term:orders:product_id"} {
+			require.NoError(t, bmStore.ScanValues(key, func(valueKey string, bm *roaring.Bitmap) bool {
+				bms[key+":"+valueKey] = bm.ToArray()
+				return true
+			}))
+		}
+		return bms
+	}
+	before := terms()
+
+	stats, err := backfillField(context.Background(), "orders", read, fields[0], func(page []Order) error {
+		return consumer.indexField(fields[0], page)
+	}, 4, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 10, stats.Rows)
+	assert.Equal(t, 3, stats.Batches)
+	weekdays := roaring.New()
+	require.NoError(t, bmStore.ScanValues("term:orders:create_weekday", func(valueKey string, bm *roaring.Bitmap) bool {
+		weekdays.Or(bm)
+		return true
+	}))
+	assert.Equal(t, []uint32{1, 2, 3, 4, 5, 6, 7, 8, 10}, weekdays.ToArray(), "the deleted order isn't indexed back")
+
+	// pages are applied by a claim between its messages
+	tasks := make(chan claimTask)
+	consumer.Tasks = tasks
+	claim := &testClaim{messages: make(chan *sarama.ConsumerMessage)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = consumer.ConsumeClaim(testSession{ctx: ctx}, claim) }()
+	done := make(chan error, 1)
+	tasks <- claimTask{run: func(consumer *saramaConsumer) error { return consumer.indexField(fields[1], orders) }, done: done}
+	require.NoError(t, <-done)
+	sortValues, found, err := fvStore.MGetFound(index.SortValuesKey("orders", "product_id"), []uint32{1, 9, 10})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true}, found)
+	assert.Equal(t, store.Int64Codec{}.Encode(1), sortValues[0])
+	assert.Equal(t, store.Int64Codec{}.Encode(99), sortValues[2], "the changed order keeps its newer value")
+	// the other indexes keep serving as they were
+	assert.Equal(t, before, terms())
+}
@@ -0,0 +1,69 @@
+package sync
+
+import (
+	"github.com/KKKIIO/inv-index-demo/index"
+	"github.com/KKKIIO/inv-index-demo/store"
+)
+
+// FieldWriter maintains the index of a field of index.TableSchema.Fields, Term or Sparse by the kind of the field
+type FieldWriter struct {
+	Field  index.Field
+	Term   *TermIndexWriter[*int64]
+	Sparse *SparseIndexWriter[int64]
+}
+
+func NewFieldWriters(tableName string, fields []index.Field) ([]*FieldWriter, error) {
+	if err := index.ValidateFields(fields); err != nil {
+		return nil, err
+	}
+	writers := make([]*FieldWriter, len(fields))
+	for i, field := range fields {
+		writers[i] = &FieldWriter{Field: field}
+		if field.Kind == index.TermKind {
+			writers[i].Term = NewTermIndexWriter[*int64](tableName, field.Name)
+			continue
+		}
+		w, err := NewSparseU64IndexWriter(tableName, field.Name, DefaultSplitThreshold)
+		if err != nil {
+			return nil, err
+		}
+		writers[i].Sparse = &SparseIndexWriter[int64]{SparseU64IndexWriter: w, Codec: store.Int64Codec{}}
+	}
+	return writers, nil
+}
+
+// Add indexes the value of id, nil is the null value
+func (w *FieldWriter) Add(bmStore store.BmStore, sortedBmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, v *int64, id uint32) error {
+	if w.Term != nil {
+		return w.Term.Add(bmStore, v, id)
+	}
+	return moveSparse(w.Sparse, sortedBmStore, fvStore, nil, v, id)
+}
+
+// Move moves id from the value before to after, it's a no-op if the value didn't change
+func (w *FieldWriter) Move(bmStore store.BmStore, sortedBmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, before *int64, after *int64, id uint32) error {
+	if w.Term != nil {
+		return w.Term.Move(bmStore, before, after, id)
+	}
+	return moveSparse(w.Sparse, sortedBmStore, fvStore, before, after, id)
+}
+
+func (w *FieldWriter) Remove(bmStore store.BmStore, sortedBmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, v *int64, id uint32) error {
+	if w.Term != nil {
+		return w.Term.Remove(bmStore, v, id)
+	}
+	return moveSparse(w.Sparse, sortedBmStore, fvStore, v, nil, id)
+}
+
+// moveSparse moves id in a sparse index of a nullable field, null values aren't indexed
+func moveSparse(w *SparseIndexWriter[int64], bmStore store.SortKeyBitmapStore, fvStore store.FieldValueStore, before *int64, after *int64, id uint32) error {
+	switch {
+	case w == nil || (before == nil && after == nil):
+		return nil
+	case before == nil:
+		return w.Add(bmStore, fvStore, *after, id)
+	case after == nil:
+		return w.Remove(bmStore, fvStore, *before, id)
+	}
+	return w.Move(bmStore, fvStore, *before, *after, id)
+}
@@ -0,0 +1,121 @@
+package sync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/KKKIIO/inv-index-demo/store"
+	"github.com/RoaringBitmap/roaring"
+)
+
+// findValueKey returns the value key of the bitmap holding id, reading every bitmap of the index until found
+func (w *TermIndexWriter[T]) findValueKey(bmStore store.BmStore, id uint32) (string, bool, error) {
+	var found string
+	var ok bool
+	err := bmStore.ScanValues(w.Index.GetIndexKey(), func(valueKey string, bm *roaring.Bitmap) bool {
+		if bm.Contains(id) {
+			found, ok = valueKey, true
+			return false
+		}
+		return true
+	})
+	return found, ok, err
+}
+
+// findValueKeys returns the value keys of all bitmaps holding id, for fields with many values per id like text tokens
+func (w *TermIndexWriter[T]) findValueKeys(bmStore store.BmStore, id uint32) ([]string, error) {
+	var found []string
+	err := bmStore.ScanValues(w.Index.GetIndexKey(), func(valueKey string, bm *roaring.Bitmap) bool {
+		if bm.Contains(id) {
+			found = append(found, valueKey)
+		}
+		return true
+	})
+	return found, err
+}
+
+// lookupOrder rebuilds the indexed values of id from the indexes, e.g. for a delete whose before image
+// only has the primary key. It's expensive, every bitmap of the term fields may be read.
+// found is false if id has no create_time, it's then not listed by any query.
+func (consumer *saramaConsumer) lookupOrder(id uint32) (order Order, found bool, err error) {
+	order.ID = id
+	createTimes, ok, err := consumer.FvStore.MGetFound(consumer.CreateTimeIndexWriter.Index.MakeIndexKey(), []uint32{id})
+	if err != nil {
+		return Order{}, false, err
+	}
+	if !ok[0] {
+		return Order{}, false, nil
+	}
+	order.CreateTime = createTimes[0]
+	lookup := func(w *TermIndexWriter[int64], v *int64) error {
+		valueKey, ok, err := w.findValueKey(consumer.BmStore, id)
+		if err != nil || !ok {
+			return err
+		}
+		if *v, err = strconv.ParseInt(valueKey, 10, 64); err != nil {
+			return fmt.Errorf("Failed to parse value key, index=%s, valueKey=%s, err: %w", w.Index.GetIndexKey(), valueKey, err)
+		}
+		return nil
+	}
+	if err := lookup(consumer.OrderStatusIndexWriter, &order.OrderStatus); err != nil {
+		return Order{}, false, err
+	}
+	if err := lookup(consumer.ProductIdIndexWriter, &order.ProductID); err != nil {
+		return Order{}, false, err
+	}
+	valueKey, indexed, err := consumer.ProviderIdIndexWriter.findValueKey(consumer.BmStore, id)
+	if err != nil {
+		return Order{}, false, err
+	}
+	if indexed && valueKey != consumer.ProviderIdIndexWriter.Index.MakeValueKey((*int64)(nil)) {
+		providerID, err := strconv.ParseInt(valueKey, 10, 64)
+		if err != nil {
+			return Order{}, false, fmt.Errorf("Failed to parse value key, index=%s, valueKey=%s, err: %w", consumer.ProviderIdIndexWriter.Index.GetIndexKey(), valueKey, err)
+		}
+		order.ProviderID = &providerID
+	}
+	for _, w := range consumer.FieldWriters {
+		v, err := w.lookup(consumer, id)
+		if err != nil {
+			return Order{}, false, err
+		}
+		if v != nil {
+			if order.Fields == nil {
+				order.Fields = make(map[string]*int64, len(consumer.FieldWriters))
+			}
+			order.Fields[w.Field.Name] = v
+		}
+	}
+	if consumer.TextIndexWriter != nil {
+		tokens, err := consumer.TextIndexWriter.findValueKeys(consumer.BmStore, id)
+		if err != nil {
+			return Order{}, false, err
+		}
+		// the tokens are the text as far as the index is concerned, they tokenize to themselves
+		text := strings.Join(tokens, " ")
+		order.Text = &text
+	}
+	return order, true, nil
+}
+
+// lookup returns the indexed value of id, nil if it's null or not indexed
+func (w *FieldWriter) lookup(consumer *saramaConsumer, id uint32) (*int64, error) {
+	if w.Sparse != nil {
+		sortKeys, ok, err := consumer.FvStore.MGetFound(w.Sparse.Index.MakeIndexKey(), []uint32{id})
+		if err != nil || !ok[0] {
+			return nil, err
+		}
+		v := w.Sparse.Codec.Decode(sortKeys[0])
+		return &v, nil
+	}
+	valueKey, ok, err := w.Term.findValueKey(consumer.BmStore, id)
+	if err != nil || !ok || valueKey == w.Term.Index.MakeValueKey((*int64)(nil)) {
+		return nil, err
+	}
+	v, err := strconv.ParseInt(valueKey, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse value key, index=%s, valueKey=%s, err: %w", w.Term.Index.GetIndexKey(), valueKey, err)
+	}
+	return &v, nil
+}
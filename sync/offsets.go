@@ -0,0 +1,182 @@
+package sync
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	stdsync "sync"
+
+	"github.com/IBM/sarama"
+	"github.com/KKKIIO/inv-index-demo/store"
+)
+
+// PartitionStatus is how far the consumer got in a claimed partition
+type PartitionStatus struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	// Offset is the next offset to apply, negative until the first message if the group has no committed offset
+	Offset        int64 `json:"offset"`
+	HighWaterMark int64 `json:"high_water_mark"`
+	// Lag is the number of messages left to apply, -1 while unknown
+	Lag int64 `json:"lag"`
+}
+
+// offsetTracker holds the progress of the partitions claimed in the current session
+type offsetTracker struct {
+	mu         stdsync.Mutex
+	partitions map[int32]trackedClaim
+}
+
+// trackedClaim is a claim with the offset it applies next
+type trackedClaim struct {
+	claim  sarama.ConsumerGroupClaim
+	offset int64
+}
+
+// track records that the claim will apply offset next
+func (t *offsetTracker) track(claim sarama.ConsumerGroupClaim, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.partitions == nil {
+		t.partitions = make(map[int32]trackedClaim)
+	}
+	t.partitions[claim.Partition()] = trackedClaim{claim: claim, offset: offset}
+}
+
+// release forgets a partition the session no longer claims
+func (t *offsetTracker) release(partition int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.partitions, partition)
+}
+
+// statuses returns the status of the tracked partitions in order. The high-water marks are read from the claims
+// at each call, so the lag of a stalled consumer keeps growing.
+func (t *offsetTracker) statuses() []PartitionStatus {
+	t.mu.Lock()
+	statuses := make([]PartitionStatus, 0, len(t.partitions))
+	for partition, tracked := range t.partitions {
+		status := PartitionStatus{Topic: tracked.claim.Topic(), Partition: partition, Offset: tracked.offset,
+			HighWaterMark: tracked.claim.HighWaterMarkOffset(), Lag: -1}
+		if status.Offset >= 0 {
+			status.Lag = max(status.HighWaterMark-status.Offset, 0)
+		}
+		statuses = append(statuses, status)
+	}
+	t.mu.Unlock()
+	slices.SortFunc(statuses, func(a, b PartitionStatus) int { return cmp.Compare(a.Partition, b.Partition) })
+	return statuses
+}
+
+// AllPartitions keys the start offset of the partitions not listed in Config.StartOffset
+const AllPartitions int32 = -1
+
+// ParseStartOffset parses a single offset of all partitions, e.g. "100",
+// or comma separated partition=offset entries, e.g. "0=100,1=250". An empty string gives none.
+func ParseStartOffset(s string) (map[int32]int64, error) {
+	offsets := make(map[int32]int64)
+	if s == "" {
+		return offsets, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		partition, offset := int64(AllPartitions), strings.TrimSpace(entry)
+		if p, o, found := strings.Cut(offset, "="); found {
+			var err error
+			if partition, err = strconv.ParseInt(p, 10, 32); err != nil || partition < 0 {
+				return nil, fmt.Errorf("Invalid start offset %q, expected partition=offset", entry)
+			}
+			offset = o
+		}
+		v, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("Invalid start offset %q, expected a non-negative offset", entry)
+		}
+		if _, ok := offsets[int32(partition)]; ok {
+			return nil, fmt.Errorf("Duplicate start offset %q", entry)
+		}
+		offsets[int32(partition)] = v
+	}
+	return offsets, nil
+}
+
+// startOffsetsOf returns the start offset of each of partitions, the ones without one are left out
+func startOffsetsOf(partitions []int32, startOffset map[int32]int64) map[int32]int64 {
+	offsets := make(map[int32]int64)
+	for _, partition := range partitions {
+		if offset, ok := startOffset[partition]; ok {
+			offsets[partition] = offset
+		} else if offset, ok := startOffset[AllPartitions]; ok {
+			offsets[partition] = offset
+		}
+	}
+	return offsets
+}
+
+// resetOffsets commits the start offsets of the partitions of topic as the offsets of group, see Config.StartOffset.
+// It returns the offset set per partition.
+func resetOffsets(brokers []string, group string, topic string, startOffset map[int32]int64, kafkaConfig *sarama.Config) (map[int32]int64, error) {
+	client, err := sarama.NewClient(brokers, kafkaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating client: %w", err)
+	}
+	defer client.Close()
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get partitions, topic=%s, err: %w", topic, err)
+	}
+	offsets := startOffsetsOf(partitions, startOffset)
+	om, err := sarama.NewOffsetManagerFromClient(group, client)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating offset manager, group=%s, err: %w", group, err)
+	}
+	if err := seedOffsets(om, group, topic, offsets); err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+// seedOffsets commits offsets through om, so the next session of the group consumes from them.
+// Unlike marking messages, it can move offsets back.
+func seedOffsets(om sarama.OffsetManager, group string, topic string, offsets map[int32]int64) error {
+	var errs []error
+	var poms []sarama.PartitionOffsetManager
+	for partition, offset := range offsets {
+		pom, err := om.ManagePartition(topic, partition)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ManagePartition failed, topic=%s, partition=%d, err: %w", topic, partition, err))
+			continue
+		}
+		poms = append(poms, pom)
+		committed, _ := pom.NextOffset()
+		slog.Warn("Resetting consumer group offset", "group", group, "topic", topic, "partition", partition, "committed", committed, "offset", offset)
+		pom.ResetOffset(offset, "")
+	}
+	om.Commit()
+	for _, pom := range poms {
+		errs = append(errs, pom.Close())
+	}
+	errs = append(errs, om.Close())
+	return errors.Join(errs...)
+}
+
+// rewindAppliedOffsets moves the applied offsets back before the reset offsets, so replayed messages aren't skipped
+func (c *Consumer) rewindAppliedOffsets(appliedOffsets *store.AppliedOffsets) error {
+	for partition, offset := range c.startOffset {
+		applied, err := appliedOffsets.Get(c.topic, partition)
+		if err != nil {
+			return err
+		}
+		if applied < offset {
+			continue
+		}
+		slog.Warn("Rewinding applied offset", "topic", c.topic, "partition", partition, "applied", applied, "offset", offset-1)
+		if err := appliedOffsets.Set(c.topic, partition, offset-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}